@@ -0,0 +1,188 @@
+package auth
+
+import (
+	"errors"
+	"goconnect/common"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//---------------------------------------------------------------------------------------
+
+const (
+	accHistoryTable         = "acc_history"
+	accHistoryPurgeInterval = 1 * time.Hour
+)
+
+//---------------------------------------------------------------------------------------
+
+const (
+	accRecordStart   = "start"
+	accRecordInterim = "interim"
+	accRecordStop    = "stop"
+)
+
+//---------------------------------------------------------------------------------------
+
+//sAccountingRecord is a row of the accounting history, the transfer is the total value at the record time
+type sAccountingRecord struct {
+	ID            int64  `db:"id, primarykey, autoincrement" json:"id"`
+	Type          string `db:"record_type,size:16" json:"type"`
+	SessionID     string `db:"session_id,size:64" json:"session_id"`
+	User          string `db:"user_name,size:64" json:"user"`
+	ClientIP      string `db:"client_ip,size:64" json:"client_ip"`
+	VirtualIP     string `db:"virtual_ip,size:64" json:"virtual_ip"`
+	AuthType      string `db:"auth_type,size:64" json:"auth_type"`
+	SendByte      int64  `db:"send_byte" json:"send_byte"`
+	ReceiveByte   int64  `db:"receive_byte" json:"receive_byte"`
+	SendPacket    int64  `db:"send_packet" json:"send_packet"`
+	ReceivePacket int64  `db:"receive_packet" json:"receive_packet"`
+	StartTime     int64  `db:"start_time" json:"start_time"`
+	Time          int64  `db:"record_time" json:"time"`
+	Duration      int64  `db:"duration" json:"duration"`
+	Reason        string `db:"reason,size:64" json:"reason"`
+	AcceptTime    int64  `db:"banner_accepted" json:"banner_accepted"`
+}
+
+//---------------------------------------------------------------------------------------
+
+type sAccountingHistoryParams struct {
+	User string `help:"User Name" schema:"user" validate:"omitempty,min=2,max=64,alphanum"`
+	IP   string `help:"Client or virtual IP" schema:"ip" validate:"omitempty,ip"`
+	ID   string `help:"Session ID" schema:"id" validate:"omitempty,alphanum"`
+	Type string `help:"Record type, one of [start|interim|stop]" schema:"type" validate:"omitempty,eq=start|eq=interim|eq=stop"`
+	From int64  `help:"Start of the time range (unix time)" schema:"from" validate:"min=0"`
+	To   int64  `help:"End of the time range (unix time), now by default" schema:"to" validate:"min=0"`
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cAuthenticationManager) ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+//---------------------------------------------------------------------------------------
+
+//saveHistory persists a record of the session, the failures are only logged so the sessions are not affected
+func (thisPt *cAuthenticationManager) saveHistory(session *cAccountingSessionBase, recordType string) {
+	if !thisPt.params.History {
+		return
+	}
+
+	record := sAccountingRecord{}
+	record.Type = recordType
+	record.SessionID = session.SessionID
+	record.User = session.User
+	record.ClientIP = thisPt.ipString(session.Ip)
+	record.VirtualIP = thisPt.ipString(session.Vip)
+	record.AuthType = session.AuthenticatorType
+	transfer := session.GetTransfer()
+	record.SendByte = int64(transfer.SendByte)
+	record.ReceiveByte = int64(transfer.ReceiveByte)
+	record.SendPacket = int64(transfer.SendPacket)
+	record.ReceivePacket = int64(transfer.ReceivePacket)
+	record.StartTime = session.GetStartTime()
+	record.Time = session.GetUpdateTime()
+	record.Duration = record.Time - record.StartTime
+	record.AcceptTime = session.AcceptTime
+	if recordType == accRecordStop {
+		record.Reason = session.getStopReason()
+	}
+
+	if err := thisPt.params.Database.SerializeObject(accHistoryTable, &record); err != nil {
+		log.Printf("can not save %s record of session %s with error %v \n", recordType, session.SessionID, err)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//removeOldHistory removes the records older than the retention days
+func (thisPt *cAuthenticationManager) removeOldHistory() {
+	limit := time.Now().Unix() - int64(thisPt.params.HistoryRetention)*24*3600
+	if err := thisPt.params.Database.Execute("delete from "+accHistoryTable+" where record_time < %d", limit); err != nil {
+		log.Printf("can not purge the accounting history with error %v \n", err)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//purgeHistory cleans the history periodically
+func (thisPt *cAuthenticationManager) purgeHistory() {
+	ticker := time.NewTicker(accHistoryPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		thisPt.removeOldHistory()
+		<-ticker.C
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//initHistory creates the history table, the history is disabled without a database
+func (thisPt *cAuthenticationManager) initHistory() {
+	if thisPt.params.Database == nil {
+		thisPt.params.History = false
+	}
+	if !thisPt.params.History {
+		return
+	}
+
+	if err := thisPt.params.Database.Register(accHistoryTable, sAccountingRecord{}); err != nil {
+		log.Printf("can not create the accounting history table with error %v \n", err)
+		thisPt.params.History = false
+		return
+	}
+
+	if thisPt.params.HistoryRetention > 0 {
+		go thisPt.purgeHistory()
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cAuthenticationManager) OnHistoryCommand(req *http.Request, params interface{}) (common.IHTTPResponse, error) {
+	if !thisPt.params.History {
+		return nil, errors.New("accounting history is not enabled")
+	}
+
+	historyParams := params.(*sAccountingHistoryParams)
+	if historyParams.To == 0 {
+		historyParams.To = time.Now().Unix()
+	}
+
+	//the string arguments are normalized by the database
+	conditions := []string{"record_time >= %d", "record_time <= %d"}
+	args := []interface{}{historyParams.From, historyParams.To}
+	if historyParams.User != "" {
+		conditions = append(conditions, "user_name = '%s'")
+		args = append(args, historyParams.User)
+	}
+	if historyParams.IP != "" {
+		conditions = append(conditions, "(client_ip = '%s' or virtual_ip = '%s')")
+		ip := net.ParseIP(historyParams.IP).String()
+		args = append(args, ip, ip)
+	}
+	if historyParams.ID != "" {
+		conditions = append(conditions, "session_id = '%s'")
+		args = append(args, historyParams.ID)
+	}
+	if historyParams.Type != "" {
+		conditions = append(conditions, "record_type = '%s'")
+		args = append(args, historyParams.Type)
+	}
+	args = append(args, common.MAXCOMMANDRESPONSEITEMS)
+
+	records := []sAccountingRecord{}
+	query := "select * from " + accHistoryTable + " where " + strings.Join(conditions, " and ") + " order by id desc limit %d"
+	if err := thisPt.params.Database.LoadObject(&records, query, args...); err != nil {
+		return nil, err
+	}
+	return thisPt.params.Utils.CreateHttpResponseFromObject(records)
+}
@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"encoding/json"
+	"goconnect/common"
+	"goconnect/db"
+	"goconnect/utils"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//---------------------------------------------------------------------------------------
+
+func TestAccountingHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goconnect")
+	if err != nil {
+		t.Fatalf("can not create temp directory %v \n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	database := db.Create("sqlite3", filepath.Join(dir, "history.db"))
+	authMan := new(cAuthenticationManager)
+	authMan.init(SAuthenticationManagerParams{Utils: utils.Create(), Database: database, History: true, HistoryRetention: 30})
+
+	createSession := func(id string, user string, ip string) *cAccountingSessionBase {
+		session := &cAccountingSessionBase{SessionID: id, User: user, AuthenticatorType: "dummy", authManager: authMan}
+		session.Ip = net.ParseIP(ip)
+		session.Vip = net.ParseIP("172.16.0.2")
+		return session
+	}
+
+	session1 := createSession("session1", "user1", "192.168.1.10")
+	session1.Start()
+	session1.UpdateSend(1000)
+	session1.Update()
+	session1.UpdateReceive(500)
+	session1.SetStopReason(common.ACCSTOPREASONADMIN)
+	session1.Stop()
+
+	session2 := createSession("session2", "user2", "192.168.1.20")
+	session2.Start()
+	session2.Stop()
+
+	history := func(params *sAccountingHistoryParams) []sAccountingRecord {
+		response, err := authMan.OnHistoryCommand(nil, params)
+		if err != nil {
+			t.Fatalf("can not load the history %v \n", err)
+		}
+		body, _ := ioutil.ReadAll(response.GetRespose().Body)
+		records := []sAccountingRecord{}
+		if err := json.Unmarshal(body, &records); err != nil {
+			t.Fatalf("invalid response %s \n", string(body))
+		}
+		return records
+	}
+
+	if records := history(&sAccountingHistoryParams{}); len(records) != 5 {
+		t.Fatalf("invalid records %v \n", records)
+	}
+
+	//the newest record is the first
+	records := history(&sAccountingHistoryParams{User: "user1"})
+	if len(records) != 3 || records[0].Type != accRecordStop || records[1].Type != accRecordInterim || records[2].Type != accRecordStart {
+		t.Fatalf("invalid user records %v \n", records)
+	}
+	if records[0].Reason != common.ACCSTOPREASONADMIN || records[0].SendByte != 1000 || records[0].ReceiveByte != 500 || records[1].ReceiveByte != 0 {
+		t.Fatalf("invalid stop record %v \n", records[0])
+	}
+
+	if records := history(&sAccountingHistoryParams{IP: "192.168.1.20", Type: accRecordStop}); len(records) != 1 || records[0].Reason != common.ACCSTOPREASONEND {
+		t.Fatalf("invalid IP filter %v \n", records)
+	}
+	if records := history(&sAccountingHistoryParams{IP: "172.16.0.2"}); len(records) != 5 {
+		t.Fatalf("invalid virtual IP filter %v \n", records)
+	}
+	if records := history(&sAccountingHistoryParams{To: 1}); len(records) != 0 {
+		t.Fatalf("invalid time range %v \n", records)
+	}
+
+	//the records older than the retention days are removed
+	database.Execute("update "+accHistoryTable+" set record_time = %d where session_id = '%s'", 1, "session1")
+	authMan.removeOldHistory()
+	if records := history(&sAccountingHistoryParams{}); len(records) != 2 {
+		t.Fatalf("old records are not removed %v \n", records)
+	}
+}
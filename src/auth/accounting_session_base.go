@@ -1,11 +1,15 @@
 package auth
 
 import (
+	"encoding/json"
 	"goconnect/common"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+//cAccountingSessionBase the counters and times are updated atomically, the other fields are guarded by the lock
 type cAccountingSessionBase struct {
 	Transfer          common.STransferStat `json:"transfer"`
 	User              string               `json:"user"`
@@ -18,9 +22,15 @@ type cAccountingSessionBase struct {
 	Vip               net.IP               `json:"virtual_ip"`
 	StartTime         int64                `json:"start_time"`
 	UpdateTime        int64                `json:"update_time"`
+	AcceptTime        int64                `json:"banner_accepted"`
 	dcCallback        common.TAccountingSessionDC
 	dcData            interface{}
+	stopReason        string
+	stopped           bool
+	lock              sync.Mutex
+	authenticator     common.IAuthenticator
 	authManager       *cAuthenticationManager
+	quotaBytes        uint64
 }
 
 //---------------------------------------------------------------------------------------
@@ -41,20 +51,33 @@ func (thisPt *cAccountingSessionBase) GetUserName() string {
 
 //GetTransfer for IAccountingSession
 func (thisPt *cAccountingSessionBase) GetTransfer() common.STransferStat {
-	return thisPt.Transfer
+	return thisPt.loadTransfer(&thisPt.Transfer)
 }
 
 //---------------------------------------------------------------------------------------
 
 //GetStepSend for IAccountingSession
 func (thisPt *cAccountingSessionBase) GetStepTransfer() common.STransferStat {
-	return thisPt.StepTransfer
+	return thisPt.loadTransfer(&thisPt.StepTransfer)
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cAccountingSessionBase) loadTransfer(transfer *common.STransferStat) common.STransferStat {
+	result := common.STransferStat{}
+	result.SendByte = atomic.LoadUint64(&transfer.SendByte)
+	result.ReceiveByte = atomic.LoadUint64(&transfer.ReceiveByte)
+	result.SendPacket = atomic.LoadUint64(&transfer.SendPacket)
+	result.ReceivePacket = atomic.LoadUint64(&transfer.ReceivePacket)
+	return result
 }
 
 //---------------------------------------------------------------------------------------
 
 //GetLocation for IAccountingSession
 func (thisPt *cAccountingSessionBase) GetLocation() (float64, float64) {
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
 	return thisPt.LocationLat, thisPt.LocationLong
 }
 
@@ -83,40 +106,42 @@ func (thisPt *cAccountingSessionBase) GetIP() net.IP {
 
 //GetStartTime for IAccountingSession
 func (thisPt *cAccountingSessionBase) GetStartTime() int64 {
-	return thisPt.StartTime
+	return atomic.LoadInt64(&thisPt.StartTime)
 }
 
 //---------------------------------------------------------------------------------------
 
 //GetUpdateTime for IAccountingSession
 func (thisPt *cAccountingSessionBase) GetUpdateTime() int64 {
-	return thisPt.UpdateTime
+	return atomic.LoadInt64(&thisPt.UpdateTime)
 }
 
 //---------------------------------------------------------------------------------------
 
 //UpdateSend for IAccountingSession
 func (thisPt *cAccountingSessionBase) UpdateSend(val uint64) {
-	thisPt.Transfer.SendByte += val
-	thisPt.Transfer.SendPacket++
-	thisPt.StepTransfer.SendByte += val
-	thisPt.StepTransfer.SendPacket++
+	atomic.AddUint64(&thisPt.Transfer.SendByte, val)
+	atomic.AddUint64(&thisPt.Transfer.SendPacket, 1)
+	atomic.AddUint64(&thisPt.StepTransfer.SendByte, val)
+	atomic.AddUint64(&thisPt.StepTransfer.SendPacket, 1)
 }
 
 //---------------------------------------------------------------------------------------
 
 //UpdateReceive for IAccountingSession
 func (thisPt *cAccountingSessionBase) UpdateReceive(val uint64) {
-	thisPt.Transfer.ReceiveByte += val
-	thisPt.Transfer.ReceivePacket++
-	thisPt.StepTransfer.ReceiveByte += val
-	thisPt.StepTransfer.ReceivePacket++
+	atomic.AddUint64(&thisPt.Transfer.ReceiveByte, val)
+	atomic.AddUint64(&thisPt.Transfer.ReceivePacket, 1)
+	atomic.AddUint64(&thisPt.StepTransfer.ReceiveByte, val)
+	atomic.AddUint64(&thisPt.StepTransfer.ReceivePacket, 1)
 }
 
 //---------------------------------------------------------------------------------------
 
 //Remove for IAccountingSession
 func (thisPt *cAccountingSessionBase) UpdateLocation(lat float64, long float64) {
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
 	thisPt.LocationLat = lat
 	thisPt.LocationLong = long
 }
@@ -125,23 +150,63 @@ func (thisPt *cAccountingSessionBase) UpdateLocation(lat float64, long float64)
 
 //Remove for IAccountingSession
 func (thisPt *cAccountingSessionBase) RegisterDCCallBack(callback common.TAccountingSessionDC, data interface{}) {
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
 	thisPt.dcCallback = callback
 	thisPt.dcData = data
 }
 
 //---------------------------------------------------------------------------------------
 
+//SetStopReason for IAccountingSession, saved by the stop record of the history. the first reason is kept
+func (thisPt *cAccountingSessionBase) SetStopReason(reason string) {
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+	if thisPt.stopReason == "" {
+		thisPt.stopReason = reason
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cAccountingSessionBase) getStopReason() string {
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+	return thisPt.stopReason
+}
+
+//---------------------------------------------------------------------------------------
+
 //Remove for IAccountingSession
 func (thisPt *cAccountingSessionBase) Start() {
-	thisPt.StartTime = time.Now().Unix()
+	now := time.Now().Unix()
+	atomic.StoreInt64(&thisPt.StartTime, now)
+	atomic.StoreInt64(&thisPt.UpdateTime, now)
+	thisPt.authManager.saveHistory(thisPt, accRecordStart)
 }
 
 //---------------------------------------------------------------------------------------
 
 //Remove for IAccountingSession
+//the protocols stop the session again after the DC callback, so only the first call is processed
 func (thisPt *cAccountingSessionBase) Stop() {
-	if thisPt.dcCallback != nil {
-		thisPt.dcCallback(thisPt, thisPt.dcData)
+	thisPt.lock.Lock()
+	if thisPt.stopped {
+		thisPt.lock.Unlock()
+		return
+	}
+	thisPt.stopped = true
+	callback, data := thisPt.dcCallback, thisPt.dcData
+	thisPt.lock.Unlock()
+
+	if callback != nil {
+		callback(thisPt, data)
+	}
+	thisPt.SetStopReason(common.ACCSTOPREASONEND)
+	atomic.StoreInt64(&thisPt.UpdateTime, time.Now().Unix())
+	thisPt.authManager.saveHistory(thisPt, accRecordStop)
+	if len(thisPt.authManager.params.Quotas) > 0 {
+		thisPt.authManager.updateQuotaUsage(thisPt)
 	}
 	thisPt.authManager.RemoveAccSession(thisPt)
 }
@@ -149,13 +214,59 @@ func (thisPt *cAccountingSessionBase) Stop() {
 //---------------------------------------------------------------------------------------
 
 //Remove for IAccountingSession
+//the authenticators can reject the session by IAccountingUpdater, the step transfer is reset after the check
 func (thisPt *cAccountingSessionBase) Update() bool {
-	thisPt.StepTransfer.SendByte = 0
-	thisPt.StepTransfer.ReceiveByte = 0
-	thisPt.StepTransfer.SendPacket = 0
-	thisPt.StepTransfer.ReceivePacket = 0
-	thisPt.UpdateTime = time.Now().Unix()
-	return true
+	atomic.StoreInt64(&thisPt.UpdateTime, time.Now().Unix())
+	thisPt.authManager.saveHistory(thisPt, accRecordInterim)
+
+	result := thisPt.authManager.checkQuota(thisPt)
+	if updater, ok := thisPt.authenticator.(common.IAccountingUpdater); ok && result {
+		result = updater.OnAccountingUpdate(thisPt)
+	}
+
+	atomic.StoreUint64(&thisPt.StepTransfer.SendByte, 0)
+	atomic.StoreUint64(&thisPt.StepTransfer.ReceiveByte, 0)
+	atomic.StoreUint64(&thisPt.StepTransfer.SendPacket, 0)
+	atomic.StoreUint64(&thisPt.StepTransfer.ReceivePacket, 0)
+	return result
+}
+
+//---------------------------------------------------------------------------------------
+
+//MarshalJSON the sessions are listed while the counters are updated
+func (thisPt *cAccountingSessionBase) MarshalJSON() ([]byte, error) {
+	type sAccountingSession struct {
+		Transfer          common.STransferStat `json:"transfer"`
+		User              string               `json:"user"`
+		LocationLat       float64              `json:"location_lat"`
+		LocationLong      float64              `json:"location_long"`
+		StepTransfer      common.STransferStat `json:"step_transfer"`
+		SessionID         string               `json:"session_id"`
+		AuthenticatorType string               `json:"auth_type"`
+		Ip                net.IP               `json:"client_ip"`
+		Vip               net.IP               `json:"virtual_ip"`
+		StartTime         int64                `json:"start_time"`
+		UpdateTime        int64                `json:"update_time"`
+		AcceptTime        int64                `json:"banner_accepted,omitempty"`
+		Quota             *sQuotaStatus        `json:"quota,omitempty"`
+	}
+
+	session := sAccountingSession{}
+	session.Transfer = thisPt.GetTransfer()
+	session.User = thisPt.User
+	session.LocationLat, session.LocationLong = thisPt.GetLocation()
+	session.StepTransfer = thisPt.GetStepTransfer()
+	session.SessionID = thisPt.SessionID
+	session.AuthenticatorType = thisPt.AuthenticatorType
+	session.Ip = thisPt.Ip
+	session.Vip = thisPt.Vip
+	session.StartTime = thisPt.GetStartTime()
+	session.UpdateTime = thisPt.GetUpdateTime()
+	session.AcceptTime = thisPt.AcceptTime
+	if thisPt.authManager != nil {
+		session.Quota = thisPt.authManager.getQuotaStatus(thisPt)
+	}
+	return json.Marshal(session)
 }
 
 //---------------------------------------------------------------------------------------
@@ -164,7 +275,9 @@ func (thisPt *cAccountingSessionBase) Init(authManager *cAuthenticationManager,
 	thisPt.Ip = info.UserIP
 	thisPt.Vip = info.VirtualIP
 	thisPt.User = info.User
+	thisPt.AcceptTime = info.AcceptTime
 	thisPt.AuthenticatorType = auth.GetType()
+	thisPt.authenticator = auth
 	thisPt.authManager = authManager
 
 	//generate session id
@@ -6,15 +6,30 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 //---------------------------------------------------------------------------------------
 
 type SAuthenticationManagerParams struct {
-	Utils     common.IUtils
-	Commander common.ICommander
+	Utils              common.IUtils
+	Commander          common.ICommander
+	RemoteCommanders   common.IRemoteCommanders
+	Database           common.IDatabase
+	History            bool
+	HistoryRetention   uint32
+	InterimInterval    uint32
+	Quotas             []SQuotaRule
+	MaxSessions        uint32
+	SessionLimitAction string
+	SessionLimits      []SSessionLimitRule
+	Lockout            SLockoutConfig
+	DummyGroups        []string
+	SplitIncludes      [][]string //split tunnels of the server and the pools, the client profiles are checked by them
+	SplitExclude       []string
 }
 
 //---------------------------------------------------------------------------------------
@@ -25,6 +40,8 @@ type sAuthenticationManagerListParams struct {
 	VirtualIP      string `help:"Virtual IP" schema:"v_ip" validate:"omitempty,cidr"`
 	ID             string `help:"Session ID" schema:"id" validate:"omitempty,alphanum"`
 	Sort           string `help:"Sort field, one of [total|send|receive|total_p|send_p|receive_p]. total by default" schema:"sort" validate:"omitempty,min=2,max=64,alphanum"`
+	Cluster        bool   `help:"Include the sessions of the other nodes" schema:"cluster"`
+	Node           string `help:"Node name, only in the cluster mode" schema:"node" validate:"omitempty,max=64"`
 	clientIPCache  *net.IPNet
 	virtualIPCache *net.IPNet
 }
@@ -44,6 +61,8 @@ type sAuthenticationManagerStat struct {
 	AdminLoginFailCount uint64 `json:"admin_login_fail_count"`
 	SessionsCount       uint64 `json:"acc_sessions_count"`
 	UsersCount          uint64 `json:"acc_users_count"`
+	LoginBlockedCount   uint64 `json:"login_blocked_count"`
+	LockoutCount        uint64 `json:"lockout_count"`
 }
 
 //---------------------------------------------------------------------------------------
@@ -51,11 +70,18 @@ type sAuthenticationManagerStat struct {
 type cAuthenticationManager struct {
 	sessions       map[string]common.IAccountingSession
 	users          map[string]uint32
+	reservations   map[string][]int64
 	sessionsLock   sync.RWMutex
 	authenticators []common.IAuthenticator
 	authLocks      sync.RWMutex
 	params         SAuthenticationManagerParams
 	stat           sAuthenticationManagerStat
+	usages         map[string]*sQuotaUsage
+	quotaLock      sync.Mutex
+	profiles       []common.SClientProfile
+	profilesLock   sync.RWMutex
+	failures       map[string]*sLoginFailure
+	lockoutLock    sync.Mutex
 }
 
 //---------------------------------------------------------------------------------------
@@ -114,6 +140,7 @@ func (thisPt *cAuthenticationManager) RegisterAccSession(session common.IAccount
 	//add users
 	thisPt.sessions[session.GetSessionID()] = session
 	thisPt.users[session.GetUserName()]++
+	thisPt.consumeReservation(session.GetUserName())
 }
 
 //---------------------------------------------------------------------------------------
@@ -161,6 +188,9 @@ func (thisPt *cAuthenticationManager) OnListUsersCommand(req *http.Request, para
 func (thisPt *cAuthenticationManager) OnListCommand(req *http.Request, params interface{}) (common.IHTTPResponse, error) {
 
 	searchParam := thisPt.prepareSearchParam(params)
+	if searchParam.Cluster && thisPt.params.RemoteCommanders != nil {
+		return thisPt.onClusterList(searchParam)
+	}
 
 	//sort function
 	sortCallBack := func(key string, item interface{}) uint64 {
@@ -198,19 +228,63 @@ func (thisPt *cAuthenticationManager) OnStatus(req *http.Request, params interfa
 func (thisPt *cAuthenticationManager) OnDCCommand(req *http.Request, params interface{}) (common.IHTTPResponse, error) {
 
 	searchParam := thisPt.prepareSearchParam(params)
+	if searchParam.Cluster && thisPt.params.RemoteCommanders != nil {
+		return thisPt.onClusterDC(searchParam)
+	}
 
-	thisPt.sessionsLock.Lock()
-	defer thisPt.sessionsLock.Unlock()
+	thisPt.dcSessions(searchParam)
+	return thisPt.params.Utils.CreateHttpResponseFromString("OK")
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *cAuthenticationManager) dcSessions(searchParam *sAuthenticationManagerListParams) {
+	sessions := []common.IAccountingSession{}
 
-	//search and DC
-	for k, v := range thisPt.sessions {
+	//search
+	thisPt.sessionsLock.RLock()
+	for _, v := range thisPt.sessions {
 		if thisPt.matchSession(v, searchParam) {
-			v.Stop()
-			delete(thisPt.sessions, k)
+			sessions = append(sessions, v)
 		}
 	}
+	thisPt.sessionsLock.RUnlock()
 
-	return thisPt.params.Utils.CreateHttpResponseFromString("OK")
+	//the stopped sessions remove themselves, so it should be called without the lock
+	for _, v := range sessions {
+		v.SetStopReason(common.ACCSTOPREASONADMIN)
+		v.Stop()
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//updateSessions sends the interim updates, the sessions rejected by the authenticators are disconnected
+func (thisPt *cAuthenticationManager) updateSessions() {
+	thisPt.sessionsLock.RLock()
+	sessions := make([]common.IAccountingSession, 0, len(thisPt.sessions))
+	for _, v := range thisPt.sessions {
+		sessions = append(sessions, v)
+	}
+	thisPt.sessionsLock.RUnlock()
+
+	for _, session := range sessions {
+		if !session.Update() {
+			log.Printf("accounting session %s of user %s is rejected by the authenticator \n", session.GetSessionID(), session.GetUserName())
+			session.SetStopReason(common.ACCSTOPREASONREJECTED)
+			session.Stop()
+		}
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cAuthenticationManager) scheduleUpdates() {
+	ticker := time.NewTicker(time.Duration(thisPt.params.InterimInterval) * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		thisPt.updateSessions()
+	}
 }
 
 //---------------------------------------------------------------------------------------
@@ -229,6 +303,39 @@ func (thisPt *cAuthenticationManager) GetAccountingSession(sessionID string, acc
 
 //---------------------------------------------------------------------------------------
 
+//GetUserAccountingSessions for IAuthenticationManger
+func (thisPt *cAuthenticationManager) GetUserAccountingSessions(user string, accessFunc common.TAccessFunction) uint32 {
+	thisPt.sessionsLock.RLock()
+	defer thisPt.sessionsLock.RUnlock()
+
+	//user names are not case sensitive for this lookup
+	count := uint32(0)
+	for _, session := range thisPt.sessions {
+		if strings.EqualFold(session.GetUserName(), user) {
+			accessFunc(session)
+			count++
+		}
+	}
+	return count
+}
+
+//---------------------------------------------------------------------------------------
+
+//GetAccountingSessionByVIP for IAuthenticationManger
+func (thisPt *cAuthenticationManager) GetAccountingSessionByVIP(vip net.IP, accessFunc common.TAccessFunction) error {
+	thisPt.sessionsLock.RLock()
+	defer thisPt.sessionsLock.RUnlock()
+	for _, session := range thisPt.sessions {
+		if session.GetVIP().Equal(vip) {
+			accessFunc(session)
+			return nil
+		}
+	}
+	return errors.New("invalid virtual IP")
+}
+
+//---------------------------------------------------------------------------------------
+
 //GetAuthenticator for IAuthenticationManger
 func (thisPt *cAuthenticationManager) GetAuthenticator(typeName string) common.IAuthenticator {
 	thisPt.authLocks.RLock()
@@ -243,6 +350,21 @@ func (thisPt *cAuthenticationManager) GetAuthenticator(typeName string) common.I
 
 //---------------------------------------------------------------------------------------
 
+//GetUserInfo for IAuthenticationManger, the authenticators without the user information return only the user name
+func (thisPt *cAuthenticationManager) GetUserInfo(user string, authenticator common.IAuthenticator) common.SUserInfo {
+	provider, ok := authenticator.(common.IUserInfoProvider)
+	if !ok {
+		return common.SUserInfo{User: user}
+	}
+	info, err := provider.GetUserInfo(user)
+	if err != nil {
+		return common.SUserInfo{User: user}
+	}
+	return info
+}
+
+//---------------------------------------------------------------------------------------
+
 //RegisterDummyAuthenticator for IAuthenticationManger
 func (thisPt *cAuthenticationManager) RegisterDummyAuthenticator(cfgFile string) error {
 	auth := new(cDummyAuthenticator)
@@ -254,20 +376,46 @@ func (thisPt *cAuthenticationManager) RegisterDummyAuthenticator(cfgFile string)
 
 //AuthenticateUser for IAuthenticationManger
 func (thisPt *cAuthenticationManager) AuthenticateUser(info common.SAuthenticationInfo) (common.IAuthenticator, error) {
+	atomic.AddUint64(&thisPt.stat.LoginReqCount, 1)
+
+	//the locked user names and IPs are not checked by the authenticators
+	if thisPt.isLockedOut(info) {
+		atomic.AddUint64(&thisPt.stat.LoginFailCount, 1)
+		log.Printf("login of user %s from ip %s is blocked by the lockout \n", info.User, info.IP.String())
+		return nil, errors.New("too many failed logins, try again later")
+	}
+
+	auth := thisPt.findUserAuthenticator(info)
+	if auth == nil {
+		atomic.AddUint64(&thisPt.stat.LoginFailCount, 1)
+		log.Printf("authentication failed for user %s from ip %s\n", info.User, info.IP.String())
+		//the delay does not slow down the parallel attempts, they are limited by the IP lockout
+		time.Sleep(thisPt.registerLoginFail(info))
+		return nil, errors.New("invalid user name or password ")
+	}
+	thisPt.clearLoginFailures(info.User, info.IP)
+
+	if err := thisPt.CheckQuota(info.User, auth); err != nil {
+		atomic.AddUint64(&thisPt.stat.LoginFailCount, 1)
+		log.Printf("user %s from ip %s has no remaining quota \n", info.User, info.IP.String())
+		return nil, err
+	}
+	return auth, nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//findUserAuthenticator returns the first authenticator accepting the user
+func (thisPt *cAuthenticationManager) findUserAuthenticator(info common.SAuthenticationInfo) common.IAuthenticator {
 	thisPt.authLocks.RLock()
 	defer thisPt.authLocks.RUnlock()
 
-	atomic.AddUint64(&thisPt.stat.LoginReqCount, 1)
-
 	for _, auth := range thisPt.authenticators {
 		if err := auth.AuthenticateUser(info); err == nil {
-			return auth, nil
+			return auth
 		}
 	}
-
-	atomic.AddUint64(&thisPt.stat.LoginFailCount, 1)
-	log.Printf("authentication failed for user %s from ip %s\n", info.User, info.IP.String())
-	return nil, errors.New("invalid user name or password ")
+	return nil
 }
 
 //---------------------------------------------------------------------------------------
@@ -314,6 +462,11 @@ func (thisPt *cAuthenticationManager) SetCommander(commander common.ICommander)
 	selector.Register("acc_users_list", thisPt.OnListUsersCommand, sAuthenticationManagerListUsersParams{})
 	selector.Register("acc_sessions_dc", thisPt.OnDCCommand, sAuthenticationManagerListParams{})
 	selector.Register("acc_sessions_status", thisPt.OnStatus, nil)
+	selector.Register("acc_history", thisPt.OnHistoryCommand, sAccountingHistoryParams{})
+	selector.Register("acc_quota_reset", thisPt.OnQuotaResetCommand, sQuotaResetParams{})
+	selector.Register("client_profiles_list", thisPt.OnProfilesListCommand, nil)
+	selector.Register("auth_lockouts", thisPt.OnLockoutsCommand, sLockoutListParams{})
+	selector.Register("auth_lockouts_clear", thisPt.OnLockoutsClearCommand, sLockoutClearParams{})
 }
 
 //---------------------------------------------------------------------------------------
@@ -322,6 +475,15 @@ func (thisPt *cAuthenticationManager) SetCommander(commander common.ICommander)
 func (thisPt *cAuthenticationManager) init(params SAuthenticationManagerParams) {
 	thisPt.params = params
 	thisPt.sessions = make(map[string]common.IAccountingSession)
+	thisPt.users = make(map[string]uint32)
+	thisPt.reservations = make(map[string][]int64)
+	thisPt.initHistory()
+	thisPt.initQuotas()
+	thisPt.initLockouts()
+
+	if thisPt.params.InterimInterval > 0 {
+		go thisPt.scheduleUpdates()
+	}
 }
 
 //---------------------------------------------------------------------------------------
@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"goconnect/common"
+	"goconnect/utils"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+//---------------------------------------------------------------------------------------
+
+type sTestQuotaAuthenticator struct {
+	common.IAuthenticator
+	limit   uint64
+	updates int32
+}
+
+func (thisPt *sTestQuotaAuthenticator) GetType() string {
+	return "quota"
+}
+
+func (thisPt *sTestQuotaAuthenticator) OnAccountingUpdate(session common.IAccountingSession) bool {
+	atomic.AddInt32(&thisPt.updates, 1)
+	return session.GetTransfer().SendByte < thisPt.limit
+}
+
+//---------------------------------------------------------------------------------------
+
+func TestAccountingUpdates(t *testing.T) {
+	util := utils.Create()
+	authMan := new(cAuthenticationManager)
+	authMan.init(SAuthenticationManagerParams{Utils: util})
+	authenticator := &sTestQuotaAuthenticator{limit: 1 << 62}
+
+	createSession := func(user string) *cAccountingSessionBase {
+		session := new(cAccountingSessionBase)
+		session.Init(authMan, common.SAccountingInfo{User: user, UserIP: net.ParseIP("192.168.1.10"), VirtualIP: net.ParseIP("172.16.0.2")}, authenticator, util)
+		session.Start()
+		return session
+	}
+
+	session1 := createSession("user1")
+	session2 := createSession("user2")
+
+	//the counters are updated by the protocols during the updates
+	var wait sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for j := 0; j < 100; j++ {
+				session1.UpdateSend(10)
+				session2.UpdateReceive(10)
+			}
+		}()
+	}
+	authMan.updateSessions()
+	wait.Wait()
+
+	if transfer := session1.GetTransfer(); transfer.SendByte != 4000 || transfer.SendPacket != 400 {
+		t.Fatalf("invalid transfer %v \n", transfer)
+	}
+
+	//the step transfer is reset by the update, the session over the quota is disconnected
+	dcCount := int32(0)
+	session1.RegisterDCCallBack(func(session common.IAccountingSession, data interface{}) bool {
+		atomic.AddInt32(&dcCount, 1)
+
+		//the protocols stop the session again
+		session.Stop()
+		return true
+	}, nil)
+
+	authenticator.limit = 1000
+	authMan.updateSessions()
+	if session2.GetStepTransfer().ReceiveByte != 0 || session2.GetTransfer().ReceiveByte != 4000 {
+		t.Fatalf("step transfer is not reset \n")
+	}
+	if len(authMan.sessions) != 1 || len(authMan.users) != 1 || atomic.LoadInt32(&dcCount) != 1 {
+		t.Fatalf("rejected session is not disconnected %d \n", len(authMan.sessions))
+	}
+	if session1.getStopReason() != common.ACCSTOPREASONREJECTED {
+		t.Fatalf("invalid stop reason %s \n", session1.getStopReason())
+	}
+	if atomic.LoadInt32(&authenticator.updates) != 4 {
+		t.Fatalf("invalid updates count %d \n", authenticator.updates)
+	}
+
+	//the admin disconnect
+	params := &sAuthenticationManagerListParams{User: "user2"}
+	if _, err := authMan.OnDCCommand(nil, authMan.prepareSearchParam(params)); err != nil {
+		t.Fatalf("can not disconnect the session %v \n", err)
+	}
+	if len(authMan.sessions) != 0 || len(authMan.users) != 0 || session2.getStopReason() != common.ACCSTOPREASONADMIN {
+		t.Fatalf("session is not disconnected \n")
+	}
+}
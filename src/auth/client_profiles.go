@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"errors"
+	"goconnect/common"
+	"net/http"
+)
+
+//---------------------------------------------------------------------------------------
+
+const clientProfilesSegment = "client_profiles"
+
+//---------------------------------------------------------------------------------------
+
+//checkSplitRoutes checks the routes sent to the clients of the profile. the include and the exclude of the profile
+//are used before the ones of the pools and the server
+func (thisPt *cAuthenticationManager) checkSplitRoutes(profile common.SClientProfile) error {
+	exclude := profile.SplitExclude
+	if len(exclude) == 0 {
+		exclude = thisPt.params.SplitExclude
+	}
+	if len(profile.SplitInclude) > 0 {
+		return thisPt.params.Utils.CheckSplitRoutes(profile.SplitInclude, exclude)
+	}
+
+	for _, include := range thisPt.params.SplitIncludes {
+		if err := thisPt.params.Utils.CheckSplitRoutes(include, exclude); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//OnCommand for IDynamicConfigActor. replaces all the client profiles, the new profiles are used by the new sessions
+func (thisPt *cAuthenticationManager) OnCommand(section string, params interface{}) error {
+	profileList, res := params.([]interface{})
+	if !res {
+		return errors.New("invalid client profiles configuration")
+	}
+
+	profiles := []common.SClientProfile{}
+	names := make(map[string]bool)
+	for _, profileInfo := range profileList {
+		profile := common.SClientProfile{}
+		if err := thisPt.params.Utils.CastJsonObject(profileInfo, &profile); err != nil {
+			return err
+		}
+
+		if err := thisPt.params.Utils.ValidateStruct(profile); err != nil {
+			return err
+		}
+
+		if err := thisPt.checkSplitRoutes(profile); err != nil {
+			return err
+		}
+
+		if names[profile.Name] {
+			return errors.New("duplicate client profile " + profile.Name)
+		}
+		names[profile.Name] = true
+		profiles = append(profiles, profile)
+	}
+
+	thisPt.profilesLock.Lock()
+	defer thisPt.profilesLock.Unlock()
+	thisPt.profiles = profiles
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//GetClientProfile for IAuthenticationManger, the user profiles are checked before the group profiles. nil for the users without any profile
+func (thisPt *cAuthenticationManager) GetClientProfile(user string, authenticator common.IAuthenticator) *common.SClientProfile {
+	thisPt.profilesLock.RLock()
+	profiles := thisPt.profiles
+	thisPt.profilesLock.RUnlock()
+	if len(profiles) == 0 {
+		return nil
+	}
+
+	for i := range profiles {
+		if thisPt.containsString(profiles[i].Users, user) {
+			profile := profiles[i]
+			return &profile
+		}
+	}
+
+	groups := thisPt.GetUserInfo(user, authenticator).Groups
+	for i := range profiles {
+		for _, group := range groups {
+			if thisPt.containsString(profiles[i].Groups, group) {
+				profile := profiles[i]
+				return &profile
+			}
+		}
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cAuthenticationManager) OnProfilesListCommand(req *http.Request, params interface{}) (common.IHTTPResponse, error) {
+	thisPt.profilesLock.RLock()
+	defer thisPt.profilesLock.RUnlock()
+
+	list := append([]common.SClientProfile{}, thisPt.profiles...)
+	return thisPt.params.Utils.CreateHttpResponseFromObject(list)
+}
+
+//---------------------------------------------------------------------------------------
+
+//SetConfigManager for IAuthenticationManger, the client profiles are loaded from the configuration
+func (thisPt *cAuthenticationManager) SetConfigManager(config common.IDynamicConfigManager) {
+	config.RegisterActor(clientProfilesSegment, nil, thisPt)
+}
@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"goconnect/utils"
+	"testing"
+)
+
+//---------------------------------------------------------------------------------------
+
+func TestClientProfiles(t *testing.T) {
+	authMan := new(cAuthenticationManager)
+	authMan.init(SAuthenticationManagerParams{Utils: utils.Create()})
+	authenticator := &sTestGroupAuthenticator{groups: map[string][]string{"user1": {"admins"}, "user2": {"admins"}}}
+
+	if authMan.GetClientProfile("user1", authenticator) != nil {
+		t.Fatalf("profile without configuration \n")
+	}
+
+	config := []interface{}{
+		map[string]interface{}{"name": "admins", "groups": []interface{}{"admins"}, "split_include": []interface{}{"10.0.0.0/8"}, "idle_timeout": 600},
+		map[string]interface{}{"name": "user1", "users": []interface{}{"user1"}, "split_dns": []interface{}{"corp.local"}, "banner": "welcome"},
+	}
+	if err := authMan.OnCommand(clientProfilesSegment, config); err != nil {
+		t.Fatalf("can not load the profiles %v \n", err)
+	}
+
+	//the user profile is used before the group profile
+	if profile := authMan.GetClientProfile("user1", authenticator); profile == nil || profile.Name != "user1" {
+		t.Fatalf("invalid user profile %v \n", profile)
+	}
+	if profile := authMan.GetClientProfile("user2", authenticator); profile == nil || profile.Name != "admins" || profile.IdleTimeout != 600 {
+		t.Fatalf("invalid group profile %v \n", profile)
+	}
+	if authMan.GetClientProfile("user3", authenticator) != nil {
+		t.Fatalf("profile for user without any group \n")
+	}
+
+	//the invalid configurations are not applied
+	invalid := []interface{}{
+		map[string]interface{}{"name": "admins"},
+		map[string]interface{}{"name": "admins"},
+	}
+	if err := authMan.OnCommand(clientProfilesSegment, invalid); err == nil {
+		t.Fatalf("duplicate profiles are accepted \n")
+	}
+	invalid = []interface{}{map[string]interface{}{"name": "admins", "split_exclude": []interface{}{"10.0.0.0"}}}
+	if err := authMan.OnCommand(clientProfilesSegment, invalid); err == nil {
+		t.Fatalf("invalid split exclude is accepted \n")
+	}
+	invalid = []interface{}{map[string]interface{}{"name": "admins", "split_include": []interface{}{"10.10.0.0/16"}, "split_exclude": []interface{}{"10.0.0.0/8"}}}
+	if err := authMan.OnCommand(clientProfilesSegment, invalid); err == nil {
+		t.Fatalf("conflicting split routes are accepted \n")
+	}
+	if len(authMan.profiles) != 2 {
+		t.Fatalf("invalid configuration is applied %v \n", authMan.profiles)
+	}
+
+	//the profiles are checked by the routes of the pools and the server
+	authMan = new(cAuthenticationManager)
+	authMan.init(SAuthenticationManagerParams{Utils: utils.Create(), SplitIncludes: [][]string{{"10.10.0.0/16"}, {"172.17.0.0/16"}}, SplitExclude: []string{"192.168.0.0/16"}})
+	invalid = []interface{}{map[string]interface{}{"name": "admins", "split_exclude": []interface{}{"172.16.0.0/12"}}}
+	if err := authMan.OnCommand(clientProfilesSegment, invalid); err == nil {
+		t.Fatalf("split exclude conflicting with the pool routes is accepted \n")
+	}
+	invalid = []interface{}{map[string]interface{}{"name": "admins", "split_include": []interface{}{"192.168.1.0/24"}}}
+	if err := authMan.OnCommand(clientProfilesSegment, invalid); err == nil {
+		t.Fatalf("split include conflicting with the server exclude is accepted \n")
+	}
+	config = []interface{}{map[string]interface{}{"name": "admins", "split_include": []interface{}{"192.168.1.0/24"}, "split_exclude": []interface{}{"172.16.0.0/12"}}}
+	if err := authMan.OnCommand(clientProfilesSegment, config); err != nil {
+		t.Fatalf("profile with its own routes is rejected %v \n", err)
+	}
+}
@@ -0,0 +1,170 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"goconnect/common"
+	"log"
+	"net/url"
+	"strings"
+)
+
+//---------------------------------------------------------------------------------------
+
+const (
+	clusterSessionsListAPI = "acc_sessions_list"
+	clusterSessionsDCAPI   = "acc_sessions_dc"
+)
+
+//---------------------------------------------------------------------------------------
+
+//sClusterSession is a session of a node, the sessions of the other nodes are kept as the json objects
+type sClusterSession struct {
+	object   map[string]interface{}
+	transfer common.STransferStat
+}
+
+//---------------------------------------------------------------------------------------
+
+//getRemoteParams the same search is done by the other nodes without the cluster mode
+func (thisPt *cAuthenticationManager) getRemoteParams(param *sAuthenticationManagerListParams) url.Values {
+	values := url.Values{}
+	for key, value := range map[string]string{"user": param.User, "ip": param.ClientIP, "v_ip": param.VirtualIP, "id": param.ID, "sort": param.Sort} {
+		if value != "" {
+			values.Set(key, value)
+		}
+	}
+	return values
+}
+
+//---------------------------------------------------------------------------------------
+
+//isNodeSelected checks the node filter of the cluster mode
+func (thisPt *cAuthenticationManager) isNodeSelected(param *sAuthenticationManagerListParams, node string) bool {
+	return param.Node == "" || param.Node == node
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cAuthenticationManager) createClusterSession(node string, data []byte) (*sClusterSession, error) {
+	session := &sClusterSession{}
+	if err := json.Unmarshal(data, &session.object); err != nil {
+		return nil, err
+	}
+	if transfer, err := json.Marshal(session.object["transfer"]); err == nil {
+		json.Unmarshal(transfer, &session.transfer)
+	}
+	session.object["node"] = node
+	return session, nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//getLocalSessions returns the sessions of this node as the cluster sessions
+func (thisPt *cAuthenticationManager) getLocalSessions(param *sAuthenticationManagerListParams) []*sClusterSession {
+	thisPt.sessionsLock.RLock()
+	defer thisPt.sessionsLock.RUnlock()
+
+	sessions := []*sClusterSession{}
+	for _, v := range thisPt.sessions {
+		if !thisPt.matchSession(v, param) {
+			continue
+		}
+
+		data, err := json.Marshal(v)
+		if err != nil {
+			continue
+		}
+		if session, err := thisPt.createClusterSession(thisPt.params.RemoteCommanders.GetName(), data); err == nil {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions
+}
+
+//---------------------------------------------------------------------------------------
+
+//getRemoteSessions returns the sessions of the other nodes by node name, the failed nodes are logged and skipped
+func (thisPt *cAuthenticationManager) getRemoteSessions(param *sAuthenticationManagerListParams) map[string][]*sClusterSession {
+	nodes := make(map[string][]*sClusterSession)
+	for _, result := range thisPt.params.RemoteCommanders.CallAll(clusterSessionsListAPI, thisPt.getRemoteParams(param)) {
+		if !thisPt.isNodeSelected(param, result.Node) {
+			continue
+		}
+
+		objects := []json.RawMessage{}
+		if result.Err == nil {
+			result.Err = json.Unmarshal(result.Response, &objects)
+		}
+		if result.Err != nil {
+			log.Printf("can not get the sessions of node %s, %s \n", result.Node, result.Err.Error())
+			continue
+		}
+
+		sessions := []*sClusterSession{}
+		for _, object := range objects {
+			if session, err := thisPt.createClusterSession(result.Node, object); err == nil {
+				sessions = append(sessions, session)
+			}
+		}
+		nodes[result.Node] = sessions
+	}
+	return nodes
+}
+
+//---------------------------------------------------------------------------------------
+
+//onClusterList merges the sessions of all the nodes, the sorter orders all the sessions by the same key
+func (thisPt *cAuthenticationManager) onClusterList(param *sAuthenticationManagerListParams) (common.IHTTPResponse, error) {
+	sortCallBack := func(key string, item interface{}) uint64 {
+		return item.(*sClusterSession).transfer.GetValue(key)
+	}
+	sorter := thisPt.params.Utils.CreateHeapSorter(common.MAXCOMMANDRESPONSEITEMS, sortCallBack, param.Sort)
+
+	count := 0
+	add := func(sessions []*sClusterSession) {
+		for _, session := range sessions {
+			sorter.AddItem(session)
+			count++
+		}
+	}
+
+	if thisPt.isNodeSelected(param, thisPt.params.RemoteCommanders.GetName()) {
+		add(thisPt.getLocalSessions(param))
+	}
+	for _, sessions := range thisPt.getRemoteSessions(param) {
+		add(sessions)
+	}
+
+	result := []map[string]interface{}{}
+	for ; count > 0 && len(result) < common.MAXCOMMANDRESPONSEITEMS; count-- {
+		result = append(result, sorter.GetItem().(*sClusterSession).object)
+	}
+	return thisPt.params.Utils.CreateHttpResponseFromObject(result)
+}
+
+//---------------------------------------------------------------------------------------
+
+//onClusterDC disconnects the local sessions and forwards the request to the nodes which own the matched sessions
+func (thisPt *cAuthenticationManager) onClusterDC(param *sAuthenticationManagerListParams) (common.IHTTPResponse, error) {
+	if thisPt.isNodeSelected(param, thisPt.params.RemoteCommanders.GetName()) {
+		thisPt.dcSessions(param)
+	}
+
+	failed := []string{}
+	values := thisPt.getRemoteParams(param)
+	for node, sessions := range thisPt.getRemoteSessions(param) {
+		if len(sessions) == 0 {
+			continue
+		}
+		if _, err := thisPt.params.RemoteCommanders.Call(node, clusterSessionsDCAPI, values); err != nil {
+			log.Printf("can not disconnect the sessions of node %s, %s \n", node, err.Error())
+			failed = append(failed, node)
+		}
+	}
+
+	if len(failed) > 0 {
+		return nil, errors.New("can not disconnect the sessions of nodes " + strings.Join(failed, ","))
+	}
+	return thisPt.params.Utils.CreateHttpResponseFromString("OK")
+}
@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"goconnect/common"
+	"goconnect/utils"
+	"io/ioutil"
+	"net/url"
+	"testing"
+)
+
+//---------------------------------------------------------------------------------------
+
+type sTestRemoteCommanders struct {
+	sessions map[string]string
+	calls    []string
+}
+
+func (thisPt *sTestRemoteCommanders) GetName() string {
+	return "gw1"
+}
+
+func (thisPt *sTestRemoteCommanders) GetNodes() []string {
+	return []string{"gw2", "gw3"}
+}
+
+func (thisPt *sTestRemoteCommanders) Call(node string, api string, params url.Values) ([]byte, error) {
+	thisPt.calls = append(thisPt.calls, node+"/"+api+"?"+params.Encode())
+	if node == "gw3" {
+		return nil, errors.New("node is not reachable")
+	}
+	if api == clusterSessionsDCAPI {
+		return []byte("OK"), nil
+	}
+	return []byte(thisPt.sessions[node]), nil
+}
+
+func (thisPt *sTestRemoteCommanders) CallAll(api string, params url.Values) []common.SRemoteCommandResult {
+	results := []common.SRemoteCommandResult{}
+	for _, node := range thisPt.GetNodes() {
+		result := common.SRemoteCommandResult{Node: node}
+		result.Response, result.Err = thisPt.Call(node, api, params)
+		results = append(results, result)
+	}
+	thisPt.calls = nil
+	return results
+}
+
+//---------------------------------------------------------------------------------------
+
+func TestClusterSessions(t *testing.T) {
+	remote := &sTestRemoteCommanders{sessions: make(map[string]string)}
+	remote.sessions["gw2"] = `[{"session_id":"remote1","user":"user2","transfer":{"send_byte":1000}},{"session_id":"remote2","user":"user1","transfer":{"send_byte":10}}]`
+
+	authMan := new(cAuthenticationManager)
+	authMan.init(SAuthenticationManagerParams{Utils: utils.Create(), RemoteCommanders: remote})
+	authMan.sessions["local1"] = &cAccountingSessionBase{SessionID: "local1", User: "user1", Transfer: common.STransferStat{SendByte: 500}}
+
+	list := func(params *sAuthenticationManagerListParams) []map[string]interface{} {
+		response, err := authMan.OnListCommand(nil, params)
+		if err != nil {
+			t.Fatalf("can not list the sessions %v \n", err)
+		}
+		body, _ := ioutil.ReadAll(response.GetRespose().Body)
+		sessions := []map[string]interface{}{}
+		if err := json.Unmarshal(body, &sessions); err != nil {
+			t.Fatalf("invalid response %s \n", string(body))
+		}
+		return sessions
+	}
+
+	//merged and sorted by the transfer, the unreachable node is skipped
+	sessions := list(&sAuthenticationManagerListParams{Cluster: true})
+	if len(sessions) != 3 || sessions[0]["session_id"] != "remote1" || sessions[1]["session_id"] != "local1" || sessions[2]["session_id"] != "remote2" {
+		t.Fatalf("invalid cluster sessions %v \n", sessions)
+	}
+	if sessions[0]["node"] != "gw2" || sessions[1]["node"] != "gw1" {
+		t.Fatalf("invalid session nodes %v \n", sessions)
+	}
+
+	//node filter
+	if sessions := list(&sAuthenticationManagerListParams{Cluster: true, Node: "gw1"}); len(sessions) != 1 {
+		t.Fatalf("invalid node filter %v \n", sessions)
+	}
+
+	//the request is forwarded to the node of the session only
+	params := &sAuthenticationManagerListParams{Cluster: true, Node: "gw2", User: "user2"}
+	if _, err := authMan.OnDCCommand(nil, params); err != nil {
+		t.Fatalf("can not disconnect the remote session %v \n", err)
+	}
+	if len(remote.calls) != 1 || remote.calls[0] != "gw2/acc_sessions_dc?user=user2" || len(authMan.sessions) != 1 {
+		t.Fatalf("invalid forwarded requests %v \n", remote.calls)
+	}
+}
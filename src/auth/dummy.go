@@ -12,6 +12,7 @@ import (
 type cDummyAuthenticator struct {
 	randomPass      string
 	randomAdminPass string
+	groups          []string
 	util            common.IUtils
 	accManager      *cAuthenticationManager
 }
@@ -53,6 +54,16 @@ func (thisPt *cDummyAuthenticator) GetType() string {
 	return "dummy"
 }
 
+//---------------------------------------------------------------------------------------
+
+//GetUserInfo for IUserInfoProvider, the dummy user is a member of the configured groups
+func (thisPt *cDummyAuthenticator) GetUserInfo(user string) (common.SUserInfo, error) {
+	if user != "dummy" {
+		return common.SUserInfo{}, errors.New("user not found")
+	}
+	return common.SUserInfo{User: user, Groups: append([]string{}, thisPt.groups...)}, nil
+}
+
 //---------------------------------------------------------------------------------------
 func (thisPt *cDummyAuthenticator) ChangePasswords(adminPass string, userPass string) {
 	thisPt.randomAdminPass = adminPass
@@ -65,6 +76,8 @@ func (thisPt *cDummyAuthenticator) init(accManager *cAuthenticationManager, util
 		fmt.Printf("users can login with user dummy and password %s\nadmin can login with user admin and password %s\n", thisPt.randomPass, thisPt.randomAdminPass)
 	}()
 
+	thisPt.groups = accManager.params.DummyGroups
+
 	//the cfg file length is zero
 	thisPt.randomAdminPass = util.GetRandomString(12)
 	thisPt.randomPass = util.GetRandomString(12)
@@ -2,6 +2,7 @@ package auth
 
 import (
 	"fmt"
+	"goconnect/utils"
 	"testing"
 )
 
@@ -30,3 +31,24 @@ func TestDummyAuth(t *testing.T) {
 	c.call()
 	c.call2()
 }
+
+//---------------------------------------------------------------------------------------
+
+func TestDummyGroups(t *testing.T) {
+	params := SAuthenticationManagerParams{Utils: utils.Create(), DummyGroups: []string{"staff"}}
+	params.SessionLimits = []SSessionLimitRule{{Name: "staff", Groups: []string{"staff"}, MaxSessions: 3}}
+	authMan := new(cAuthenticationManager)
+	authMan.init(params)
+	if err := authMan.RegisterDummyAuthenticator(""); err != nil {
+		t.Fatalf("can not register dummy authenticator %v \n", err)
+	}
+
+	//the group rules should match the dummy user
+	authenticator := authMan.GetAuthenticator("dummy")
+	if info := authMan.GetUserInfo("dummy", authenticator); len(info.Groups) != 1 || info.Groups[0] != "staff" {
+		t.Fatalf("invalid groups of the dummy user %v \n", info)
+	}
+	if authMan.getSessionLimit("dummy", authenticator) != 3 || authMan.getSessionLimit("other", authenticator) != 0 {
+		t.Fatalf("group rule is not used for the dummy user \n")
+	}
+}
@@ -0,0 +1,255 @@
+package auth
+
+import (
+	"goconnect/common"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+//---------------------------------------------------------------------------------------
+
+const (
+	lockoutTypeUser      = "user"
+	lockoutTypeIP        = "ip"
+	lockoutPurgeInterval = 1 * time.Minute
+	loginMaxDelay        = 8 * time.Second
+)
+
+//---------------------------------------------------------------------------------------
+
+//SLockoutConfig the user names are tracked by the source IPs and the source IPs are tracked separately, the zero fail count
+//disables the tracking. the other IPs can not lock out a user, the IP lockout limits the attempts to the different users
+type SLockoutConfig struct {
+	UserFailCount uint32
+	IPFailCount   uint32
+	TrackTime     uint32 //the failures older than the track time are forgotten (second)
+	LockoutTime   uint32 //second
+	Delay         uint32 //delay of the first failure, doubled by each failure (millisecond)
+}
+
+//---------------------------------------------------------------------------------------
+
+//sLoginFailure is the failed logins of a user name or a source IP
+type sLoginFailure struct {
+	Type        string `json:"type"`
+	ID          string `json:"id"`
+	Failures    uint32 `json:"failures"`
+	LastFail    int64  `json:"last_fail"`
+	LockedUntil int64  `json:"locked_until"`
+	Blocked     uint64 `json:"blocked"`
+}
+
+//---------------------------------------------------------------------------------------
+
+type sLockoutListParams struct {
+	Locked bool `help:"Only the locked user names and IPs" schema:"locked"`
+}
+
+//---------------------------------------------------------------------------------------
+
+type sLockoutClearParams struct {
+	User string `help:"User Name, cleared for all the source IPs. all the user names and IPs are cleared without the user and the IP" schema:"user" validate:"omitempty,max=64"`
+	IP   string `help:"Source IP" schema:"ip" validate:"omitempty,ip"`
+}
+
+//---------------------------------------------------------------------------------------
+
+//userLockoutID the failures of a user name are tracked by each source IP
+func (thisPt *cAuthenticationManager) userLockoutID(user string, ip net.IP) string {
+	return user + "@" + thisPt.ipString(ip)
+}
+
+//---------------------------------------------------------------------------------------
+
+//getLoginFailure should be called by the lock
+func (thisPt *cAuthenticationManager) getLoginFailure(failureType string, id string, create bool) *sLoginFailure {
+	key := failureType + ":" + id
+	failure, ok := thisPt.failures[key]
+	if !ok && create {
+		failure = &sLoginFailure{Type: failureType, ID: id}
+		thisPt.failures[key] = failure
+	}
+	return failure
+}
+
+//---------------------------------------------------------------------------------------
+
+//isLockedOut checks the user name and the source IP, the blocked attempts are counted
+func (thisPt *cAuthenticationManager) isLockedOut(info common.SAuthenticationInfo) bool {
+	thisPt.lockoutLock.Lock()
+	defer thisPt.lockoutLock.Unlock()
+
+	now := time.Now().Unix()
+	locked := false
+	for _, failure := range []*sLoginFailure{thisPt.getLoginFailure(lockoutTypeUser, thisPt.userLockoutID(info.User, info.IP), false), thisPt.getLoginFailure(lockoutTypeIP, thisPt.ipString(info.IP), false)} {
+		if failure != nil && failure.LockedUntil > now {
+			failure.Blocked++
+			locked = true
+		}
+	}
+
+	if locked {
+		atomic.AddUint64(&thisPt.stat.LoginBlockedCount, 1)
+	}
+	return locked
+}
+
+//---------------------------------------------------------------------------------------
+
+//getLoginDelay the delay is doubled by each failure up to the maximum delay
+func (thisPt *cAuthenticationManager) getLoginDelay(failures uint32) time.Duration {
+	if failures == 0 || thisPt.params.Lockout.Delay == 0 {
+		return 0
+	}
+
+	delay := time.Duration(thisPt.params.Lockout.Delay) * time.Millisecond
+	for i := uint32(1); i < failures && delay < loginMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > loginMaxDelay {
+		delay = loginMaxDelay
+	}
+	return delay
+}
+
+//---------------------------------------------------------------------------------------
+
+//registerLoginFail returns the delay of the failed login, the user name or the IP is locked after too many failures.
+//the delay slows down only the failed connection, the parallel attempts are limited by the IP lockout
+func (thisPt *cAuthenticationManager) registerLoginFail(info common.SAuthenticationInfo) time.Duration {
+	thisPt.lockoutLock.Lock()
+	defer thisPt.lockoutLock.Unlock()
+
+	items := []struct {
+		failureType string
+		id          string
+		limit       uint32
+	}{
+		{lockoutTypeUser, thisPt.userLockoutID(info.User, info.IP), thisPt.params.Lockout.UserFailCount},
+		{lockoutTypeIP, thisPt.ipString(info.IP), thisPt.params.Lockout.IPFailCount},
+	}
+
+	now := time.Now().Unix()
+	maxFailures := uint32(0)
+	for _, item := range items {
+		if item.limit == 0 {
+			continue
+		}
+
+		//the expired failures and lockouts are started again
+		failure := thisPt.getLoginFailure(item.failureType, item.id, true)
+		if now-failure.LastFail > int64(thisPt.params.Lockout.TrackTime) || (failure.LockedUntil != 0 && failure.LockedUntil <= now) {
+			failure.Failures = 0
+			failure.LockedUntil = 0
+		}
+
+		failure.Failures++
+		failure.LastFail = now
+		if failure.Failures >= item.limit && failure.LockedUntil == 0 {
+			failure.LockedUntil = now + int64(thisPt.params.Lockout.LockoutTime)
+			atomic.AddUint64(&thisPt.stat.LockoutCount, 1)
+			log.Printf("%s %s is locked out for %d seconds after %d failed logins \n", item.failureType, item.id, thisPt.params.Lockout.LockoutTime, failure.Failures)
+		}
+
+		if failure.Failures > maxFailures {
+			maxFailures = failure.Failures
+		}
+	}
+	return thisPt.getLoginDelay(maxFailures)
+}
+
+//---------------------------------------------------------------------------------------
+
+//clearLoginFailures the failures of the source IP are kept after the successful logins
+func (thisPt *cAuthenticationManager) clearLoginFailures(user string, ip net.IP) {
+	thisPt.lockoutLock.Lock()
+	defer thisPt.lockoutLock.Unlock()
+	delete(thisPt.failures, lockoutTypeUser+":"+thisPt.userLockoutID(user, ip))
+}
+
+//---------------------------------------------------------------------------------------
+
+//purgeLoginFailures removes the expired failures periodically
+func (thisPt *cAuthenticationManager) purgeLoginFailures() {
+	ticker := time.NewTicker(lockoutPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		<-ticker.C
+		now := time.Now().Unix()
+		thisPt.lockoutLock.Lock()
+		for key, failure := range thisPt.failures {
+			if failure.LockedUntil <= now && now-failure.LastFail > int64(thisPt.params.Lockout.TrackTime) {
+				delete(thisPt.failures, key)
+			}
+		}
+		thisPt.lockoutLock.Unlock()
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cAuthenticationManager) OnLockoutsCommand(req *http.Request, params interface{}) (common.IHTTPResponse, error) {
+	listParams := params.(*sLockoutListParams)
+
+	thisPt.lockoutLock.Lock()
+	now := time.Now().Unix()
+	result := []sLoginFailure{}
+	for _, failure := range thisPt.failures {
+		if listParams.Locked && failure.LockedUntil <= now {
+			continue
+		}
+		result = append(result, *failure)
+	}
+	thisPt.lockoutLock.Unlock()
+
+	//the last failures first
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].LastFail > result[j].LastFail
+	})
+	if len(result) > common.MAXCOMMANDRESPONSEITEMS {
+		result = result[:common.MAXCOMMANDRESPONSEITEMS]
+	}
+	return thisPt.params.Utils.CreateHttpResponseFromObject(result)
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cAuthenticationManager) OnLockoutsClearCommand(req *http.Request, params interface{}) (common.IHTTPResponse, error) {
+	clearParams := params.(*sLockoutClearParams)
+
+	thisPt.lockoutLock.Lock()
+	defer thisPt.lockoutLock.Unlock()
+
+	if clearParams.User == "" && clearParams.IP == "" {
+		thisPt.failures = make(map[string]*sLoginFailure)
+	}
+	//the user name is cleared from all the source IPs
+	if clearParams.User != "" {
+		for key, failure := range thisPt.failures {
+			index := strings.LastIndex(failure.ID, "@")
+			if failure.Type == lockoutTypeUser && index >= 0 && failure.ID[:index] == clearParams.User {
+				delete(thisPt.failures, key)
+			}
+		}
+	}
+	if clearParams.IP != "" {
+		delete(thisPt.failures, lockoutTypeIP+":"+net.ParseIP(clearParams.IP).String())
+	}
+	return thisPt.params.Utils.CreateHttpResponseFromString("OK")
+}
+
+//---------------------------------------------------------------------------------------
+
+//initLockouts the failures are kept in the memory
+func (thisPt *cAuthenticationManager) initLockouts() {
+	thisPt.failures = make(map[string]*sLoginFailure)
+	if thisPt.params.Lockout.UserFailCount != 0 || thisPt.params.Lockout.IPFailCount != 0 {
+		go thisPt.purgeLoginFailures()
+	}
+}
@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"errors"
+	"goconnect/common"
+	"goconnect/utils"
+	"net"
+	"testing"
+	"time"
+)
+
+//---------------------------------------------------------------------------------------
+
+type sTestPasswordAuthenticator struct {
+	common.IAuthenticator
+}
+
+func (thisPt *sTestPasswordAuthenticator) GetType() string {
+	return "password"
+}
+
+func (thisPt *sTestPasswordAuthenticator) AuthenticateUser(info common.SAuthenticationInfo) error {
+	if info.Password != "123456" {
+		return errors.New("invalid password")
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+
+func TestLoginLockout(t *testing.T) {
+	params := SAuthenticationManagerParams{Utils: utils.Create()}
+	params.Lockout = SLockoutConfig{UserFailCount: 3, IPFailCount: 5, TrackTime: 60, LockoutTime: 60, Delay: 1}
+	authMan := new(cAuthenticationManager)
+	authMan.init(params)
+	authMan.registerAuthenticator(&sTestPasswordAuthenticator{})
+
+	login := func(user string, password string, ip string) error {
+		_, err := authMan.AuthenticateUser(common.SAuthenticationInfo{User: user, Password: password, IP: net.ParseIP(ip)})
+		return err
+	}
+
+	//the delay is doubled by each failure
+	if authMan.getLoginDelay(1) != time.Millisecond || authMan.getLoginDelay(4) != 8*time.Millisecond || authMan.getLoginDelay(100) != loginMaxDelay {
+		t.Fatalf("invalid login delays \n")
+	}
+
+	//the successful login clears the user failures
+	login("user1", "wrong", "192.168.1.10")
+	login("user1", "wrong", "192.168.1.10")
+	if err := login("user1", "123456", "192.168.1.10"); err != nil || authMan.failures["user:user1@192.168.1.10"] != nil {
+		t.Fatalf("user failures are not cleared %v \n", err)
+	}
+
+	//user lockout, the user is locked only for the source IP of the failures
+	for i := 0; i < 3; i++ {
+		login("user2", "wrong", "192.168.1.20")
+	}
+	if err := login("user2", "123456", "192.168.1.20"); err == nil {
+		t.Fatalf("locked user can login \n")
+	}
+	if err := login("user2", "123456", "192.168.1.21"); err != nil {
+		t.Fatalf("user is locked by the failures of the other IP %v \n", err)
+	}
+	if err := login("user3", "123456", "192.168.1.20"); err != nil {
+		t.Fatalf("IP is locked before the IP threshold %v \n", err)
+	}
+
+	//IP lockout, the other users of the same IP are blocked
+	login("user4", "wrong", "192.168.1.20")
+	login("user5", "wrong", "192.168.1.20")
+	if err := login("user6", "123456", "192.168.1.20"); err == nil {
+		t.Fatalf("locked IP can login \n")
+	}
+	if authMan.stat.LockoutCount != 2 || authMan.stat.LoginBlockedCount != 2 {
+		t.Fatalf("invalid lockout metrics %v \n", authMan.stat)
+	}
+
+	//clear
+	authMan.OnLockoutsClearCommand(nil, &sLockoutClearParams{User: "user2", IP: "192.168.1.20"})
+	if err := login("user2", "123456", "192.168.1.20"); err != nil {
+		t.Fatalf("cleared lockout is not removed %v \n", err)
+	}
+}
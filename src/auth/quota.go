@@ -0,0 +1,329 @@
+package auth
+
+import (
+	"errors"
+	"goconnect/common"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+//---------------------------------------------------------------------------------------
+
+const (
+	accUsageTable      = "acc_usage"
+	quotaCheckInterval = 60 //second
+)
+
+//---------------------------------------------------------------------------------------
+
+//SQuotaRule limits of the users, the user rules are checked before the group rules. zero values are unlimited
+type SQuotaRule struct {
+	Name           string
+	Users          []string
+	Groups         []string
+	DailyBytes     uint64
+	MonthlyBytes   uint64
+	MaxSessionTime uint32
+}
+
+//---------------------------------------------------------------------------------------
+
+//sQuotaUsage is the persistent usage of a user, the sent and received bytes are counted
+type sQuotaUsage struct {
+	ID           int64       `db:"id, primarykey, autoincrement" json:"-"`
+	User         string      `db:"user_name,size:64" json:"user"`
+	Day          string      `db:"day,size:16" json:"day"`
+	Month        string      `db:"month,size:16" json:"month"`
+	DailyBytes   int64       `db:"daily_bytes" json:"daily_bytes"`
+	MonthlyBytes int64       `db:"monthly_bytes" json:"monthly_bytes"`
+	rule         *SQuotaRule `db:"-"`
+	resolved     bool        `db:"-"`
+}
+
+//---------------------------------------------------------------------------------------
+
+//sQuotaStatus is reported by the sessions list, -1 is unlimited
+type sQuotaStatus struct {
+	Rule                 string `json:"rule"`
+	DailyRemaining       int64  `json:"daily_remaining"`
+	MonthlyRemaining     int64  `json:"monthly_remaining"`
+	SessionTimeRemaining int64  `json:"session_time_remaining"`
+}
+
+//---------------------------------------------------------------------------------------
+
+type sQuotaResetParams struct {
+	User string `help:"User Name" schema:"user" validate:"min=2,max=64,alphanum"`
+}
+
+//---------------------------------------------------------------------------------------
+
+//roll resets the counters of the previous day and month
+func (thisPt *sQuotaUsage) roll(now time.Time) {
+	if day := now.Format("2006-01-02"); thisPt.Day != day {
+		thisPt.Day = day
+		thisPt.DailyBytes = 0
+	}
+	if month := now.Format("2006-01"); thisPt.Month != month {
+		thisPt.Month = month
+		thisPt.MonthlyBytes = 0
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *sQuotaUsage) isExceeded() bool {
+	if thisPt.rule == nil {
+		return false
+	}
+	if thisPt.rule.DailyBytes > 0 && uint64(thisPt.DailyBytes) >= thisPt.rule.DailyBytes {
+		return true
+	}
+	return thisPt.rule.MonthlyBytes > 0 && uint64(thisPt.MonthlyBytes) >= thisPt.rule.MonthlyBytes
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cAuthenticationManager) findQuotaRule(user string, authenticator common.IAuthenticator) *SQuotaRule {
+	for i := range thisPt.params.Quotas {
+		if thisPt.containsString(thisPt.params.Quotas[i].Users, user) {
+			return &thisPt.params.Quotas[i]
+		}
+	}
+
+	groups := thisPt.GetUserInfo(user, authenticator).Groups
+	for i := range thisPt.params.Quotas {
+		for _, group := range groups {
+			if thisPt.containsString(thisPt.params.Quotas[i].Groups, group) {
+				return &thisPt.params.Quotas[i]
+			}
+		}
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//getUsage should be called by the quota lock, the usage is loaded from the database at the first access.
+//the rule is resolved at the first access with the authenticator of the user
+func (thisPt *cAuthenticationManager) getUsage(user string, authenticator common.IAuthenticator) *sQuotaUsage {
+	usage, ok := thisPt.usages[user]
+	if !ok {
+		usage = &sQuotaUsage{User: user}
+		if thisPt.params.Database != nil {
+			usages := []sQuotaUsage{}
+			if err := thisPt.params.Database.LoadObject(&usages, "select * from "+accUsageTable+" where user_name='%s'", user); err == nil && len(usages) > 0 {
+				*usage = usages[0]
+			}
+		}
+		thisPt.usages[user] = usage
+	}
+
+	if !usage.resolved && authenticator != nil {
+		thisPt.resolveQuotaRule(usage, authenticator)
+	}
+	usage.roll(time.Now())
+	return usage
+}
+
+//---------------------------------------------------------------------------------------
+
+//resolveQuotaRule should be called by the quota lock, the groups of the user may change between the logins
+func (thisPt *cAuthenticationManager) resolveQuotaRule(usage *sQuotaUsage, authenticator common.IAuthenticator) {
+	usage.rule = thisPt.findQuotaRule(usage.User, authenticator)
+	usage.resolved = true
+}
+
+//---------------------------------------------------------------------------------------
+
+//saveUsage should be called by the quota lock
+func (thisPt *cAuthenticationManager) saveUsage(usage *sQuotaUsage) {
+	if thisPt.params.Database == nil {
+		return
+	}
+
+	var err error
+	if usage.ID == 0 {
+		err = thisPt.params.Database.SerializeObject(accUsageTable, usage)
+	} else {
+		err = thisPt.params.Database.UpdateObject(accUsageTable, usage)
+	}
+	if err != nil {
+		log.Printf("can not save the quota usage of user %s with error %v \n", usage.User, err)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//updateQuotaUsage adds the transfer of the session since the last update to the usage of the user
+func (thisPt *cAuthenticationManager) updateQuotaUsage(session *cAccountingSessionBase) sQuotaUsage {
+	transfer := session.GetTransfer()
+	total := transfer.SendByte + transfer.ReceiveByte
+	delta := total - atomic.SwapUint64(&session.quotaBytes, total)
+
+	thisPt.quotaLock.Lock()
+	defer thisPt.quotaLock.Unlock()
+
+	usage := thisPt.getUsage(session.User, session.authenticator)
+	if delta > 0 {
+		usage.DailyBytes += int64(delta)
+		usage.MonthlyBytes += int64(delta)
+		thisPt.saveUsage(usage)
+	}
+	return *usage
+}
+
+//---------------------------------------------------------------------------------------
+
+//checkQuota is called by the interim updates and the quota checks, the session is rejected after the limits
+func (thisPt *cAuthenticationManager) checkQuota(session *cAccountingSessionBase) bool {
+	if len(thisPt.params.Quotas) == 0 {
+		return true
+	}
+
+	usage := thisPt.updateQuotaUsage(session)
+	if usage.rule == nil {
+		return true
+	}
+
+	if usage.rule.MaxSessionTime > 0 && time.Now().Unix()-session.GetStartTime() >= int64(usage.rule.MaxSessionTime) {
+		log.Printf("session %s of user %s reached the time limit of quota %s \n", session.SessionID, session.User, usage.rule.Name)
+		session.SetStopReason(common.ACCSTOPREASONTIMELIMIT)
+		return false
+	}
+
+	if usage.isExceeded() {
+		log.Printf("user %s exceeded the quota %s \n", session.User, usage.rule.Name)
+		session.SetStopReason(common.ACCSTOPREASONQUOTA)
+		return false
+	}
+	return true
+}
+
+//---------------------------------------------------------------------------------------
+
+//checkQuotas stops the sessions over the limits, so the quotas are enforced even without the interim updates
+func (thisPt *cAuthenticationManager) checkQuotas() {
+	thisPt.sessionsLock.RLock()
+	sessions := make([]*cAccountingSessionBase, 0, len(thisPt.sessions))
+	for _, v := range thisPt.sessions {
+		if session, ok := v.(*cAccountingSessionBase); ok {
+			sessions = append(sessions, session)
+		}
+	}
+	thisPt.sessionsLock.RUnlock()
+
+	//the stopped sessions remove themselves, so it should be called without the lock
+	for _, session := range sessions {
+		if !thisPt.checkQuota(session) {
+			session.Stop()
+		}
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cAuthenticationManager) scheduleQuotaChecks() {
+	ticker := time.NewTicker(quotaCheckInterval * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		thisPt.checkQuotas()
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//CheckQuota for IAuthenticationManger, the users without the remaining quota can not create new sessions.
+//the protocols without the user authentication should call it before the creation of the sessions.
+//the rule is resolved again at each login
+func (thisPt *cAuthenticationManager) CheckQuota(user string, authenticator common.IAuthenticator) error {
+	if len(thisPt.params.Quotas) == 0 {
+		return nil
+	}
+
+	thisPt.quotaLock.Lock()
+	defer thisPt.quotaLock.Unlock()
+	usage := thisPt.getUsage(user, nil)
+	if authenticator != nil {
+		thisPt.resolveQuotaRule(usage, authenticator)
+	}
+	if usage.isExceeded() {
+		return errors.New("quota exceeded")
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//getQuotaStatus returns the remaining quota of the session, nil for the users without any rule
+func (thisPt *cAuthenticationManager) getQuotaStatus(session *cAccountingSessionBase) *sQuotaStatus {
+	if len(thisPt.params.Quotas) == 0 {
+		return nil
+	}
+
+	thisPt.quotaLock.Lock()
+	usage := *thisPt.getUsage(session.User, session.authenticator)
+	thisPt.quotaLock.Unlock()
+	if usage.rule == nil {
+		return nil
+	}
+
+	//the transfer since the last update is not in the usage yet
+	transfer := session.GetTransfer()
+	pending := int64(transfer.SendByte + transfer.ReceiveByte - atomic.LoadUint64(&session.quotaBytes))
+
+	remaining := func(limit int64, used int64) int64 {
+		if limit == 0 {
+			return -1
+		}
+		if used >= limit {
+			return 0
+		}
+		return limit - used
+	}
+
+	status := &sQuotaStatus{Rule: usage.rule.Name}
+	status.DailyRemaining = remaining(int64(usage.rule.DailyBytes), usage.DailyBytes+pending)
+	status.MonthlyRemaining = remaining(int64(usage.rule.MonthlyBytes), usage.MonthlyBytes+pending)
+	status.SessionTimeRemaining = remaining(int64(usage.rule.MaxSessionTime), time.Now().Unix()-session.GetStartTime())
+	return status
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cAuthenticationManager) OnQuotaResetCommand(req *http.Request, params interface{}) (common.IHTTPResponse, error) {
+	if len(thisPt.params.Quotas) == 0 {
+		return nil, errors.New("quotas are not configured")
+	}
+
+	thisPt.quotaLock.Lock()
+	defer thisPt.quotaLock.Unlock()
+
+	usage := thisPt.getUsage(params.(*sQuotaResetParams).User, nil)
+	usage.DailyBytes = 0
+	usage.MonthlyBytes = 0
+	thisPt.saveUsage(usage)
+	return thisPt.params.Utils.CreateHttpResponseFromString("OK")
+}
+
+//---------------------------------------------------------------------------------------
+
+//initQuotas creates the usage table, the usages are kept in the memory without a database
+func (thisPt *cAuthenticationManager) initQuotas() {
+	thisPt.usages = make(map[string]*sQuotaUsage)
+	if len(thisPt.params.Quotas) == 0 {
+		return
+	}
+	go thisPt.scheduleQuotaChecks()
+
+	if thisPt.params.Database == nil {
+		return
+	}
+
+	if err := thisPt.params.Database.Register(accUsageTable, sQuotaUsage{}); err != nil {
+		log.Printf("can not create the quota usage table with error %v \n", err)
+	}
+}
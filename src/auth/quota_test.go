@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"goconnect/common"
+	"goconnect/db"
+	"goconnect/utils"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//---------------------------------------------------------------------------------------
+
+type sTestGroupAuthenticator struct {
+	common.IAuthenticator
+	groups map[string][]string
+}
+
+func (thisPt *sTestGroupAuthenticator) GetType() string {
+	return "group"
+}
+
+func (thisPt *sTestGroupAuthenticator) AuthenticateUser(info common.SAuthenticationInfo) error {
+	return nil
+}
+
+func (thisPt *sTestGroupAuthenticator) GetUserInfo(user string) (common.SUserInfo, error) {
+	groups, ok := thisPt.groups[user]
+	if !ok {
+		return common.SUserInfo{}, errors.New("user not found")
+	}
+	return common.SUserInfo{User: user, Groups: groups}, nil
+}
+
+//---------------------------------------------------------------------------------------
+
+func TestQuotas(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goconnect")
+	if err != nil {
+		t.Fatalf("can not create temp directory %v \n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	params := SAuthenticationManagerParams{Utils: utils.Create(), Database: db.Create("sqlite3", filepath.Join(dir, "quota.db"))}
+	params.Quotas = []SQuotaRule{
+		{Name: "user", Users: []string{"user1"}, DailyBytes: 1000},
+		{Name: "group", Groups: []string{"guests"}, MonthlyBytes: 5000, MaxSessionTime: 3600},
+	}
+	authMan := new(cAuthenticationManager)
+	authMan.init(params)
+	authenticator := &sTestGroupAuthenticator{groups: map[string][]string{"user1": {"guests"}, "user2": {"guests"}}}
+	authMan.registerAuthenticator(authenticator)
+
+	createSession := func(user string) *cAccountingSessionBase {
+		session := new(cAccountingSessionBase)
+		session.Init(authMan, common.SAccountingInfo{User: user, UserIP: net.ParseIP("192.168.1.10"), VirtualIP: net.ParseIP("172.16.0.2")}, authenticator, authMan.params.Utils)
+		session.Start()
+		return session
+	}
+
+	//the user rule is used before the group rule
+	session1 := createSession("user1")
+	session1.UpdateSend(600)
+	if !session1.Update() {
+		t.Fatalf("session is rejected before the quota \n")
+	}
+	session1.UpdateReceive(600)
+
+	status := authMan.getQuotaStatus(session1)
+	if status == nil || status.Rule != "user" || status.DailyRemaining != 0 || status.MonthlyRemaining != -1 || status.SessionTimeRemaining != -1 {
+		t.Fatalf("invalid quota status %v \n", status)
+	}
+	if session1.Update() || session1.getStopReason() != common.ACCSTOPREASONQUOTA {
+		t.Fatalf("session over the quota is not rejected \n")
+	}
+	session1.Stop()
+
+	if _, err := authMan.AuthenticateUser(common.SAuthenticationInfo{User: "user1", IP: net.ParseIP("192.168.1.10")}); err == nil {
+		t.Fatalf("user without quota is authenticated \n")
+	}
+
+	//the usage is persisted and reset by the API
+	authMan.usages = make(map[string]*sQuotaUsage)
+	if usage := authMan.getUsage("user1", authenticator); usage.DailyBytes != 1200 || usage.MonthlyBytes != 1200 {
+		t.Fatalf("usage is not persisted %v \n", usage)
+	}
+	if _, err := authMan.OnQuotaResetCommand(nil, &sQuotaResetParams{User: "user1"}); err != nil {
+		t.Fatalf("can not reset the quota %v \n", err)
+	}
+	if _, err := authMan.AuthenticateUser(common.SAuthenticationInfo{User: "user1", IP: net.ParseIP("192.168.1.10")}); err != nil {
+		t.Fatalf("quota is not reset %v \n", err)
+	}
+
+	//the group rule, the session time limit
+	session2 := createSession("user2")
+	session2.UpdateSend(100)
+	body, _ := json.Marshal(session2)
+	listed := struct {
+		Quota *sQuotaStatus `json:"quota"`
+	}{}
+	if err := json.Unmarshal(body, &listed); err != nil || listed.Quota == nil || listed.Quota.Rule != "group" || listed.Quota.MonthlyRemaining != 4900 {
+		t.Fatalf("invalid listed quota %s \n", string(body))
+	}
+
+	session2.StartTime = time.Now().Unix() - 3600
+	if session2.Update() || session2.getStopReason() != common.ACCSTOPREASONTIMELIMIT {
+		t.Fatalf("session over the time limit is not rejected \n")
+	}
+
+	//the users without any rule are not limited
+	session3 := createSession("user3")
+	session3.UpdateSend(1 << 20)
+	if !session3.Update() || authMan.getQuotaStatus(session3) != nil {
+		t.Fatalf("user without quota is rejected \n")
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+func TestQuotaChecks(t *testing.T) {
+	params := SAuthenticationManagerParams{Utils: utils.Create()}
+	params.Quotas = []SQuotaRule{{Name: "user", Users: []string{"user1"}, DailyBytes: 1000}}
+	authMan := new(cAuthenticationManager)
+	authMan.init(params)
+	authenticator := &sTestGroupAuthenticator{}
+
+	session := new(cAccountingSessionBase)
+	session.Init(authMan, common.SAccountingInfo{User: "user1", UserIP: net.ParseIP("192.168.1.10"), VirtualIP: net.ParseIP("172.16.0.2")}, authenticator, authMan.params.Utils)
+	session.Start()
+
+	//the quotas are checked without the interim updates
+	session.UpdateSend(600)
+	authMan.checkQuotas()
+	if session.getStopReason() != "" || len(authMan.sessions) != 1 {
+		t.Fatalf("session under the quota is stopped \n")
+	}
+
+	session.UpdateReceive(600)
+	authMan.checkQuotas()
+	if session.getStopReason() != common.ACCSTOPREASONQUOTA || len(authMan.sessions) != 0 {
+		t.Fatalf("session over the quota is not stopped \n")
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+func TestQuotaRuleResolution(t *testing.T) {
+	params := SAuthenticationManagerParams{Utils: utils.Create()}
+	params.Quotas = []SQuotaRule{{Name: "group", Groups: []string{"guests"}, DailyBytes: 1000}}
+	authMan := new(cAuthenticationManager)
+	authMan.init(params)
+	authenticator := &sTestGroupAuthenticator{groups: map[string][]string{"user1": {"guests"}}}
+
+	//the user is first seen without an authenticator
+	if _, err := authMan.OnQuotaResetCommand(nil, &sQuotaResetParams{User: "user1"}); err != nil {
+		t.Fatalf("can not reset the quota %v \n", err)
+	}
+	authMan.usages["user1"].DailyBytes = 1200
+	if err := authMan.CheckQuota("user1", authenticator); err == nil {
+		t.Fatalf("rule is not resolved after the first access without authenticator \n")
+	}
+
+	//the group changes are applied at the next login
+	authenticator.groups["user1"] = []string{"staff"}
+	if err := authMan.CheckQuota("user1", authenticator); err != nil {
+		t.Fatalf("rule of the old group is used %v \n", err)
+	}
+	authenticator.groups["user1"] = []string{"guests"}
+	if err := authMan.CheckQuota("user1", authenticator); err == nil {
+		t.Fatalf("rule of the new group is not used \n")
+	}
+}
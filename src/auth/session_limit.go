@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"errors"
+	"goconnect/common"
+	"log"
+	"sort"
+	"time"
+)
+
+//---------------------------------------------------------------------------------------
+
+//SESSIONLIMITACTION the action after reaching the maximum sessions of a user
+const (
+	SESSIONLIMITACTIONREJECT     = "reject"
+	SESSIONLIMITACTIONDCOLDEST   = "disconnect_oldest"
+	sessionLimitRejectedErrorMsg = "maximum concurrent sessions reached"
+	sessionReservationTime       = 300 //second, the login should be connected in the reservation time
+)
+
+//---------------------------------------------------------------------------------------
+
+//SSessionLimitRule maximum concurrent sessions of the users, the user rules are checked before the group rules. zero is unlimited
+type SSessionLimitRule struct {
+	Name        string
+	Users       []string
+	Groups      []string
+	MaxSessions uint32
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cAuthenticationManager) containsString(items []string, value string) bool {
+	for _, item := range items {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+//---------------------------------------------------------------------------------------
+
+//getSessionLimit returns the maximum sessions of the user, the global limit is used without any matched rule
+func (thisPt *cAuthenticationManager) getSessionLimit(user string, authenticator common.IAuthenticator) uint32 {
+	for _, rule := range thisPt.params.SessionLimits {
+		if thisPt.containsString(rule.Users, user) {
+			return rule.MaxSessions
+		}
+	}
+
+	groups := thisPt.GetUserInfo(user, authenticator).Groups
+	for _, rule := range thisPt.params.SessionLimits {
+		for _, group := range groups {
+			if thisPt.containsString(rule.Groups, group) {
+				return rule.MaxSessions
+			}
+		}
+	}
+	return thisPt.params.MaxSessions
+}
+
+//---------------------------------------------------------------------------------------
+
+//purgeReservations removes the expired reservations of the user, should be called by the lock
+func (thisPt *cAuthenticationManager) purgeReservations(user string, now int64) int {
+	reservations := thisPt.reservations[user]
+	for len(reservations) > 0 && reservations[0] <= now {
+		reservations = reservations[1:]
+	}
+	if len(reservations) == 0 {
+		delete(thisPt.reservations, user)
+	} else {
+		thisPt.reservations[user] = reservations
+	}
+	return len(reservations)
+}
+
+//---------------------------------------------------------------------------------------
+
+//consumeReservation the new session uses the oldest reservation of the user, should be called by the lock
+func (thisPt *cAuthenticationManager) consumeReservation(user string) {
+	if thisPt.purgeReservations(user, time.Now().Unix()) > 0 {
+		thisPt.reservations[user] = thisPt.reservations[user][1:]
+		thisPt.purgeReservations(user, 0)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//ReleaseSessionLimit for IAuthenticationManger, releases the place reserved by CheckSessionLimit if the session is not created
+func (thisPt *cAuthenticationManager) ReleaseSessionLimit(user string) {
+	thisPt.sessionsLock.Lock()
+	defer thisPt.sessionsLock.Unlock()
+	thisPt.consumeReservation(user)
+}
+
+//---------------------------------------------------------------------------------------
+
+//CheckSessionLimit for IAuthenticationManger, called before the creation of a new session of the user.
+//a place is reserved for the session until it is registered, so the logins which are not connected yet are counted too.
+//the oldest sessions are disconnected to free a place for the new session in the disconnect_oldest mode
+func (thisPt *cAuthenticationManager) CheckSessionLimit(user string, authenticator common.IAuthenticator) error {
+	limit := thisPt.getSessionLimit(user, authenticator)
+	if limit == 0 {
+		return nil
+	}
+
+	now := time.Now().Unix()
+	thisPt.sessionsLock.Lock()
+	reserved := uint32(thisPt.purgeReservations(user, now))
+	count := thisPt.users[user] + reserved
+	if count < limit {
+		thisPt.reservations[user] = append(thisPt.reservations[user], now+sessionReservationTime)
+		thisPt.sessionsLock.Unlock()
+		return nil
+	}
+
+	//the reserved places can not be freed by disconnecting the sessions
+	if thisPt.params.SessionLimitAction != SESSIONLIMITACTIONDCOLDEST || reserved >= limit {
+		thisPt.sessionsLock.Unlock()
+		log.Printf("user %s reached the maximum sessions %d \n", user, limit)
+		return errors.New(sessionLimitRejectedErrorMsg)
+	}
+
+	sessions := []common.IAccountingSession{}
+	for _, v := range thisPt.sessions {
+		if v.GetUserName() == user {
+			sessions = append(sessions, v)
+		}
+	}
+	thisPt.reservations[user] = append(thisPt.reservations[user], now+sessionReservationTime)
+	thisPt.sessionsLock.Unlock()
+
+	//the stopped sessions remove themselves, so it should be called without the lock
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].GetStartTime() < sessions[j].GetStartTime()
+	})
+	stopCount := int(count) - int(limit) + 1
+	if stopCount > len(sessions) {
+		stopCount = len(sessions)
+	}
+	for _, v := range sessions[:stopCount] {
+		log.Printf("session %s of user %s is disconnected by the maximum sessions %d \n", v.GetSessionID(), user, limit)
+		v.SetStopReason(common.ACCSTOPREASONLIMIT)
+		v.Stop()
+	}
+	return nil
+}
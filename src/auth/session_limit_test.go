@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"goconnect/common"
+	"goconnect/utils"
+	"net"
+	"testing"
+	"time"
+)
+
+//---------------------------------------------------------------------------------------
+
+func TestSessionLimit(t *testing.T) {
+	params := SAuthenticationManagerParams{Utils: utils.Create(), MaxSessions: 2}
+	params.SessionLimits = []SSessionLimitRule{
+		{Name: "user", Users: []string{"user1"}, MaxSessions: 1},
+		{Name: "group", Groups: []string{"guests"}, MaxSessions: 3},
+	}
+	authMan := new(cAuthenticationManager)
+	authMan.init(params)
+	authenticator := &sTestGroupAuthenticator{groups: map[string][]string{"user1": {"guests"}, "user2": {"guests"}}}
+
+	createSession := func(user string, startTime int64) *cAccountingSessionBase {
+		session := new(cAccountingSessionBase)
+		session.Init(authMan, common.SAccountingInfo{User: user, UserIP: net.ParseIP("192.168.1.10"), VirtualIP: net.ParseIP("172.16.0.2")}, authenticator, authMan.params.Utils)
+		session.Start()
+		session.StartTime = startTime
+		return session
+	}
+
+	//the user rule is used before the group rule, the global limit without any rule
+	if authMan.getSessionLimit("user1", authenticator) != 1 || authMan.getSessionLimit("user2", authenticator) != 3 || authMan.getSessionLimit("user3", authenticator) != 2 {
+		t.Fatalf("invalid session limits \n")
+	}
+
+	//reject mode
+	createSession("user3", 100)
+	if err := authMan.CheckSessionLimit("user3", authenticator); err != nil {
+		t.Fatalf("session under the limit is rejected %v \n", err)
+	}
+	createSession("user3", 200)
+	if err := authMan.CheckSessionLimit("user3", authenticator); err == nil {
+		t.Fatalf("session over the limit is accepted \n")
+	}
+
+	//disconnect oldest mode
+	authMan.params.SessionLimitAction = SESSIONLIMITACTIONDCOLDEST
+	oldest := createSession("user2", 100)
+	newest := createSession("user2", 300)
+	middle := createSession("user2", 200)
+	if err := authMan.CheckSessionLimit("user2", authenticator); err != nil {
+		t.Fatalf("session is rejected in the disconnect mode %v \n", err)
+	}
+	if oldest.getStopReason() != common.ACCSTOPREASONLIMIT || middle.getStopReason() != "" || newest.getStopReason() != "" {
+		t.Fatalf("oldest session is not disconnected \n")
+	}
+	if authMan.users["user2"] != 2 || authMan.users["user3"] != 2 {
+		t.Fatalf("invalid user sessions %v \n", authMan.users)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+func TestSessionLimitReservation(t *testing.T) {
+	params := SAuthenticationManagerParams{Utils: utils.Create(), MaxSessions: 1}
+	authMan := new(cAuthenticationManager)
+	authMan.init(params)
+	authenticator := &sTestGroupAuthenticator{}
+
+	//the second login before the connection of the first login should be rejected
+	if err := authMan.CheckSessionLimit("user1", authenticator); err != nil {
+		t.Fatalf("first login is rejected %v \n", err)
+	}
+	if err := authMan.CheckSessionLimit("user1", authenticator); err == nil {
+		t.Fatalf("second login before the connection is accepted \n")
+	}
+
+	session := new(cAccountingSessionBase)
+	session.Init(authMan, common.SAccountingInfo{User: "user1", UserIP: net.ParseIP("192.168.1.10"), VirtualIP: net.ParseIP("172.16.0.2")}, authenticator, authMan.params.Utils)
+	session.Start()
+	if authMan.users["user1"] != 1 || len(authMan.reservations["user1"]) != 0 {
+		t.Fatalf("reservation is not used by the session %v \n", authMan.reservations)
+	}
+	if err := authMan.CheckSessionLimit("user1", authenticator); err == nil {
+		t.Fatalf("login over the limit is accepted \n")
+	}
+
+	//the disconnect mode can not free the reserved places
+	authMan.params.SessionLimitAction = SESSIONLIMITACTIONDCOLDEST
+	if err := authMan.CheckSessionLimit("user2", authenticator); err != nil {
+		t.Fatalf("first login is rejected %v \n", err)
+	}
+	if err := authMan.CheckSessionLimit("user2", authenticator); err == nil {
+		t.Fatalf("second login before the connection is accepted in the disconnect mode \n")
+	}
+
+	//the released and the expired reservations are not counted
+	authMan.ReleaseSessionLimit("user2")
+	if err := authMan.CheckSessionLimit("user2", authenticator); err != nil {
+		t.Fatalf("released reservation is counted %v \n", err)
+	}
+	authMan.reservations["user2"][0] = time.Now().Unix() - 1
+	if err := authMan.CheckSessionLimit("user2", authenticator); err != nil {
+		t.Fatalf("expired reservation is counted %v \n", err)
+	}
+}
@@ -0,0 +1,17 @@
+package cluster
+
+import (
+	"goconnect/common"
+	"log"
+)
+
+//---------------------------------------------------------------------------------------
+
+//CreateNodeManager ...
+func CreateNodeManager(params SNodeManagerInitParams) common.INodeManager {
+	manager := new(cNodeManager)
+	if err := manager.Init(params); err != nil {
+		log.Fatalln(err)
+	}
+	return manager
+}
@@ -0,0 +1,266 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/binary"
+	"goconnect/common"
+	"goconnect/utils"
+	"goconnect/vnet"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//---------------------------------------------------------------------------------------
+
+const testClusterKey = "0123456789abcdef0123"
+
+//---------------------------------------------------------------------------------------
+
+type sTestClusterActor struct {
+	factory common.IProcessFactory
+	packets chan common.IProcessInfo
+}
+
+func (thisPt *sTestClusterActor) OnNewPacket(packet common.IProcessInfo) {
+	thisPt.packets <- packet
+}
+
+//---------------------------------------------------------------------------------------
+
+type sTestClusterNodesActor struct {
+	leafs int32
+}
+
+func (thisPt *sTestClusterNodesActor) OnNewNode(node common.INodes) {}
+
+func (thisPt *sTestClusterNodesActor) OnNewLeaf(leaf common.ILeaf) {
+	atomic.AddInt32(&thisPt.leafs, 1)
+}
+
+func (thisPt *sTestClusterNodesActor) OnRemoveNode(node common.INodes) {}
+
+func (thisPt *sTestClusterNodesActor) OnRemoveLeaf(leaf common.ILeaf) {
+	atomic.AddInt32(&thisPt.leafs, -1)
+}
+
+//---------------------------------------------------------------------------------------
+
+type sTestClusterClient struct {
+	id  uint64
+	vip net.IP
+}
+
+func (thisPt *sTestClusterClient) GetID() uint64 {
+	return thisPt.id
+}
+func (thisPt *sTestClusterClient) GetName() string {
+	return "client"
+}
+func (thisPt *sTestClusterClient) GetType() uint32 {
+	return common.INICTypeClient
+}
+func (thisPt *sTestClusterClient) GetStat() common.STransferStat {
+	return common.STransferStat{}
+}
+func (thisPt *sTestClusterClient) GetPeerIP() net.IP {
+	return nil
+}
+func (thisPt *sTestClusterClient) GetVirtualIP() net.IP {
+	return thisPt.vip
+}
+func (thisPt *sTestClusterClient) GetRoutes() []net.IPNet {
+	return []net.IPNet{getLeafNetwork(thisPt.vip)}
+}
+func (thisPt *sTestClusterClient) WriteData(data common.IProcessInfo) {
+}
+func (thisPt *sTestClusterClient) End() {
+}
+
+//---------------------------------------------------------------------------------------
+
+type sTestClusterNode struct {
+	manager    *cNodeManager
+	router     common.IRouter
+	nicManager common.INICManager
+	actor      *sTestClusterActor
+	factory    common.IProcessFactory
+}
+
+//---------------------------------------------------------------------------------------
+
+func createTestClusterNode(t *testing.T, name string, key string, peers []string) *sTestClusterNode {
+	node := &sTestClusterNode{}
+	util := utils.Create()
+	node.factory = vnet.CreateProcessFactory()
+	node.actor = &sTestClusterActor{factory: node.factory, packets: make(chan common.IProcessInfo, 64)}
+	node.router = vnet.CreateRouter(vnet.SRouteParams{Util: util, Version: 4})
+	node.nicManager = vnet.CreateNICManager(vnet.SNICManagerInitparams{RouterV4: node.router, RouterV6: vnet.CreateRouter(vnet.SRouteParams{Util: util, Version: 6})})
+
+	params := SNodeManagerInitParams{}
+	params.Name = name
+	params.BindAddress = "127.0.0.1:0"
+	params.SharedKey = key
+	params.Peers = peers
+	params.RouterV4 = node.router
+	params.RouterV6 = vnet.CreateRouter(vnet.SRouteParams{Util: util, Version: 6})
+	params.NetworkManager = node.nicManager
+	params.PacketFactory = node.factory
+	params.ProtocolActor = node.actor
+	params.Utils = util
+
+	node.manager = new(cNodeManager)
+	if err := node.manager.Init(params); err != nil {
+		t.Fatalf("can not init cluster node %v \n", err)
+	}
+	return node
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *sTestClusterNode) getNode(name string) *cNode {
+	thisPt.manager.lock.RLock()
+	defer thisPt.manager.lock.RUnlock()
+
+	return thisPt.manager.nodes[getNodeID(name)]
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *sTestClusterNode) getNodeNIC(name string) uint64 {
+	if node := thisPt.getNode(name); node != nil {
+		return node.nic.id
+	}
+	return 0
+}
+
+//---------------------------------------------------------------------------------------
+
+func waitTestCluster(t *testing.T, message string, condition func() bool) {
+	for i := 0; i < 100; i++ {
+		if condition() {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("%s \n", message)
+}
+
+//---------------------------------------------------------------------------------------
+
+func createTestClusterPacket(src string, dst string) []byte {
+	packet := make([]byte, 28)
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+	packet[8] = 64
+	packet[9] = 17
+	copy(packet[12:], net.ParseIP(src).To4())
+	copy(packet[16:], net.ParseIP(dst).To4())
+	binary.BigEndian.PutUint16(packet[20:], 1000)
+	binary.BigEndian.PutUint16(packet[22:], 2000)
+	binary.BigEndian.PutUint16(packet[24:], 8)
+	return packet
+}
+
+//---------------------------------------------------------------------------------------
+
+func TestCluster(t *testing.T) {
+	nodeA := createTestClusterNode(t, "nodea", testClusterKey, nil)
+	defer nodeA.manager.End()
+
+	//the client of node A is registered before the other nodes
+	nodeA.nicManager.RegisterNIC(&sTestClusterClient{id: 1, vip: net.ParseIP("172.16.0.2").To4()})
+
+	nodeB := createTestClusterNode(t, "nodeb", testClusterKey, []string{nodeA.manager.address})
+	defer nodeB.manager.End()
+
+	//node C finds node B by node A
+	nodeC := createTestClusterNode(t, "nodec", testClusterKey, []string{nodeA.manager.address})
+	defer nodeC.manager.End()
+
+	nodesActor := &sTestClusterNodesActor{}
+	nodeC.manager.Subscribe(nodesActor)
+
+	nodeB.nicManager.RegisterNIC(&sTestClusterClient{id: 2, vip: net.ParseIP("172.16.1.2").To4()})
+
+	waitTestCluster(t, "the nodes are not connected", func() bool {
+		return len(nodeA.manager.GetNodes()) == 2 && len(nodeB.manager.GetNodes()) == 2 && len(nodeC.manager.GetNodes()) == 2
+	})
+
+	waitTestCluster(t, "the leafs are not routed", func() bool {
+		return nodeC.router.GetDestinatin(net.ParseIP("172.16.0.2"), 0) == nodeC.getNodeNIC("nodea") &&
+			nodeC.router.GetDestinatin(net.ParseIP("172.16.1.2"), 0) == nodeC.getNodeNIC("nodeb") &&
+			nodeA.router.GetDestinatin(net.ParseIP("172.16.1.2"), 0) == nodeA.getNodeNIC("nodeb")
+	})
+
+	if len(nodeC.manager.GetLeafs()) != 2 || atomic.LoadInt32(&nodesActor.leafs) != 2 {
+		t.Fatalf("invalid leafs %v \n", nodeC.manager.GetLeafs())
+	}
+
+	//the local client has the connected route
+	if nodeA.router.GetDestinatin(net.ParseIP("172.16.0.2"), 0) != 1 {
+		t.Fatalf("local client is not preferred \n")
+	}
+
+	//a packet of node C to the client of node A
+	packet := createTestClusterPacket("172.16.2.2", "172.16.0.2")
+	process := nodeC.factory.CreateProcessInfo(packet)
+	nodeC.nicManager.WriteData(nodeC.getNodeNIC("nodea"), process)
+
+	select {
+	case received := <-nodeA.actor.packets:
+		if !bytes.Equal(received.GetBuffer(), packet) || received.GetInNIC() != nodeA.getNodeNIC("nodec") {
+			t.Fatalf("invalid packet is received \n")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("packet is not received \n")
+	}
+
+	//the packets of a node are not forwarded to another node
+	process.SetInNIC(nodeA.getNodeNIC("nodec"))
+	nodeA.nicManager.WriteData(nodeA.getNodeNIC("nodeb"), process)
+	if nodeA.getNode("nodeb").getStat().TransitPackets != 1 {
+		t.Fatalf("transit packet is forwarded \n")
+	}
+
+	//the removed client is removed from the other nodes
+	nodeA.nicManager.RemoveNIC(1)
+	waitTestCluster(t, "the leaf is not removed", func() bool {
+		return nodeC.router.GetDestinatin(net.ParseIP("172.16.0.2"), 0) == 0
+	})
+
+	//the routes of a disconnected node are removed
+	nodeB.manager.End()
+	waitTestCluster(t, "the node is not removed", func() bool {
+		return len(nodeC.manager.GetNodes()) == 1 && nodeC.router.GetDestinatin(net.ParseIP("172.16.1.2"), 0) == 0
+	})
+
+	if atomic.LoadInt32(&nodesActor.leafs) != 0 {
+		t.Fatalf("the actor is not notified \n")
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+func TestClusterInvalidKey(t *testing.T) {
+	nodeA := createTestClusterNode(t, "nodea", testClusterKey, nil)
+	defer nodeA.manager.End()
+
+	nodeB := createTestClusterNode(t, "nodeb", "fedcba9876543210fedc", []string{nodeA.manager.address})
+	defer nodeB.manager.End()
+
+	//a node with the same name is the node itself
+	nodeC := createTestClusterNode(t, "nodea", testClusterKey, []string{nodeA.manager.address})
+	defer nodeC.manager.End()
+
+	time.Sleep(500 * time.Millisecond)
+	if len(nodeA.manager.GetNodes()) != 0 || len(nodeB.manager.GetNodes()) != 0 || len(nodeC.manager.GetNodes()) != 0 {
+		t.Fatalf("invalid node is connected \n")
+	}
+
+	params := SNodeManagerInitParams{Name: "noded", SharedKey: "short"}
+	if err := new(cNodeManager).Init(params); err == nil {
+		t.Fatalf("short key is accepted \n")
+	}
+}
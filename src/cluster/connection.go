@@ -0,0 +1,228 @@
+package cluster
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+//---------------------------------------------------------------------------------------
+
+const (
+	clusterMessageNodes       = 1
+	clusterMessageLeafs       = 2
+	clusterMessageAddLeaf     = 3
+	clusterMessageRemoveLeaf  = 4
+	clusterMessagePing        = 5
+	clusterMessageData        = 6
+	clusterNonceSize          = 32
+	clusterMaxHelloSize       = 4096
+	clusterMaxFrameSize       = 4 * 1024 * 1024
+	clusterHandshakeTimeout   = 10 * time.Second
+	clusterWriteTimeout       = 10 * time.Second
+	clusterReadBufferSize     = 64 * 1024
+	clusterRoleDialer         = "dialer"
+	clusterRoleListener       = "listener"
+	clusterProofLabel         = " proof"
+	clusterKeyLabel           = " key"
+	clusterMinSharedKeyLength = 16
+)
+
+//---------------------------------------------------------------------------------------
+
+//sClusterHello is the only plain message, the nonces make the proofs and the keys unique per connection
+type sClusterHello struct {
+	ID      uint64 `json:"id"`
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Nonce   []byte `json:"nonce"`
+}
+
+//---------------------------------------------------------------------------------------
+
+//cClusterConnection is an authenticated connection between two nodes. the frames are length prefixed and
+//sealed by AES-GCM, the nonces are the frame counters since TCP keeps the order
+type cClusterConnection struct {
+	conn        net.Conn
+	reader      *bufio.Reader
+	dialer      bool
+	remote      sClusterHello
+	proof       []byte
+	sendAEAD    cipher.AEAD
+	recvAEAD    cipher.AEAD
+	sendCounter uint64
+	recvCounter uint64
+	writeLock   sync.Mutex
+}
+
+//---------------------------------------------------------------------------------------
+
+func clusterHMAC(key []byte, label string, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+//---------------------------------------------------------------------------------------
+
+func clusterAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//---------------------------------------------------------------------------------------
+
+func clusterNonce(counter uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cClusterConnection) writeFrame(body []byte) error {
+	frame := make([]byte, 4+len(body))
+	binary.BigEndian.PutUint32(frame, uint32(len(body)))
+	copy(frame[4:], body)
+	_, err := thisPt.conn.Write(frame)
+	return err
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cClusterConnection) readFrame(maxSize uint32) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(thisPt.reader, header); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header)
+	if size == 0 || size > maxSize {
+		return nil, errors.New("invalid cluster frame size")
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(thisPt.reader, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//handshake authenticates the both nodes by the shared key. the proofs and the keys are bound to the both hellos
+//and the roles, so a proof can not be replayed or reflected
+func (thisPt *cClusterConnection) handshake(sharedKey []byte, local sClusterHello) error {
+	thisPt.conn.SetDeadline(time.Now().Add(clusterHandshakeTimeout))
+	defer thisPt.conn.SetDeadline(time.Time{})
+
+	localHello, err := json.Marshal(local)
+	if err != nil {
+		return err
+	}
+	if err := thisPt.writeFrame(localHello); err != nil {
+		return err
+	}
+
+	remoteHello, err := thisPt.readFrame(clusterMaxHelloSize)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(remoteHello, &thisPt.remote); err != nil || len(thisPt.remote.Nonce) != clusterNonceSize {
+		return errors.New("invalid cluster hello")
+	}
+
+	//the dialer hello is always the first one
+	localRole, remoteRole := clusterRoleListener, clusterRoleDialer
+	transcript := append(append([]byte{}, remoteHello...), localHello...)
+	if thisPt.dialer {
+		localRole, remoteRole = clusterRoleDialer, clusterRoleListener
+		transcript = append(append([]byte{}, localHello...), remoteHello...)
+	}
+	digest := sha256.Sum256(transcript)
+	transcript = digest[:]
+
+	if err := thisPt.writeFrame(clusterHMAC(sharedKey, localRole+clusterProofLabel, transcript)); err != nil {
+		return err
+	}
+
+	proof, err := thisPt.readFrame(sha256.Size)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(proof, clusterHMAC(sharedKey, remoteRole+clusterProofLabel, transcript)) {
+		return errors.New("invalid cluster key")
+	}
+	thisPt.proof = proof
+
+	if thisPt.sendAEAD, err = clusterAEAD(clusterHMAC(sharedKey, localRole+clusterKeyLabel, transcript)); err != nil {
+		return err
+	}
+	if thisPt.recvAEAD, err = clusterAEAD(clusterHMAC(sharedKey, remoteRole+clusterKeyLabel, transcript)); err != nil {
+		return err
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cClusterConnection) writeMessage(messageType byte, payload []byte) error {
+	thisPt.writeLock.Lock()
+	defer thisPt.writeLock.Unlock()
+
+	plain := make([]byte, 1+len(payload))
+	plain[0] = messageType
+	copy(plain[1:], payload)
+
+	body := thisPt.sendAEAD.Seal(nil, clusterNonce(thisPt.sendCounter), plain, nil)
+	thisPt.sendCounter++
+
+	thisPt.conn.SetWriteDeadline(time.Now().Add(clusterWriteTimeout))
+	return thisPt.writeFrame(body)
+}
+
+//---------------------------------------------------------------------------------------
+
+//readMessage is called by the reader of the connection only
+func (thisPt *cClusterConnection) readMessage() (byte, []byte, error) {
+	body, err := thisPt.readFrame(clusterMaxFrameSize)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	plain, err := thisPt.recvAEAD.Open(body[:0], clusterNonce(thisPt.recvCounter), body, nil)
+	if err != nil || len(plain) == 0 {
+		return 0, nil, errors.New("invalid cluster message")
+	}
+	thisPt.recvCounter++
+	return plain[0], plain[1:], nil
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cClusterConnection) close() {
+	thisPt.conn.Close()
+}
+
+//---------------------------------------------------------------------------------------
+
+func createClusterConnection(conn net.Conn, dialer bool) *cClusterConnection {
+	connection := new(cClusterConnection)
+	connection.conn = conn
+	connection.reader = bufio.NewReaderSize(conn, clusterReadBufferSize)
+	connection.dialer = dialer
+	return connection
+}
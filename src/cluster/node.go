@@ -0,0 +1,434 @@
+package cluster
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"goconnect/common"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//---------------------------------------------------------------------------------------
+
+const (
+	clusterSendQueueSize = 4096
+)
+
+//---------------------------------------------------------------------------------------
+
+//sClusterLeafInfo is the leaf of the leaf messages
+type sClusterLeafInfo struct {
+	ID   uint64 `json:"id"`
+	Name string `json:"name"`
+	VIP  net.IP `json:"vip"`
+}
+
+//---------------------------------------------------------------------------------------
+
+type sClusterMessage struct {
+	messageType byte
+	payload     []byte
+}
+
+//---------------------------------------------------------------------------------------
+
+type sNodeStat struct {
+	DroppedPackets uint64 `json:"dropped_packets"`
+	InvalidPackets uint64 `json:"invalid_packets"`
+	TransitPackets uint64 `json:"transit_packets"`
+}
+
+//---------------------------------------------------------------------------------------
+
+//cLeaf is a virtual IP of a node
+type cLeaf struct {
+	id     uint64
+	name   string
+	vip    net.IP
+	nodeID uint64
+}
+
+//GetID for ILeaf
+func (thisPt *cLeaf) GetID() uint64 {
+	return thisPt.id
+}
+
+//GetName for ILeaf
+func (thisPt *cLeaf) GetName() string {
+	return thisPt.name
+}
+
+//GetVIP for ILeaf
+func (thisPt *cLeaf) GetVIP() net.IP {
+	return thisPt.vip
+}
+
+//GetNodeID for ILeaf
+func (thisPt *cLeaf) GetNodeID() uint64 {
+	return thisPt.nodeID
+}
+
+//---------------------------------------------------------------------------------------
+
+//cNodeNIC is the peer NIC of a node, the leafs of the node are routed to this NIC
+type cNodeNIC struct {
+	id   uint64
+	node *cNode
+	stat common.STransferStat
+}
+
+//GetID for INIC
+func (thisPt *cNodeNIC) GetID() uint64 {
+	return thisPt.id
+}
+
+//GetName for INIC
+func (thisPt *cNodeNIC) GetName() string {
+	return "cluster_" + thisPt.node.connection.remote.Name
+}
+
+//GetType for INIC
+func (thisPt *cNodeNIC) GetType() uint32 {
+	return common.INICTypePeer
+}
+
+//GetStat for INIC
+func (thisPt *cNodeNIC) GetStat() common.STransferStat {
+	stat := common.STransferStat{}
+	stat.SendByte = atomic.LoadUint64(&thisPt.stat.SendByte)
+	stat.SendPacket = atomic.LoadUint64(&thisPt.stat.SendPacket)
+	stat.ReceiveByte = atomic.LoadUint64(&thisPt.stat.ReceiveByte)
+	stat.ReceivePacket = atomic.LoadUint64(&thisPt.stat.ReceivePacket)
+	return stat
+}
+
+//GetPeerIP for INIC
+func (thisPt *cNodeNIC) GetPeerIP() net.IP {
+	return thisPt.node.GetIP()
+}
+
+//GetVirtualIP for INIC
+func (thisPt *cNodeNIC) GetVirtualIP() net.IP {
+	return nil
+}
+
+//GetRoutes for INIC, the leaf routes are registered by the node
+func (thisPt *cNodeNIC) GetRoutes() []net.IPNet {
+	return nil
+}
+
+//WriteData for INIC
+func (thisPt *cNodeNIC) WriteData(data common.IProcessInfo) {
+	//the nodes are a full mesh, so the packets of a node are never forwarded to another node
+	if thisPt.node.manager.isNodeNIC(data.GetInNIC()) {
+		atomic.AddUint64(&thisPt.node.stat.TransitPackets, 1)
+		return
+	}
+
+	if !thisPt.node.send(clusterMessageData, data.GetBuffer(), false) {
+		atomic.AddUint64(&thisPt.node.stat.DroppedPackets, 1)
+		return
+	}
+	atomic.AddUint64(&thisPt.stat.ReceiveByte, uint64(data.GetUsedSize()))
+	atomic.AddUint64(&thisPt.stat.ReceivePacket, 1)
+}
+
+//End for INIC
+func (thisPt *cNodeNIC) End() {
+	thisPt.node.end()
+}
+
+//---------------------------------------------------------------------------------------
+
+//cNode is a connected node of the cluster
+type cNode struct {
+	connection  *cClusterConnection
+	manager     *cNodeManager
+	nic         *cNodeNIC
+	leafs       map[uint64]*cLeaf
+	queue       chan sClusterMessage
+	connectTime int64
+	lastSeen    int64
+	stat        sNodeStat
+	ended       bool
+	lock        sync.Mutex
+	done        chan bool
+}
+
+//GetID for INodes
+func (thisPt *cNode) GetID() uint64 {
+	return thisPt.connection.remote.ID
+}
+
+//GetNetwork for INodes, the cluster address of the node
+func (thisPt *cNode) GetNetwork() string {
+	return thisPt.connection.remote.Address
+}
+
+//GetIP for INodes
+func (thisPt *cNode) GetIP() net.IP {
+	if address, ok := thisPt.connection.conn.RemoteAddr().(*net.TCPAddr); ok {
+		return address.IP
+	}
+	return nil
+}
+
+//GetUpTime for INodes
+func (thisPt *cNode) GetUpTime() uint32 {
+	return uint32(time.Now().Unix() - thisPt.connectTime)
+}
+
+//GetLastSeen for INodes
+func (thisPt *cNode) GetLastSeen() uint32 {
+	return uint32(time.Now().Unix() - atomic.LoadInt64(&thisPt.lastSeen))
+}
+
+//GetAuthKey for INodes, the proof of the node for this connection
+func (thisPt *cNode) GetAuthKey() string {
+	return hex.EncodeToString(thisPt.connection.proof)
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cNode) getStat() sNodeStat {
+	stat := sNodeStat{}
+	stat.DroppedPackets = atomic.LoadUint64(&thisPt.stat.DroppedPackets)
+	stat.InvalidPackets = atomic.LoadUint64(&thisPt.stat.InvalidPackets)
+	stat.TransitPackets = atomic.LoadUint64(&thisPt.stat.TransitPackets)
+	return stat
+}
+
+//---------------------------------------------------------------------------------------
+
+//send queues the message for the writer, the control messages should not be dropped, so the node is
+//disconnected and the leafs are synced again on the next connection
+func (thisPt *cNode) send(messageType byte, payload []byte, control bool) bool {
+	message := sClusterMessage{messageType: messageType, payload: append([]byte{}, payload...)}
+	select {
+	case thisPt.queue <- message:
+		return true
+	case <-thisPt.done:
+		return false
+	default:
+	}
+
+	if control {
+		log.Printf("cluster node %s is too slow \n", thisPt.connection.remote.Name)
+		thisPt.end()
+	}
+	return false
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cNode) sendObject(messageType byte, object interface{}) {
+	payload, err := json.Marshal(object)
+	if err != nil {
+		log.Printf("can not create cluster message %s \n", err.Error())
+		return
+	}
+	thisPt.send(messageType, payload, true)
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cNode) write() {
+	for {
+		select {
+		case <-thisPt.done:
+			return
+		case message := <-thisPt.queue:
+			if err := thisPt.connection.writeMessage(message.messageType, message.payload); err != nil {
+				thisPt.end()
+				return
+			}
+		}
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//read processes the messages until the connection is closed
+func (thisPt *cNode) read() {
+	for {
+		messageType, payload, err := thisPt.connection.readMessage()
+		if err != nil {
+			return
+		}
+		atomic.StoreInt64(&thisPt.lastSeen, time.Now().Unix())
+
+		switch messageType {
+		case clusterMessageData:
+			thisPt.onData(payload)
+		case clusterMessageNodes:
+			addresses := []string{}
+			if json.Unmarshal(payload, &addresses) == nil {
+				thisPt.manager.onNodes(addresses)
+			}
+		case clusterMessageLeafs:
+			leafs := []sClusterLeafInfo{}
+			if json.Unmarshal(payload, &leafs) == nil {
+				thisPt.setLeafs(leafs)
+			}
+		case clusterMessageAddLeaf:
+			leaf := sClusterLeafInfo{}
+			if json.Unmarshal(payload, &leaf) == nil {
+				thisPt.addLeaf(leaf)
+			}
+		case clusterMessageRemoveLeaf:
+			leaf := sClusterLeafInfo{}
+			if json.Unmarshal(payload, &leaf) == nil {
+				thisPt.removeLeaf(leaf.ID)
+			}
+		}
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cNode) onData(payload []byte) {
+	packet := thisPt.manager.params.PacketFactory.CreateProcessInfo(payload)
+	if !packet.ProcessAsNetPacket() {
+		atomic.AddUint64(&thisPt.stat.InvalidPackets, 1)
+		thisPt.manager.params.PacketFactory.FreeProcessInfo(packet)
+		return
+	}
+
+	//the packet is owned by the actor after this call
+	packet.SetInNIC(thisPt.nic.id)
+	atomic.AddUint64(&thisPt.nic.stat.SendByte, uint64(packet.GetUsedSize()))
+	atomic.AddUint64(&thisPt.nic.stat.SendPacket, 1)
+	thisPt.manager.params.ProtocolActor.OnNewPacket(packet)
+}
+
+//---------------------------------------------------------------------------------------
+
+//addLeaf routes the virtual IP to the node. the local clients have the connected routes, so a duplicate virtual IP
+//does not hijack a local client
+func (thisPt *cNode) addLeaf(info sClusterLeafInfo) {
+	vip := info.VIP.To4()
+	if vip == nil {
+		vip = info.VIP.To16()
+	}
+	if vip == nil {
+		return
+	}
+
+	thisPt.lock.Lock()
+	if thisPt.ended || thisPt.leafs[info.ID] != nil {
+		thisPt.lock.Unlock()
+		return
+	}
+	leaf := &cLeaf{id: info.ID, name: info.Name, vip: vip, nodeID: thisPt.GetID()}
+	thisPt.leafs[leaf.id] = leaf
+	thisPt.manager.getRouter(vip).RegisterRoute(getLeafNetwork(vip), thisPt.nic.id, thisPt.nic.GetName(), common.ROUTEMETRICREMOTE)
+	thisPt.lock.Unlock()
+
+	thisPt.manager.notify(func(actor common.INodesActor) { actor.OnNewLeaf(leaf) })
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cNode) removeLeaf(id uint64) {
+	thisPt.lock.Lock()
+	leaf := thisPt.leafs[id]
+	if thisPt.ended || leaf == nil {
+		thisPt.lock.Unlock()
+		return
+	}
+	delete(thisPt.leafs, id)
+	thisPt.manager.getRouter(leaf.vip).RemoveRoute(getLeafNetwork(leaf.vip), thisPt.nic.id)
+	thisPt.lock.Unlock()
+
+	thisPt.manager.notify(func(actor common.INodesActor) { actor.OnRemoveLeaf(leaf) })
+}
+
+//---------------------------------------------------------------------------------------
+
+//setLeafs replaces all the leafs of the node
+func (thisPt *cNode) setLeafs(leafs []sClusterLeafInfo) {
+	valid := make(map[uint64]bool)
+	for _, leaf := range leafs {
+		valid[leaf.ID] = true
+	}
+
+	for _, leaf := range thisPt.getLeafs() {
+		if !valid[leaf.GetID()] {
+			thisPt.removeLeaf(leaf.GetID())
+		}
+	}
+
+	for _, leaf := range leafs {
+		thisPt.addLeaf(leaf)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cNode) getLeafs() []common.ILeaf {
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+
+	leafs := []common.ILeaf{}
+	for _, leaf := range thisPt.leafs {
+		leafs = append(leafs, leaf)
+	}
+	return leafs
+}
+
+//---------------------------------------------------------------------------------------
+
+//end closes the connection, the reader releases the node
+func (thisPt *cNode) end() {
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+
+	select {
+	case <-thisPt.done:
+	default:
+		close(thisPt.done)
+		thisPt.connection.close()
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//release removes the leaf routes, it should be called once after end
+func (thisPt *cNode) release() []common.ILeaf {
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+
+	leafs := []common.ILeaf{}
+	for _, leaf := range thisPt.leafs {
+		thisPt.manager.getRouter(leaf.vip).RemoveRoute(getLeafNetwork(leaf.vip), thisPt.nic.id)
+		leafs = append(leafs, leaf)
+	}
+	thisPt.leafs = make(map[uint64]*cLeaf)
+	thisPt.ended = true
+	return leafs
+}
+
+//---------------------------------------------------------------------------------------
+
+func getLeafNetwork(vip net.IP) net.IPNet {
+	bits := len(vip) * 8
+	return net.IPNet{IP: vip, Mask: net.CIDRMask(bits, bits)}
+}
+
+//---------------------------------------------------------------------------------------
+
+func createNode(connection *cClusterConnection, manager *cNodeManager) *cNode {
+	node := new(cNode)
+	node.connection = connection
+	node.manager = manager
+	node.leafs = make(map[uint64]*cLeaf)
+	node.queue = make(chan sClusterMessage, clusterSendQueueSize)
+	node.connectTime = time.Now().Unix()
+	node.lastSeen = node.connectTime
+	node.done = make(chan bool)
+	node.nic = &cNodeNIC{id: manager.params.Utils.GetUniqID(), node: node}
+	return node
+}
@@ -0,0 +1,568 @@
+package cluster
+
+import (
+	"crypto/rand"
+	"errors"
+	"goconnect/common"
+	"hash/fnv"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//---------------------------------------------------------------------------------------
+
+const (
+	clusterMaintainInterval = 5 * time.Second
+	clusterDialTimeout      = 5 * time.Second
+	clusterNodeTimeout      = 20
+)
+
+//---------------------------------------------------------------------------------------
+
+//SNodeManagerInitParams ...
+type SNodeManagerInitParams struct {
+	Name             string
+	BindAddress      string
+	AdvertiseAddress string
+	SharedKey        string
+	Peers            []string
+	RouterV4         common.IRouter
+	RouterV6         common.IRouter
+	NetworkManager   common.INICManager
+	PacketFactory    common.IProcessFactory
+	ProtocolActor    common.IProtocolActor
+	Utils            common.IUtils
+	Commander        common.ICommander
+}
+
+//---------------------------------------------------------------------------------------
+
+//cNodeManager connects the gateways as a full mesh. each node announces the virtual IPs of its clients as the leafs
+//and the other nodes route the leafs to the node
+type cNodeManager struct {
+	params     SNodeManagerInitParams
+	id         uint64
+	address    string
+	listener   net.Listener
+	nodes      map[uint64]*cNode
+	nics       map[uint64]*cNode
+	localLeafs map[uint64]*cLeaf
+	peers      map[string]bool
+	peerIDs    map[string]uint64
+	dialing    map[string]bool
+	actors     []common.INodesActor
+	lock       sync.RWMutex
+	done       chan bool
+}
+
+//---------------------------------------------------------------------------------------
+
+//getNodeID is the ID of the node name, so a node has the same ID after restart
+func getNodeID(name string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(name))
+	return hash.Sum64()
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cNodeManager) getRouter(ip net.IP) common.IRouter {
+	if ip.To4() != nil {
+		return thisPt.params.RouterV4
+	}
+	return thisPt.params.RouterV6
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cNodeManager) isEnded() bool {
+	select {
+	case <-thisPt.done:
+		return true
+	default:
+	}
+	return false
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cNodeManager) isNodeNIC(id uint64) bool {
+	thisPt.lock.RLock()
+	defer thisPt.lock.RUnlock()
+
+	return thisPt.nics[id] != nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//notify calls the actors without any lock
+func (thisPt *cNodeManager) notify(callback func(actor common.INodesActor)) {
+	thisPt.lock.RLock()
+	actors := append([]common.INodesActor{}, thisPt.actors...)
+	thisPt.lock.RUnlock()
+
+	for _, actor := range actors {
+		callback(actor)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//getAddresses returns the cluster addresses of this node and the connected nodes, should be called by lock
+func (thisPt *cNodeManager) getAddresses() []string {
+	addresses := []string{thisPt.address}
+	for _, node := range thisPt.nodes {
+		addresses = append(addresses, node.GetNetwork())
+	}
+	return addresses
+}
+
+//---------------------------------------------------------------------------------------
+
+//isConnected checks the address by the dialed and the announced addresses, should be called by lock
+func (thisPt *cNodeManager) isConnected(address string) bool {
+	if id, fnd := thisPt.peerIDs[address]; fnd {
+		return id == thisPt.id || thisPt.nodes[id] != nil
+	}
+	for _, node := range thisPt.nodes {
+		if node.GetNetwork() == address {
+			return true
+		}
+	}
+	return address == thisPt.address
+}
+
+//---------------------------------------------------------------------------------------
+
+//isPreferred resolves the duplicate connections, when the both nodes dial each other, the both keep the connection
+//dialed by the lower ID
+func (thisPt *cNodeManager) isPreferred(node *cNode, existing *cNode) bool {
+	dialerID := func(node *cNode) uint64 {
+		if node.connection.dialer {
+			return thisPt.id
+		}
+		return node.GetID()
+	}
+
+	//the existing one is stale, e.g. the node is restarted
+	if dialerID(node) == dialerID(existing) {
+		return true
+	}
+
+	lowerID := thisPt.id
+	if node.GetID() < lowerID {
+		lowerID = node.GetID()
+	}
+	return dialerID(node) == lowerID
+}
+
+//---------------------------------------------------------------------------------------
+
+//addNode registers an authenticated node, the node is synced by the nodes and the leafs messages
+func (thisPt *cNodeManager) addNode(node *cNode) bool {
+	thisPt.lock.Lock()
+	existing := thisPt.nodes[node.GetID()]
+	if thisPt.isEnded() || (existing != nil && !thisPt.isPreferred(node, existing)) {
+		thisPt.lock.Unlock()
+		return false
+	}
+	if existing != nil {
+		delete(thisPt.nics, existing.nic.id)
+	}
+	thisPt.nodes[node.GetID()] = node
+	thisPt.nics[node.nic.id] = node
+
+	//the leafs are queued by lock, so the later changes are queued after the full list
+	leafs := []sClusterLeafInfo{}
+	for _, leaf := range thisPt.localLeafs {
+		leafs = append(leafs, sClusterLeafInfo{ID: leaf.id, Name: leaf.name, VIP: leaf.vip})
+	}
+	addresses := thisPt.getAddresses()
+	for _, other := range thisPt.nodes {
+		other.sendObject(clusterMessageNodes, addresses)
+	}
+	node.sendObject(clusterMessageLeafs, leafs)
+	thisPt.lock.Unlock()
+
+	if existing != nil {
+		existing.end()
+		thisPt.releaseNode(existing)
+	}
+
+	thisPt.params.NetworkManager.RegisterNIC(node.nic)
+	thisPt.notify(func(actor common.INodesActor) { actor.OnNewNode(node) })
+	log.Printf("cluster node %s (%s) is connected \n", node.connection.remote.Name, node.GetNetwork())
+	return true
+}
+
+//---------------------------------------------------------------------------------------
+
+//removeNode is called after the node reader is terminated
+func (thisPt *cNodeManager) removeNode(node *cNode) {
+	node.end()
+
+	thisPt.lock.Lock()
+	current := thisPt.nodes[node.GetID()] == node
+	if current {
+		delete(thisPt.nodes, node.GetID())
+		delete(thisPt.nics, node.nic.id)
+	}
+	thisPt.lock.Unlock()
+
+	if current {
+		thisPt.releaseNode(node)
+		log.Printf("cluster node %s (%s) is disconnected \n", node.connection.remote.Name, node.GetNetwork())
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cNodeManager) releaseNode(node *cNode) {
+	leafs := node.release()
+	thisPt.params.NetworkManager.RemoveNIC(node.nic.id)
+
+	for _, leaf := range leafs {
+		thisPt.notify(func(actor common.INodesActor) { actor.OnRemoveLeaf(leaf) })
+	}
+	thisPt.notify(func(actor common.INodesActor) { actor.OnRemoveNode(node) })
+}
+
+//---------------------------------------------------------------------------------------
+
+//handle authenticates the connection and serves the node until the connection is closed
+func (thisPt *cNodeManager) handle(conn net.Conn, dialer bool, address string) {
+	connection := createClusterConnection(conn, dialer)
+
+	hello := sClusterHello{ID: thisPt.id, Name: thisPt.params.Name, Address: thisPt.address}
+	hello.Nonce = make([]byte, clusterNonceSize)
+	rand.Read(hello.Nonce)
+
+	if err := connection.handshake([]byte(thisPt.params.SharedKey), hello); err != nil {
+		log.Printf("cluster handshake with %s is failed with error %s \n", conn.RemoteAddr().String(), err.Error())
+		connection.close()
+		return
+	}
+
+	if dialer {
+		thisPt.lock.Lock()
+		thisPt.peerIDs[address] = connection.remote.ID
+		thisPt.lock.Unlock()
+	}
+
+	if connection.remote.ID == thisPt.id {
+		connection.close()
+		return
+	}
+
+	node := createNode(connection, thisPt)
+	go node.write()
+	if !thisPt.addNode(node) {
+		node.end()
+		return
+	}
+
+	node.read()
+	thisPt.removeNode(node)
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cNodeManager) dial(address string) {
+	conn, err := net.DialTimeout("tcp", address, clusterDialTimeout)
+	if err == nil {
+		thisPt.handle(conn, true, address)
+	}
+
+	thisPt.lock.Lock()
+	delete(thisPt.dialing, address)
+
+	//the announced addresses are forgotten after a failure, the other nodes announce them again
+	if err != nil && !thisPt.peers[address] {
+		delete(thisPt.peers, address)
+	}
+	thisPt.lock.Unlock()
+}
+
+//---------------------------------------------------------------------------------------
+
+//connect dials the peers which are not connected, should be called by lock
+func (thisPt *cNodeManager) connect() {
+	for address := range thisPt.peers {
+		if thisPt.dialing[address] || thisPt.isConnected(address) {
+			continue
+		}
+		thisPt.dialing[address] = true
+		go thisPt.dial(address)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//onNodes dials the nodes announced by the other nodes
+func (thisPt *cNodeManager) onNodes(addresses []string) {
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+
+	for _, address := range addresses {
+		if _, fnd := thisPt.peers[address]; !fnd && address != "" {
+			thisPt.peers[address] = false
+		}
+	}
+	thisPt.connect()
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cNodeManager) accept() {
+	for {
+		conn, err := thisPt.listener.Accept()
+		if err != nil {
+			if thisPt.isEnded() {
+				return
+			}
+			log.Printf("can not accept cluster connection %s \n", err.Error())
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		go thisPt.handle(conn, false, "")
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//maintain keeps the nodes alive and reconnects the peers
+func (thisPt *cNodeManager) maintain() {
+	ticker := time.NewTicker(clusterMaintainInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-thisPt.done:
+			return
+		case <-ticker.C:
+		}
+
+		thisPt.lock.Lock()
+		for _, node := range thisPt.nodes {
+			if node.GetLastSeen() > clusterNodeTimeout {
+				log.Printf("cluster node %s is timed out \n", node.connection.remote.Name)
+				node.end()
+				continue
+			}
+			node.send(clusterMessagePing, nil, true)
+		}
+		thisPt.connect()
+		thisPt.lock.Unlock()
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//OnNICRegistered for INICObserver, the client virtual IPs are the leafs of this node
+func (thisPt *cNodeManager) OnNICRegistered(nic common.INIC) {
+	if nic.GetType() != common.INICTypeClient || nic.GetVirtualIP() == nil {
+		return
+	}
+
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+
+	leaf := &cLeaf{id: nic.GetID(), name: nic.GetName(), vip: nic.GetVirtualIP(), nodeID: thisPt.id}
+	thisPt.localLeafs[leaf.id] = leaf
+	for _, node := range thisPt.nodes {
+		node.sendObject(clusterMessageAddLeaf, sClusterLeafInfo{ID: leaf.id, Name: leaf.name, VIP: leaf.vip})
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//OnNICRemoved for INICObserver
+func (thisPt *cNodeManager) OnNICRemoved(nic common.INIC) {
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+
+	leaf := thisPt.localLeafs[nic.GetID()]
+	if leaf == nil {
+		return
+	}
+	delete(thisPt.localLeafs, leaf.id)
+	for _, node := range thisPt.nodes {
+		node.sendObject(clusterMessageRemoveLeaf, sClusterLeafInfo{ID: leaf.id})
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//GetNodes for INodeManager
+func (thisPt *cNodeManager) GetNodes() []common.INodes {
+	thisPt.lock.RLock()
+	defer thisPt.lock.RUnlock()
+
+	nodes := []common.INodes{}
+	for _, node := range thisPt.nodes {
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+//---------------------------------------------------------------------------------------
+
+//GetLeafs for INodeManager, the local and the remote leafs
+func (thisPt *cNodeManager) GetLeafs() []common.ILeaf {
+	thisPt.lock.RLock()
+	nodes := []*cNode{}
+	leafs := []common.ILeaf{}
+	for _, leaf := range thisPt.localLeafs {
+		leafs = append(leafs, leaf)
+	}
+	for _, node := range thisPt.nodes {
+		nodes = append(nodes, node)
+	}
+	thisPt.lock.RUnlock()
+
+	for _, node := range nodes {
+		leafs = append(leafs, node.getLeafs()...)
+	}
+	return leafs
+}
+
+//---------------------------------------------------------------------------------------
+
+//Subscribe for INodeManager
+func (thisPt *cNodeManager) Subscribe(actor common.INodesActor) {
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+
+	thisPt.actors = append(thisPt.actors, actor)
+}
+
+//---------------------------------------------------------------------------------------
+
+//End for INodeManager
+func (thisPt *cNodeManager) End() {
+	thisPt.lock.Lock()
+	if thisPt.isEnded() {
+		thisPt.lock.Unlock()
+		return
+	}
+	close(thisPt.done)
+	thisPt.listener.Close()
+	for _, node := range thisPt.nodes {
+		node.end()
+	}
+	thisPt.lock.Unlock()
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cNodeManager) OnNodesCommand(req *http.Request, params interface{}) (common.IHTTPResponse, error) {
+	type sNodeStatus struct {
+		ID       uint64               `json:"id"`
+		Name     string               `json:"name"`
+		Address  string               `json:"address"`
+		IP       string               `json:"ip"`
+		UpTime   uint32               `json:"up_time"`
+		LastSeen uint32               `json:"last_seen"`
+		Leafs    int                  `json:"leafs"`
+		Transfer common.STransferStat `json:"transfer"`
+		Stat     sNodeStat            `json:"stat"`
+	}
+
+	thisPt.lock.RLock()
+	nodes := []*cNode{}
+	for _, node := range thisPt.nodes {
+		nodes = append(nodes, node)
+	}
+	thisPt.lock.RUnlock()
+
+	status := []sNodeStatus{}
+	for _, node := range nodes {
+		item := sNodeStatus{}
+		item.ID = node.GetID()
+		item.Name = node.connection.remote.Name
+		item.Address = node.GetNetwork()
+		item.IP = node.GetIP().String()
+		item.UpTime = node.GetUpTime()
+		item.LastSeen = node.GetLastSeen()
+		item.Leafs = len(node.getLeafs())
+		item.Transfer = node.nic.GetStat()
+		item.Stat = node.getStat()
+		status = append(status, item)
+	}
+	return thisPt.params.Utils.CreateHttpResponseFromObject(status)
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cNodeManager) OnLeafsCommand(req *http.Request, params interface{}) (common.IHTTPResponse, error) {
+	type sLeafStatus struct {
+		ID     uint64 `json:"id"`
+		Name   string `json:"name"`
+		VIP    string `json:"vip"`
+		NodeID uint64 `json:"node_id"`
+		Local  bool   `json:"local"`
+	}
+
+	status := []sLeafStatus{}
+	for _, leaf := range thisPt.GetLeafs() {
+		status = append(status, sLeafStatus{ID: leaf.GetID(), Name: leaf.GetName(), VIP: leaf.GetVIP().String(), NodeID: leaf.GetNodeID(), Local: leaf.GetNodeID() == thisPt.id})
+	}
+	return thisPt.params.Utils.CreateHttpResponseFromObject(status)
+}
+
+//---------------------------------------------------------------------------------------
+
+//Init the local virtual IPs are learned from the NIC registrations, so it should be initialized before the protocols
+func (thisPt *cNodeManager) Init(params SNodeManagerInitParams) error {
+	thisPt.params = params
+	thisPt.nodes = make(map[uint64]*cNode)
+	thisPt.nics = make(map[uint64]*cNode)
+	thisPt.localLeafs = make(map[uint64]*cLeaf)
+	thisPt.peers = make(map[string]bool)
+	thisPt.peerIDs = make(map[string]uint64)
+	thisPt.dialing = make(map[string]bool)
+	thisPt.done = make(chan bool)
+
+	if params.Name == "" {
+		return errors.New("cluster node name is empty")
+	}
+	if len(params.SharedKey) < clusterMinSharedKeyLength {
+		return errors.New("cluster shared key is too short")
+	}
+	thisPt.id = getNodeID(params.Name)
+
+	var err error
+	if thisPt.listener, err = net.Listen("tcp", params.BindAddress); err != nil {
+		return err
+	}
+
+	thisPt.address = params.AdvertiseAddress
+	if thisPt.address == "" {
+		thisPt.address = thisPt.listener.Addr().String()
+	}
+
+	thisPt.params.NetworkManager.RegisterObserver(thisPt)
+
+	//
+	thisPt.lock.Lock()
+	for _, peer := range params.Peers {
+		thisPt.peers[peer] = true
+	}
+	thisPt.connect()
+	thisPt.lock.Unlock()
+
+	go thisPt.accept()
+	go thisPt.maintain()
+
+	//register api
+	if thisPt.params.Commander != nil {
+		selector := thisPt.params.Commander.CreateSelector()
+		selector.Register("cluster_nodes", thisPt.OnNodesCommand, nil)
+		selector.Register("cluster_leafs", thisPt.OnLeafsCommand, nil)
+	}
+
+	return nil
+}
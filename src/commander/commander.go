@@ -340,3 +340,14 @@ func Create(params SCommanderInitParams) common.ICommander {
 	cmd.Init(params)
 	return &cmd
 }
+
+//---------------------------------------------------------------------------------------
+
+//CreateRemoteCommanders ...
+func CreateRemoteCommanders(params SRemoteCommandersInitParams) common.IRemoteCommanders {
+	remote := new(cRemoteCommanders)
+	if err := remote.Init(params); err != nil {
+		log.Fatalln(err)
+	}
+	return remote
+}
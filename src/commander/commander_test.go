@@ -12,15 +12,24 @@ import (
 )
 
 //---------------------------------------------------------------------------------------
-func testAuthentication(t *testing.T) {
-	commander := cCommander{}
 
-	authParam := auth.SAuthenticationManagerParams{}
+//createTestParams listens on a free local port, the commanders of the tests can not share a fixed port
+//and a failed listen exits the test process
+func createTestParams() SCommanderInitParams {
 	params := SCommanderInitParams{}
-	params.BindAddress = "0.0.0.0:4443"
+	params.BindAddress = "127.0.0.1:0"
 	params.EnableSeprateManagemnet = true
 	params.ServeStaticContents = true
 	params.Utils = utils.Create()
+	return params
+}
+
+//---------------------------------------------------------------------------------------
+func testAuthentication(t *testing.T) {
+	commander := cCommander{}
+
+	authParam := auth.SAuthenticationManagerParams{}
+	params := createTestParams()
 	params.TokenMaxLifeTime = 1600
 
 	authParam.Utils = params.Utils
@@ -117,11 +126,7 @@ func testAuthentication(t *testing.T) {
 //---------------------------------------------------------------------------------------
 func testFunctionality(t *testing.T) {
 	commander := cCommander{}
-	params := SCommanderInitParams{}
-	params.BindAddress = "0.0.0.0:4443"
-	params.EnableSeprateManagemnet = true
-	params.ServeStaticContents = true
-	params.Utils = utils.Create()
+	params := createTestParams()
 	params.StaticDataPath = "/tmp/"
 	params.MaintenanceHook = true
 
@@ -0,0 +1,201 @@
+package commander
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"goconnect/common"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+//---------------------------------------------------------------------------------------
+
+const (
+	remoteCommanderTimeout         = 10 * time.Second
+	remoteCommanderMaxResponseSize = 16 * 1024 * 1024
+)
+
+//---------------------------------------------------------------------------------------
+
+//SRemoteCommanderInfo ...
+type SRemoteCommanderInfo struct {
+	Name       string
+	Address    string
+	User       string
+	Password   string
+	SkipVerify bool
+}
+
+//---------------------------------------------------------------------------------------
+
+//SRemoteCommandersInitParams ...
+type SRemoteCommandersInitParams struct {
+	Name  string
+	Peers []SRemoteCommanderInfo
+}
+
+//---------------------------------------------------------------------------------------
+
+//sRemoteCommander is the commander of a node, the admin token is reused until It is rejected
+type sRemoteCommander struct {
+	info   SRemoteCommanderInfo
+	client *http.Client
+	token  string
+	lock   sync.Mutex
+}
+
+//---------------------------------------------------------------------------------------
+
+//cRemoteCommanders ...
+type cRemoteCommanders struct {
+	params SRemoteCommandersInitParams
+	peers  []*sRemoteCommander
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *sRemoteCommander) post(api string, params url.Values) (int, []byte, error) {
+	resp, err := thisPt.client.PostForm("https://"+thisPt.info.Address+"/"+api, params)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, remoteCommanderMaxResponseSize))
+	return resp.StatusCode, body, err
+}
+
+//---------------------------------------------------------------------------------------
+
+//login should be called by lock
+func (thisPt *sRemoteCommander) login() error {
+	params := url.Values{}
+	params.Set("user", thisPt.info.User)
+	params.Set("password", thisPt.info.Password)
+
+	_, body, err := thisPt.post(authCommandLoginAdmin, params)
+	if err != nil {
+		return err
+	}
+
+	result := struct {
+		Token string `json:"token"`
+		Msg   string `json:"msg"`
+	}{}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return err
+	}
+	if result.Token == "" {
+		return errors.New("login to node " + thisPt.info.Name + " failed, " + result.Msg)
+	}
+	thisPt.token = result.Token
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//call runs the API by the current token, the failed APIs have empty responses, so It logins again once
+func (thisPt *sRemoteCommander) call(api string, params url.Values) ([]byte, error) {
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+
+	for retry := 0; retry < 2; retry++ {
+		if thisPt.token == "" {
+			if err := thisPt.login(); err != nil {
+				return nil, err
+			}
+		}
+
+		values := url.Values{}
+		for k, v := range params {
+			values[k] = v
+		}
+		values.Set("token", thisPt.token)
+
+		status, body, err := thisPt.post(api, values)
+		if err != nil {
+			return nil, err
+		}
+		if status == http.StatusOK && len(strings.TrimSpace(string(body))) > 0 {
+			return body, nil
+		}
+		thisPt.token = ""
+	}
+	return nil, errors.New("API " + api + " failed on node " + thisPt.info.Name)
+}
+
+//---------------------------------------------------------------------------------------
+
+//GetName for IRemoteCommanders, the name of this node
+func (thisPt *cRemoteCommanders) GetName() string {
+	return thisPt.params.Name
+}
+
+//---------------------------------------------------------------------------------------
+
+//GetNodes for IRemoteCommanders
+func (thisPt *cRemoteCommanders) GetNodes() []string {
+	nodes := []string{}
+	for _, peer := range thisPt.peers {
+		nodes = append(nodes, peer.info.Name)
+	}
+	return nodes
+}
+
+//---------------------------------------------------------------------------------------
+
+//Call for IRemoteCommanders
+func (thisPt *cRemoteCommanders) Call(node string, api string, params url.Values) ([]byte, error) {
+	for _, peer := range thisPt.peers {
+		if peer.info.Name == node {
+			return peer.call(api, params)
+		}
+	}
+	return nil, errors.New("invalid node " + node)
+}
+
+//---------------------------------------------------------------------------------------
+
+//CallAll for IRemoteCommanders, the nodes are called in parallel
+func (thisPt *cRemoteCommanders) CallAll(api string, params url.Values) []common.SRemoteCommandResult {
+	results := make([]common.SRemoteCommandResult, len(thisPt.peers))
+
+	var wait sync.WaitGroup
+	for index, peer := range thisPt.peers {
+		wait.Add(1)
+		go func(index int, peer *sRemoteCommander) {
+			defer wait.Done()
+			results[index].Node = peer.info.Name
+			results[index].Response, results[index].Err = peer.call(api, params)
+		}(index, peer)
+	}
+	wait.Wait()
+	return results
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cRemoteCommanders) Init(params SRemoteCommandersInitParams) error {
+	thisPt.params = params
+
+	names := map[string]bool{params.Name: true}
+	for _, info := range params.Peers {
+		if names[info.Name] {
+			return errors.New("duplicate node name " + info.Name)
+		}
+		names[info.Name] = true
+
+		peer := new(sRemoteCommander)
+		peer.info = info
+		peer.client = &http.Client{Timeout: remoteCommanderTimeout}
+		peer.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: info.SkipVerify}}
+		thisPt.peers = append(thisPt.peers, peer)
+	}
+	return nil
+}
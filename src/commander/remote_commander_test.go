@@ -0,0 +1,92 @@
+package commander
+
+import (
+	"goconnect/auth"
+	"goconnect/common"
+	"goconnect/utils"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+//---------------------------------------------------------------------------------------
+
+type sTestEchoParams struct {
+	Message string `schema:"message" validate:"max=64"`
+}
+
+//---------------------------------------------------------------------------------------
+
+func createTestRemoteNode(t *testing.T) (*httptest.Server, *cCommander) {
+	util := utils.Create()
+	authMan := auth.Create(auth.SAuthenticationManagerParams{Utils: util})
+	authMan.RegisterDummyAuthenticator("")
+	authMan.SetDummyInfo("123456", "123456")
+
+	commander := new(cCommander)
+	commander.Init(SCommanderInitParams{Utils: util, Authenticator: authMan})
+
+	//the same authenticator of the separate management channel, without the listener
+	authParam := sCommandAuthenticatorParams{}
+	authParam.Authenticator = authMan
+	authParam.Commander = commander
+	authParam.LoginFailCount = common.MAXAUTHFAILCOUNT
+	authParam.LoginFailTrackTime = common.MAXAUTHTRACKTIME
+	authParam.Utils = util
+	authParam.TokenMaxLifeTime = 1600
+	commander.accessValidator = new(cCommandAuthenticator)
+	commander.accessValidator.Init(authParam)
+
+	selector := commander.CreateSelector()
+	selector.Register("echo", func(req *http.Request, params interface{}) (common.IHTTPResponse, error) {
+		return util.CreateHttpResponseFromString(params.(*sTestEchoParams).Message)
+	}, sTestEchoParams{})
+
+	return httptest.NewTLSServer(commander), commander
+}
+
+//---------------------------------------------------------------------------------------
+
+func TestRemoteCommanders(t *testing.T) {
+	server, _ := createTestRemoteNode(t)
+	defer server.Close()
+
+	address := strings.TrimPrefix(server.URL, "https://")
+	remote := new(cRemoteCommanders)
+	err := remote.Init(SRemoteCommandersInitParams{Name: "gw1", Peers: []SRemoteCommanderInfo{
+		{Name: "gw2", Address: address, User: "admin", Password: "123456", SkipVerify: true},
+		{Name: "gw3", Address: address, User: "admin", Password: "654321", SkipVerify: true},
+	}})
+	if err != nil {
+		t.Fatalf("can not init remote commanders %v \n", err)
+	}
+
+	params := url.Values{}
+	params.Set("message", "hello")
+	if response, err := remote.Call("gw2", "echo", params); err != nil || string(response) != "hello" {
+		t.Fatalf("invalid response %s %v \n", string(response), err)
+	}
+
+	//the rejected token is renewed
+	remote.peers[0].token = "invalid token 0123456789"
+	if response, err := remote.Call("gw2", "echo", params); err != nil || string(response) != "hello" {
+		t.Fatalf("token is not renewed %v \n", err)
+	}
+
+	//invalid password
+	results := remote.CallAll("echo", params)
+	if len(results) != 2 || results[0].Err != nil || results[1].Err == nil || results[1].Node != "gw3" {
+		t.Fatalf("invalid results %v \n", results)
+	}
+
+	if _, err := remote.Call("gw4", "echo", params); err == nil {
+		t.Fatalf("invalid node is accepted \n")
+	}
+
+	//duplicate names
+	if err := new(cRemoteCommanders).Init(SRemoteCommandersInitParams{Name: "gw1", Peers: []SRemoteCommanderInfo{{Name: "gw1"}}}); err == nil {
+		t.Fatalf("duplicate node name is accepted \n")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 )
 
 //---------------------------------------------------------------------------------------
@@ -89,6 +90,7 @@ func (thisPt SIPNet) MarshalJSON() ([]byte, error) {
 //IDatabase ...
 type IDatabase interface {
 	LoadObject(objects interface{}, query string, args ...interface{}) error
+	Execute(query string, args ...interface{}) error
 	NormalizeString(input string) string
 	RemoveObject(tableName string, object interface{}) error
 	UpdateObject(tableName string, object interface{}) error
@@ -101,11 +103,50 @@ type IDatabase interface {
 //IIPPool ...
 type IIPPool interface {
 	AllocateIP() (bool, net.IP)
+	AllocateUserIP(user string, staticIP net.IP) (bool, net.IP)
+	SetStaticIP(user string, ip net.IP) error
+	SetLeaseStore(database IDatabase) error
 	FreeIP(net.IP)
 }
 
 //---------------------------------------------------------------------------------------
 
+//SIPPoolConfig is a named pool, the groups are checked before the authenticators.
+//the empty client options are replaced by the protocol defaults
+type SIPPoolConfig struct {
+	Name           string
+	Start          string
+	End            string
+	Start6         string
+	End6           string
+	NetMask        string
+	DNSServers     []string
+	SplitTunnels   []string
+	Groups         []string
+	Authenticators []string
+}
+
+//SIPAllocation is the allocated IPs of a session and the client options of the pool
+type SIPAllocation struct {
+	Pool         string
+	IP           net.IP
+	IP6          net.IP
+	NetMask      string
+	DNSServers   []string
+	SplitTunnels []string
+}
+
+//IIPPoolManager selects the pool of the users, the first pool is the default pool
+type IIPPoolManager interface {
+	AllocateIP(user string, authenticator string, info SUserInfo) (SIPAllocation, error)
+	FreeIP(ip net.IP)
+	SetStaticIP(user string, ip net.IP) error
+	SetLeaseStore(database IDatabase) error
+	SetCommander(commander ICommander)
+}
+
+//---------------------------------------------------------------------------------------
+
 //THashCompareFunc ...
 type THashCompareFunc func(inHashData interface{}, userdata interface{}) bool
 
@@ -183,6 +224,7 @@ type IHeapSorter interface {
 type IUtils interface {
 	CreateNewIPTrie(ipVersion int) IIPTrie
 	CreateLocalIPPool(start string, end string) IIPPool
+	CreateIPPoolManager(pools []SIPPoolConfig) (IIPPoolManager, error)
 	CreateHashLinkList(segmentCount uint32, inactveTimeOut uint64) IHashLinkList
 	CreateBuffer(len uint32) IBuffer
 	GetUniqID() uint64
@@ -205,6 +247,7 @@ type IUtils interface {
 	CreateHttpResponseFromBuffer(buffer []byte) (IHTTPResponse, error)
 	CreateHttpResponseFromString(buffer string) (IHTTPResponse, error)
 	CastJsonObject(in interface{}, out interface{}) error
+	CheckSplitRoutes(include []string, exclude []string) error
 }
 
 //---------------------------------------------------------------------------------------
@@ -246,18 +289,29 @@ type INIC interface {
 type INICManager interface {
 	RegisterNIC(INIC)
 	GetNICName(uint64) string
+	GetNICType(uint64) uint32
 	RemoveNIC(uint64)
 	WriteData(id uint64, data IProcessInfo)
+	RegisterObserver(INICObserver)
 	Flush()
 }
 
 //---------------------------------------------------------------------------------------
 
+//INICObserver is notified on the NIC registrations, e.g. the cluster announces the client NICs to the other nodes
+type INICObserver interface {
+	OnNICRegistered(INIC)
+	OnNICRemoved(INIC)
+}
+
+//---------------------------------------------------------------------------------------
+
 //Common L4 protocols
 const (
-	L4PROTOCOLICMP = 1
-	L4PROTOCOLTCP  = 6
-	L4PROTOCOLUDP  = 17
+	L4PROTOCOLICMP   = 1
+	L4PROTOCOLTCP    = 6
+	L4PROTOCOLUDP    = 17
+	L4PROTOCOLICMPV6 = 58
 )
 
 //---------------------------------------------------------------------------------------
@@ -325,6 +379,7 @@ type IFlow interface {
 	GetDirection(IProcessInfo) uint32
 	GetID() uint64
 	GetBlocked() bool
+	SetBlocked(bool)
 }
 
 //---------------------------------------------------------------------------------------
@@ -337,6 +392,45 @@ type IFlowManager interface {
 
 //---------------------------------------------------------------------------------------
 
+//Flow end reasons, same as IPFIX flowEndReason
+const (
+	FLOWENDREASONIDLE   = 1
+	FLOWENDREASONACTIVE = 2
+	FLOWENDREASONEND    = 3
+	FLOWENDREASONFORCED = 4
+)
+
+//SFlowRecord ...
+type SFlowRecord struct {
+	Source          net.IP
+	Destination     net.IP
+	SourcePort      uint16
+	DestinationPort uint16
+	Protocol        uint8
+	InNIC           uint64
+	OutNIC          uint64
+	Stat            STransferStat
+	StartTime       int64
+	EndTime         int64
+	EndReason       uint8
+}
+
+//IFlowExporter ...
+type IFlowExporter interface {
+	Export(record *SFlowRecord)
+	End()
+}
+
+//---------------------------------------------------------------------------------------
+
+//IPipeline dispatches the packets to the worker goroutines
+type IPipeline interface {
+	IProtocolActor
+	End()
+}
+
+//---------------------------------------------------------------------------------------
+
 //IProcessFactory ...
 type IProcessFactory interface {
 	CreateProcessInfo([]byte) IProcessInfo
@@ -355,11 +449,69 @@ const (
 	ROUTEMETRICREMOTE    = 3
 )
 
+//blackhole routes drop the packets silently
+const (
+	ROUTENICBLACKHOLE     = ^uint64(0)
+	ROUTENICBLACKHOLENAME = "blackhole"
+)
+
+//SRouteCandidate is a next hop of a route lookup
+type SRouteCandidate struct {
+	NIC     uint64 `json:"nic_id"`
+	NICName string `json:"nic_name"`
+	Metric  uint32 `json:"metric"`
+	Static  bool   `json:"static"`
+	Active  bool   `json:"active"`
+}
+
+//SRouteLookup is the result of a route lookup
+type SRouteLookup struct {
+	Network    string            `json:"network"`
+	Candidates []SRouteCandidate `json:"candidates"`
+	Selected   uint64            `json:"selected_nic_id"`
+}
+
 //IRouter ...
 type IRouter interface {
 	RegisterRoute(network net.IPNet, nicID uint64, nicName string, metric uint32)
 	RemoveRoute(network net.IPNet, nicID uint64)
-	GetDestinatin(ip net.IP) uint64
+	RegisterStaticRoute(network net.IPNet, nicName string, metric uint32) bool
+	RemoveStaticRoute(network net.IPNet, nicName string) bool
+	BindNIC(nicID uint64, nicName string)
+	UnbindNIC(nicID uint64)
+	GetDestinatin(ip net.IP, flowKey uint64) uint64
+	Lookup(ip net.IP, flowKey uint64) SRouteLookup
+}
+
+//---------------------------------------------------------------------------------------
+
+//IRouteTracer ...
+type IRouteTracer interface {
+	Lookup(ip net.IP, source net.IP) (SRouteLookup, error)
+	Evaluate(source net.IP, destination net.IP, protocol string, sourcePort uint16, destinationPort uint16) (uint32, error)
+}
+
+//---------------------------------------------------------------------------------------
+
+//IStaticRouteManager ...
+type IStaticRouteManager interface {
+	AddRoute(network string, nicName string, blackhole bool) error
+	RemoveRoute(network string, nicName string, blackhole bool) error
+}
+
+//---------------------------------------------------------------------------------------
+
+//ICMPREASON reasons used for the gateway generated ICMP errors
+const (
+	ICMPREASONNOROUTE    = 1
+	ICMPREASONPROHIBITED = 2
+)
+
+//IICMPGenerator ...
+type IICMPGenerator interface {
+	IsGatewayEchoRequest(packet IProcessInfo) bool
+	CreateEchoReply(packet IProcessInfo) IProcessInfo
+	CreateUnreachable(packet IProcessInfo, reason uint32) IProcessInfo
 }
 
 //---------------------------------------------------------------------------------------
@@ -371,6 +523,16 @@ type IProtocolActor interface {
 
 //---------------------------------------------------------------------------------------
 
+//ACCSTOPREASON reasons of the accounting session termination, saved by the accounting history
+const (
+	ACCSTOPREASONEND       = "session_end"
+	ACCSTOPREASONADMIN     = "admin_disconnect"
+	ACCSTOPREASONREJECTED  = "rejected_by_authenticator"
+	ACCSTOPREASONQUOTA     = "quota_exceeded"
+	ACCSTOPREASONTIMELIMIT = "session_time_limit"
+	ACCSTOPREASONLIMIT     = "session_limit"
+)
+
 //TAccountingSessionDC disconnect callback
 type TAccountingSessionDC func(session IAccountingSession, userData interface{}) bool
 
@@ -390,6 +552,7 @@ type IAccountingSession interface {
 	UpdateReceive(uint64)
 	UpdateLocation(lat float64, long float64)
 	RegisterDCCallBack(TAccountingSessionDC, interface{})
+	SetStopReason(reason string)
 	Start()
 	Stop()
 	Update() bool
@@ -414,9 +577,10 @@ type SAuthenticationInfo struct {
 
 //SAccountingInfo ...
 type SAccountingInfo struct {
-	User      string
-	UserIP    net.IP
-	VirtualIP net.IP
+	User       string
+	UserIP     net.IP
+	VirtualIP  net.IP
+	AcceptTime int64 //the acceptance time of the banner, zero without the acceptance
 }
 
 //IAuthenticator ...
@@ -427,6 +591,42 @@ type IAuthenticator interface {
 	CreateAccountingSession(info SAccountingInfo) IAccountingSession
 }
 
+//IAccountingUpdater is implemented by the authenticators which check the sessions on the interim updates,
+//the rejected sessions are disconnected
+type IAccountingUpdater interface {
+	OnAccountingUpdate(session IAccountingSession) bool
+}
+
+//---------------------------------------------------------------------------------------
+
+//SUserInfo is the directory information of a user, the static IP is the framed IP of the user
+type SUserInfo struct {
+	User     string
+	Groups   []string
+	StaticIP net.IP
+}
+
+//IUserInfoProvider is implemented by the authenticators which know the groups of the users
+type IUserInfoProvider interface {
+	GetUserInfo(user string) (SUserInfo, error)
+}
+
+//---------------------------------------------------------------------------------------
+
+//SClientProfile is the client configuration of the users and groups, the empty values are replaced by the server options
+type SClientProfile struct {
+	Name         string   `json:"name" validate:"min=1,max=64"`
+	Users        []string `json:"users" validate:"max=1024"`
+	Groups       []string `json:"groups" validate:"max=256"`
+	SplitInclude []string `json:"split_include" validate:"routes"`
+	SplitExclude []string `json:"split_exclude" validate:"routes"`
+	ExcludeLAN   bool     `json:"exclude_local_lan"`
+	SplitDNS     []string `json:"split_dns" validate:"max=64,dive,min=1,max=255"`
+	DNSServers   []string `json:"dns_servers" validate:"iplist"`
+	IdleTimeout  uint32   `json:"idle_timeout" validate:"omitempty,min=60,max=86400"`
+	Banner       string   `json:"banner" validate:"max=4096"`
+}
+
 //---------------------------------------------------------------------------------------
 
 //IAuthenticationManger ..
@@ -435,9 +635,36 @@ type IAuthenticationManger interface {
 	RegisterDummyAuthenticator(cfgFile string) error
 	GetAuthenticator(typeName string) IAuthenticator
 	GetAccountingSession(sessionID string, accessFunc TAccessFunction) error
+	GetUserAccountingSessions(user string, accessFunc TAccessFunction) uint32
+	GetAccountingSessionByVIP(vip net.IP, accessFunc TAccessFunction) error
 	AuthenticateUser(info SAuthenticationInfo) (IAuthenticator, error)
 	AuthenticateAdmin(info SAuthenticationInfo) (IAuthenticator, int, error)
+	CheckSessionLimit(user string, authenticator IAuthenticator) error
+	CheckQuota(user string, authenticator IAuthenticator) error
+	ReleaseSessionLimit(user string)
+	GetUserInfo(user string, authenticator IAuthenticator) SUserInfo
+	GetClientProfile(user string, authenticator IAuthenticator) *SClientProfile
 	SetCommander(commander ICommander)
+	SetConfigManager(config IDynamicConfigManager)
+}
+
+//---------------------------------------------------------------------------------------
+
+//SRemoteCommandResult ...
+type SRemoteCommandResult struct {
+	Node     string
+	Response []byte
+	Err      error
+}
+
+//---------------------------------------------------------------------------------------
+
+//IRemoteCommanders calls the APIs of the commanders of the other nodes
+type IRemoteCommanders interface {
+	GetName() string
+	GetNodes() []string
+	Call(node string, api string, params url.Values) ([]byte, error)
+	CallAll(api string, params url.Values) []SRemoteCommandResult
 }
 
 //---------------------------------------------------------------------------------------
@@ -500,13 +727,51 @@ type IPolicy interface {
 	Match(process IProcessInfo) uint32
 }
 
+//---------------------------------------------------------------------------------------
+//
+const (
+	POLICYACTIONNOMATCH = 0
+	POLICYACTIONALLOW   = 1
+	POLICYACTIONBLOCK   = 2
+)
+
+//IPolicyManager ...
+type IPolicyManager interface {
+	Evaluate(process IProcessInfo) uint32
+	Trace(process IProcessInfo) (string, uint32)
+}
+
+//---------------------------------------------------------------------------------------
+
+//IPacketCapture ...
+type IPacketCapture interface {
+	Capture(process IProcessInfo)
+}
+
+//---------------------------------------------------------------------------------------
+
+//IDNSForwarder ...
+type IDNSForwarder interface {
+	Resolve(query []byte) ([]byte, error)
+	FlushCache()
+	End()
+}
+
+//---------------------------------------------------------------------------------------
+
+//IDNSInspector ...
+type IDNSInspector interface {
+	Inspect(process IProcessInfo)
+	GetDomains(ip net.IP) []string
+}
+
 //---------------------------------------------------------------------------------------
 
-//GRPC FUNCTIONS
-//	PullNodes()
-//	PullLeafs()
-//	PushLeafs()
-//	Subscribe() return a list of nodes
+//Cluster messages
+//	PullNodes()		the connected nodes are exchanged, so the nodes find each other
+//	PullLeafs()		the leafs are pushed right after the authentication
+//	PushLeafs()		the leaf changes are pushed to all the nodes
+//	Subscribe()		INodesActor is notified on the node and leaf changes
 
 //INodes ...
 type INodes interface {
@@ -539,3 +804,13 @@ type INodesActor interface {
 }
 
 //---------------------------------------------------------------------------------------
+
+//INodeManager ...
+type INodeManager interface {
+	GetNodes() []INodes
+	GetLeafs() []ILeaf
+	Subscribe(INodesActor)
+	End()
+}
+
+//---------------------------------------------------------------------------------------
@@ -50,6 +50,22 @@ func (thisPt *cDB) LoadObject(objects interface{}, query string, args ...interfa
 
 //---------------------------------------------------------------------------------------
 
+//Execute for IDatabase, used for the bulk updates and deletes
+func (thisPt *cDB) Execute(query string, args ...interface{}) error {
+
+	//simple sql injection check
+	for i, arg := range args {
+		if str, ok := arg.(string); ok == true {
+			args[i] = thisPt.NormalizeString(str)
+		}
+	}
+
+	_, err := thisPt.dbMap.Exec(fmt.Sprintf(query, args...))
+	return err
+}
+
+//---------------------------------------------------------------------------------------
+
 //RemoveObject for IDatabase
 func (thisPt *cDB) RemoveObject(tableName string, object interface{}) error {
 	_, err := thisPt.dbMap.Delete(object)
@@ -82,4 +82,16 @@ func TestDB(t *testing.T) {
 		t.Fatalf("can not insert database object %v", err)
 	}
 
+	//bulk delete
+	if err = db.SerializeObject("test", &testObject{ValueNumber: 30}); err != nil {
+		t.Fatalf("can not insert database object %v", err)
+	}
+	if err = db.Execute("delete from test where ValueNumber=%d", 30); err != nil {
+		t.Fatalf("can not execute query %v", err)
+	}
+	objects = nil
+	if err = db.LoadObject(&objects, "select * from test where ValueNumber=%d", 30); err != nil || len(objects) != 0 {
+		t.Fatalf("bulk delete failed %v", err)
+	}
+
 }
@@ -0,0 +1,26 @@
+package dns
+
+import (
+	"goconnect/common"
+	"log"
+)
+
+//---------------------------------------------------------------------------------------
+
+//CreateDNSForwarder ...
+func CreateDNSForwarder(params SDNSForwarderInitParams) common.IDNSForwarder {
+	forwarder := new(cDNSForwarder)
+	if err := forwarder.Init(params); err != nil {
+		log.Fatalln(err)
+	}
+	return forwarder
+}
+
+//---------------------------------------------------------------------------------------
+
+//CreateDNSInspector ...
+func CreateDNSInspector(params SDNSInspectorInitParams) common.IDNSInspector {
+	inspector := new(cDNSInspector)
+	inspector.Init(params)
+	return inspector
+}
@@ -0,0 +1,445 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"goconnect/common"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+//---------------------------------------------------------------------------------------
+
+const (
+	dnsForwarderMaxMessageSize = 4096
+	dnsForwarderNegativeTTL    = 60
+	dnsForwarderLocalTTL       = 30
+)
+
+//---------------------------------------------------------------------------------------
+
+//SDNSSplitDomain ...
+type SDNSSplitDomain struct {
+	Domain    string
+	Upstreams []string
+}
+
+//---------------------------------------------------------------------------------------
+
+//SDNSForwarderInitParams ...
+type SDNSForwarderInitParams struct {
+	BindAddresses []string
+	Upstreams     []string
+	SplitDNS      []SDNSSplitDomain
+	LocalDomain   string
+	CacheSize     uint32
+	MaxCacheTTL   uint32
+	Timeout       uint32
+	Util          common.IUtils
+	Commander     common.ICommander
+	AuthMan       common.IAuthenticationManger
+}
+
+//---------------------------------------------------------------------------------------
+
+type sDNSCacheItem struct {
+	response   []byte
+	createTime int64
+	expireTime int64
+}
+
+//---------------------------------------------------------------------------------------
+
+type sDNSForwarderStat struct {
+	Queries          uint64 `json:"queries"`
+	CacheHits        uint64 `json:"cache_hits"`
+	LocalAnswers     uint64 `json:"local_answers"`
+	UpstreamQueries  uint64 `json:"upstream_queries"`
+	UpstreamFailures uint64 `json:"upstream_failures"`
+	InvalidQueries   uint64 `json:"invalid_queries"`
+}
+
+//---------------------------------------------------------------------------------------
+
+//cDNSForwarder ...
+type cDNSForwarder struct {
+	params    SDNSForwarderInitParams
+	cache     map[string]*sDNSCacheItem
+	cacheLock sync.RWMutex
+	listeners []*net.UDPConn
+	stat      sDNSForwarderStat
+	ended     bool
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cDNSForwarder) getCacheKey(question layers.DNSQuestion) string {
+	return fmt.Sprintf("%s/%d/%d", normalizeName(string(question.Name)), question.Type, question.Class)
+}
+
+//---------------------------------------------------------------------------------------
+
+//getFromCache returns a copy of the cached response with the given transaction ID
+func (thisPt *cDNSForwarder) getFromCache(key string, id uint16) []byte {
+	thisPt.cacheLock.RLock()
+	item := thisPt.cache[key]
+	thisPt.cacheLock.RUnlock()
+
+	now := time.Now().Unix()
+	if item == nil || item.expireTime <= now {
+		return nil
+	}
+
+	response := make([]byte, len(item.response))
+	copy(response, item.response)
+	setMessageID(response, id)
+	if err := decreaseTTL(response, uint32(now-item.createTime)); err != nil {
+		return nil
+	}
+	return response
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cDNSForwarder) addToCache(key string, response *layers.DNS, raw []byte) {
+	if thisPt.params.CacheSize == 0 || response.TC {
+		return
+	}
+
+	//only cache successful and negative responses
+	ttl := uint32(0)
+	if response.ResponseCode == layers.DNSResponseCodeNoErr && len(response.Answers) > 0 {
+		minTTL, res := getMinTTL(raw)
+		if !res {
+			return
+		}
+		ttl = minTTL
+	} else if response.ResponseCode == layers.DNSResponseCodeNXDomain {
+		ttl = dnsForwarderNegativeTTL
+	} else {
+		return
+	}
+
+	if ttl > thisPt.params.MaxCacheTTL {
+		ttl = thisPt.params.MaxCacheTTL
+	}
+
+	if ttl == 0 {
+		return
+	}
+
+	item := new(sDNSCacheItem)
+	item.response = make([]byte, len(raw))
+	copy(item.response, raw)
+	item.createTime = time.Now().Unix()
+	item.expireTime = item.createTime + int64(ttl)
+
+	thisPt.cacheLock.Lock()
+	defer thisPt.cacheLock.Unlock()
+
+	//make room for the new item
+	if uint32(len(thisPt.cache)) >= thisPt.params.CacheSize {
+		thisPt.removeExpired(item.createTime)
+	}
+	if uint32(len(thisPt.cache)) >= thisPt.params.CacheSize {
+		for k := range thisPt.cache {
+			delete(thisPt.cache, k)
+			break
+		}
+	}
+	thisPt.cache[key] = item
+}
+
+//---------------------------------------------------------------------------------------
+
+//removeExpired should be called in the context of cacheLock
+func (thisPt *cDNSForwarder) removeExpired(now int64) {
+	for k, v := range thisPt.cache {
+		if v.expireTime <= now {
+			delete(thisPt.cache, k)
+		}
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//getUpstreams select upstream servers based on the split dns configuration. the longest match wins
+func (thisPt *cDNSForwarder) getUpstreams(name string) []string {
+	upstreams := thisPt.params.Upstreams
+	matchLen := 0
+	for _, split := range thisPt.params.SplitDNS {
+		domain := normalizeName(split.Domain)
+		if isSubDomain(name, domain) && len(domain) > matchLen {
+			upstreams = split.Upstreams
+			matchLen = len(domain)
+		}
+	}
+	return upstreams
+}
+
+//---------------------------------------------------------------------------------------
+
+//isLocalName checks whether the name belongs to the local domain
+func (thisPt *cDNSForwarder) isLocalName(name string) bool {
+	if len(thisPt.params.LocalDomain) == 0 {
+		return false
+	}
+	return isSubDomain(name, normalizeName(thisPt.params.LocalDomain))
+}
+
+//---------------------------------------------------------------------------------------
+
+//createLocalResponse answers <user>.<local domain> with the user's virtual IPs
+func (thisPt *cDNSForwarder) createLocalResponse(query *layers.DNS) ([]byte, error) {
+
+	question := query.Questions[0]
+	name := normalizeName(string(question.Name))
+	domain := normalizeName(thisPt.params.LocalDomain)
+
+	response := &layers.DNS{
+		ID:           query.ID,
+		QR:           true,
+		OpCode:       query.OpCode,
+		AA:           true,
+		RD:           query.RD,
+		RA:           true,
+		ResponseCode: layers.DNSResponseCodeNoErr,
+		Questions:    query.Questions,
+	}
+
+	userName := ""
+	if name != domain {
+		userName = name[:len(name)-len(domain)-1]
+	}
+
+	//fill answers
+	found := uint32(0)
+	if len(userName) > 0 {
+		found = thisPt.params.AuthMan.GetUserAccountingSessions(userName, func(object interface{}) {
+			session := object.(common.IAccountingSession)
+			vip := session.GetVIP()
+			if vip == nil {
+				return
+			}
+
+			record := layers.DNSResourceRecord{Name: question.Name, Class: layers.DNSClassIN, TTL: dnsForwarderLocalTTL}
+			if v4 := vip.To4(); v4 != nil && question.Type == layers.DNSTypeA {
+				record.Type = layers.DNSTypeA
+				record.IP = v4
+			} else if v4 == nil && question.Type == layers.DNSTypeAAAA {
+				record.Type = layers.DNSTypeAAAA
+				record.IP = vip
+			} else {
+				return
+			}
+			response.Answers = append(response.Answers, record)
+		})
+	}
+
+	if found == 0 && name != domain {
+		response.ResponseCode = layers.DNSResponseCodeNXDomain
+	}
+
+	atomic.AddUint64(&thisPt.stat.LocalAnswers, 1)
+	return encodeMessage(response)
+}
+
+//---------------------------------------------------------------------------------------
+
+//exchange sends the query to the upstream server and waits for the response
+func (thisPt *cDNSForwarder) exchange(query []byte, queryID uint16, upstream string) ([]byte, *layers.DNS, error) {
+	atomic.AddUint64(&thisPt.stat.UpstreamQueries, 1)
+
+	conn, err := net.Dial("udp", upstream)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	timeout := time.Duration(thisPt.params.Timeout) * time.Second
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, nil, err
+	}
+
+	buffer := make([]byte, dnsForwarderMaxMessageSize)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		response, err := decodeMessage(buffer[:n])
+		if err != nil || !response.QR || response.ID != queryID {
+			//ignore unrelated packets, until deadline
+			continue
+		}
+		return buffer[:n], response, nil
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//Resolve for IDNSForwarder
+func (thisPt *cDNSForwarder) Resolve(query []byte) ([]byte, error) {
+	atomic.AddUint64(&thisPt.stat.Queries, 1)
+
+	//parse query
+	dnsQuery, err := decodeMessage(query)
+	if err != nil || dnsQuery.QR || len(dnsQuery.Questions) != 1 {
+		atomic.AddUint64(&thisPt.stat.InvalidQueries, 1)
+		return nil, errors.New("invalid dns query")
+	}
+
+	question := dnsQuery.Questions[0]
+	name := normalizeName(string(question.Name))
+
+	//local records
+	if thisPt.isLocalName(name) {
+		return thisPt.createLocalResponse(dnsQuery)
+	}
+
+	//check cache
+	key := thisPt.getCacheKey(question)
+	if response := thisPt.getFromCache(key, dnsQuery.ID); response != nil {
+		atomic.AddUint64(&thisPt.stat.CacheHits, 1)
+		return response, nil
+	}
+
+	//forward to upstreams
+	for _, upstream := range thisPt.getUpstreams(name) {
+		raw, response, err := thisPt.exchange(query, dnsQuery.ID, upstream)
+		if err != nil {
+			atomic.AddUint64(&thisPt.stat.UpstreamFailures, 1)
+			log.Printf("dns query for %s to %s failed with error %v \n", name, upstream, err)
+			continue
+		}
+
+		thisPt.addToCache(key, response, raw)
+		return raw, nil
+	}
+
+	return nil, errors.New("can not resolve " + name)
+}
+
+//---------------------------------------------------------------------------------------
+
+//FlushCache for IDNSForwarder
+func (thisPt *cDNSForwarder) FlushCache() {
+	thisPt.cacheLock.Lock()
+	defer thisPt.cacheLock.Unlock()
+	thisPt.cache = make(map[string]*sDNSCacheItem)
+}
+
+//---------------------------------------------------------------------------------------
+
+//End for IDNSForwarder
+func (thisPt *cDNSForwarder) End() {
+	thisPt.ended = true
+	for _, listener := range thisPt.listeners {
+		listener.Close()
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cDNSForwarder) handleQuery(conn *net.UDPConn, addr *net.UDPAddr, query []byte) {
+	response, err := thisPt.Resolve(query)
+	if err != nil {
+		return
+	}
+
+	if _, err := conn.WriteToUDP(response, addr); err != nil {
+		log.Printf("can not send dns response with error %v \n", err)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cDNSForwarder) serve(conn *net.UDPConn) {
+	buffer := make([]byte, dnsForwarderMaxMessageSize)
+	for {
+		n, addr, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			if thisPt.ended {
+				return
+			}
+			log.Printf("can not read dns query with error %v \n", err)
+			time.Sleep(1 * time.Second)
+			continue
+		}
+
+		query := make([]byte, n)
+		copy(query, buffer[:n])
+		go thisPt.handleQuery(conn, addr, query)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cDNSForwarder) OnStatusCommand(req *http.Request, params interface{}) (common.IHTTPResponse, error) {
+	type sDNSStatus struct {
+		CacheItems uint32            `json:"cache_items"`
+		Upstreams  []string          `json:"upstreams"`
+		Stat       sDNSForwarderStat `json:"stat"`
+	}
+
+	status := sDNSStatus{}
+	thisPt.cacheLock.RLock()
+	status.CacheItems = uint32(len(thisPt.cache))
+	thisPt.cacheLock.RUnlock()
+	status.Upstreams = thisPt.params.Upstreams
+	status.Stat.Queries = atomic.LoadUint64(&thisPt.stat.Queries)
+	status.Stat.CacheHits = atomic.LoadUint64(&thisPt.stat.CacheHits)
+	status.Stat.LocalAnswers = atomic.LoadUint64(&thisPt.stat.LocalAnswers)
+	status.Stat.UpstreamQueries = atomic.LoadUint64(&thisPt.stat.UpstreamQueries)
+	status.Stat.UpstreamFailures = atomic.LoadUint64(&thisPt.stat.UpstreamFailures)
+	status.Stat.InvalidQueries = atomic.LoadUint64(&thisPt.stat.InvalidQueries)
+	return thisPt.params.Util.CreateHttpResponseFromObject(status)
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cDNSForwarder) OnFlushCommand(req *http.Request, params interface{}) (common.IHTTPResponse, error) {
+	thisPt.FlushCache()
+	return thisPt.params.Util.CreateHttpResponseFromString("OK")
+}
+
+//---------------------------------------------------------------------------------------
+
+//Init
+func (thisPt *cDNSForwarder) Init(params SDNSForwarderInitParams) error {
+	thisPt.params = params
+	thisPt.cache = make(map[string]*sDNSCacheItem)
+
+	//open listeners
+	for _, address := range params.BindAddresses {
+		udpAddr, err := net.ResolveUDPAddr("udp", address)
+		if err != nil {
+			return err
+		}
+
+		conn, err := net.ListenUDP("udp", udpAddr)
+		if err != nil {
+			return err
+		}
+		thisPt.listeners = append(thisPt.listeners, conn)
+		go thisPt.serve(conn)
+	}
+
+	//register api
+	if thisPt.params.Commander != nil {
+		selector := thisPt.params.Commander.CreateSelector()
+		selector.Register("dns_status", thisPt.OnStatusCommand, nil)
+		selector.Register("dns_cache_flush", thisPt.OnFlushCommand, nil)
+	}
+
+	return nil
+}
@@ -0,0 +1,155 @@
+package dns
+
+import (
+	"goconnect/common"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+//---------------------------------------------------------------------------------------
+
+type sTestAccountingSession struct {
+	common.IAccountingSession
+	vip net.IP
+}
+
+func (thisPt *sTestAccountingSession) GetVIP() net.IP {
+	return thisPt.vip
+}
+
+//---------------------------------------------------------------------------------------
+
+type sTestAuthManager struct {
+	common.IAuthenticationManger
+}
+
+func (thisPt *sTestAuthManager) GetUserAccountingSessions(user string, accessFunc common.TAccessFunction) uint32 {
+	if user != "user1" {
+		return 0
+	}
+	accessFunc(&sTestAccountingSession{vip: net.ParseIP("172.16.0.10")})
+	return 1
+}
+
+//---------------------------------------------------------------------------------------
+
+//startTestUpstream runs a fake dns server that answers all the A queries with the given IP
+func startTestUpstream(t *testing.T, ip string, counter *uint32) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("can not create upstream with error %v \n", err)
+	}
+
+	go func() {
+		buffer := make([]byte, 4096)
+		for {
+			n, addr, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			atomic.AddUint32(counter, 1)
+
+			query, _ := decodeMessage(buffer[:n])
+			query.QR = true
+			query.Answers = []layers.DNSResourceRecord{{
+				Name:  query.Questions[0].Name,
+				Type:  layers.DNSTypeA,
+				Class: layers.DNSClassIN,
+				TTL:   300,
+				IP:    net.ParseIP(ip).To4(),
+			}}
+			response, _ := encodeMessage(query)
+			conn.WriteToUDP(response, addr)
+		}
+	}()
+
+	return conn
+}
+
+//---------------------------------------------------------------------------------------
+
+func createTestQuery(id uint16, name string, qType layers.DNSType) []byte {
+	query := &layers.DNS{ID: id, RD: true, Questions: []layers.DNSQuestion{{Name: []byte(name), Type: qType, Class: layers.DNSClassIN}}}
+	raw, _ := encodeMessage(query)
+	return raw
+}
+
+//---------------------------------------------------------------------------------------
+
+func TestDNSForwarder(t *testing.T) {
+
+	publicCounter := uint32(0)
+	privateCounter := uint32(0)
+
+	publicUpstream := startTestUpstream(t, "1.1.1.1", &publicCounter)
+	defer publicUpstream.Close()
+	privateUpstream := startTestUpstream(t, "10.0.0.1", &privateCounter)
+	defer privateUpstream.Close()
+
+	params := SDNSForwarderInitParams{}
+	params.Upstreams = []string{publicUpstream.LocalAddr().String()}
+	params.SplitDNS = []SDNSSplitDomain{{Domain: "corp.local", Upstreams: []string{privateUpstream.LocalAddr().String()}}}
+	params.LocalDomain = "vpn.internal"
+	params.CacheSize = 16
+	params.MaxCacheTTL = 60
+	params.Timeout = 2
+	params.AuthMan = &sTestAuthManager{}
+
+	forwarder := cDNSForwarder{}
+	if err := forwarder.Init(params); err != nil {
+		t.Fatalf("can not create forwarder with error %v \n", err)
+	}
+	defer forwarder.End()
+
+	checkAnswer := func(raw []byte, id uint16, ip string) {
+		response, err := decodeMessage(raw)
+		if err != nil || response.ID != id || len(response.Answers) != 1 || !response.Answers[0].IP.Equal(net.ParseIP(ip)) {
+			t.Fatalf("invalid response %v for %s \n", response, ip)
+		}
+	}
+
+	//public query
+	raw, err := forwarder.Resolve(createTestQuery(1, "www.example.com", layers.DNSTypeA))
+	if err != nil {
+		t.Fatalf("can not resolve with error %v \n", err)
+	}
+	checkAnswer(raw, 1, "1.1.1.1")
+
+	//cached query with a different ID
+	raw, _ = forwarder.Resolve(createTestQuery(2, "WWW.example.com", layers.DNSTypeA))
+	checkAnswer(raw, 2, "1.1.1.1")
+	if atomic.LoadUint32(&publicCounter) != 1 {
+		t.Fatalf("cache failed \n")
+	}
+
+	//split dns
+	raw, _ = forwarder.Resolve(createTestQuery(3, "git.corp.local", layers.DNSTypeA))
+	checkAnswer(raw, 3, "10.0.0.1")
+	if atomic.LoadUint32(&privateCounter) != 1 {
+		t.Fatalf("split dns failed \n")
+	}
+
+	//local records
+	raw, _ = forwarder.Resolve(createTestQuery(4, "user1.vpn.internal", layers.DNSTypeA))
+	checkAnswer(raw, 4, "172.16.0.10")
+
+	raw, _ = forwarder.Resolve(createTestQuery(5, "user2.vpn.internal", layers.DNSTypeA))
+	if response, _ := decodeMessage(raw); response == nil || response.ResponseCode != layers.DNSResponseCodeNXDomain {
+		t.Fatalf("invalid response for unknown user \n")
+	}
+
+	//flush
+	forwarder.FlushCache()
+	forwarder.Resolve(createTestQuery(6, "www.example.com", layers.DNSTypeA))
+	if atomic.LoadUint32(&publicCounter) != 2 {
+		t.Fatalf("flush cache failed \n")
+	}
+
+	//invalid query
+	if _, err := forwarder.Resolve([]byte{1, 2, 3}); err == nil {
+		t.Fatalf("invalid query accepted \n")
+	}
+}
@@ -0,0 +1,363 @@
+package dns
+
+import (
+	"goconnect/common"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+//---------------------------------------------------------------------------------------
+
+const (
+	dnsInspectorPort         = 53
+	dnsInspectorMinTTL       = 60
+	dnsInspectorQueryTimeout = 10 //second
+	dnsInspectorMaxQueries   = 16384
+)
+
+//---------------------------------------------------------------------------------------
+
+//SDNSInspectorInitParams ...
+type SDNSInspectorInitParams struct {
+	CacheSize  uint32
+	MaxTTL     uint32
+	LogQueries bool
+	Util       common.IUtils
+	Commander  common.ICommander
+	AuthMan    common.IAuthenticationManger
+	NicManager common.INICManager
+}
+
+//---------------------------------------------------------------------------------------
+
+type sDNSInspectorLookupParams struct {
+	IP string `help:"IP address" schema:"ip" validate:"ip"`
+}
+
+//---------------------------------------------------------------------------------------
+
+type sDNSDomainItem struct {
+	domains    []string
+	expireTime int64
+}
+
+//---------------------------------------------------------------------------------------
+
+//sDNSQueryKey the answers are matched to the queries by the client address, the server and the transaction ID
+type sDNSQueryKey struct {
+	client     string
+	clientPort uint16
+	server     string
+	id         uint16
+}
+
+//---------------------------------------------------------------------------------------
+
+type sDNSPendingQuery struct {
+	name       string
+	qType      layers.DNSType
+	expireTime int64
+}
+
+//---------------------------------------------------------------------------------------
+
+type sDNSInspectorStat struct {
+	Queries          uint64 `json:"queries"`
+	Answers          uint64 `json:"answers"`
+	LearnedIPs       uint64 `json:"learned_ips"`
+	InvalidPackets   uint64 `json:"invalid_packets"`
+	UnmatchedAnswers uint64 `json:"unmatched_answers"`
+}
+
+//---------------------------------------------------------------------------------------
+
+//cDNSInspector ...
+type cDNSInspector struct {
+	params      SDNSInspectorInitParams
+	cache       map[string]*sDNSDomainItem
+	cacheLock   sync.RWMutex
+	queries     map[sDNSQueryKey]sDNSPendingQuery
+	queriesLock sync.Mutex
+	stat        sDNSInspectorStat
+}
+
+//---------------------------------------------------------------------------------------
+
+//getUserName returns the owner of the virtual IP
+func (thisPt *cDNSInspector) getUserName(vip net.IP) string {
+	user := "unknown"
+	if thisPt.params.AuthMan == nil {
+		return user
+	}
+
+	thisPt.params.AuthMan.GetAccountingSessionByVIP(vip, func(object interface{}) {
+		user = object.(common.IAccountingSession).GetUserName()
+	})
+	return user
+}
+
+//---------------------------------------------------------------------------------------
+
+//learn adds ip->domain mapping to the cache
+func (thisPt *cDNSInspector) learn(ip net.IP, domains []string, ttl uint32) {
+	if thisPt.params.CacheSize == 0 {
+		return
+	}
+
+	if ttl < dnsInspectorMinTTL {
+		ttl = dnsInspectorMinTTL
+	}
+
+	if ttl > thisPt.params.MaxTTL {
+		ttl = thisPt.params.MaxTTL
+	}
+
+	now := time.Now().Unix()
+	key := ip.String()
+
+	thisPt.cacheLock.Lock()
+	defer thisPt.cacheLock.Unlock()
+
+	item := thisPt.cache[key]
+	if item == nil {
+		//make room for the new item
+		if uint32(len(thisPt.cache)) >= thisPt.params.CacheSize {
+			for k, v := range thisPt.cache {
+				if v.expireTime <= now {
+					delete(thisPt.cache, k)
+				}
+			}
+		}
+		if uint32(len(thisPt.cache)) >= thisPt.params.CacheSize {
+			for k := range thisPt.cache {
+				delete(thisPt.cache, k)
+				break
+			}
+		}
+
+		item = new(sDNSDomainItem)
+		thisPt.cache[key] = item
+		atomic.AddUint64(&thisPt.stat.LearnedIPs, 1)
+	} else if item.expireTime <= now {
+		item.domains = nil
+	}
+
+	//merge domains
+	for _, domain := range domains {
+		found := false
+		for _, current := range item.domains {
+			if current == domain {
+				found = true
+				break
+			}
+		}
+		if !found {
+			item.domains = append(item.domains, domain)
+		}
+	}
+
+	if expire := now + int64(ttl); expire > item.expireTime {
+		item.expireTime = expire
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//addQuery keeps the query until its answer or the timeout
+func (thisPt *cDNSInspector) addQuery(process common.IProcessInfo, msg *layers.DNS) {
+	if thisPt.params.CacheSize == 0 || len(msg.Questions) == 0 {
+		return
+	}
+
+	key := sDNSQueryKey{process.GetSourceIP().String(), process.GetSourcePort(), process.GetDestinationIP().String(), msg.ID}
+	query := sDNSPendingQuery{normalizeName(string(msg.Questions[0].Name)), msg.Questions[0].Type, time.Now().Unix() + dnsInspectorQueryTimeout}
+
+	thisPt.queriesLock.Lock()
+	defer thisPt.queriesLock.Unlock()
+
+	//make room for the new query
+	if len(thisPt.queries) >= dnsInspectorMaxQueries {
+		for k, v := range thisPt.queries {
+			if v.expireTime <= time.Now().Unix() {
+				delete(thisPt.queries, k)
+			}
+		}
+	}
+	if len(thisPt.queries) >= dnsInspectorMaxQueries {
+		for k := range thisPt.queries {
+			delete(thisPt.queries, k)
+			break
+		}
+	}
+	thisPt.queries[key] = query
+}
+
+//---------------------------------------------------------------------------------------
+
+//matchQuery removes the query of the answer, the answer should go to the client with the same question
+func (thisPt *cDNSInspector) matchQuery(process common.IProcessInfo, msg *layers.DNS) bool {
+	if len(msg.Questions) == 0 {
+		return false
+	}
+
+	key := sDNSQueryKey{process.GetDestinationIP().String(), process.GetDestinationPort(), process.GetSourceIP().String(), msg.ID}
+
+	thisPt.queriesLock.Lock()
+	defer thisPt.queriesLock.Unlock()
+
+	query, ok := thisPt.queries[key]
+	if !ok || query.expireTime <= time.Now().Unix() || query.name != normalizeName(string(msg.Questions[0].Name)) || query.qType != msg.Questions[0].Type {
+		return false
+	}
+	delete(thisPt.queries, key)
+	return true
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cDNSInspector) inspectQuery(process common.IProcessInfo, msg *layers.DNS) {
+	atomic.AddUint64(&thisPt.stat.Queries, 1)
+	thisPt.addQuery(process, msg)
+	if !thisPt.params.LogQueries {
+		return
+	}
+
+	vip := process.GetSourceIP()
+	for _, question := range msg.Questions {
+		log.Printf("dns query from %s (%s) for %s %s \n", thisPt.getUserName(vip), vip.String(), normalizeName(string(question.Name)), question.Type.String())
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//inspectAnswer the answers are learned only on the way to the clients which sent the query, the answers from the
+//client NICs are ignored
+func (thisPt *cDNSInspector) inspectAnswer(process common.IProcessInfo, msg *layers.DNS) {
+	atomic.AddUint64(&thisPt.stat.Answers, 1)
+	if thisPt.params.NicManager != nil && thisPt.params.NicManager.GetNICType(process.GetInNIC()) == common.INICTypeClient {
+		atomic.AddUint64(&thisPt.stat.UnmatchedAnswers, 1)
+		return
+	}
+	if !thisPt.matchQuery(process, msg) {
+		atomic.AddUint64(&thisPt.stat.UnmatchedAnswers, 1)
+		return
+	}
+
+	question := normalizeName(string(msg.Questions[0].Name))
+	for _, answer := range msg.Answers {
+		if answer.Type != layers.DNSTypeA && answer.Type != layers.DNSTypeAAAA {
+			continue
+		}
+
+		//map the IP to both the queried name and the record owner (CNAME chains)
+		domains := []string{question}
+		if name := normalizeName(string(answer.Name)); name != question {
+			domains = append(domains, name)
+		}
+		thisPt.learn(answer.IP, domains, answer.TTL)
+
+		if thisPt.params.LogQueries {
+			vip := process.GetDestinationIP()
+			log.Printf("dns answer to %s (%s) for %s is %s \n", thisPt.getUserName(vip), vip.String(), question, answer.IP.String())
+		}
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//Inspect for IDNSInspector
+func (thisPt *cDNSInspector) Inspect(process common.IProcessInfo) {
+	if process.GetL4Protocol() != common.L4PROTOCOLUDP {
+		return
+	}
+
+	isQuery := process.GetDestinationPort() == dnsInspectorPort
+	isAnswer := process.GetSourcePort() == dnsInspectorPort
+	if !isQuery && !isAnswer {
+		return
+	}
+
+	payload := process.GetApplicationPayload()
+	if len(payload) == 0 {
+		return
+	}
+
+	msg, err := decodeMessage(payload)
+	if err != nil {
+		atomic.AddUint64(&thisPt.stat.InvalidPackets, 1)
+		return
+	}
+
+	if msg.QR {
+		thisPt.inspectAnswer(process, msg)
+	} else {
+		thisPt.inspectQuery(process, msg)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//GetDomains for IDNSInspector, returns a copy of the cached domains
+func (thisPt *cDNSInspector) GetDomains(ip net.IP) []string {
+	thisPt.cacheLock.RLock()
+	defer thisPt.cacheLock.RUnlock()
+
+	item := thisPt.cache[ip.String()]
+	if item == nil || item.expireTime <= time.Now().Unix() {
+		return nil
+	}
+	return append([]string{}, item.domains...)
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cDNSInspector) OnStatusCommand(req *http.Request, params interface{}) (common.IHTTPResponse, error) {
+	type sDNSInspectorStatus struct {
+		CacheItems uint32            `json:"cache_items"`
+		Stat       sDNSInspectorStat `json:"stat"`
+	}
+
+	status := sDNSInspectorStatus{}
+	thisPt.cacheLock.RLock()
+	status.CacheItems = uint32(len(thisPt.cache))
+	thisPt.cacheLock.RUnlock()
+	status.Stat.Queries = atomic.LoadUint64(&thisPt.stat.Queries)
+	status.Stat.Answers = atomic.LoadUint64(&thisPt.stat.Answers)
+	status.Stat.LearnedIPs = atomic.LoadUint64(&thisPt.stat.LearnedIPs)
+	status.Stat.InvalidPackets = atomic.LoadUint64(&thisPt.stat.InvalidPackets)
+	status.Stat.UnmatchedAnswers = atomic.LoadUint64(&thisPt.stat.UnmatchedAnswers)
+	return thisPt.params.Util.CreateHttpResponseFromObject(status)
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cDNSInspector) OnLookupCommand(req *http.Request, params interface{}) (common.IHTTPResponse, error) {
+	lookupParams := params.(*sDNSInspectorLookupParams)
+	domains := thisPt.GetDomains(net.ParseIP(lookupParams.IP))
+	if domains == nil {
+		domains = []string{}
+	}
+	return thisPt.params.Util.CreateHttpResponseFromObject(domains)
+}
+
+//---------------------------------------------------------------------------------------
+
+//Init
+func (thisPt *cDNSInspector) Init(params SDNSInspectorInitParams) {
+	thisPt.params = params
+	thisPt.cache = make(map[string]*sDNSDomainItem)
+	thisPt.queries = make(map[sDNSQueryKey]sDNSPendingQuery)
+
+	//register api
+	if thisPt.params.Commander != nil {
+		selector := thisPt.params.Commander.CreateSelector()
+		selector.Register("dns_inspector_status", thisPt.OnStatusCommand, nil)
+		selector.Register("dns_ip_lookup", thisPt.OnLookupCommand, sDNSInspectorLookupParams{})
+	}
+}
@@ -0,0 +1,83 @@
+package dns
+
+import (
+	"goconnect/common"
+	"goconnect/vnet"
+	"net"
+	"testing"
+)
+
+//---------------------------------------------------------------------------------------
+
+type sTestDNSNICManager struct {
+	common.INICManager
+	types map[uint64]uint32
+}
+
+func (thisPt *sTestDNSNICManager) GetNICType(id uint64) uint32 {
+	return thisPt.types[id]
+}
+
+//---------------------------------------------------------------------------------------
+
+func TestDNSInspector(t *testing.T) {
+
+	params := SDNSInspectorInitParams{}
+	params.CacheSize = 16
+	params.MaxTTL = 3600
+	params.LogQueries = true
+	params.NicManager = &sTestDNSNICManager{types: map[uint64]uint32{1: common.INICTypeTUN, 2: common.INICTypeClient}}
+
+	inspector := cDNSInspector{}
+	inspector.Init(params)
+
+	packetFactory := vnet.CreateProcessFactory()
+
+	answer := func(nic uint64) common.IProcessInfo {
+		packet := packetFactory.CreateProcessInfoByName("dns_resv4")
+		packet.SetInNIC(nic)
+		return packet
+	}
+
+	//the answers without a query are not learned
+	inspector.Inspect(answer(1))
+	if len(inspector.cache) != 0 {
+		t.Fatalf("answer without query is learned \n")
+	}
+
+	//queries do not change the cache
+	inspector.Inspect(packetFactory.CreateProcessInfoByName("dns_reqv4"))
+	if inspector.stat.Queries != 1 || len(inspector.cache) != 0 {
+		t.Fatalf("invalid query inspection %v \n", inspector.stat)
+	}
+
+	//a client can not forge the answers of its own query
+	inspector.Inspect(answer(2))
+	if len(inspector.cache) != 0 {
+		t.Fatalf("answer of client is learned \n")
+	}
+
+	//learn google.com address from the answer
+	inspector.Inspect(answer(1))
+	domains := inspector.GetDomains(net.ParseIP("172.217.169.238"))
+	if len(domains) != 1 || domains[0] != "google.com" {
+		t.Fatalf("invalid domains %v \n", domains)
+	}
+	domains[0] = "changed"
+	if domains := inspector.GetDomains(net.ParseIP("172.217.169.238")); domains[0] != "google.com" {
+		t.Fatalf("cached domains are changed by the caller %v \n", domains)
+	}
+
+	if inspector.GetDomains(net.ParseIP("8.8.8.8")) != nil {
+		t.Fatalf("invalid lookup \n")
+	}
+
+	//the query is answered once
+	inspector.Inspect(answer(1))
+
+	//non DNS packets should be ignored
+	inspector.Inspect(packetFactory.CreateProcessInfoByName("icmp_echo_reqv4"))
+	if inspector.stat.Queries != 1 || inspector.stat.Answers != 4 || inspector.stat.UnmatchedAnswers != 3 || len(inspector.queries) != 0 {
+		t.Fatalf("invalid stat %v \n", inspector.stat)
+	}
+}
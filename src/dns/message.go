@@ -0,0 +1,163 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+//---------------------------------------------------------------------------------------
+
+const (
+	dnsHeaderLen     = 12
+	dnsMaxNameLabels = 128
+)
+
+//---------------------------------------------------------------------------------------
+
+//skipName returns the offset right after a (possibly compressed) domain name
+func skipName(msg []byte, offset int) (int, error) {
+	for i := 0; i < dnsMaxNameLabels; i++ {
+		if offset >= len(msg) {
+			return 0, errors.New("invalid dns name")
+		}
+
+		labelLen := int(msg[offset])
+		if labelLen == 0 {
+			return offset + 1, nil
+		}
+
+		//compression pointer, name ends here
+		if labelLen&0xc0 == 0xc0 {
+			return offset + 2, nil
+		}
+
+		offset += labelLen + 1
+	}
+	return 0, errors.New("invalid dns name")
+}
+
+//---------------------------------------------------------------------------------------
+
+//iterateRecords calls callback with the offset of the TTL field of each resource record
+func iterateRecords(msg []byte, callback func(rType uint16, ttlOffset int)) error {
+	if len(msg) < dnsHeaderLen {
+		return errors.New("invalid dns message")
+	}
+
+	qdCount := int(binary.BigEndian.Uint16(msg[4:]))
+	rrCount := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+
+	var err error
+	offset := dnsHeaderLen
+
+	//skip questions
+	for i := 0; i < qdCount; i++ {
+		if offset, err = skipName(msg, offset); err != nil {
+			return err
+		}
+		offset += 4
+	}
+
+	//resource records
+	for i := 0; i < rrCount; i++ {
+		if offset, err = skipName(msg, offset); err != nil {
+			return err
+		}
+
+		if offset+10 > len(msg) {
+			return errors.New("invalid dns record")
+		}
+
+		rType := binary.BigEndian.Uint16(msg[offset:])
+		callback(rType, offset+4)
+		offset += 10 + int(binary.BigEndian.Uint16(msg[offset+8:]))
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//getMinTTL returns the minimum TTL of a response, OPT records are ignored
+func getMinTTL(msg []byte) (uint32, bool) {
+	minTTL := uint32(0)
+	found := false
+	err := iterateRecords(msg, func(rType uint16, ttlOffset int) {
+		if rType == uint16(layers.DNSTypeOPT) {
+			return
+		}
+		ttl := binary.BigEndian.Uint32(msg[ttlOffset:])
+		if !found || ttl < minTTL {
+			minTTL = ttl
+			found = true
+		}
+	})
+	return minTTL, (err == nil && found)
+}
+
+//---------------------------------------------------------------------------------------
+
+//decreaseTTL decreases the TTL of all the records. It is used for the cached responses
+func decreaseTTL(msg []byte, elapsed uint32) error {
+	return iterateRecords(msg, func(rType uint16, ttlOffset int) {
+		if rType == uint16(layers.DNSTypeOPT) {
+			return
+		}
+		ttl := binary.BigEndian.Uint32(msg[ttlOffset:])
+		if ttl > elapsed {
+			ttl -= elapsed
+		} else {
+			ttl = 0
+		}
+		binary.BigEndian.PutUint32(msg[ttlOffset:], ttl)
+	})
+}
+
+//---------------------------------------------------------------------------------------
+
+//setMessageID changes the transaction ID of a raw message
+func setMessageID(msg []byte, id uint16) {
+	binary.BigEndian.PutUint16(msg, id)
+}
+
+//---------------------------------------------------------------------------------------
+
+//decodeMessage decode a raw dns message
+func decodeMessage(msg []byte) (*layers.DNS, error) {
+	dnsMsg := &layers.DNS{}
+	if err := dnsMsg.DecodeFromBytes(msg, gopacket.NilDecodeFeedback); err != nil {
+		return nil, err
+	}
+	return dnsMsg, nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//encodeMessage serialize a dns message
+func encodeMessage(dnsMsg *layers.DNS) ([]byte, error) {
+	buffer := gopacket.NewSerializeBuffer()
+	if err := dnsMsg.SerializeTo(buffer, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//normalizeName converts a domain name to lower case without the trailing dot
+func normalizeName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+//---------------------------------------------------------------------------------------
+
+//isSubDomain checks whether the name is equal to domain or is one of its sub domains
+func isSubDomain(name string, domain string) bool {
+	if name == domain {
+		return true
+	}
+	return strings.HasSuffix(name, "."+domain)
+}
@@ -1,13 +1,157 @@
 package policy
 
+import (
+	"goconnect/common"
+	"sync/atomic"
+)
+
+//---------------------------------------------------------------------------------------
+const (
+	PolicyActionAllow = "allow"
+	PolicyActionBlock = "block"
+)
+
 //---------------------------------------------------------------------------------------
 type cPolicy struct {
-	Source     string `json:"source" validate:"omitempty,min=3,max=64,alphanum"`
-	Destinaton string `json:"destination" validate:"omitempty,min=3,max=64,alphanum"`
+	Name       string `json:"name" validate:"name"`
+	Order      uint32 `json:"order"`
+	Source     string `json:"source" validate:"omitempty,name"`
+	Destinaton string `json:"destination" validate:"omitempty,name"`
+	Action     string `json:"action" validate:"eq=allow|eq=block"`
+	User       string `json:"user" validate:"omitempty,max=64"`
+	Group      string `json:"group" validate:"omitempty,max=64"`
+	Hits       uint64 `json:"hits"`
 	//Location       string `json:"location" validate:"omitempty,min=3,max=64,alphanum"`
 	//SourceCNT      string `json:"source_country" validate:"omitempty,min=3,max=64,alphanum"`
 	//DestinationCNT string `json:"destination_country" validate:"omitempty,min=3,max=64,alphanum"`
 	//Schedule       string `json:"schedule" validate:"omitempty,min=3,max=64,alphanum"`
-	//User           string `json:"user" validate:"omitempty,min=3,max=64,alphanum"`
-	//Group          string `json:"group" validate:"omitempty,min=3,max=64,alphanum"`
+	objectMan *cPolicyObjectManager
+	authMan   common.IAuthenticationManger
+}
+
+//---------------------------------------------------------------------------------------
+
+//sPolicySubject is the user of the source virtual IP, resolved once per evaluation
+type sPolicySubject struct {
+	authMan  common.IAuthenticationManger
+	process  common.IProcessInfo
+	resolved bool
+	user     string
+	groups   []string
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *sPolicySubject) resolve() {
+	if thisPt.resolved {
+		return
+	}
+	thisPt.resolved = true
+	if thisPt.authMan == nil {
+		return
+	}
+
+	authType := ""
+	thisPt.authMan.GetAccountingSessionByVIP(thisPt.process.GetSourceIP(), func(object interface{}) {
+		session := object.(common.IAccountingSession)
+		thisPt.user = session.GetUserName()
+		authType = session.GetAuthenticationType()
+	})
+	if len(thisPt.user) == 0 {
+		return
+	}
+
+	info := thisPt.authMan.GetUserInfo(thisPt.user, thisPt.authMan.GetAuthenticator(authType))
+	thisPt.groups = info.Groups
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *sPolicySubject) matchUser(user string) bool {
+	thisPt.resolve()
+	return len(thisPt.user) > 0 && thisPt.user == user
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *sPolicySubject) matchGroup(group string) bool {
+	thisPt.resolve()
+	for _, item := range thisPt.groups {
+		if item == group {
+			return true
+		}
+	}
+	return false
+}
+
+//---------------------------------------------------------------------------------------
+
+//GetName for IPolicy
+func (thisPt *cPolicy) GetName() string {
+	return thisPt.Name
+}
+
+//---------------------------------------------------------------------------------------
+
+//GetOrder for IPolicy
+func (thisPt *cPolicy) GetOrder() uint32 {
+	return thisPt.Order
+}
+
+//---------------------------------------------------------------------------------------
+
+//Check returns the policy action without updating the hits
+func (thisPt *cPolicy) Check(process common.IProcessInfo, subject *sPolicySubject) uint32 {
+
+	if len(thisPt.Source) > 0 && !thisPt.objectMan.Match(thisPt.Source, process, ObjectMatchSideSource) {
+		return common.POLICYACTIONNOMATCH
+	}
+
+	if len(thisPt.Destinaton) > 0 && !thisPt.objectMan.Match(thisPt.Destinaton, process, ObjectMatchSideDestination) {
+		return common.POLICYACTIONNOMATCH
+	}
+
+	if len(thisPt.User) > 0 && !subject.matchUser(thisPt.User) {
+		return common.POLICYACTIONNOMATCH
+	}
+
+	if len(thisPt.Group) > 0 && !subject.matchGroup(thisPt.Group) {
+		return common.POLICYACTIONNOMATCH
+	}
+
+	if thisPt.Action == PolicyActionBlock {
+		return common.POLICYACTIONBLOCK
+	}
+	return common.POLICYACTIONALLOW
+}
+
+//---------------------------------------------------------------------------------------
+
+//Match for IPolicy
+func (thisPt *cPolicy) Match(process common.IProcessInfo) uint32 {
+	return thisPt.match(process, thisPt.createSubject(process))
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cPolicy) match(process common.IProcessInfo, subject *sPolicySubject) uint32 {
+	action := thisPt.Check(process, subject)
+	if action != common.POLICYACTIONNOMATCH {
+		atomic.AddUint64(&thisPt.Hits, 1)
+	}
+	return action
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cPolicy) createSubject(process common.IProcessInfo) *sPolicySubject {
+	return &sPolicySubject{authMan: thisPt.authMan, process: process}
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cPolicy) Init(objectMan *cPolicyObjectManager, authMan common.IAuthenticationManger, util common.IUtils) error {
+	thisPt.objectMan = objectMan
+	thisPt.authMan = authMan
+	return util.ValidateStruct(*thisPt)
 }
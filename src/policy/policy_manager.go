@@ -1,10 +1,149 @@
 package policy
 
-import "sync"
+import (
+	"errors"
+	"goconnect/common"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+//---------------------------------------------------------------------------------------
+
+//SPolicyManagerInitParams ...
+type SPolicyManagerInitParams struct {
+	Util         common.IUtils
+	Config       common.IDynamicConfigManager
+	Commander    common.ICommander
+	DNSInspector common.IDNSInspector
+	AuthMan      common.IAuthenticationManger
+}
 
 //---------------------------------------------------------------------------------------
 
 type cPolicyManager struct {
-	objects map[string]cPolicy
-	lock    sync.RWMutex
+	policies  []*cPolicy
+	lock      sync.RWMutex
+	objectMan cPolicyObjectManager
+	params    SPolicyManagerInitParams
+}
+
+//---------------------------------------------------------------------------------------
+
+//OnCommand for IDynamicConfigActor
+func (thisPt *cPolicyManager) OnCommand(section string, params interface{}) error {
+	policyList := params.([]interface{})
+	tempList := []*cPolicy{}
+	names := make(map[string]bool)
+
+	for _, policyInfo := range policyList {
+		policy := &cPolicy{}
+		if err := thisPt.params.Util.CastJsonObject(policyInfo, policy); err != nil {
+			return err
+		}
+
+		if err := policy.Init(&thisPt.objectMan, thisPt.params.AuthMan, thisPt.params.Util); err != nil {
+			return err
+		}
+
+		//check for duplicate policy name
+		if names[policy.GetName()] {
+			return errors.New("duplicate policy name " + policy.GetName())
+		}
+		names[policy.GetName()] = true
+		policy.Hits = 0
+
+		tempList = append(tempList, policy)
+	}
+
+	//lower orders are evaluated first
+	sort.SliceStable(tempList, func(i, j int) bool {
+		return tempList[i].GetOrder() < tempList[j].GetOrder()
+	})
+
+	//Everything seems good, swap the list
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+
+	thisPt.policies = tempList
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//Evaluate for IPolicyManager. the first matched policy wins
+func (thisPt *cPolicyManager) Evaluate(process common.IProcessInfo) uint32 {
+	thisPt.lock.RLock()
+	defer thisPt.lock.RUnlock()
+
+	subject := &sPolicySubject{authMan: thisPt.params.AuthMan, process: process}
+	for _, policy := range thisPt.policies {
+		if action := policy.match(process, subject); action != common.POLICYACTIONNOMATCH {
+			return action
+		}
+	}
+	return common.POLICYACTIONNOMATCH
+}
+
+//---------------------------------------------------------------------------------------
+
+//Trace for IPolicyManager. returns the matched policy, without updating the hits
+func (thisPt *cPolicyManager) Trace(process common.IProcessInfo) (string, uint32) {
+	thisPt.lock.RLock()
+	defer thisPt.lock.RUnlock()
+
+	subject := &sPolicySubject{authMan: thisPt.params.AuthMan, process: process}
+	for _, policy := range thisPt.policies {
+		if action := policy.Check(process, subject); action != common.POLICYACTIONNOMATCH {
+			return policy.GetName(), action
+		}
+	}
+	return "", common.POLICYACTIONNOMATCH
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cPolicyManager) OnListCommand(req *http.Request, params interface{}) (common.IHTTPResponse, error) {
+	thisPt.lock.RLock()
+	defer thisPt.lock.RUnlock()
+
+	list := []cPolicy{}
+	for _, policy := range thisPt.policies {
+		item := *policy
+		item.Hits = atomic.LoadUint64(&policy.Hits)
+		list = append(list, item)
+	}
+	return thisPt.params.Util.CreateHttpResponseFromObject(list)
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cPolicyManager) Init(params SPolicyManagerInitParams) {
+	thisPt.params = params
+
+	//objects
+	objectParams := sPolicyObjectManagerParams{}
+	objectParams.config = params.Config
+	objectParams.utils = params.Util
+	objectParams.dnsInspector = params.DNSInspector
+	thisPt.objectMan.Init(objectParams)
+
+	//policies
+	thisPt.params.Config.RegisterActor("policy", nil, thisPt)
+
+	//register api
+	if thisPt.params.Commander != nil {
+		selector := thisPt.params.Commander.CreateSelector()
+		selector.Register("policy_list", thisPt.OnListCommand, nil)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//CreatePolicyManager ...
+func CreatePolicyManager(params SPolicyManagerInitParams) common.IPolicyManager {
+	manager := new(cPolicyManager)
+	manager.Init(params)
+	return manager
 }
@@ -0,0 +1,236 @@
+package policy
+
+import (
+	"errors"
+	"goconnect/common"
+	"goconnect/config"
+	"goconnect/utils"
+	"goconnect/vnet"
+	"net"
+	"testing"
+)
+
+//---------------------------------------------------------------------------------------
+type sTestDNSInspector struct {
+	domains map[string][]string
+}
+
+func (thisPt *sTestDNSInspector) Inspect(process common.IProcessInfo) {
+}
+
+func (thisPt *sTestDNSInspector) GetDomains(ip net.IP) []string {
+	return thisPt.domains[ip.String()]
+}
+
+//---------------------------------------------------------------------------------------
+type sTestAccountingSession struct {
+	common.IAccountingSession
+	user string
+}
+
+func (thisPt *sTestAccountingSession) GetUserName() string {
+	return thisPt.user
+}
+
+func (thisPt *sTestAccountingSession) GetAuthenticationType() string {
+	return "test"
+}
+
+//---------------------------------------------------------------------------------------
+type sTestAuthManager struct {
+	common.IAuthenticationManger
+	sessions map[string]string
+	groups   map[string][]string
+	lookups  int
+}
+
+func (thisPt *sTestAuthManager) GetAccountingSessionByVIP(vip net.IP, accessFunc common.TAccessFunction) error {
+	thisPt.lookups++
+	user, ok := thisPt.sessions[vip.String()]
+	if !ok {
+		return errors.New("invalid virtual IP")
+	}
+	accessFunc(&sTestAccountingSession{user: user})
+	return nil
+}
+
+func (thisPt *sTestAuthManager) GetAuthenticator(typeName string) common.IAuthenticator {
+	return nil
+}
+
+func (thisPt *sTestAuthManager) GetUserInfo(user string, authenticator common.IAuthenticator) common.SUserInfo {
+	return common.SUserInfo{User: user, Groups: thisPt.groups[user]}
+}
+
+//---------------------------------------------------------------------------------------
+func TestPolicyManager(t *testing.T) {
+	configJsons :=
+		`
+{
+	"objects" : 
+	[
+		{
+			"type":"ip",
+			"name":"clients",
+			"ip":"192.168.1.0/24"
+		},
+		{
+			"type":"fqdn",
+			"name":"search_engines",
+			"fqdn":["*.google.com","Google.com."]
+		},
+		{
+			"type":"fqdn",
+			"name":"social",
+			"fqdn":["*.facebook.com"]
+		}
+	],
+	"policy" :
+	[
+		{
+			"name":"allow_all",
+			"order":100,
+			"action":"allow"
+		},
+		{
+			"name":"block_search",
+			"order":10,
+			"source":"clients",
+			"destination":"search_engines",
+			"action":"block"
+		}
+	]
+}
+`
+	inspector := &sTestDNSInspector{domains: make(map[string][]string)}
+
+	params := SPolicyManagerInitParams{}
+	params.Util = utils.Create()
+	params.Config = config.Create(params.Util)
+	params.DNSInspector = inspector
+
+	policyMan := &cPolicyManager{}
+	policyMan.Init(params)
+
+	if err := params.Config.LoadConfig(configJsons); err != nil {
+		t.Fatal(err)
+	}
+
+	processFactory := vnet.CreateProcessFactory()
+	pInfo := processFactory.CreateProcessInfoByName("dns_reqv4")
+
+	//the destination is unknown
+	if policyMan.Evaluate(pInfo) != common.POLICYACTIONALLOW {
+		t.Fatal("evaluation failed")
+	}
+
+	//learn the destination domain
+	inspector.domains["8.8.8.8"] = []string{"google.com"}
+	if policyMan.Evaluate(pInfo) != common.POLICYACTIONBLOCK {
+		t.Fatal("fqdn match failed")
+	}
+
+	inspector.domains["8.8.8.8"] = []string{"dns.google.com"}
+	if policyMan.Evaluate(pInfo) != common.POLICYACTIONBLOCK {
+		t.Fatal("wildcard match failed")
+	}
+
+	inspector.domains["8.8.8.8"] = []string{"google.com.evil.net"}
+	if policyMan.Evaluate(pInfo) != common.POLICYACTIONALLOW {
+		t.Fatal("invalid wildcard match")
+	}
+
+	if policyMan.objectMan.Match("social", pInfo, ObjectMatchSideDestination) {
+		t.Fatal("invalid object match")
+	}
+
+	//trace should not update the hits
+	inspector.domains["8.8.8.8"] = []string{"google.com"}
+	hits := []uint64{}
+	for _, policy := range policyMan.policies {
+		hits = append(hits, policy.Hits)
+	}
+	if name, action := policyMan.Trace(pInfo); action != common.POLICYACTIONBLOCK || len(name) == 0 {
+		t.Fatal("trace failed")
+	}
+	for i, policy := range policyMan.policies {
+		if policy.Hits != hits[i] {
+			t.Fatal("trace updated the hits")
+		}
+	}
+}
+
+//---------------------------------------------------------------------------------------
+func TestPolicyUserGroup(t *testing.T) {
+	configJsons :=
+		`
+{
+	"policy" :
+	[
+		{
+			"name":"allow_all",
+			"order":100,
+			"action":"allow"
+		},
+		{
+			"name":"block_guests",
+			"order":10,
+			"group":"guests",
+			"action":"block"
+		},
+		{
+			"name":"block_bob",
+			"order":20,
+			"user":"bob",
+			"action":"block"
+		}
+	]
+}
+`
+	authMan := &sTestAuthManager{sessions: make(map[string]string), groups: make(map[string][]string)}
+
+	params := SPolicyManagerInitParams{}
+	params.Util = utils.Create()
+	params.Config = config.Create(params.Util)
+	params.DNSInspector = &sTestDNSInspector{domains: make(map[string][]string)}
+	params.AuthMan = authMan
+
+	policyMan := &cPolicyManager{}
+	policyMan.Init(params)
+
+	if err := params.Config.LoadConfig(configJsons); err != nil {
+		t.Fatal(err)
+	}
+
+	processFactory := vnet.CreateProcessFactory()
+	pInfo := processFactory.CreateProcessInfoByName("dns_reqv4")
+	vip := pInfo.GetSourceIP().String()
+
+	//no session owns the source IP
+	if policyMan.Evaluate(pInfo) != common.POLICYACTIONALLOW {
+		t.Fatalf("policy without session matched \n")
+	}
+
+	authMan.sessions[vip] = "alice"
+	if policyMan.Evaluate(pInfo) != common.POLICYACTIONALLOW {
+		t.Fatalf("policy of the other user matched \n")
+	}
+
+	authMan.sessions[vip] = "bob"
+	if name, action := policyMan.Trace(pInfo); action != common.POLICYACTIONBLOCK || name != "block_bob" {
+		t.Fatalf("user match failed %s \n", name)
+	}
+
+	authMan.sessions[vip] = "alice"
+	authMan.groups["alice"] = []string{"staff", "guests"}
+	if name, action := policyMan.Trace(pInfo); action != common.POLICYACTIONBLOCK || name != "block_guests" {
+		t.Fatalf("group match failed %s \n", name)
+	}
+
+	//the session is resolved once per evaluation
+	authMan.lookups = 0
+	authMan.groups["alice"] = []string{"staff"}
+	if policyMan.Evaluate(pInfo) != common.POLICYACTIONALLOW || authMan.lookups != 1 {
+		t.Fatalf("session resolved %d times \n", authMan.lookups)
+	}
+}
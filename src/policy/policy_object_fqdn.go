@@ -0,0 +1,64 @@
+package policy
+
+import (
+	"errors"
+	"goconnect/common"
+	"path"
+	"strings"
+)
+
+type cPolicyObjectFQDN struct {
+	cPolicyObjectBase
+	FQDN []string `json:"fqdn" validate:"min=1,max=1024,dive,min=1,max=255"`
+}
+
+//---------------------------------------------------------------------------------------
+
+//matchDomain checks the domain against the patterns. "*.example.com" matches all the sub domains of example.com
+func (thisPt *cPolicyObjectFQDN) matchDomain(domain string) bool {
+	for _, pattern := range thisPt.FQDN {
+		if match, _ := path.Match(pattern, domain); match {
+			return true
+		}
+	}
+	return false
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cPolicyObjectFQDN) Match(packet common.IProcessInfo, side uint32) bool {
+
+	inspector := thisPt.policyMan.GetDNSInspector()
+	if inspector == nil {
+		return false
+	}
+
+	var ipObj = packet.GetSourceIP()
+	if side == ObjectMatchSideDestination {
+		ipObj = packet.GetDestinationIP()
+	}
+
+	//domains learned from the DNS answers
+	for _, domain := range inspector.GetDomains(ipObj) {
+		if thisPt.matchDomain(domain) {
+			return true
+		}
+	}
+	return false
+}
+
+//---------------------------------------------------------------------------------------
+//override
+func (thisPt *cPolicyObjectFQDN) Init(pMan iPolicyObjectManager, base *cPolicyObjectBase, util common.IUtils) error {
+	thisPt.LoadBase(pMan, base, util, ObjectPositionDomain)
+
+	//normalize patterns
+	for i, pattern := range thisPt.FQDN {
+		pattern = strings.TrimSuffix(strings.ToLower(pattern), ".")
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.New("invalid domain pattern " + pattern)
+		}
+		thisPt.FQDN[i] = pattern
+	}
+	return util.ValidateStruct(*thisPt)
+}
@@ -11,6 +11,7 @@ const (
 	ObjectTypeIP    = "ip"
 	ObjectTypeRange = "range"
 	ObjectTypeSch   = "schedule"
+	ObjectTypeFQDN  = "fqdn"
 )
 
 //---------------------------------------------------------------------------------------
@@ -19,6 +20,7 @@ const (
 	ObjectPositionl3Protocol = 1
 	ObjectPositionl4Address  = 3
 	ObjectPositionl4Protocol = 4
+	ObjectPositionDomain     = 5
 	ObjectPositionLatLong    = 6
 	ObjectPositionCountry    = 7
 	ObjectPositionAS         = 8
@@ -45,12 +47,14 @@ type iPolicyObject interface {
 //---------------------------------------------------------------------------------------
 type iPolicyObjectManager interface {
 	GetObject(name string) iPolicyObject
+	GetDNSInspector() common.IDNSInspector
 }
 
 //---------------------------------------------------------------------------------------
 type sPolicyObjectManagerParams struct {
-	config common.IDynamicConfigManager
-	utils  common.IUtils
+	config       common.IDynamicConfigManager
+	utils        common.IUtils
+	dnsInspector common.IDNSInspector
 }
 
 //---------------------------------------------------------------------------------------
@@ -84,6 +88,13 @@ func (thisPt *cPolicyObjectManager) GetObject(name string) iPolicyObject {
 
 //---------------------------------------------------------------------------------------
 
+//GetDNSInspector for iPolicyObjectManager
+func (thisPt *cPolicyObjectManager) GetDNSInspector() common.IDNSInspector {
+	return thisPt.params.dnsInspector
+}
+
+//---------------------------------------------------------------------------------------
+
 //OnCommand for IDynamicConfigActor
 func (thisPt *cPolicyObjectManager) OnCommand(section string, params interface{}) error {
 	objectList := params.([]interface{})
@@ -130,6 +141,17 @@ func (thisPt *cPolicyObjectManager) OnCommand(section string, params interface{}
 				return err
 			}
 
+			if err := obj.Init(thisPt, &baseInfo, thisPt.params.utils); err != nil {
+				return err
+			}
+			iobj = obj
+		} else if baseInfo.GetType() == ObjectTypeFQDN { //domain object
+			obj := &cPolicyObjectFQDN{}
+
+			if err := thisPt.loadObject(objectInfo, obj); err != nil {
+				return err
+			}
+
 			if err := obj.Init(thisPt, &baseInfo, thisPt.params.utils); err != nil {
 				return err
 			}
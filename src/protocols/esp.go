@@ -1,39 +1,890 @@
 package protocols
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"goconnect/common"
+	"log"
 	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+//---------------------------------------------------------------------------------------
+
+const (
+	espHeaderLen         = 8
+	espIVLen             = 8
+	espICVLen            = 16
+	espKeyLen            = 32
+	espSaltLen           = 4
+	espNextHeaderIPv4    = 4
+	espNextHeaderIPv6    = 41
+	espNextHeaderNone    = 59
+	espReplayWindow      = 64
+	espMaxInboundSAs     = 4
+	espMinSPI            = 256
+	espMaxSequence       = 0xffffff00
+	espNATKeepAlive      = 0xff
+	espKeepAliveInterval = 20
+	espDefaultLifetime   = 3600
+	espMaxReadBuffer     = 65535
+	espKeyLabel          = "goconnect esp"
+	espMACLabel          = "goconnect esp exchange"
+	espNonceLen          = 32
+	espMaxRetiredSPIs    = 1024
+	espOfferRetry        = 2  //second
+	espOfferLifetime     = 30 //second, the retransmitted offers are renewed after the lifetime
+	espOfferWindow       = 60 //second, the offers out of the window are rejected
+)
+
+//---------------------------------------------------------------------------------------
+
+//the exchange messages start with the non-ESP marker, the zero SPI
+const (
+	espMsgOffer       = 1
+	espMsgAccept      = 2
+	espFlagNoInbound  = 1 //the sender does not have any inbound SA, it is restarted
+	espMsgTypeOffset  = 4
+	espMsgFlagsOffset = 5
+	espMsgSPIOffset   = 6
+	espMsgStampOffset = 10
+	espMsgNonceOffset = 18
+	espMsgKeyOffset   = espMsgNonceOffset + espNonceLen
+	espMsgMACOffset   = espMsgKeyOffset + espKeyLen
+	espMsgLen         = espMsgMACOffset + sha256.Size
 )
 
 //---------------------------------------------------------------------------------------
 
 //SESPInitParams ...
 type SESPInitParams struct {
-	Name           string
-	IPList         []string
-	Routes         []string
-	Mtu            int
-	BindAddress    string
-	PeerAddress    string
-	PeerPSK        string
-	MyPSK          string
-	Utils          common.IUtils
-	PacketFactory  common.IProcessFactory
-	ProtocolActor  common.IProtocolActor
-	NetworkManager common.INICManager
+	Name            string
+	IPList          []string
+	Routes          []string
+	Mtu             int
+	BindAddress     string
+	PeerAddress     string
+	PeerPSK         string
+	MyPSK           string
+	Lifetime        uint32
+	LifetimePackets uint32
+	Utils           common.IUtils
+	PacketFactory   common.IProcessFactory
+	ProtocolActor   common.IProtocolActor
+	NetworkManager  common.INICManager
+	Commander       common.ICommander
 }
 
 //---------------------------------------------------------------------------------------
 
+//sESPSA is a security association. the keys are derived from an ephemeral curve25519 secret and the nonces of both sides,
+//so every SA has a new key even if the SPI is repeated
+type sESPSA struct {
+	seq         uint64
+	spi         uint32
+	aead        cipher.AEAD
+	salt        [espSaltLen]byte
+	createTime  int64
+	lastSeq     uint32
+	replayBits  uint64
+	maxSequence uint64
+	offerNonce  [espNonceLen]byte //inbound SAs, the retransmitted offer is answered by the same accept
+	accept      []byte
+}
+
+//---------------------------------------------------------------------------------------
+
+//sESPOffer is an outbound SA waiting for the accept of the peer
+type sESPOffer struct {
+	spi        uint32
+	nonce      [espNonceLen]byte
+	private    [espKeyLen]byte
+	message    []byte
+	createTime int64
+}
+
+//---------------------------------------------------------------------------------------
+
+type sESPStat struct {
+	Rekeys          uint64 `json:"rekeys"`
+	ReplayDrops     uint64 `json:"replay_drops"`
+	AuthFailures    uint64 `json:"auth_failures"`
+	InvalidPackets  uint64 `json:"invalid_packets"`
+	SpoofedPackets  uint64 `json:"spoofed_packets"`
+	KeepAlives      uint64 `json:"keepalives"`
+	EncryptedPacket uint64 `json:"encrypted_packets"`
+	DecryptedPacket uint64 `json:"decrypted_packets"`
+	UnknownSPIs     uint64 `json:"unknown_spis"`
+	NoSADrops       uint64 `json:"no_sa_drops"`
+}
+
+//---------------------------------------------------------------------------------------
+
+//cESP is a site to site ESP in UDP tunnel (RFC 3948) with AES-GCM (RFC 4106). each side offers its outbound SAs
+//by an exchange authenticated with its PSK, the peer accepts it with its own nonce and ephemeral key
 type cESP struct {
 	cNICBase
-	params       SESPInitParams
-	serverSocket net.UDPConn
-	clientSocket net.UDPConn
+	params     SESPInitParams
+	socket     *net.UDPConn
+	peer       *net.UDPAddr
+	outbound   *sESPSA
+	pending    *sESPOffer
+	inbound    []*sESPSA
+	retired    map[uint32]bool
+	retiredSPI []uint32
+	lastStamp  uint64
+	lock       sync.RWMutex
+	stat       sESPStat
+	done       chan bool
+}
+
+//---------------------------------------------------------------------------------------
+
+//createSA derives the SA keys from the ephemeral secret, the PSK of the sender and the nonces of both sides
+func (thisPt *cESP) createSA(secret []byte, psk string, spi uint32, offerNonce []byte, acceptNonce []byte) (*sESPSA, error) {
+	mac := hmac.New(sha512.New, secret)
+	mac.Write([]byte(espKeyLabel))
+	mac.Write([]byte(psk))
+	binary.Write(mac, binary.BigEndian, spi)
+	mac.Write(offerNonce)
+	mac.Write(acceptNonce)
+	material := mac.Sum(nil)
+
+	block, err := aes.NewCipher(material[:espKeyLen])
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	sa := new(sESPSA)
+	sa.spi = spi
+	sa.aead = aead
+	sa.createTime = time.Now().Unix()
+	sa.maxSequence = espMaxSequence
+	if thisPt.params.LifetimePackets != 0 {
+		sa.maxSequence = uint64(thisPt.params.LifetimePackets)
+	}
+	copy(sa.salt[:], material[espKeyLen:])
+	return sa, nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//signMessage returns the MAC of the exchange message, the accept is bound to the nonce of the offer
+func (thisPt *cESP) signMessage(message []byte, psk string, offerNonce []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(psk))
+	mac.Write([]byte(espMACLabel))
+	mac.Write(message[espMsgTypeOffset:espMsgMACOffset])
+	mac.Write(offerNonce)
+	return mac.Sum(nil)
 }
 
 //---------------------------------------------------------------------------------------
 
-func (thisPt *cESP) Init(param SESPInitParams) {
+//createMessage creates an exchange message with a new nonce and a new ephemeral key
+func (thisPt *cESP) createMessage(msgType byte, spi uint32, stamp uint64, private *[espKeyLen]byte, offerNonce []byte) ([]byte, error) {
+	message := make([]byte, espMsgLen)
+	message[espMsgTypeOffset] = msgType
+	if len(thisPt.inbound) == 0 {
+		message[espMsgFlagsOffset] = espFlagNoInbound
+	}
+	binary.BigEndian.PutUint32(message[espMsgSPIOffset:], spi)
+	binary.BigEndian.PutUint64(message[espMsgStampOffset:], stamp)
+
+	if _, err := rand.Read(message[espMsgNonceOffset:espMsgKeyOffset]); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(private[:]); err != nil {
+		return nil, err
+	}
+	public, err := curve25519.X25519(private[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	copy(message[espMsgKeyOffset:], public)
+	copy(message[espMsgMACOffset:], thisPt.signMessage(message, thisPt.params.MyPSK, offerNonce))
+	return message, nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//rekey creates an offer of a new outbound SA with a random SPI, the current SA is used until the peer accepts the offer.
+//should be called by the lock
+func (thisPt *cESP) rekey() ([]byte, error) {
+	spiBuffer := [4]byte{}
+	spi := uint32(0)
+	for spi < espMinSPI || (thisPt.outbound != nil && spi == thisPt.outbound.spi) {
+		if _, err := rand.Read(spiBuffer[:]); err != nil {
+			return nil, err
+		}
+		spi = binary.BigEndian.Uint32(spiBuffer[:])
+	}
+
+	offer := new(sESPOffer)
+	offer.spi = spi
+	offer.createTime = time.Now().Unix()
+	message, err := thisPt.createMessage(espMsgOffer, spi, uint64(time.Now().UnixNano()), &offer.private, nil)
+	if err != nil {
+		return nil, err
+	}
+	copy(offer.nonce[:], message[espMsgNonceOffset:espMsgKeyOffset])
+	offer.message = message
+	thisPt.pending = offer
+	return message, nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//startRekey sends an offer if there is not any pending offer
+func (thisPt *cESP) startRekey() {
+	thisPt.lock.Lock()
+	if thisPt.pending != nil {
+		thisPt.lock.Unlock()
+		return
+	}
+	message, err := thisPt.rekey()
+	peer := thisPt.peer
+	thisPt.lock.Unlock()
+
+	if err != nil {
+		log.Printf("can not rekey esp tunnel %s with error %v \n", thisPt.Name, err)
+		return
+	}
+	thisPt.socket.WriteToUDP(message, peer)
+}
+
+//---------------------------------------------------------------------------------------
+
+//getOutboundSA returns the current outbound SA and the next sequence. the rekey is started after the lifetime,
+//the SA is not used after the maximum sequence
+func (thisPt *cESP) getOutboundSA() (*sESPSA, uint64, error) {
+	thisPt.lock.RLock()
+	sa := thisPt.outbound
+	thisPt.lock.RUnlock()
+	if sa == nil {
+		return nil, 0, errors.New("esp tunnel is not established")
+	}
+
+	seq := atomic.AddUint64(&sa.seq, 1)
+	if seq > sa.maxSequence || time.Now().Unix()-sa.createTime > int64(thisPt.params.Lifetime) {
+		thisPt.startRekey()
+	}
+	if seq > espMaxSequence {
+		return nil, 0, errors.New("esp SA is exhausted")
+	}
+	return sa, seq, nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//encrypt creates an ESP packet of the inner IP packet
+func (thisPt *cESP) encrypt(sa *sESPSA, seq uint64, inner []byte) []byte {
+	nextHeader := byte(espNextHeaderIPv4)
+	if len(inner) > 0 && (inner[0]>>4) == 6 {
+		nextHeader = espNextHeaderIPv6
+	}
+
+	//payload, padding, pad length and next header should be aligned to 4 bytes
+	plainLen := (len(inner) + 2 + 3) &^ 3
+	padLen := plainLen - len(inner) - 2
+
+	packet := make([]byte, espHeaderLen+espIVLen+plainLen+espICVLen)
+	binary.BigEndian.PutUint32(packet[0:], sa.spi)
+	binary.BigEndian.PutUint32(packet[4:], uint32(seq))
+	binary.BigEndian.PutUint64(packet[espHeaderLen:], seq)
+
+	plain := packet[espHeaderLen+espIVLen : espHeaderLen+espIVLen+plainLen]
+	copy(plain, inner)
+	for i := 0; i < padLen; i++ {
+		plain[len(inner)+i] = byte(i + 1)
+	}
+	plain[plainLen-2] = byte(padLen)
+	plain[plainLen-1] = nextHeader
+
+	nonce := [espSaltLen + espIVLen]byte{}
+	copy(nonce[:], sa.salt[:])
+	copy(nonce[espSaltLen:], packet[espHeaderLen:espHeaderLen+espIVLen])
+	sa.aead.Seal(plain[:0], nonce[:], plain, packet[:espHeaderLen])
+	return packet
+}
+
+//---------------------------------------------------------------------------------------
+
+//checkReplay checks the sequence against the sliding window
+func (thisPt *cESP) checkReplay(sa *sESPSA, seq uint32) bool {
+	if seq == 0 {
+		return false
+	}
+	if seq > sa.lastSeq {
+		return true
+	}
+	diff := sa.lastSeq - seq
+	if diff >= espReplayWindow {
+		return false
+	}
+	return sa.replayBits&(uint64(1)<<diff) == 0
+}
+
+//---------------------------------------------------------------------------------------
+
+//updateReplay updates the sliding window, after the packet is authenticated
+func (thisPt *cESP) updateReplay(sa *sESPSA, seq uint32) {
+	if seq > sa.lastSeq {
+		shift := seq - sa.lastSeq
+		if shift < espReplayWindow {
+			sa.replayBits = (sa.replayBits << shift) | 1
+		} else {
+			sa.replayBits = 1
+		}
+		sa.lastSeq = seq
+		return
+	}
+	sa.replayBits |= uint64(1) << (sa.lastSeq - seq)
+}
+
+//---------------------------------------------------------------------------------------
+
+//findInboundSA returns the inbound SA of the SPI and whether it is the current SA, only the accepted SPIs are known
+func (thisPt *cESP) findInboundSA(spi uint32) (*sESPSA, bool) {
+	thisPt.lock.RLock()
+	defer thisPt.lock.RUnlock()
+
+	for i, sa := range thisPt.inbound {
+		if sa.spi == spi {
+			return sa, i == len(thisPt.inbound)-1
+		}
+	}
+	return nil, false
+}
+
+//---------------------------------------------------------------------------------------
+
+//installInboundSA keeps the latest inbound SAs, so the packets of the old SA are accepted during the rekey.
+//the removed SPIs are retired and can not be offered again. should be called by the lock
+func (thisPt *cESP) installInboundSA(sa *sESPSA, peer *net.UDPAddr) {
+	if len(thisPt.inbound) >= espMaxInboundSAs {
+		thisPt.retireSPI(thisPt.inbound[0].spi)
+		thisPt.inbound = thisPt.inbound[1:]
+	}
+	thisPt.inbound = append(thisPt.inbound, sa)
+	log.Printf("esp tunnel %s new inbound SPI %08x from %s \n", thisPt.Name, sa.spi, peer.String())
+}
+
+//---------------------------------------------------------------------------------------
+
+//retireSPI keeps the latest retired SPIs. should be called by the lock
+func (thisPt *cESP) retireSPI(spi uint32) {
+	if len(thisPt.retiredSPI) >= espMaxRetiredSPIs {
+		delete(thisPt.retired, thisPt.retiredSPI[0])
+		thisPt.retiredSPI = thisPt.retiredSPI[1:]
+	}
+	thisPt.retired[spi] = true
+	thisPt.retiredSPI = append(thisPt.retiredSPI, spi)
+}
+
+//---------------------------------------------------------------------------------------
+
+//isRetiredSPI ...
+func (thisPt *cESP) isRetiredSPI(spi uint32) bool {
+	thisPt.lock.RLock()
+	defer thisPt.lock.RUnlock()
+	return thisPt.retired[spi]
+}
+
+//---------------------------------------------------------------------------------------
+
+//followPeer NAT-T, follows the address of the authenticated and new packets. should be called by the lock
+func (thisPt *cESP) followPeer(peer *net.UDPAddr) {
+	if !thisPt.peer.IP.Equal(peer.IP) || thisPt.peer.Port != peer.Port {
+		log.Printf("esp tunnel %s peer address changed to %s \n", thisPt.Name, peer.String())
+		thisPt.peer = peer
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//onOffer installs the inbound SA of the offer and accepts it. the offers older than the last offer are replays,
+//except the retransmission of the accepted offers
+func (thisPt *cESP) onOffer(message []byte, peer *net.UDPAddr) {
+	if !hmac.Equal(message[espMsgMACOffset:], thisPt.signMessage(message, thisPt.params.PeerPSK, nil)) {
+		atomic.AddUint64(&thisPt.stat.AuthFailures, 1)
+		return
+	}
+
+	spi := binary.BigEndian.Uint32(message[espMsgSPIOffset:])
+	stamp := binary.BigEndian.Uint64(message[espMsgStampOffset:])
+	offerNonce := message[espMsgNonceOffset:espMsgKeyOffset]
+
+	thisPt.lock.Lock()
+	replies := [][]byte{}
+	defer func() {
+		thisPt.lock.Unlock()
+		for _, reply := range replies {
+			thisPt.socket.WriteToUDP(reply, peer)
+		}
+	}()
+
+	for _, sa := range thisPt.inbound {
+		if sa.spi == spi {
+			if bytes.Equal(sa.offerNonce[:], offerNonce) {
+				replies = append(replies, sa.accept)
+			} else {
+				atomic.AddUint64(&thisPt.stat.ReplayDrops, 1)
+			}
+			return
+		}
+	}
+
+	now := time.Now().UnixNano()
+	window := int64(espOfferWindow * time.Second)
+	if spi < espMinSPI || thisPt.retired[spi] || stamp <= thisPt.lastStamp || int64(stamp) < now-window || int64(stamp) > now+window {
+		atomic.AddUint64(&thisPt.stat.ReplayDrops, 1)
+		return
+	}
+
+	private := [espKeyLen]byte{}
+	accept, err := thisPt.createMessage(espMsgAccept, spi, stamp, &private, offerNonce)
+	if err != nil {
+		log.Printf("can not accept the offer of esp tunnel %s with error %v \n", thisPt.Name, err)
+		return
+	}
+
+	secret, err := curve25519.X25519(private[:], message[espMsgKeyOffset:espMsgMACOffset])
+	if err != nil {
+		atomic.AddUint64(&thisPt.stat.InvalidPackets, 1)
+		return
+	}
+
+	sa, err := thisPt.createSA(secret, thisPt.params.PeerPSK, spi, offerNonce, accept[espMsgNonceOffset:espMsgKeyOffset])
+	if err != nil {
+		atomic.AddUint64(&thisPt.stat.InvalidPackets, 1)
+		return
+	}
+	copy(sa.offerNonce[:], offerNonce)
+	sa.accept = accept
+	thisPt.installInboundSA(sa, peer)
+	thisPt.lastStamp = stamp
+	replies = append(replies, accept)
+
+	//the peer does not have our SA after its restart, or our own offer is lost
+	if thisPt.outbound == nil && thisPt.pending != nil {
+		replies = append(replies, thisPt.pending.message)
+	} else if message[espMsgFlagsOffset]&espFlagNoInbound != 0 && thisPt.pending == nil {
+		if offer, err := thisPt.rekey(); err == nil {
+			replies = append(replies, offer)
+		}
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//onAccept switches to the new outbound SA of the pending offer
+func (thisPt *cESP) onAccept(message []byte, peer *net.UDPAddr) {
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+
+	offer := thisPt.pending
+	if offer == nil || binary.BigEndian.Uint32(message[espMsgSPIOffset:]) != offer.spi {
+		atomic.AddUint64(&thisPt.stat.ReplayDrops, 1)
+		return
+	}
+
+	if !hmac.Equal(message[espMsgMACOffset:], thisPt.signMessage(message, thisPt.params.PeerPSK, offer.nonce[:])) {
+		atomic.AddUint64(&thisPt.stat.AuthFailures, 1)
+		return
+	}
+
+	secret, err := curve25519.X25519(offer.private[:], message[espMsgKeyOffset:espMsgMACOffset])
+	if err != nil {
+		atomic.AddUint64(&thisPt.stat.InvalidPackets, 1)
+		return
+	}
+
+	sa, err := thisPt.createSA(secret, thisPt.params.MyPSK, offer.spi, offer.nonce[:], message[espMsgNonceOffset:espMsgKeyOffset])
+	if err != nil {
+		atomic.AddUint64(&thisPt.stat.InvalidPackets, 1)
+		return
+	}
+
+	if thisPt.outbound != nil {
+		atomic.AddUint64(&thisPt.stat.Rekeys, 1)
+		log.Printf("esp tunnel %s rekeyed, new SPI %08x \n", thisPt.Name, offer.spi)
+	}
+	thisPt.outbound = sa
+	thisPt.pending = nil
+	thisPt.followPeer(peer)
+}
+
+//---------------------------------------------------------------------------------------
+
+//onMessage handles the exchange messages
+func (thisPt *cESP) onMessage(message []byte, peer *net.UDPAddr) {
+	if len(message) != espMsgLen {
+		atomic.AddUint64(&thisPt.stat.InvalidPackets, 1)
+		return
+	}
+
+	switch message[espMsgTypeOffset] {
+	case espMsgOffer:
+		thisPt.onOffer(message, peer)
+	case espMsgAccept:
+		thisPt.onAccept(message, peer)
+	default:
+		atomic.AddUint64(&thisPt.stat.InvalidPackets, 1)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//decrypt returns the inner IP packet of the ESP packet
+func (thisPt *cESP) decrypt(packet []byte, peer *net.UDPAddr) []byte {
+	if len(packet) < espHeaderLen+espIVLen+4+espICVLen {
+		atomic.AddUint64(&thisPt.stat.InvalidPackets, 1)
+		return nil
+	}
+
+	spi := binary.BigEndian.Uint32(packet[0:])
+	seq := binary.BigEndian.Uint32(packet[4:])
+	if spi < espMinSPI {
+		atomic.AddUint64(&thisPt.stat.InvalidPackets, 1)
+		return nil
+	}
+
+	sa, current := thisPt.findInboundSA(spi)
+	if sa == nil {
+		if thisPt.isRetiredSPI(spi) {
+			atomic.AddUint64(&thisPt.stat.ReplayDrops, 1)
+		} else {
+			atomic.AddUint64(&thisPt.stat.UnknownSPIs, 1)
+		}
+		return nil
+	}
+
+	//the packets are read by a single goroutine, so the window does not need any lock
+	if !thisPt.checkReplay(sa, seq) {
+		atomic.AddUint64(&thisPt.stat.ReplayDrops, 1)
+		return nil
+	}
+
+	nonce := [espSaltLen + espIVLen]byte{}
+	copy(nonce[:], sa.salt[:])
+	copy(nonce[espSaltLen:], packet[espHeaderLen:espHeaderLen+espIVLen])
+	cipherText := packet[espHeaderLen+espIVLen:]
+	plain, err := sa.aead.Open(cipherText[:0], nonce[:], cipherText, packet[:espHeaderLen])
+	if err != nil {
+		atomic.AddUint64(&thisPt.stat.AuthFailures, 1)
+		return nil
+	}
+
+	//only the new packets of the current SA move the peer, so the replayed and the delayed packets can not
+	newSequence := seq > sa.lastSeq
+	thisPt.updateReplay(sa, seq)
+	if current && newSequence {
+		thisPt.lock.Lock()
+		thisPt.followPeer(peer)
+		thisPt.lock.Unlock()
+	}
+
+	//remove the trailer
+	nextHeader := plain[len(plain)-1]
+	padLen := int(plain[len(plain)-2])
+	if padLen+2 > len(plain) {
+		atomic.AddUint64(&thisPt.stat.InvalidPackets, 1)
+		return nil
+	}
+
+	//dummy packets
+	if nextHeader == espNextHeaderNone {
+		return nil
+	}
+
+	if nextHeader != espNextHeaderIPv4 && nextHeader != espNextHeaderIPv6 {
+		atomic.AddUint64(&thisPt.stat.InvalidPackets, 1)
+		return nil
+	}
+
+	atomic.AddUint64(&thisPt.stat.DecryptedPacket, 1)
+	return plain[:len(plain)-2-padLen]
+}
+
+//---------------------------------------------------------------------------------------
+
+//isValidSource checks whether the inner packet is from the networks behind the peer
+func (thisPt *cESP) isValidSource(packet common.IProcessInfo) bool {
+	for _, route := range thisPt.Routes {
+		if route.Contains(packet.GetSourceIP()) {
+			return true
+		}
+	}
+	return false
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cESP) read() {
+	buffer := make([]byte, espMaxReadBuffer)
+	for {
+		n, peer, err := thisPt.socket.ReadFromUDP(buffer)
+		if err != nil {
+			select {
+			case <-thisPt.done:
+				return
+			default:
+			}
+			log.Printf("can not read from esp tunnel %s with error %s \n", thisPt.Name, err.Error())
+			time.Sleep(1 * time.Second)
+			continue
+		}
+
+		//NAT keepalive
+		if n == 1 && buffer[0] == espNATKeepAlive {
+			atomic.AddUint64(&thisPt.stat.KeepAlives, 1)
+			continue
+		}
+
+		//the exchange messages have the non-ESP marker
+		if n >= 4 && binary.BigEndian.Uint32(buffer) == 0 {
+			thisPt.onMessage(buffer[:n], peer)
+			continue
+		}
+
+		inner := thisPt.decrypt(buffer[:n], peer)
+		if inner == nil {
+			continue
+		}
+
+		//create packet
+		packet := thisPt.params.PacketFactory.CreateProcessInfo(inner)
+		if !packet.ProcessAsNetPacket() {
+			atomic.AddUint64(&thisPt.stat.InvalidPackets, 1)
+			thisPt.params.PacketFactory.FreeProcessInfo(packet)
+			continue
+		}
+
+		if !thisPt.isValidSource(packet) {
+			atomic.AddUint64(&thisPt.stat.SpoofedPackets, 1)
+			thisPt.params.PacketFactory.FreeProcessInfo(packet)
+			continue
+		}
+
+		//the packet is owned by the actor after this call
+		packet.SetInNIC(thisPt.Id)
+		thisPt.UpdateSend(packet)
+		thisPt.params.ProtocolActor.OnNewPacket(packet)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//retryOffer retransmits the pending offer, the offer is renewed after its lifetime
+func (thisPt *cESP) retryOffer() {
+	thisPt.lock.Lock()
+	offer := thisPt.pending
+	if offer == nil {
+		thisPt.lock.Unlock()
+		return
+	}
+
+	message := offer.message
+	if time.Now().Unix()-offer.createTime > espOfferLifetime {
+		var err error
+		if message, err = thisPt.rekey(); err != nil {
+			thisPt.lock.Unlock()
+			log.Printf("can not rekey esp tunnel %s with error %v \n", thisPt.Name, err)
+			return
+		}
+	}
+	peer := thisPt.peer
+	thisPt.lock.Unlock()
+	thisPt.socket.WriteToUDP(message, peer)
+}
+
+//---------------------------------------------------------------------------------------
+
+//keepAlive keeps the NAT mappings open and retransmits the offers
+func (thisPt *cESP) keepAlive() {
+	ticker := time.NewTicker(espKeepAliveInterval * time.Second)
+	defer ticker.Stop()
+	retryTicker := time.NewTicker(espOfferRetry * time.Second)
+	defer retryTicker.Stop()
+
+	for {
+		select {
+		case <-thisPt.done:
+			return
+		case <-ticker.C:
+			thisPt.lock.RLock()
+			peer := thisPt.peer
+			thisPt.lock.RUnlock()
+			thisPt.socket.WriteToUDP([]byte{espNATKeepAlive}, peer)
+		case <-retryTicker.C:
+			thisPt.retryOffer()
+		}
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//Write override cNICBase.write
+func (thisPt *cESP) WriteData(data common.IProcessInfo) {
+	//the packets are dropped until the peer accepts an SA
+	sa, seq, err := thisPt.getOutboundSA()
+	if err != nil {
+		atomic.AddUint64(&thisPt.stat.NoSADrops, 1)
+		return
+	}
+
+	packet := thisPt.encrypt(sa, seq, data.GetBuffer())
+
+	thisPt.lock.RLock()
+	peer := thisPt.peer
+	thisPt.lock.RUnlock()
+
+	if _, err := thisPt.socket.WriteToUDP(packet, peer); err != nil {
+		log.Printf("esp tunnel %s write failed with error %v \n", thisPt.Name, err)
+		return
+	}
+	atomic.AddUint64(&thisPt.stat.EncryptedPacket, 1)
+	thisPt.UpdateReceive(data)
+}
+
+//---------------------------------------------------------------------------------------
+
+//End override cNICBase.end
+func (thisPt *cESP) End() {
+	select {
+	case <-thisPt.done:
+		return
+	default:
+	}
+	close(thisPt.done)
+	thisPt.socket.Close()
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cESP) OnStatusCommand(req *http.Request, params interface{}) (common.IHTTPResponse, error) {
+	type sESPStatus struct {
+		Name        string   `json:"name"`
+		Peer        string   `json:"peer"`
+		OutboundSPI string   `json:"outbound_spi"`
+		PendingSPI  string   `json:"pending_spi"`
+		Sequence    uint64   `json:"sequence"`
+		InboundSPIs []string `json:"inbound_spis"`
+		Stat        sESPStat `json:"stat"`
+	}
+
+	status := sESPStatus{}
+	status.Name = thisPt.Name
+	status.InboundSPIs = []string{}
+
+	thisPt.lock.RLock()
+	status.Peer = thisPt.peer.String()
+	if thisPt.outbound != nil {
+		status.OutboundSPI = fmt.Sprintf("%08x", thisPt.outbound.spi)
+		status.Sequence = atomic.LoadUint64(&thisPt.outbound.seq)
+	}
+	if thisPt.pending != nil {
+		status.PendingSPI = fmt.Sprintf("%08x", thisPt.pending.spi)
+	}
+	for _, sa := range thisPt.inbound {
+		status.InboundSPIs = append(status.InboundSPIs, fmt.Sprintf("%08x", sa.spi))
+	}
+	thisPt.lock.RUnlock()
+
+	status.Stat.Rekeys = atomic.LoadUint64(&thisPt.stat.Rekeys)
+	status.Stat.ReplayDrops = atomic.LoadUint64(&thisPt.stat.ReplayDrops)
+	status.Stat.AuthFailures = atomic.LoadUint64(&thisPt.stat.AuthFailures)
+	status.Stat.InvalidPackets = atomic.LoadUint64(&thisPt.stat.InvalidPackets)
+	status.Stat.SpoofedPackets = atomic.LoadUint64(&thisPt.stat.SpoofedPackets)
+	status.Stat.KeepAlives = atomic.LoadUint64(&thisPt.stat.KeepAlives)
+	status.Stat.EncryptedPacket = atomic.LoadUint64(&thisPt.stat.EncryptedPacket)
+	status.Stat.DecryptedPacket = atomic.LoadUint64(&thisPt.stat.DecryptedPacket)
+	status.Stat.UnknownSPIs = atomic.LoadUint64(&thisPt.stat.UnknownSPIs)
+	status.Stat.NoSADrops = atomic.LoadUint64(&thisPt.stat.NoSADrops)
+	return thisPt.params.Utils.CreateHttpResponseFromObject(status)
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cESP) Init(param SESPInitParams) error {
 	thisPt.params = param
+	thisPt.done = make(chan bool)
+	thisPt.retired = make(map[uint32]bool)
+	if thisPt.params.Lifetime == 0 {
+		thisPt.params.Lifetime = espDefaultLifetime
+	}
+
+	if len(thisPt.params.MyPSK) == 0 || len(thisPt.params.PeerPSK) == 0 {
+		return errors.New("esp tunnel needs both PSKs")
+	}
+
+	//register internally
+	thisPt.Id = thisPt.params.Utils.GetUniqID()
+	thisPt.Name = thisPt.params.Name
+	thisPt.NicType = common.INICTypeTunnel
+
+	for _, r := range thisPt.params.Routes {
+		_, netres, err := net.ParseCIDR(r)
+		if err != nil {
+			return err
+		}
+		thisPt.Routes = append(thisPt.Routes, *netres)
+	}
+
+	//sockets
+	bindAddress, err := net.ResolveUDPAddr("udp", thisPt.params.BindAddress)
+	if err != nil {
+		return err
+	}
+
+	if thisPt.peer, err = net.ResolveUDPAddr("udp", thisPt.params.PeerAddress); err != nil {
+		return err
+	}
+	thisPt.Ip = thisPt.peer.IP
+
+	if thisPt.socket, err = net.ListenUDP("udp", bindAddress); err != nil {
+		return err
+	}
+
+	//outbound SA, the offer is retransmitted until the peer accepts it
+	offer, err := thisPt.rekey()
+	if err != nil {
+		thisPt.socket.Close()
+		return err
+	}
+	thisPt.socket.WriteToUDP(offer, thisPt.peer)
+
+	if thisPt.params.NetworkManager != nil {
+		thisPt.params.NetworkManager.RegisterNIC(thisPt)
+	}
+
+	//
+	go thisPt.read()
+	go thisPt.keepAlive()
+
+	//register api
+	if thisPt.params.Commander != nil {
+		selector := thisPt.params.Commander.CreateSelector()
+		selector.Register(fmt.Sprintf("esp_%s_status", thisPt.Name), thisPt.OnStatusCommand, nil)
+	}
+
+	return nil
 }
@@ -0,0 +1,270 @@
+package protocols
+
+import (
+	"bytes"
+	"encoding/binary"
+	"goconnect/common"
+	"goconnect/utils"
+	"goconnect/vnet"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//---------------------------------------------------------------------------------------
+
+type sTestESPNICManager struct {
+	common.INICManager
+	nics []common.INIC
+}
+
+func (thisPt *sTestESPNICManager) RegisterNIC(nic common.INIC) {
+	thisPt.nics = append(thisPt.nics, nic)
+}
+
+//---------------------------------------------------------------------------------------
+
+type sTestESPActor struct {
+	factory common.IProcessFactory
+	packets chan []byte
+}
+
+func (thisPt *sTestESPActor) OnNewPacket(packet common.IProcessInfo) {
+	thisPt.packets <- append([]byte{}, packet.GetBuffer()...)
+	thisPt.factory.FreeProcessInfo(packet)
+}
+
+//---------------------------------------------------------------------------------------
+
+//createTestESPPacket creates an IPv4/UDP packet
+func createTestESPPacket(src string, dst string, payload []byte) []byte {
+	packet := make([]byte, 28+len(payload))
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+	packet[8] = 64
+	packet[9] = 17
+	copy(packet[12:], net.ParseIP(src).To4())
+	copy(packet[16:], net.ParseIP(dst).To4())
+	binary.BigEndian.PutUint16(packet[20:], 1000)
+	binary.BigEndian.PutUint16(packet[22:], 2000)
+	binary.BigEndian.PutUint16(packet[24:], uint16(8+len(payload)))
+	copy(packet[28:], payload)
+	return packet
+}
+
+//---------------------------------------------------------------------------------------
+
+func createTestESP(t *testing.T, name string, bind string, peer string, routes []string, myPSK string, peerPSK string, factory common.IProcessFactory) (*cESP, *sTestESPActor) {
+	actor := &sTestESPActor{factory: factory, packets: make(chan []byte, 64)}
+
+	params := SESPInitParams{}
+	params.Name = name
+	params.BindAddress = bind
+	params.PeerAddress = peer
+	params.Routes = routes
+	params.MyPSK = myPSK
+	params.PeerPSK = peerPSK
+	params.Utils = utils.Create()
+	params.PacketFactory = factory
+	params.ProtocolActor = actor
+	params.NetworkManager = &sTestESPNICManager{}
+
+	esp := new(cESP)
+	if err := esp.Init(params); err != nil {
+		t.Fatalf("can not init esp tunnel %s %v \n", name, err)
+	}
+	return esp, actor
+}
+
+//---------------------------------------------------------------------------------------
+
+func waitTestESPPacket(t *testing.T, actor *sTestESPActor, expected []byte) {
+	t.Helper()
+	select {
+	case packet := <-actor.packets:
+		if !bytes.Equal(packet, expected) {
+			t.Fatalf("invalid packet received %v \n", packet)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("packet did not pass the tunnel \n")
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//waitTestESPRekey waits for the accept of the peer, the old SA is nil for the first SA
+func waitTestESPRekey(t *testing.T, esp *cESP, old *sESPSA) *sESPSA {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		esp.lock.RLock()
+		sa := esp.outbound
+		esp.lock.RUnlock()
+		if sa != nil && sa != old {
+			return sa
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("esp tunnel %s is not rekeyed \n", esp.Name)
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//rekeyTestESP starts a rekey and waits for the new outbound SA
+func rekeyTestESP(t *testing.T, esp *cESP) {
+	t.Helper()
+	esp.lock.RLock()
+	old := esp.outbound
+	esp.lock.RUnlock()
+	esp.startRekey()
+	waitTestESPRekey(t, esp, old)
+}
+
+//---------------------------------------------------------------------------------------
+
+func TestESP(t *testing.T) {
+	const pskA = "site-a-secret-key-0001"
+	const pskB = "site-b-secret-key-0002"
+
+	factory := vnet.CreateProcessFactory()
+	siteA, actorA := createTestESP(t, "sitea", "127.0.0.1:45001", "127.0.0.1:45002", []string{"10.2.0.0/16"}, pskA, pskB, factory)
+	defer siteA.End()
+	siteB, actorB := createTestESP(t, "siteb", "127.0.0.1:45002", "127.0.0.1:45001", []string{"10.1.0.0/16"}, pskB, pskA, factory)
+	defer siteB.End()
+
+	if len(siteA.params.NetworkManager.(*sTestESPNICManager).nics) != 1 || siteA.GetType() != common.INICTypeTunnel || len(siteA.GetRoutes()) != 1 {
+		t.Fatalf("tunnel is not registered as a NIC \n")
+	}
+	waitTestESPRekey(t, siteA, nil)
+	waitTestESPRekey(t, siteB, nil)
+
+	//both directions
+	for i := 0; i < 4; i++ {
+		packet := createTestESPPacket("10.1.0.1", "10.2.0.1", []byte{byte(i), 1, 2, 3, 4})
+		siteA.WriteData(factory.CreateProcessInfo(packet))
+		waitTestESPPacket(t, actorB, packet)
+
+		packet = createTestESPPacket("10.2.0.1", "10.1.0.1", []byte{byte(i), 5, 6, 7})
+		siteB.WriteData(factory.CreateProcessInfo(packet))
+		waitTestESPPacket(t, actorA, packet)
+	}
+
+	//a replayed datagram should be dropped
+	packet := createTestESPPacket("10.1.0.1", "10.2.0.1", []byte{9, 9, 9})
+	sa, seq, _ := siteA.getOutboundSA()
+	datagram := siteA.encrypt(sa, seq, packet)
+	siteA.socket.WriteToUDP(datagram, siteA.peer)
+	siteA.socket.WriteToUDP(datagram, siteA.peer)
+	waitTestESPPacket(t, actorB, packet)
+	time.Sleep(100 * time.Millisecond)
+	if atomic.LoadUint64(&siteB.stat.ReplayDrops) != 1 || len(actorB.packets) != 0 {
+		t.Fatalf("replayed packet is accepted \n")
+	}
+
+	//tampered datagram
+	datagram = siteA.encrypt(sa, seq+1, packet)
+	datagram[len(datagram)-1] ^= 0xff
+	siteA.socket.WriteToUDP(datagram, siteA.peer)
+
+	//spoofed inner source
+	siteA.WriteData(factory.CreateProcessInfo(createTestESPPacket("192.168.1.1", "10.2.0.1", []byte{1})))
+	time.Sleep(100 * time.Millisecond)
+	if atomic.LoadUint64(&siteB.stat.AuthFailures) != 1 || atomic.LoadUint64(&siteB.stat.SpoofedPackets) != 1 || len(actorB.packets) != 0 {
+		t.Fatalf("invalid packets are accepted \n")
+	}
+
+	//a datagram of an evicted SA should be dropped after the rekeys
+	packet = createTestESPPacket("10.1.0.1", "10.2.0.1", []byte{8, 8, 8})
+	sa, seq, _ = siteA.getOutboundSA()
+	datagram = siteA.encrypt(sa, seq, packet)
+	siteA.socket.WriteToUDP(datagram, siteA.peer)
+	waitTestESPPacket(t, actorB, packet)
+	for i := 0; i < 5; i++ {
+		rekeyTestESP(t, siteA)
+		packet := createTestESPPacket("10.1.0.1", "10.2.0.1", []byte{byte(i)})
+		siteA.WriteData(factory.CreateProcessInfo(packet))
+		waitTestESPPacket(t, actorB, packet)
+	}
+	if atomic.LoadUint64(&siteA.stat.Rekeys) != 5 || len(siteB.inbound) != espMaxInboundSAs {
+		t.Fatalf("tunnel is not rekeyed %v \n", siteA.stat)
+	}
+
+	replayDrops := atomic.LoadUint64(&siteB.stat.ReplayDrops)
+	siteA.socket.WriteToUDP(datagram, siteA.peer)
+	time.Sleep(100 * time.Millisecond)
+	if atomic.LoadUint64(&siteB.stat.ReplayDrops) != replayDrops+1 || len(actorB.packets) != 0 {
+		t.Fatalf("datagram of an evicted SA is accepted \n")
+	}
+
+	//a replayed datagram from another address should not move the peer
+	sa, seq, _ = siteA.getOutboundSA()
+	datagram = siteA.encrypt(sa, seq, packet)
+	siteA.socket.WriteToUDP(datagram, siteA.peer)
+	waitTestESPPacket(t, actorB, packet)
+	spoofer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("can not create the udp socket %v \n", err)
+	}
+	defer spoofer.Close()
+	spoofer.WriteToUDP(datagram, siteA.peer)
+	time.Sleep(100 * time.Millisecond)
+	siteB.lock.RLock()
+	peerPort := siteB.peer.Port
+	siteB.lock.RUnlock()
+	if peerPort != 45001 || len(actorB.packets) != 0 {
+		t.Fatalf("replayed packet moved the peer to %d \n", peerPort)
+	}
+
+	//traffic should continue over the new SAs after the packet lifetime
+	siteA.lock.Lock()
+	siteA.params.LifetimePackets = 5
+	siteA.lock.Unlock()
+	rekeyTestESP(t, siteA)
+	for i := 0; i < 20; i++ {
+		packet := createTestESPPacket("10.1.0.1", "10.2.0.1", []byte{byte(i)})
+		siteA.WriteData(factory.CreateProcessInfo(packet))
+		waitTestESPPacket(t, actorB, packet)
+		time.Sleep(5 * time.Millisecond)
+	}
+	if atomic.LoadUint64(&siteA.stat.Rekeys) < 8 {
+		t.Fatalf("tunnel is not rekeyed by the packet lifetime %v \n", siteA.stat)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+func TestESPRestart(t *testing.T) {
+	const pskA = "site-a-secret-key-0001"
+	const pskB = "site-b-secret-key-0002"
+
+	factory := vnet.CreateProcessFactory()
+	siteA, _ := createTestESP(t, "sitea", "127.0.0.1:45011", "127.0.0.1:45012", []string{"10.2.0.0/16"}, pskA, pskB, factory)
+	defer siteA.End()
+	siteB, actorB := createTestESP(t, "siteb", "127.0.0.1:45012", "127.0.0.1:45011", []string{"10.1.0.0/16"}, pskB, pskA, factory)
+	defer siteB.End()
+	oldSA := waitTestESPRekey(t, siteA, nil)
+	waitTestESPRekey(t, siteB, nil)
+
+	packet := createTestESPPacket("10.1.0.1", "10.2.0.1", []byte{7, 7, 7})
+	sa, seq, _ := siteA.getOutboundSA()
+	datagram := siteA.encrypt(sa, seq, packet)
+	siteA.socket.WriteToUDP(datagram, siteA.peer)
+	waitTestESPPacket(t, actorB, packet)
+
+	//the re-created server does not know the old SPIs, the peer should rekey by its offer
+	siteB.End()
+	siteB, actorB = createTestESP(t, "siteb", "127.0.0.1:45012", "127.0.0.1:45011", []string{"10.1.0.0/16"}, pskB, pskA, factory)
+	defer siteB.End()
+	waitTestESPRekey(t, siteA, oldSA)
+	waitTestESPRekey(t, siteB, nil)
+
+	siteA.socket.WriteToUDP(datagram, siteA.peer)
+	time.Sleep(100 * time.Millisecond)
+	if atomic.LoadUint64(&siteB.stat.UnknownSPIs) != 1 || atomic.LoadUint64(&siteB.stat.DecryptedPacket) != 0 || len(actorB.packets) != 0 {
+		t.Fatalf("replayed packet is accepted by the re-created server %v \n", siteB.stat)
+	}
+
+	siteA.WriteData(factory.CreateProcessInfo(packet))
+	waitTestESPPacket(t, actorB, packet)
+}
@@ -0,0 +1,254 @@
+package protocols
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"goconnect/common"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+//---------------------------------------------------------------------------------------
+
+const (
+	greFlagChecksum  = 0x8000
+	greFlagRouting   = 0x4000
+	greFlagKey       = 0x2000
+	greFlagSequence  = 0x1000
+	greVersionMask   = 0x0007
+	greProtocolIPv4  = 0x0800
+	greProtocolIPv6  = 0x86dd
+	greIPProtocol    = 47
+	greHeaderLen     = 4
+	greMaxReadBuffer = 65535
+)
+
+//---------------------------------------------------------------------------------------
+
+//SGREInitParams ...
+type SGREInitParams struct {
+	Name           string
+	LocalAddress   string
+	RemoteAddress  string
+	Key            uint32
+	Routes         []string
+	Utils          common.IUtils
+	PacketFactory  common.IProcessFactory
+	ProtocolActor  common.IProtocolActor
+	NetworkManager common.INICManager
+	Commander      common.ICommander
+}
+
+//---------------------------------------------------------------------------------------
+
+//cGRE is a userspace GRE (RFC 2784, RFC 2890) tunnel over IPv4 or IPv6
+type cGRE struct {
+	cPacketTunnel
+	params SGREInitParams
+	remote *net.IPAddr
+	socket *net.IPConn
+}
+
+//---------------------------------------------------------------------------------------
+
+//greChecksum is the internet checksum of the GRE header and payload
+func greChecksum(data []byte) uint16 {
+	sum := uint32(0)
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+//---------------------------------------------------------------------------------------
+
+//encapsulate adds the GRE header
+func (thisPt *cGRE) encapsulate(packet []byte) []byte {
+	headerLen := greHeaderLen
+	flags := uint16(0)
+	if thisPt.params.Key != 0 {
+		headerLen += 4
+		flags |= greFlagKey
+	}
+
+	protocol := uint16(greProtocolIPv4)
+	if len(packet) > 0 && packet[0]>>4 == 6 {
+		protocol = greProtocolIPv6
+	}
+
+	message := make([]byte, headerLen+len(packet))
+	binary.BigEndian.PutUint16(message[0:], flags)
+	binary.BigEndian.PutUint16(message[2:], protocol)
+	if thisPt.params.Key != 0 {
+		binary.BigEndian.PutUint32(message[4:], thisPt.params.Key)
+	}
+	copy(message[headerLen:], packet)
+	return message
+}
+
+//---------------------------------------------------------------------------------------
+
+//decapsulate returns the inner packet of the GRE message
+func (thisPt *cGRE) decapsulate(message []byte) ([]byte, error) {
+	if len(message) < greHeaderLen {
+		return nil, errors.New("short GRE header")
+	}
+
+	flags := binary.BigEndian.Uint16(message[0:])
+	protocol := binary.BigEndian.Uint16(message[2:])
+	if flags&greVersionMask != 0 || flags&greFlagRouting != 0 {
+		return nil, errors.New("unsupported GRE version")
+	}
+
+	offset := greHeaderLen
+	if flags&greFlagChecksum != 0 {
+		if len(message) < offset+4 || greChecksum(message) != 0 {
+			return nil, errors.New("invalid GRE checksum")
+		}
+		offset += 4
+	}
+
+	key := uint32(0)
+	if flags&greFlagKey != 0 {
+		if len(message) < offset+4 {
+			return nil, errors.New("short GRE header")
+		}
+		key = binary.BigEndian.Uint32(message[offset:])
+		offset += 4
+	}
+	if key != thisPt.params.Key {
+		return nil, errors.New("invalid GRE key")
+	}
+
+	if flags&greFlagSequence != 0 {
+		offset += 4
+	}
+
+	if len(message) < offset || (protocol != greProtocolIPv4 && protocol != greProtocolIPv6) {
+		return nil, errors.New("unsupported GRE payload")
+	}
+	return message[offset:], nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//isKeepAlive checks for the GRE keepalives of the routers. the inner packet is a GRE packet to the router itself
+func (thisPt *cGRE) isKeepAlive(inner []byte) bool {
+	if len(inner) < 20 || inner[0]>>4 != 4 || inner[9] != greIPProtocol {
+		return false
+	}
+	return net.IP(inner[16:20]).Equal(thisPt.remote.IP)
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cGRE) read() {
+	buffer := make([]byte, greMaxReadBuffer)
+	for {
+		//IPv4 header is removed by the socket
+		n, source, err := thisPt.socket.ReadFromIP(buffer)
+		if err != nil {
+			if thisPt.isEnded() {
+				return
+			}
+			log.Printf("can not read from GRE tunnel %s with error %s \n", thisPt.Name, err.Error())
+			time.Sleep(1 * time.Second)
+			continue
+		}
+
+		if !source.IP.Equal(thisPt.remote.IP) {
+			atomic.AddUint64(&thisPt.stat.UnknownSources, 1)
+			continue
+		}
+
+		inner, err := thisPt.decapsulate(buffer[:n])
+		if err != nil {
+			atomic.AddUint64(&thisPt.stat.InvalidPackets, 1)
+			continue
+		}
+
+		//the keepalive is reflected to the router
+		if thisPt.isKeepAlive(inner) {
+			atomic.AddUint64(&thisPt.stat.KeepAlives, 1)
+			if length := getIPPacketLength(inner); length > 20 && length <= len(inner) {
+				thisPt.socket.WriteToIP(inner[20:length], thisPt.remote)
+			}
+			continue
+		}
+
+		thisPt.onPacket(inner)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//Write override cNICBase.write
+func (thisPt *cGRE) WriteData(data common.IProcessInfo) {
+	if _, err := thisPt.socket.WriteToIP(thisPt.encapsulate(data.GetBuffer()), thisPt.remote); err != nil {
+		atomic.AddUint64(&thisPt.stat.WriteErrors, 1)
+		return
+	}
+	thisPt.UpdateReceive(data)
+}
+
+//---------------------------------------------------------------------------------------
+
+//End override cNICBase.end
+func (thisPt *cGRE) End() {
+	if thisPt.end() {
+		thisPt.socket.Close()
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cGRE) Init(params SGREInitParams) error {
+	thisPt.params = params
+	if err := thisPt.init(params.Name, "gre", params.Routes, params.Utils, params.PacketFactory, params.ProtocolActor); err != nil {
+		return err
+	}
+
+	local := net.ParseIP(params.LocalAddress)
+	remote := net.ParseIP(params.RemoteAddress)
+	if local == nil || remote == nil || (local.To4() == nil) != (remote.To4() == nil) {
+		return errors.New("invalid GRE tunnel addresses " + params.LocalAddress + " " + params.RemoteAddress)
+	}
+	thisPt.localAddress = local.String()
+	thisPt.remoteAddress = remote.String()
+	thisPt.remote = &net.IPAddr{IP: remote}
+	thisPt.Ip = remote
+
+	network := "ip6:gre"
+	if remote.To4() != nil {
+		network = "ip4:gre"
+	}
+
+	var err error
+	if thisPt.socket, err = net.ListenIP(network, &net.IPAddr{IP: local}); err != nil {
+		return err
+	}
+
+	if thisPt.params.NetworkManager != nil {
+		thisPt.params.NetworkManager.RegisterNIC(thisPt)
+	}
+
+	//
+	go thisPt.read()
+
+	//register api
+	if thisPt.params.Commander != nil {
+		selector := thisPt.params.Commander.CreateSelector()
+		selector.Register(fmt.Sprintf("gre_%s_status", thisPt.Name), thisPt.OnStatusCommand, nil)
+	}
+
+	return nil
+}
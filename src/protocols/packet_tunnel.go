@@ -0,0 +1,145 @@
+package protocols
+
+import (
+	"encoding/binary"
+	"goconnect/common"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+//---------------------------------------------------------------------------------------
+
+type sPacketTunnelStat struct {
+	InvalidPackets uint64 `json:"invalid_packets"`
+	UnknownSources uint64 `json:"unknown_sources"`
+	KeepAlives     uint64 `json:"keepalives"`
+	WriteErrors    uint64 `json:"write_errors"`
+}
+
+//---------------------------------------------------------------------------------------
+
+//cPacketTunnel is the base of the stateless tunnels to the routers, e.g. GRE and VXLAN
+type cPacketTunnel struct {
+	cNICBase
+	tunnelType    string
+	localAddress  string
+	remoteAddress string
+	packetFactory common.IProcessFactory
+	protocolActor common.IProtocolActor
+	utils         common.IUtils
+	stat          sPacketTunnelStat
+	done          chan bool
+}
+
+//---------------------------------------------------------------------------------------
+
+//init registers the tunnel as a NIC
+func (thisPt *cPacketTunnel) init(name string, tunnelType string, routes []string, utils common.IUtils, factory common.IProcessFactory, actor common.IProtocolActor) error {
+	thisPt.Id = utils.GetUniqID()
+	thisPt.Name = name
+	thisPt.NicType = common.INICTypePeer
+	thisPt.tunnelType = tunnelType
+	thisPt.utils = utils
+	thisPt.packetFactory = factory
+	thisPt.protocolActor = actor
+	thisPt.done = make(chan bool)
+
+	for _, r := range routes {
+		_, netres, err := net.ParseCIDR(r)
+		if err != nil {
+			return err
+		}
+		thisPt.Routes = append(thisPt.Routes, *netres)
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//isEnded checks whether the read error is because of the tunnel termination
+func (thisPt *cPacketTunnel) isEnded() bool {
+	select {
+	case <-thisPt.done:
+		return true
+	default:
+	}
+	return false
+}
+
+//---------------------------------------------------------------------------------------
+
+//end should be called once by the tunnels
+func (thisPt *cPacketTunnel) end() bool {
+	if thisPt.isEnded() {
+		return false
+	}
+	close(thisPt.done)
+	return true
+}
+
+//---------------------------------------------------------------------------------------
+
+//getIPPacketLength returns the IP packet length without the padding of the tunnels
+func getIPPacketLength(packet []byte) int {
+	switch {
+	case len(packet) >= 20 && packet[0]>>4 == 4:
+		return int(binary.BigEndian.Uint16(packet[2:]))
+	case len(packet) >= 40 && packet[0]>>4 == 6:
+		return 40 + int(binary.BigEndian.Uint16(packet[4:]))
+	}
+	return 0
+}
+
+//---------------------------------------------------------------------------------------
+
+//onPacket passes the decapsulated packet to the actor
+func (thisPt *cPacketTunnel) onPacket(inner []byte) {
+	length := getIPPacketLength(inner)
+	if length == 0 || length > len(inner) {
+		atomic.AddUint64(&thisPt.stat.InvalidPackets, 1)
+		return
+	}
+
+	packet := thisPt.packetFactory.CreateProcessInfo(inner[:length])
+	if !packet.ProcessAsNetPacket() {
+		atomic.AddUint64(&thisPt.stat.InvalidPackets, 1)
+		thisPt.packetFactory.FreeProcessInfo(packet)
+		return
+	}
+
+	//the packet is owned by the actor after this call
+	packet.SetInNIC(thisPt.Id)
+	thisPt.UpdateSend(packet)
+	thisPt.protocolActor.OnNewPacket(packet)
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cPacketTunnel) OnStatusCommand(req *http.Request, params interface{}) (common.IHTTPResponse, error) {
+	type sPacketTunnelStatus struct {
+		Name          string               `json:"name"`
+		Type          string               `json:"type"`
+		LocalAddress  string               `json:"local_address"`
+		RemoteAddress string               `json:"remote_address"`
+		Routes        []string             `json:"routes"`
+		Transfer      common.STransferStat `json:"transfer"`
+		Stat          sPacketTunnelStat    `json:"stat"`
+	}
+
+	status := sPacketTunnelStatus{}
+	status.Name = thisPt.Name
+	status.Type = thisPt.tunnelType
+	status.LocalAddress = thisPt.localAddress
+	status.RemoteAddress = thisPt.remoteAddress
+	status.Routes = []string{}
+	for _, route := range thisPt.Routes {
+		status.Routes = append(status.Routes, route.String())
+	}
+	status.Transfer = thisPt.GetStat()
+	status.Stat.InvalidPackets = atomic.LoadUint64(&thisPt.stat.InvalidPackets)
+	status.Stat.UnknownSources = atomic.LoadUint64(&thisPt.stat.UnknownSources)
+	status.Stat.KeepAlives = atomic.LoadUint64(&thisPt.stat.KeepAlives)
+	status.Stat.WriteErrors = atomic.LoadUint64(&thisPt.stat.WriteErrors)
+	return thisPt.utils.CreateHttpResponseFromObject(status)
+}
@@ -0,0 +1,128 @@
+package protocols
+
+import (
+	"bytes"
+	"encoding/binary"
+	"goconnect/common"
+	"goconnect/utils"
+	"goconnect/vnet"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//---------------------------------------------------------------------------------------
+
+func TestGRE(t *testing.T) {
+	factory := vnet.CreateProcessFactory()
+	actorA := &sTestESPActor{factory: factory, packets: make(chan []byte, 64)}
+	actorB := &sTestESPActor{factory: factory, packets: make(chan []byte, 64)}
+
+	siteA := new(cGRE)
+	err := siteA.Init(SGREInitParams{Name: "grea", LocalAddress: "127.0.0.1", RemoteAddress: "127.0.0.2", Key: 10, Routes: []string{"10.2.0.0/16"}, Utils: utils.Create(), PacketFactory: factory, ProtocolActor: actorA})
+	if err != nil {
+		t.Skipf("can not open GRE socket %v \n", err)
+	}
+	defer siteA.End()
+
+	siteB := new(cGRE)
+	if err := siteB.Init(SGREInitParams{Name: "greb", LocalAddress: "127.0.0.2", RemoteAddress: "127.0.0.1", Key: 10, Routes: []string{"10.1.0.0/16"}, Utils: utils.Create(), PacketFactory: factory, ProtocolActor: actorB}); err != nil {
+		t.Fatalf("can not init GRE tunnel %v \n", err)
+	}
+	defer siteB.End()
+
+	if siteA.GetType() != common.INICTypePeer || len(siteA.GetRoutes()) != 1 {
+		t.Fatalf("invalid NIC \n")
+	}
+
+	//both directions
+	packet := createTestESPPacket("10.1.0.1", "10.2.0.1", []byte{1, 2, 3})
+	siteA.WriteData(factory.CreateProcessInfo(packet))
+	waitTestESPPacket(t, actorB, packet)
+
+	packet = createTestESPPacket("10.2.0.1", "10.1.0.1", []byte{4, 5})
+	siteB.WriteData(factory.CreateProcessInfo(packet))
+	waitTestESPPacket(t, actorA, packet)
+
+	if siteA.GetStat().ReceivePacket != 1 || siteA.GetStat().SendPacket != 1 {
+		t.Fatalf("invalid NIC stat %v \n", siteA.GetStat())
+	}
+
+	//invalid key
+	wrongKey := cGRE{params: SGREInitParams{Key: 11}}
+	siteA.socket.WriteToIP(wrongKey.encapsulate(packet), siteA.remote)
+	time.Sleep(100 * time.Millisecond)
+	if atomic.LoadUint64(&siteB.stat.InvalidPackets) != 1 || len(actorB.packets) != 0 {
+		t.Fatalf("invalid key is accepted \n")
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+func TestGREDecapsulate(t *testing.T) {
+	tunnel := cGRE{}
+	inner := createTestESPPacket("10.1.0.1", "10.2.0.1", []byte{1})
+
+	//checksum, key and sequence
+	message := make([]byte, 16+len(inner))
+	binary.BigEndian.PutUint16(message[0:], greFlagChecksum|greFlagKey|greFlagSequence)
+	binary.BigEndian.PutUint16(message[2:], greProtocolIPv4)
+	copy(message[16:], inner)
+	binary.BigEndian.PutUint16(message[4:], greChecksum(message))
+
+	if result, err := tunnel.decapsulate(message); err != nil || !bytes.Equal(result, inner) {
+		t.Fatalf("can not decapsulate GRE packet %v \n", err)
+	}
+
+	message[20] ^= 0xff
+	if _, err := tunnel.decapsulate(message); err == nil {
+		t.Fatalf("invalid checksum is accepted \n")
+	}
+
+	if _, err := tunnel.decapsulate(tunnel.encapsulate(inner)[:2]); err == nil {
+		t.Fatalf("short header is accepted \n")
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+func TestVXLAN(t *testing.T) {
+	factory := vnet.CreateProcessFactory()
+	actorA := &sTestESPActor{factory: factory, packets: make(chan []byte, 64)}
+	actorB := &sTestESPActor{factory: factory, packets: make(chan []byte, 64)}
+
+	siteA := new(cVXLAN)
+	if err := siteA.Init(SVXLANInitParams{Name: "vxlana", BindAddress: "127.0.0.1:45301", RemoteAddress: "127.0.0.1:45302", VNI: 100, Routes: []string{"2001:db8:2::/48"}, Utils: utils.Create(), PacketFactory: factory, ProtocolActor: actorA}); err != nil {
+		t.Fatalf("can not init VXLAN tunnel %v \n", err)
+	}
+	defer siteA.End()
+
+	siteB := new(cVXLAN)
+	if err := siteB.Init(SVXLANInitParams{Name: "vxlanb", BindAddress: "127.0.0.1:45302", RemoteAddress: "127.0.0.1:45301", VNI: 100, Routes: []string{"10.1.0.0/16"}, Utils: utils.Create(), PacketFactory: factory, ProtocolActor: actorB}); err != nil {
+		t.Fatalf("can not init VXLAN tunnel %v \n", err)
+	}
+	defer siteB.End()
+
+	packet := createTestESPPacket("10.1.0.1", "10.2.0.1", []byte{1, 2, 3})
+	siteA.WriteData(factory.CreateProcessInfo(packet))
+	waitTestESPPacket(t, actorB, packet)
+
+	packet = createTestESPPacket("10.2.0.1", "10.1.0.1", []byte{4})
+	siteB.WriteData(factory.CreateProcessInfo(packet))
+	waitTestESPPacket(t, actorA, packet)
+
+	//VNI mismatch and unknown sources
+	message := siteA.encapsulate(packet)
+	binary.BigEndian.PutUint32(message[4:], 101<<8)
+	siteA.socket.WriteToUDP(message, siteB.socket.LocalAddr().(*net.UDPAddr))
+
+	other, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.2")})
+	defer other.Close()
+	other.WriteToUDP(siteA.encapsulate(packet), siteB.socket.LocalAddr().(*net.UDPAddr))
+
+	time.Sleep(100 * time.Millisecond)
+	if atomic.LoadUint64(&siteB.stat.InvalidPackets) != 1 || atomic.LoadUint64(&siteB.stat.UnknownSources) != 1 || len(actorB.packets) != 0 {
+		t.Fatalf("invalid packets are accepted %v \n", siteB.stat)
+	}
+}
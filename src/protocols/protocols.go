@@ -21,3 +21,53 @@ func CreateSSLVPN(params SSSLVpnInitParams) {
 		log.Fatalln(err)
 	}
 }
+
+//---------------------------------------------------------------------------------------
+
+//CreateESPTunnel ...
+func CreateESPTunnel(params SESPInitParams) {
+	esp := new(cESP)
+	if err := esp.Init(params); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//CreateWireGuardServer ...
+func CreateWireGuardServer(params SWireGuardInitParams) {
+	wg := new(cWireGuardServer)
+	if err := wg.Init(params); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//CreateGRETunnel ...
+func CreateGRETunnel(params SGREInitParams) {
+	gre := new(cGRE)
+	if err := gre.Init(params); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//CreateVXLANTunnel ...
+func CreateVXLANTunnel(params SVXLANInitParams) {
+	vxlan := new(cVXLAN)
+	if err := vxlan.Init(params); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//CreateProxyServer ...
+func CreateProxyServer(params SProxyInitParams) {
+	proxy := new(cProxyServer)
+	if err := proxy.Init(params); err != nil {
+		log.Fatalln(err)
+	}
+}
@@ -0,0 +1,796 @@
+package protocols
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"goconnect/common"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+//---------------------------------------------------------------------------------------
+
+const (
+	proxySocksVersion     = 5
+	proxySocksAuthVersion = 1
+	proxySocksAuthUser    = 2
+	proxySocksNoMethod    = 0xff
+	proxySocksConnect     = 1
+	proxySocksIPv4        = 1
+	proxySocksDomain      = 3
+	proxySocksIPv6        = 4
+)
+
+//---------------------------------------------------------------------------------------
+
+//results of the connect requests, mapped to the SOCKS replies and HTTP status codes
+const (
+	proxyResultOK          = 0
+	proxyResultFailure     = 1
+	proxyResultBlocked     = 2
+	proxyResultNoRoute     = 3
+	proxyResultUnreachable = 4
+	proxyResultRefused     = 5
+	proxyResultUnsupported = 7
+	proxyResultAuth        = 0x100
+)
+
+//---------------------------------------------------------------------------------------
+
+const (
+	proxyHandshakeTimeout = 30 * time.Second
+	proxyDialTimeout      = 10 * time.Second
+	proxyBufferSize       = 32 * 1024
+	proxyDefaultIdle      = 300
+)
+
+//---------------------------------------------------------------------------------------
+
+//SProxyInitParams ...
+type SProxyInitParams struct {
+	BindAddress  string
+	IdleTimeout  uint32
+	Utils        common.IUtils
+	AuthMan      common.IAuthenticationManger
+	IPPool       common.IIPPoolManager
+	RouteTracer  common.IRouteTracer
+	NicManager   common.INICManager
+	FlowExporter common.IFlowExporter
+	Commander    common.ICommander
+}
+
+//---------------------------------------------------------------------------------------
+
+type sProxyStat struct {
+	Connections     uint64 `json:"connections"`
+	AuthFailures    uint64 `json:"auth_failures"`
+	Blocked         uint64 `json:"blocked"`
+	ConnectErrors   uint64 `json:"connect_errors"`
+	InvalidRequests uint64 `json:"invalid_requests"`
+}
+
+//---------------------------------------------------------------------------------------
+
+//sProxyRequest is a connect request of the SOCKS or HTTP clients
+type sProxyRequest struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	socks   bool
+	host    string
+	port    uint16
+	session *cProxySession
+}
+
+//---------------------------------------------------------------------------------------
+
+//cProxySession is the accounting session of a user and client IP, shared by all the connections of the client
+type cProxySession struct {
+	key        string
+	user       string
+	clientIP   net.IP
+	virtualIP  net.IP
+	allocation common.SIPAllocation
+	accSession common.IAccountingSession
+	conns      map[net.Conn]bool
+	lastActive int64
+	released   bool
+}
+
+//---------------------------------------------------------------------------------------
+
+//cProxyServer accepts the SOCKS5 and HTTP CONNECT requests on the same listener,
+//the connections are originated by the gateway after the same policy and route checks as the tunnel packets
+type cProxyServer struct {
+	params   SProxyInitParams
+	listener net.Listener
+	sessions map[string]*cProxySession
+	lock     sync.Mutex
+	done     chan bool
+	stat     sProxyStat
+	dial     func(network string, address string, timeout time.Duration) (net.Conn, error) //net.DialTimeout
+}
+
+//---------------------------------------------------------------------------------------
+
+//touchSession returns the active session of the key
+func (thisPt *cProxyServer) touchSession(key string) *cProxySession {
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+
+	session, ok := thisPt.sessions[key]
+	if !ok {
+		return nil
+	}
+	session.lastActive = time.Now().Unix()
+	return session
+}
+
+//---------------------------------------------------------------------------------------
+
+//getSession authenticates the user and returns the session of the client, a new session is created for the new clients
+func (thisPt *cProxyServer) getSession(user string, password string, clientIP net.IP) (*cProxySession, error) {
+	authParams := common.SAuthenticationInfo{}
+	authParams.User = user
+	authParams.Password = password
+	authParams.IP = clientIP
+	authenticator, err := thisPt.params.AuthMan.AuthenticateUser(authParams)
+	if err != nil {
+		atomic.AddUint64(&thisPt.stat.AuthFailures, 1)
+		return nil, err
+	}
+
+	key := user + "/" + clientIP.String()
+	if session := thisPt.touchSession(key); session != nil {
+		return session, nil
+	}
+
+	//the oldest sessions may be stopped, so it should be called without the lock
+	if err := thisPt.params.AuthMan.CheckSessionLimit(user, authenticator); err != nil {
+		atomic.AddUint64(&thisPt.stat.AuthFailures, 1)
+		return nil, err
+	}
+	userInfo := thisPt.params.AuthMan.GetUserInfo(user, authenticator)
+
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+
+	//a parallel request of the client has created the session
+	if session, ok := thisPt.sessions[key]; ok {
+		thisPt.params.AuthMan.ReleaseSessionLimit(user)
+		session.lastActive = time.Now().Unix()
+		return session, nil
+	}
+
+	//the virtual IP is the source of the policies, the IPv4 is preferred for the dual stack pools
+	allocation, err := thisPt.params.IPPool.AllocateIP(user, authenticator.GetType(), userInfo)
+	if err != nil {
+		thisPt.params.AuthMan.ReleaseSessionLimit(user)
+		return nil, err
+	}
+	ip := allocation.IP
+	if ip == nil {
+		ip = allocation.IP6
+	}
+
+	session := &cProxySession{key: key, user: user, clientIP: clientIP, virtualIP: ip, allocation: allocation}
+	session.conns = make(map[net.Conn]bool)
+	session.lastActive = time.Now().Unix()
+
+	info := common.SAccountingInfo{}
+	info.User = user
+	info.UserIP = clientIP
+	info.VirtualIP = ip
+	session.accSession = authenticator.CreateAccountingSession(info)
+	session.accSession.RegisterDCCallBack(func(acc common.IAccountingSession, data interface{}) bool {
+		//closing the connections in case of the accounting session termination
+		thisPt.releaseSession(data.(*cProxySession))
+		return true
+	}, session)
+	session.accSession.Start()
+
+	thisPt.sessions[key] = session
+	return session, nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//releaseSession closes the connections of the session and frees the virtual IP
+func (thisPt *cProxyServer) releaseSession(session *cProxySession) {
+	thisPt.lock.Lock()
+	if thisPt.sessions[session.key] == session {
+		delete(thisPt.sessions, session.key)
+	}
+	if session.released {
+		thisPt.lock.Unlock()
+		return
+	}
+	session.released = true
+	conns := session.conns
+	session.conns = make(map[net.Conn]bool)
+	thisPt.lock.Unlock()
+
+	for conn := range conns {
+		conn.Close()
+	}
+	thisPt.params.IPPool.FreeIP(session.allocation.IP)
+	thisPt.params.IPPool.FreeIP(session.allocation.IP6)
+}
+
+//---------------------------------------------------------------------------------------
+
+//addConnection should be called after the connect, the connections of the released sessions are rejected
+func (thisPt *cProxyServer) addConnection(session *cProxySession, conn net.Conn) bool {
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+
+	if session.released {
+		return false
+	}
+	session.conns[conn] = true
+	return true
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cProxyServer) removeConnection(session *cProxySession, conn net.Conn) {
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+
+	delete(session.conns, conn)
+	session.lastActive = time.Now().Unix()
+}
+
+//---------------------------------------------------------------------------------------
+
+//checkSessions stops the sessions without any connection after the idle timeout
+func (thisPt *cProxyServer) checkSessions() {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-thisPt.done:
+			return
+		case now := <-ticker.C:
+			inactives := []*cProxySession{}
+			thisPt.lock.Lock()
+			for key, session := range thisPt.sessions {
+				if len(session.conns) == 0 && now.Unix()-session.lastActive >= int64(thisPt.params.IdleTimeout) {
+					delete(thisPt.sessions, key)
+					inactives = append(inactives, session)
+				}
+			}
+			thisPt.lock.Unlock()
+
+			//the DC callback needs the lock
+			for _, session := range inactives {
+				session.accSession.Stop()
+			}
+		}
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//readSocksRequest reads the SOCKS5 negotiation, only the user/password method and the connect command are supported
+func (thisPt *cProxyServer) readSocksRequest(request *sProxyRequest) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(request.reader, header); err != nil {
+		return err
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(request.reader, methods); err != nil {
+		return err
+	}
+
+	selected := byte(proxySocksNoMethod)
+	for _, method := range methods {
+		if method == proxySocksAuthUser {
+			selected = proxySocksAuthUser
+		}
+	}
+	if _, err := request.conn.Write([]byte{proxySocksVersion, selected}); err != nil {
+		return err
+	}
+	if selected == proxySocksNoMethod {
+		return errors.New("client does not support the user/password authentication")
+	}
+
+	//RFC 1929
+	readField := func() (string, error) {
+		size, err := request.reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		field := make([]byte, size)
+		_, err = io.ReadFull(request.reader, field)
+		return string(field), err
+	}
+
+	version, err := request.reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	if version != proxySocksAuthVersion {
+		return errors.New("invalid SOCKS authentication version")
+	}
+	user, err := readField()
+	if err != nil {
+		return err
+	}
+	password, err := readField()
+	if err != nil {
+		return err
+	}
+
+	if request.session, err = thisPt.getSession(user, password, thisPt.getClientIP(request.conn)); err != nil {
+		request.conn.Write([]byte{proxySocksAuthVersion, 1})
+		return err
+	}
+	if _, err := request.conn.Write([]byte{proxySocksAuthVersion, 0}); err != nil {
+		return err
+	}
+
+	//connect request
+	header = make([]byte, 4)
+	if _, err := io.ReadFull(request.reader, header); err != nil {
+		return err
+	}
+	if header[0] != proxySocksVersion || header[1] != proxySocksConnect {
+		thisPt.reply(request, proxyResultUnsupported, nil)
+		return errors.New("unsupported SOCKS command")
+	}
+
+	switch header[3] {
+	case proxySocksIPv4, proxySocksIPv6:
+		ip := make([]byte, net.IPv4len)
+		if header[3] == proxySocksIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(request.reader, ip); err != nil {
+			return err
+		}
+		request.host = net.IP(ip).String()
+	case proxySocksDomain:
+		if request.host, err = readField(); err != nil {
+			return err
+		}
+	default:
+		thisPt.reply(request, proxyResultUnsupported, nil)
+		return errors.New("unsupported SOCKS address type")
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(request.reader, port); err != nil {
+		return err
+	}
+	request.port = binary.BigEndian.Uint16(port)
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//readHTTPRequest reads the CONNECT request, the credentials are sent by the basic proxy authorization
+func (thisPt *cProxyServer) readHTTPRequest(request *sProxyRequest) error {
+	req, err := http.ReadRequest(request.reader)
+	if err != nil {
+		return err
+	}
+	if req.Method != http.MethodConnect {
+		thisPt.reply(request, proxyResultUnsupported, nil)
+		return errors.New("unsupported HTTP method " + req.Method)
+	}
+
+	host, port, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		thisPt.reply(request, proxyResultUnsupported, nil)
+		return err
+	}
+	portNumber, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		thisPt.reply(request, proxyResultUnsupported, nil)
+		return err
+	}
+	request.host = host
+	request.port = uint16(portNumber)
+
+	user, password := "", ""
+	authorization := req.Header.Get("Proxy-Authorization")
+	if strings.HasPrefix(authorization, "Basic ") {
+		if credentials, err := base64.StdEncoding.DecodeString(authorization[6:]); err == nil {
+			if index := strings.IndexByte(string(credentials), ':'); index >= 0 {
+				user, password = string(credentials[:index]), string(credentials[index+1:])
+			}
+		}
+	}
+
+	if request.session, err = thisPt.getSession(user, password, thisPt.getClientIP(request.conn)); err != nil {
+		thisPt.reply(request, proxyResultAuth, nil)
+		return err
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//reply sends the result of the request, the bound address is used by the SOCKS clients
+func (thisPt *cProxyServer) reply(request *sProxyRequest, result int, bound net.Addr) error {
+	if request.socks {
+		response := []byte{proxySocksVersion, byte(result), 0, proxySocksIPv4, 0, 0, 0, 0, 0, 0}
+		if address, ok := bound.(*net.TCPAddr); ok {
+			if ip := address.IP.To4(); ip != nil {
+				copy(response[4:], ip)
+			} else {
+				response = append(response[:3], proxySocksIPv6)
+				response = append(response, address.IP.To16()...)
+				response = append(response, 0, 0)
+			}
+			binary.BigEndian.PutUint16(response[len(response)-2:], uint16(address.Port))
+		}
+		_, err := request.conn.Write(response)
+		return err
+	}
+
+	status := http.StatusBadGateway
+	switch result {
+	case proxyResultOK:
+		status = http.StatusOK
+	case proxyResultAuth:
+		status = http.StatusProxyAuthRequired
+	case proxyResultBlocked:
+		status = http.StatusForbidden
+	case proxyResultUnsupported:
+		status = http.StatusMethodNotAllowed
+	}
+
+	response := fmt.Sprintf("HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	if result == proxyResultAuth {
+		response += "Proxy-Authenticate: Basic realm=\"goconnect\"\r\n"
+	}
+	if result != proxyResultOK {
+		response += "Content-Length: 0\r\nConnection: close\r\n"
+	}
+	_, err := request.conn.Write([]byte(response + "\r\n"))
+	return err
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cProxyServer) getClientIP(conn net.Conn) net.IP {
+	if address, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return address.IP
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//resolve returns the addresses of the host with the same version as the virtual IP
+func (thisPt *cProxyServer) resolve(host string, virtualIP net.IP) []net.IP {
+	ips := []net.IP{}
+	if ip := net.ParseIP(host); ip != nil {
+		ips = append(ips, ip)
+	} else if addresses, err := net.LookupIP(host); err == nil {
+		ips = addresses
+	}
+
+	result := []net.IP{}
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (virtualIP.To4() != nil) {
+			result = append(result, ip)
+		}
+	}
+	return result
+}
+
+//---------------------------------------------------------------------------------------
+
+//isGatewayAddress checks whether the destination is the gateway itself or an address which is not reachable by the tunnels
+func (thisPt *cProxyServer) isGatewayAddress(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsMulticast() {
+		return true
+	}
+
+	addresses, err := net.InterfaceAddrs()
+	if err != nil {
+		return true
+	}
+	for _, address := range addresses {
+		if network, ok := address.(*net.IPNet); ok && network.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//---------------------------------------------------------------------------------------
+
+//isTUNRoute checks whether the destination is routed to the TUN device, the connections are originated by the host stack
+//so the other NICs, e.g. the tunnels and the client sessions, can not be reached by the proxy
+func (thisPt *cProxyServer) isTUNRoute(source net.IP, destination net.IP) bool {
+	route, err := thisPt.params.RouteTracer.Lookup(destination, source)
+	if err != nil || route.Selected == 0 || route.Selected == common.ROUTENICBLACKHOLE {
+		return false
+	}
+	return thisPt.params.NicManager.GetNICType(route.Selected) == common.INICTypeTUN
+}
+
+//---------------------------------------------------------------------------------------
+
+//connect originates the connection after the policy and route checks, the virtual IP of the session is the source
+func (thisPt *cProxyServer) connect(request *sProxyRequest) (net.Conn, *common.SFlowRecord, int) {
+	session := request.session
+	ips := thisPt.resolve(request.host, session.virtualIP)
+	if len(ips) == 0 {
+		log.Printf("proxy can not resolve %s for user %s \n", request.host, session.user)
+		return nil, nil, proxyResultUnreachable
+	}
+
+	record := &common.SFlowRecord{}
+	record.Source = session.virtualIP
+	record.Destination = ips[0]
+	record.SourcePort = uint16(49152 + rand.Intn(16384))
+	record.DestinationPort = request.port
+	record.Protocol = uint8(syscall.IPPROTO_TCP)
+
+	if thisPt.isGatewayAddress(record.Destination) {
+		atomic.AddUint64(&thisPt.stat.Blocked, 1)
+		log.Printf("proxy connection of user %s to the gateway address %s:%d is refused \n", session.user, record.Destination, request.port)
+		return nil, nil, proxyResultBlocked
+	}
+
+	reason, err := thisPt.params.RouteTracer.Evaluate(record.Source, record.Destination, "tcp", record.SourcePort, record.DestinationPort)
+	switch {
+	case reason == common.ICMPREASONPROHIBITED:
+		atomic.AddUint64(&thisPt.stat.Blocked, 1)
+		log.Printf("proxy connection of user %s to %s:%d is blocked \n", session.user, record.Destination, request.port)
+		return nil, nil, proxyResultBlocked
+	case err != nil:
+		atomic.AddUint64(&thisPt.stat.ConnectErrors, 1)
+		log.Printf("proxy connection of user %s to %s:%d failed, %s \n", session.user, record.Destination, request.port, err.Error())
+		return nil, nil, proxyResultNoRoute
+	}
+
+	if !thisPt.isTUNRoute(record.Source, record.Destination) {
+		atomic.AddUint64(&thisPt.stat.ConnectErrors, 1)
+		log.Printf("proxy connection of user %s to %s:%d failed, the destination is not routed to the tun device \n", session.user, record.Destination, request.port)
+		return nil, nil, proxyResultNoRoute
+	}
+
+	address := net.JoinHostPort(record.Destination.String(), strconv.Itoa(int(request.port)))
+	target, err := thisPt.dial("tcp", address, proxyDialTimeout)
+	if err != nil {
+		atomic.AddUint64(&thisPt.stat.ConnectErrors, 1)
+		log.Printf("proxy connection of user %s to %s failed, %s \n", session.user, address, err.Error())
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, nil, proxyResultRefused
+		}
+		return nil, nil, proxyResultUnreachable
+	}
+
+	log.Printf("proxy connection of user %s from %s to %s \n", session.user, session.clientIP, address)
+	record.StartTime = time.Now().Unix()
+	return target, record, proxyResultOK
+}
+
+//---------------------------------------------------------------------------------------
+
+//relay copies the data of one direction, the closed connection ends the other direction too
+func (thisPt *cProxyServer) relay(dst net.Conn, src io.Reader, update func(uint64)) {
+	buffer := make([]byte, proxyBufferSize)
+	for {
+		n, err := src.Read(buffer)
+		if n > 0 {
+			update(uint64(n))
+			if _, err := dst.Write(buffer[:n]); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	dst.Close()
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cProxyServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	request := &sProxyRequest{conn: conn, reader: bufio.NewReader(conn)}
+	conn.SetDeadline(time.Now().Add(proxyHandshakeTimeout))
+
+	first, err := request.reader.Peek(1)
+	if err != nil {
+		return
+	}
+	request.socks = first[0] == proxySocksVersion
+	if request.socks {
+		err = thisPt.readSocksRequest(request)
+	} else {
+		err = thisPt.readHTTPRequest(request)
+	}
+	if err != nil {
+		if request.session == nil {
+			atomic.AddUint64(&thisPt.stat.InvalidRequests, 1)
+		}
+		log.Printf("invalid proxy request from %s, %s \n", conn.RemoteAddr().String(), err.Error())
+		return
+	}
+
+	session := request.session
+	target, record, result := thisPt.connect(request)
+	if result != proxyResultOK {
+		thisPt.reply(request, result, nil)
+		return
+	}
+	defer target.Close()
+
+	//closing the client connection by the session termination ends the both directions
+	if !thisPt.addConnection(session, conn) {
+		thisPt.reply(request, proxyResultFailure, nil)
+		return
+	}
+	defer thisPt.removeConnection(session, conn)
+
+	if err := thisPt.reply(request, proxyResultOK, target.LocalAddr()); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	atomic.AddUint64(&thisPt.stat.Connections, 1)
+
+	//the buffered data of the client is sent first
+	done := make(chan bool)
+	go func() {
+		thisPt.relay(conn, target, func(size uint64) {
+			session.accSession.UpdateReceive(size)
+			record.Stat.ReceiveByte += size
+			record.Stat.ReceivePacket++
+		})
+		close(done)
+	}()
+	thisPt.relay(target, request.reader, func(size uint64) {
+		session.accSession.UpdateSend(size)
+		record.Stat.SendByte += size
+		record.Stat.SendPacket++
+	})
+	<-done
+
+	if thisPt.params.FlowExporter != nil {
+		record.EndTime = time.Now().Unix()
+		record.EndReason = common.FLOWENDREASONEND
+		thisPt.params.FlowExporter.Export(record)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cProxyServer) accept() {
+	for {
+		conn, err := thisPt.listener.Accept()
+		if err != nil {
+			select {
+			case <-thisPt.done:
+				return
+			default:
+			}
+			log.Printf("can not accept proxy connection with error %s \n", err.Error())
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		go thisPt.handle(conn)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//End stops the server, the sessions are stopped too
+func (thisPt *cProxyServer) End() {
+	select {
+	case <-thisPt.done:
+		return
+	default:
+	}
+	close(thisPt.done)
+	thisPt.listener.Close()
+
+	thisPt.lock.Lock()
+	sessions := []*cProxySession{}
+	for _, session := range thisPt.sessions {
+		sessions = append(sessions, session)
+	}
+	thisPt.lock.Unlock()
+
+	for _, session := range sessions {
+		session.accSession.Stop()
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cProxyServer) OnSessionsCommand(req *http.Request, params interface{}) (common.IHTTPResponse, error) {
+	type sProxySessionStatus struct {
+		User        string               `json:"user"`
+		ClientIP    string               `json:"client_ip"`
+		VirtualIP   string               `json:"virtual_ip"`
+		SessionID   string               `json:"session_id"`
+		Connections int                  `json:"connections"`
+		LastActive  int64                `json:"last_active"`
+		Transfer    common.STransferStat `json:"transfer"`
+	}
+
+	type sProxyStatus struct {
+		Sessions []sProxySessionStatus `json:"sessions"`
+		Stat     sProxyStat            `json:"stat"`
+	}
+
+	status := sProxyStatus{}
+	status.Sessions = []sProxySessionStatus{}
+
+	thisPt.lock.Lock()
+	for _, session := range thisPt.sessions {
+		item := sProxySessionStatus{}
+		item.User = session.user
+		item.ClientIP = session.clientIP.String()
+		item.VirtualIP = session.virtualIP.String()
+		item.SessionID = session.accSession.GetSessionID()
+		item.Connections = len(session.conns)
+		item.LastActive = session.lastActive
+		item.Transfer = session.accSession.GetTransfer()
+		status.Sessions = append(status.Sessions, item)
+	}
+	thisPt.lock.Unlock()
+
+	status.Stat.Connections = atomic.LoadUint64(&thisPt.stat.Connections)
+	status.Stat.AuthFailures = atomic.LoadUint64(&thisPt.stat.AuthFailures)
+	status.Stat.Blocked = atomic.LoadUint64(&thisPt.stat.Blocked)
+	status.Stat.ConnectErrors = atomic.LoadUint64(&thisPt.stat.ConnectErrors)
+	status.Stat.InvalidRequests = atomic.LoadUint64(&thisPt.stat.InvalidRequests)
+	return thisPt.params.Utils.CreateHttpResponseFromObject(status)
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cProxyServer) Init(params SProxyInitParams) error {
+	thisPt.params = params
+	thisPt.done = make(chan bool)
+	thisPt.sessions = make(map[string]*cProxySession)
+	thisPt.dial = net.DialTimeout
+	if thisPt.params.IdleTimeout == 0 {
+		thisPt.params.IdleTimeout = proxyDefaultIdle
+	}
+
+	if thisPt.params.AuthMan == nil || thisPt.params.IPPool == nil || thisPt.params.RouteTracer == nil || thisPt.params.NicManager == nil {
+		return errors.New("proxy needs the authentication manager, IP pool, route tracer and NIC manager")
+	}
+
+	var err error
+	if thisPt.listener, err = net.Listen("tcp", thisPt.params.BindAddress); err != nil {
+		return err
+	}
+
+	//
+	go thisPt.accept()
+	go thisPt.checkSessions()
+
+	//register api
+	if thisPt.params.Commander != nil {
+		selector := thisPt.params.Commander.CreateSelector()
+		selector.Register("proxy_sessions", thisPt.OnSessionsCommand, nil)
+	}
+
+	return nil
+}
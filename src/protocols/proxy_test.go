@@ -0,0 +1,386 @@
+package protocols
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"goconnect/common"
+	"goconnect/utils"
+	"goconnect/vnet"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//---------------------------------------------------------------------------------------
+
+type sTestProxyAccSession struct {
+	common.IAccountingSession
+	send     uint64
+	receive  uint64
+	callback common.TAccountingSessionDC
+	data     interface{}
+}
+
+func (thisPt *sTestProxyAccSession) GetSessionID() string {
+	return "proxy"
+}
+
+func (thisPt *sTestProxyAccSession) GetTransfer() common.STransferStat {
+	return common.STransferStat{SendByte: atomic.LoadUint64(&thisPt.send), ReceiveByte: atomic.LoadUint64(&thisPt.receive)}
+}
+
+func (thisPt *sTestProxyAccSession) UpdateSend(size uint64) {
+	atomic.AddUint64(&thisPt.send, size)
+}
+
+func (thisPt *sTestProxyAccSession) UpdateReceive(size uint64) {
+	atomic.AddUint64(&thisPt.receive, size)
+}
+
+func (thisPt *sTestProxyAccSession) RegisterDCCallBack(callback common.TAccountingSessionDC, data interface{}) {
+	thisPt.callback, thisPt.data = callback, data
+}
+
+func (thisPt *sTestProxyAccSession) Start() {
+}
+
+func (thisPt *sTestProxyAccSession) Stop() {
+	thisPt.callback(thisPt, thisPt.data)
+}
+
+//---------------------------------------------------------------------------------------
+
+type sTestProxyAuthenticator struct {
+	common.IAuthenticator
+	sessions int32
+}
+
+func (thisPt *sTestProxyAuthenticator) GetType() string {
+	return "proxy"
+}
+
+func (thisPt *sTestProxyAuthenticator) CreateAccountingSession(info common.SAccountingInfo) common.IAccountingSession {
+	atomic.AddInt32(&thisPt.sessions, 1)
+	return &sTestProxyAccSession{}
+}
+
+//---------------------------------------------------------------------------------------
+
+type sTestProxyAuthMan struct {
+	common.IAuthenticationManger
+	authenticator *sTestProxyAuthenticator
+}
+
+func (thisPt *sTestProxyAuthMan) AuthenticateUser(info common.SAuthenticationInfo) (common.IAuthenticator, error) {
+	if info.User != "user1" || info.Password != "123456" {
+		return nil, errors.New("invalid password")
+	}
+	return thisPt.authenticator, nil
+}
+
+func (thisPt *sTestProxyAuthMan) CheckSessionLimit(user string, authenticator common.IAuthenticator) error {
+	return nil
+}
+
+func (thisPt *sTestProxyAuthMan) ReleaseSessionLimit(user string) {
+}
+
+func (thisPt *sTestProxyAuthMan) GetUserInfo(user string, authenticator common.IAuthenticator) common.SUserInfo {
+	return common.SUserInfo{User: user}
+}
+
+func (thisPt *sTestProxyAuthMan) GetClientProfile(user string, authenticator common.IAuthenticator) *common.SClientProfile {
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+
+type sTestProxyRouteTracer struct {
+	common.IRouteTracer
+	blockedPort uint16
+}
+
+func (thisPt *sTestProxyRouteTracer) Evaluate(source net.IP, destination net.IP, protocol string, sourcePort uint16, destinationPort uint16) (uint32, error) {
+	if destinationPort == thisPt.blockedPort {
+		return common.ICMPREASONPROHIBITED, errors.New("blocked by policy")
+	}
+	return 0, nil
+}
+
+func (thisPt *sTestProxyRouteTracer) Lookup(ip net.IP, source net.IP) (common.SRouteLookup, error) {
+	return common.SRouteLookup{Network: "0.0.0.0/0", Selected: 1}, nil
+}
+
+//---------------------------------------------------------------------------------------
+
+type sTestProxyNICManager struct {
+	common.INICManager
+	types map[uint64]uint32
+}
+
+func (thisPt *sTestProxyNICManager) GetNICType(id uint64) uint32 {
+	return thisPt.types[id]
+}
+
+//---------------------------------------------------------------------------------------
+
+//setTestProxyTarget the connections to the documentation address are dialed to the local target,
+//since the proxy refuses the gateway addresses
+func setTestProxyTarget(proxy *cProxyServer, target *net.TCPAddr) (*net.TCPAddr, *int32) {
+	dials := new(int32)
+	remote := &net.TCPAddr{IP: net.ParseIP("198.51.100.10").To4(), Port: target.Port}
+	proxy.dial = func(network string, address string, timeout time.Duration) (net.Conn, error) {
+		atomic.AddInt32(dials, 1)
+		if address == remote.String() {
+			address = target.String()
+		}
+		return net.DialTimeout(network, address, timeout)
+	}
+	return remote, dials
+}
+
+//---------------------------------------------------------------------------------------
+
+func createTestProxyEcho(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("can not create echo server %v \n", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return listener
+}
+
+//---------------------------------------------------------------------------------------
+
+func checkTestProxyEcho(t *testing.T, conn net.Conn, reader io.Reader) {
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("can not write to proxy connection %v \n", err)
+	}
+	response := make([]byte, 5)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(reader, response); err != nil || string(response) != "hello" {
+		t.Fatalf("invalid echo response %s %v \n", string(response), err)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+func dialTestSocks(t *testing.T, proxy string, password string, target *net.TCPAddr) (net.Conn, int) {
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatalf("can not connect to proxy %v \n", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	response := make([]byte, 2)
+	conn.Write([]byte{proxySocksVersion, 1, proxySocksAuthUser})
+	if _, err := io.ReadFull(conn, response); err != nil || response[1] != proxySocksAuthUser {
+		t.Fatalf("invalid method selection %v %v \n", response, err)
+	}
+
+	auth := append([]byte{proxySocksAuthVersion, 5}, "user1"...)
+	auth = append(append(auth, byte(len(password))), password...)
+	conn.Write(auth)
+	if _, err := io.ReadFull(conn, response); err != nil || response[1] != 0 {
+		return conn, proxyResultAuth
+	}
+
+	request := append([]byte{proxySocksVersion, proxySocksConnect, 0, proxySocksIPv4}, target.IP.To4()...)
+	request = append(request, 0, 0)
+	binary.BigEndian.PutUint16(request[len(request)-2:], uint16(target.Port))
+	conn.Write(request)
+
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("invalid connect reply %v \n", err)
+	}
+	return conn, int(reply[1])
+}
+
+//---------------------------------------------------------------------------------------
+
+func dialTestHTTPProxy(t *testing.T, proxy string, credentials string, target string) (net.Conn, *bufio.Reader, string) {
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatalf("can not connect to proxy %v \n", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	request := "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n"
+	if credentials != "" {
+		request += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(credentials)) + "\r\n"
+	}
+	conn.Write([]byte(request + "\r\n"))
+
+	reader := bufio.NewReader(conn)
+	status, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("invalid proxy response %v \n", err)
+	}
+	for line := ""; line != "\r\n"; {
+		if line, err = reader.ReadString('\n'); err != nil {
+			t.Fatalf("invalid proxy headers %v \n", err)
+		}
+	}
+	return conn, reader, status
+}
+
+//---------------------------------------------------------------------------------------
+
+func TestProxy(t *testing.T) {
+	echo := createTestProxyEcho(t)
+	defer echo.Close()
+
+	util := utils.Create()
+	authMan := &sTestProxyAuthMan{authenticator: &sTestProxyAuthenticator{}}
+
+	params := SProxyInitParams{}
+	params.BindAddress = "127.0.0.1:0"
+	params.Utils = util
+	params.AuthMan = authMan
+	params.IPPool, _ = util.CreateIPPoolManager([]common.SIPPoolConfig{{Name: "default", Start: "172.16.0.1", End: "172.16.0.3"}})
+	params.RouteTracer = &sTestProxyRouteTracer{blockedPort: 23}
+	params.NicManager = &sTestProxyNICManager{types: map[uint64]uint32{1: common.INICTypeTUN}}
+
+	proxy := new(cProxyServer)
+	if err := proxy.Init(params); err != nil {
+		t.Fatalf("can not init proxy %v \n", err)
+	}
+	defer proxy.End()
+	address := proxy.listener.Addr().String()
+	target, _ := setTestProxyTarget(proxy, echo.Addr().(*net.TCPAddr))
+
+	//SOCKS5
+	conn, result := dialTestSocks(t, address, "123456", target)
+	if result != proxyResultOK {
+		t.Fatalf("SOCKS connect failed %d \n", result)
+	}
+	checkTestProxyEcho(t, conn, conn)
+
+	if _, result := dialTestSocks(t, address, "654321", target); result != proxyResultAuth {
+		t.Fatalf("invalid password is accepted \n")
+	}
+	if _, result := dialTestSocks(t, address, "123456", &net.TCPAddr{IP: target.IP, Port: 23}); result != proxyResultBlocked {
+		t.Fatalf("blocked connection is accepted %d \n", result)
+	}
+
+	//HTTP CONNECT, the same client shares the session
+	httpConn, reader, status := dialTestHTTPProxy(t, address, "user1:123456", target.String())
+	if !strings.Contains(status, " 200 ") {
+		t.Fatalf("HTTP connect failed %s \n", status)
+	}
+	checkTestProxyEcho(t, httpConn, reader)
+
+	if _, _, status := dialTestHTTPProxy(t, address, "", target.String()); !strings.Contains(status, " 407 ") {
+		t.Fatalf("request without credentials is accepted %s \n", status)
+	}
+	if _, _, status := dialTestHTTPProxy(t, address, "user1:123456", target.IP.String()+":23"); !strings.Contains(status, " 403 ") {
+		t.Fatalf("blocked connection is accepted %s \n", status)
+	}
+
+	proxy.lock.Lock()
+	session := proxy.sessions["user1/127.0.0.1"]
+	sessions, conns := len(proxy.sessions), len(session.conns)
+	proxy.lock.Unlock()
+	if sessions != 1 || conns != 2 || atomic.LoadInt32(&authMan.authenticator.sessions) != 1 {
+		t.Fatalf("invalid sessions %d %d \n", sessions, conns)
+	}
+
+	acc := session.accSession.(*sTestProxyAccSession)
+	if transfer := acc.GetTransfer(); transfer.SendByte != 10 || transfer.ReceiveByte != 10 {
+		t.Fatalf("invalid accounting %v \n", transfer)
+	}
+
+	//the accounting session termination closes the connections
+	acc.Stop()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("connection is not closed \n")
+	}
+	if len(proxy.sessions) != 0 {
+		t.Fatalf("session is not removed \n")
+	}
+
+	//the only virtual IP of the pool is returned
+	if _, err := params.IPPool.AllocateIP("user2", "dummy", common.SUserInfo{}); err != nil {
+		t.Fatalf("virtual IP is not freed \n")
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+func TestProxyDestinations(t *testing.T) {
+	echo := createTestProxyEcho(t)
+	defer echo.Close()
+
+	util := utils.Create()
+	routerV4 := vnet.CreateRouter(vnet.SRouteParams{Util: util, Version: 4})
+	_, defaultRoute, _ := net.ParseCIDR("0.0.0.0/0")
+	routerV4.RegisterRoute(*defaultRoute, 1, "tun", common.ROUTEMETRICSTATIC)
+	_, siteRoute, _ := net.ParseCIDR("10.0.0.0/8")
+	routerV4.RegisterRoute(*siteRoute, 2, "site", common.ROUTEMETRICSTATIC)
+
+	tracerParams := vnet.SRouteTracerInitParams{}
+	tracerParams.RouterV4 = routerV4
+	tracerParams.RouterV6 = vnet.CreateRouter(vnet.SRouteParams{Util: util, Version: 6})
+	tracerParams.PacketFactory = vnet.CreateProcessFactory()
+	tracerParams.Util = util
+
+	params := SProxyInitParams{}
+	params.BindAddress = "127.0.0.1:0"
+	params.Utils = util
+	params.AuthMan = &sTestProxyAuthMan{authenticator: &sTestProxyAuthenticator{}}
+	params.IPPool, _ = util.CreateIPPoolManager([]common.SIPPoolConfig{{Name: "default", Start: "172.16.0.1", End: "172.16.0.3"}})
+	params.RouteTracer = vnet.CreateRouteTracer(tracerParams)
+	params.NicManager = &sTestProxyNICManager{types: map[uint64]uint32{1: common.INICTypeTUN, 2: common.INICTypeTunnel}}
+
+	proxy := new(cProxyServer)
+	if err := proxy.Init(params); err != nil {
+		t.Fatalf("can not init proxy %v \n", err)
+	}
+	defer proxy.End()
+	address := proxy.listener.Addr().String()
+	local := echo.Addr().(*net.TCPAddr)
+	target, dials := setTestProxyTarget(proxy, local)
+
+	//the gateway itself is not reachable even if the route is the tun device
+	for _, ip := range []string{"127.0.0.1", "0.0.0.0", "169.254.169.254", "224.0.0.1"} {
+		if _, result := dialTestSocks(t, address, "123456", &net.TCPAddr{IP: net.ParseIP(ip), Port: local.Port}); result != proxyResultBlocked {
+			t.Fatalf("connection to %s is accepted %d \n", ip, result)
+		}
+	}
+	if _, _, status := dialTestHTTPProxy(t, address, "user1:123456", local.String()); !strings.Contains(status, " 403 ") {
+		t.Fatalf("connection to the loopback address is accepted %s \n", status)
+	}
+
+	//the destinations routed to the other NICs are not dialed by the host stack
+	if _, result := dialTestSocks(t, address, "123456", &net.TCPAddr{IP: net.ParseIP("10.1.1.1"), Port: local.Port}); result != proxyResultNoRoute {
+		t.Fatalf("connection to the site route is accepted %d \n", result)
+	}
+	if atomic.LoadInt32(dials) != 0 || atomic.LoadUint64(&proxy.stat.Blocked) != 5 {
+		t.Fatalf("refused destinations are dialed %d %v \n", atomic.LoadInt32(dials), proxy.stat)
+	}
+
+	conn, result := dialTestSocks(t, address, "123456", target)
+	if result != proxyResultOK {
+		t.Fatalf("SOCKS connect over the tun route failed %d \n", result)
+	}
+	checkTestProxyEcho(t, conn, conn)
+	conn.Close()
+}
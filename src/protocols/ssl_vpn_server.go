@@ -20,6 +20,7 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const sslVpnServerMAXReadBuffer = 16384
@@ -36,6 +37,15 @@ const (
 const (
 	sslVPNFormTypeLogin         = 0
 	sslVPNFormTypeRegisteration = 1
+	sslVPNFormTypeBanner        = 2
+)
+
+//---------------------------------------------------------------------------------------
+
+//answers of the acceptable use notice form
+const (
+	sslVPNBannerAccept  = "yes"
+	sslVPNBannerDecline = "no"
 )
 
 //---------------------------------------------------------------------------------------
@@ -72,8 +82,10 @@ type sSSLVpnHTTPProcessResult struct {
 	Status        int
 	Response      http.Response
 	VirtualIP     net.IP
+	VirtualIP6    net.IP
 	Authenticator string
 	SessionID     uint64
+	AcceptTime    int64
 }
 
 //---------------------------------------------------------------------------------------
@@ -92,6 +104,9 @@ type sSSLVpnServerConnectionInfo struct {
 
 const sslVPNCSTPHEADERLEN = 8
 
+//the clients keep the access to their local LAN by this split exclude route
+const sslVPNLocalLANRoute = "0.0.0.0/255.255.255.255"
+
 const (
 	sslCSTPPacketTypeDATA       = 0x00
 	sslCSTPPacketTypeDPDREQ     = 0x03
@@ -124,6 +139,14 @@ type sSSLVpnServerContextCookie struct {
 
 //---------------------------------------------------------------------------------------
 
+//sSSLVpnServerBannerCookie is the context of a session waiting for the acceptance of the banner
+type sSSLVpnServerBannerCookie struct {
+	PendingID uint64
+	sSSLVpnServerContextCookie
+}
+
+//---------------------------------------------------------------------------------------
+
 type sSSLVpnServerKeyCookie struct {
 	UserName      string
 	Authenticator string
@@ -136,8 +159,14 @@ type sSSLVpnServerKeyCookie struct {
 //---------------------------------------------------------------------------------------
 
 type sSSLVpnSessionInfo struct {
-	VirtualIP net.IP
-	IsActive  bool
+	VirtualIP     net.IP
+	Allocation    common.SIPAllocation
+	Profile       *common.SClientProfile
+	UserName      string
+	Authenticator string
+	ClientIP      string
+	AcceptTime    int64 //the acceptance time of the banner
+	IsActive      bool
 }
 
 //---------------------------------------------------------------------------------------
@@ -156,7 +185,12 @@ type SSSLVpnInitParams struct {
 	DPDInterval             uint16
 	ClientsNetMask          string
 	SplitTunnels            []string
+	SplitExclude            []string
+	ExcludeLAN              bool
 	DNSServers              []string
+	SplitDNS                []string
+	Banner                  string
+	BannerAcceptance        bool
 	TunnelDNS               bool
 	KeepAlive               uint32
 	IdelTimeout             uint32
@@ -168,7 +202,7 @@ type SSSLVpnInitParams struct {
 	Utils                   common.IUtils
 	Command                 common.ICommander
 	AuthMan                 common.IAuthenticationManger
-	IPPool                  common.IIPPool
+	IPPool                  common.IIPPoolManager
 	PacketFactory           common.IProcessFactory
 	ProtocolActor           common.IProtocolActor
 	NetworkManager          common.INICManager
@@ -259,6 +293,17 @@ func (thisPt *cSSLVpnServer) generateContextCookie(authType int) string {
 	return fmt.Sprintf("%s=%s", sslCookieNameContext, contextStr)
 }
 
+//---------------------------------------------------------------------------------------
+func (thisPt *cSSLVpnServer) generateBannerCookie(sessionID uint64) string {
+	bannerInfo := sSSLVpnServerBannerCookie{PendingID: sessionID}
+	bannerInfo.Magic = sslVpnCookieMagic
+	bannerInfo.RandomCounter = thisPt.randomCounter
+	bannerInfo.Salt = thisPt.params.Utils.GetRandomString(32)
+	bannerInfo.Type = sslVPNFormTypeBanner
+	bannerStr := thisPt.params.Utils.EncryptData(thisPt.encKey[0:], thisPt.encIV[0:], &bannerInfo)
+	return fmt.Sprintf("%s=%s", sslCookieNameContext, bannerStr)
+}
+
 //---------------------------------------------------------------------------------------
 func (thisPt *cSSLVpnServer) generateHTTPResponseObject(value string) http.Response {
 
@@ -329,6 +374,37 @@ func (thisPt *cSSLVpnServer) generateHTTPInitResponse(formType int) http.Respons
 	return resp
 }
 
+//---------------------------------------------------------------------------------------
+
+//generateHTTPBannerResponse asks the user to accept the banner, the session is pending until the acceptance
+func (thisPt *cSSLVpnServer) generateHTTPBannerResponse(banner string, sessionID uint64) http.Response {
+
+	responseTemplate :=
+		`<?xml version="1.0" encoding="UTF-8"?>
+<config-auth client="vpn" type="auth-request">
+	<version who="sg">0.1(1)</version>
+	<auth id="banner">
+		<message>%s</message>
+		<form method="post" action="/auth">
+			<select name="accept" label="Acceptable use:">
+				<option value="%s">Accept</option>
+				<option value="%s">Decline</option>
+			</select>
+		</form>
+	</auth>
+</config-auth>
+`
+	message := bytes.Buffer{}
+	xml.EscapeText(&message, []byte(banner))
+	respStr := fmt.Sprintf(responseTemplate, message.String(), sslVPNBannerAccept, sslVPNBannerDecline)
+
+	resp := thisPt.generateHTTPResponseObject(respStr)
+	resp.Header.Add("Set-Cookie", thisPt.generateBannerCookie(sessionID))
+	resp.Header.Add("Content-Type", "text/xml")
+	resp.Header.Add("X-Transcend-Version", "1")
+	return resp
+}
+
 //---------------------------------------------------------------------------------------
 func (thisPt *cSSLVpnServer) generateHTTPAuthError(msg string) http.Response {
 	resp := thisPt.generateHTTPResponseObject(msg)
@@ -348,14 +424,63 @@ func (thisPt *cSSLVpnServer) removeSessionID(id uint64) {
 
 	//When this function is called the client can't use her token anymore
 	releaseIP := func(inHashData interface{}, userdata interface{}) bool {
-		session := inHashData.(*sSSLVpnSessionInfo)
-		thisPt.params.IPPool.FreeIP(session.VirtualIP)
+		thisPt.releaseSessionIPs(inHashData.(*sSSLVpnSessionInfo))
 		return true
 	}
 	thisPt.activeSessions.IDList.Remove(id, releaseIP, nil)
 
 }
 
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cSSLVpnServer) releaseSessionIPs(session *sSSLVpnSessionInfo) {
+	thisPt.params.IPPool.FreeIP(session.Allocation.IP)
+	thisPt.params.IPPool.FreeIP(session.Allocation.IP6)
+}
+
+//---------------------------------------------------------------------------------------
+
+//getSessionInfo returns a copy of the session, the IPs and the client options of the session pool and profile
+func (thisPt *cSSLVpnServer) getSessionInfo(id uint64) (sSSLVpnSessionInfo, bool) {
+	info := sSSLVpnSessionInfo{}
+	found := false
+	getInfo := func(inHashData interface{}, userdata interface{}) bool {
+		info = *inHashData.(*sSSLVpnSessionInfo)
+		found = true
+		return true
+	}
+	thisPt.activeSessions.IDList.Find(id, getInfo, nil)
+	return info, found
+}
+
+//---------------------------------------------------------------------------------------
+
+//acceptBanner records the acceptance time of the banner
+func (thisPt *cSSLVpnServer) acceptBanner(id uint64) {
+	accept := func(inHashData interface{}, userdata interface{}) bool {
+		inHashData.(*sSSLVpnSessionInfo).AcceptTime = time.Now().Unix()
+		return true
+	}
+	thisPt.activeSessions.IDList.Find(id, accept, nil)
+}
+
+//---------------------------------------------------------------------------------------
+
+//getBanner the profile banner is used before the server banner
+func (thisPt *cSSLVpnServer) getBanner(profile *common.SClientProfile) string {
+	if profile != nil && profile.Banner != "" {
+		return profile.Banner
+	}
+	return thisPt.params.Banner
+}
+
+//---------------------------------------------------------------------------------------
+
+//isBannerPending checks the sessions which should accept the banner before the connection
+func (thisPt *cSSLVpnServer) isBannerPending(session sSSLVpnSessionInfo) bool {
+	return thisPt.params.BannerAcceptance && session.AcceptTime == 0 && thisPt.getBanner(session.Profile) != ""
+}
+
 //---------------------------------------------------------------------------------------
 func (thisPt *cSSLVpnServer) setSessionStatus(id uint64, status bool) {
 
@@ -369,12 +494,13 @@ func (thisPt *cSSLVpnServer) setSessionStatus(id uint64, status bool) {
 }
 
 //---------------------------------------------------------------------------------------
-func (thisPt *cSSLVpnServer) generateSessionID() (uint64, net.IP) {
+func (thisPt *cSSLVpnServer) generateSessionID(user string, auth common.IAuthenticator, clientIP net.IP) (uint64, net.IP) {
 
-	//allocate IP
-	res, ip := thisPt.params.IPPool.AllocateIP()
-	if !res {
-		log.Printf("out of IP \n")
+	//allocate IP from the pool of the user groups or the authenticator, the users get their static or last IP
+	userInfo := thisPt.params.AuthMan.GetUserInfo(user, auth)
+	allocation, err := thisPt.params.IPPool.AllocateIP(user, auth.GetType(), userInfo)
+	if err != nil {
+		log.Printf("can not allocate IP for user %s with error %v \n", user, err)
 		return 0, nil
 	}
 
@@ -383,7 +509,15 @@ func (thisPt *cSSLVpnServer) generateSessionID() (uint64, net.IP) {
 
 	sessionInfo := new(sSSLVpnSessionInfo)
 	sessionInfo.IsActive = true
-	sessionInfo.VirtualIP = ip
+	sessionInfo.Allocation = allocation
+	sessionInfo.Profile = thisPt.params.AuthMan.GetClientProfile(user, auth)
+	sessionInfo.UserName = user
+	sessionInfo.Authenticator = auth.GetType()
+	sessionInfo.ClientIP = clientIP.String()
+	sessionInfo.VirtualIP = allocation.IP
+	if sessionInfo.VirtualIP == nil {
+		sessionInfo.VirtualIP = allocation.IP6
+	}
 	thisPt.activeSessions.IDList.Add(id, sessionInfo)
 	return id, sessionInfo.VirtualIP
 }
@@ -396,8 +530,7 @@ func (thisPt *cSSLVpnServer) removeInactiveSessions(t int64) {
 	checkFunction := func(inHashData interface{}, userdata interface{}, delta int64) bool {
 		session := inHashData.(*sSSLVpnSessionInfo)
 		if !session.IsActive {
-			session := inHashData.(*sSSLVpnSessionInfo)
-			thisPt.params.IPPool.FreeIP(session.VirtualIP)
+			thisPt.releaseSessionIPs(session)
 			return true
 		}
 		return false
@@ -423,7 +556,7 @@ func (thisPt *cSSLVpnServer) generateHTTPGetResponse(req *http.Request, conetion
 }
 
 //---------------------------------------------------------------------------------------
-func (thisPt *cSSLVpnServer) generateHTTPStablishResponse(req *http.Request, virtualIP string) http.Response {
+func (thisPt *cSSLVpnServer) generateHTTPStablishResponse(req *http.Request, virtualIP string, allocation common.SIPAllocation, profile *common.SClientProfile) http.Response {
 
 	resp := thisPt.generateHTTPResponseObject("")
 	resp.Status = "200 CONNECTED"
@@ -442,15 +575,64 @@ func (thisPt *cSSLVpnServer) generateHTTPStablishResponse(req *http.Request, vir
 	Add("X-CSTP-Server-Name", fmt.Sprintf("goconnect %s", common.GOCONNECTVERSION))
 	Add("X-CSTP-Hostname", "goconnect")
 	Add("X-CSTP-DPD", fmt.Sprintf("%d", thisPt.params.DPDInterval))
-	Add("X-CSTP-Address", virtualIP)
-	Add("X-CSTP-Netmask", thisPt.params.ClientsNetMask)
-	for _, ip := range thisPt.params.SplitTunnels {
-		Add("X-CSTP-Split-Include", ip)
+	//the profile options are used before the pool options and the pool options before the server options
+	netMask, splitTunnels, dnsServers := thisPt.params.ClientsNetMask, thisPt.params.SplitTunnels, thisPt.params.DNSServers
+	splitDNS, idleTimeout := thisPt.params.SplitDNS, thisPt.params.IdelTimeout
+	splitExclude, excludeLAN, banner := thisPt.params.SplitExclude, thisPt.params.ExcludeLAN, thisPt.getBanner(profile)
+	if allocation.NetMask != "" {
+		netMask = allocation.NetMask
+	}
+	if len(allocation.SplitTunnels) > 0 {
+		splitTunnels = allocation.SplitTunnels
+	}
+	if len(allocation.DNSServers) > 0 {
+		dnsServers = allocation.DNSServers
+	}
+	if profile != nil {
+		if len(profile.SplitInclude) > 0 {
+			splitTunnels = profile.SplitInclude
+		}
+		if len(profile.DNSServers) > 0 {
+			dnsServers = profile.DNSServers
+		}
+		if len(profile.SplitDNS) > 0 {
+			splitDNS = profile.SplitDNS
+		}
+		if profile.IdleTimeout != 0 {
+			idleTimeout = profile.IdleTimeout
+		}
+		if len(profile.SplitExclude) > 0 {
+			splitExclude = profile.SplitExclude
+		}
+		excludeLAN = excludeLAN || profile.ExcludeLAN
+	}
+
+	if allocation.IP != nil {
+		Add("X-CSTP-Address", virtualIP)
+		Add("X-CSTP-Netmask", netMask)
+	}
+	if allocation.IP6 != nil {
+		Add("X-CSTP-Address-IP6", allocation.IP6.String()+"/128")
+	}
+	//the IPv6 routes have their own headers
+	addRoutes := func(key string, routes []string) {
+		for _, route := range routes {
+			if ip, _, err := net.ParseCIDR(route); err == nil && ip.To4() == nil {
+				Add(key+"-IP6", route)
+			} else {
+				Add(key, route)
+			}
+		}
+	}
+	addRoutes("X-CSTP-Split-Include", splitTunnels)
+	addRoutes("X-CSTP-Split-Exclude", splitExclude)
+	if excludeLAN {
+		Add("X-CSTP-Split-Exclude", sslVPNLocalLANRoute)
 	}
 	Add("X-CSTP-Tunnel-All-DNS", fmt.Sprintf("%v", thisPt.params.TunnelDNS))
 	Add("X-CSTP-Keepalive", fmt.Sprintf("%d", thisPt.params.KeepAlive))
-	if thisPt.params.IdelTimeout != 0 {
-		Add("X-CSTP-Idle-Timeout", fmt.Sprintf("%d", thisPt.params.IdelTimeout))
+	if idleTimeout != 0 {
+		Add("X-CSTP-Idle-Timeout", fmt.Sprintf("%d", idleTimeout))
 	}
 	Add("X-CSTP-Rekey-Time", fmt.Sprintf("%d", thisPt.params.RekeyInterval))
 	Add("X-CSTP-Rekey-Method", "ssl")
@@ -463,8 +645,17 @@ func (thisPt *cSSLVpnServer) generateHTTPStablishResponse(req *http.Request, vir
 	Add("X-CSTP-MTU", fmt.Sprintf("%d", thisPt.params.Mtu))
 
 	//add DNS
-	for _, dns := range thisPt.params.DNSServers {
-		Add("X-CSTP-DNS:", dns)
+	for _, dns := range dnsServers {
+		Add("X-CSTP-DNS", dns)
+	}
+
+	//add split DNS domains
+	for _, domain := range splitDNS {
+		Add("X-CSTP-Split-DNS", domain)
+	}
+
+	if banner != "" {
+		Add("X-CSTP-Banner", banner)
 	}
 
 	resp.Header = header
@@ -485,6 +676,11 @@ func (thisPt *cSSLVpnServer) generateHTTPAuthResponse(req *http.Request, conetio
 		return thisPt.generateHTTPAuthError("invalid request")
 	}
 
+	//the banner form has no credentials
+	if contextInfo.Type == sslVPNFormTypeBanner {
+		return thisPt.generateHTTPBannerAuthResponse(req, contextCooki.Value, conetionInfo)
+	}
+
 	//get forms input
 	formInfo, res := thisPt.parseAuthForm(req)
 	if !res {
@@ -505,13 +701,22 @@ func (thisPt *cSSLVpnServer) generateHTTPAuthResponse(req *http.Request, conetio
 	if err != nil {
 		return thisPt.generateHTTPAuthError(err.Error())
 	}
+	if err := thisPt.params.AuthMan.CheckSessionLimit(formInfo.UserName, auth); err != nil {
+		return thisPt.generateHTTPAuthError(err.Error())
+	}
 
 	//allocate IP
-	sessionID, vip := thisPt.generateSessionID()
+	sessionID, vip := thisPt.generateSessionID(formInfo.UserName, auth, conetionInfo.ClinetIP)
 	if sessionID == 0 {
+		thisPt.params.AuthMan.ReleaseSessionLimit(formInfo.UserName)
 		return thisPt.generateHTTPAuthError("out of IP")
 	}
 
+	//the key is not sent before the acceptance of the banner
+	if sessionInfo, _ := thisPt.getSessionInfo(sessionID); thisPt.isBannerPending(sessionInfo) {
+		return thisPt.generateHTTPBannerResponse(thisPt.getBanner(sessionInfo.Profile), sessionID)
+	}
+
 	//create key
 	keyInfo := sSSLVpnServerKeyCookie{}
 	keyInfo.UserName = formInfo.UserName
@@ -519,6 +724,46 @@ func (thisPt *cSSLVpnServer) generateHTTPAuthResponse(req *http.Request, conetio
 	keyInfo.ClientIP = conetionInfo.ClinetIP.String()
 	keyInfo.VirtaulIP = vip.String()
 	keyInfo.SessionID = sessionID
+	return thisPt.generateHTTPAuthCompleteResponse(keyInfo)
+}
+
+//---------------------------------------------------------------------------------------
+
+//generateHTTPBannerAuthResponse the declined sessions are removed
+func (thisPt *cSSLVpnServer) generateHTTPBannerAuthResponse(req *http.Request, cookie string, conetionInfo *sSSLVpnServerConnectionInfo) http.Response {
+	bannerInfo := sSSLVpnServerBannerCookie{}
+	if thisPt.params.Utils.DecryptData(thisPt.encKey[0:], thisPt.encIV[0:], cookie, &bannerInfo) != nil {
+		return thisPt.generateHTTPAuthError("invalid request")
+	}
+
+	accepted, res := thisPt.parseBannerForm(req)
+	if !res {
+		return thisPt.generateHTTPAuthError("invalid request")
+	}
+
+	sessionInfo, found := thisPt.getSessionInfo(bannerInfo.PendingID)
+	if !found || sessionInfo.ClientIP != conetionInfo.ClinetIP.String() {
+		return thisPt.generateHTTPAuthError("invalid request")
+	}
+
+	if !accepted {
+		thisPt.removeSessionID(bannerInfo.PendingID)
+		thisPt.params.AuthMan.ReleaseSessionLimit(sessionInfo.UserName)
+		return thisPt.generateHTTPAuthError("acceptable use notice is declined")
+	}
+	thisPt.acceptBanner(bannerInfo.PendingID)
+
+	keyInfo := sSSLVpnServerKeyCookie{}
+	keyInfo.UserName = sessionInfo.UserName
+	keyInfo.Authenticator = sessionInfo.Authenticator
+	keyInfo.ClientIP = sessionInfo.ClientIP
+	keyInfo.VirtaulIP = sessionInfo.VirtualIP.String()
+	keyInfo.SessionID = bannerInfo.PendingID
+	return thisPt.generateHTTPAuthCompleteResponse(keyInfo)
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *cSSLVpnServer) generateHTTPAuthCompleteResponse(keyInfo sSSLVpnServerKeyCookie) http.Response {
 
 	keyCookieStr := thisPt.generateKeyCookie(keyInfo)
 	contextCookiStr := thisPt.generateContextCookie(sslVPNFormTypeLogin)
@@ -598,6 +843,45 @@ func (thisPt *cSSLVpnServer) parseAuthForm(req *http.Request) (sSSLVpnAuthentica
 	return param, true
 }
 
+//---------------------------------------------------------------------------------------
+
+//parseBannerForm returns the acceptance of the banner and the validity of the form
+func (thisPt *cSSLVpnServer) parseBannerForm(req *http.Request) (bool, bool) {
+
+	type sSSLVPNBannerXML struct {
+		Accept string `xml:"auth>accept"`
+	}
+
+	//check url
+	if req.RequestURI != "/auth" {
+		return false, false
+	}
+
+	accept := ""
+	agentType := thisPt.getAgentType(req)
+	if agentType == sslVPNAgentOpenConnect {
+		xmlParam := sSSLVPNBannerXML{}
+		if err := xml.NewDecoder(req.Body).Decode(&xmlParam); err != nil {
+			log.Printf("invalid banner parameters {%s} \n", err.Error())
+			return false, false
+		}
+		accept = xmlParam.Accept
+	} else if agentType == sslVPNAgentCiscoAnyConnect {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err := req.ParseForm(); err != nil {
+			log.Printf("invalid banner parameters {%s} \n", err.Error())
+			return false, false
+		}
+		accept = req.PostFormValue("accept")
+	}
+
+	if accept != sslVPNBannerAccept && accept != sslVPNBannerDecline {
+		log.Printf("invalid banner parameters \n")
+		return false, false
+	}
+	return accept == sslVPNBannerAccept, true
+}
+
 //---------------------------------------------------------------------------------------
 func (thisPt *cSSLVpnServer) decodeContextCookie(data string) (sSSLVpnServerContextCookie, bool) {
 	contextInfo := sSSLVpnServerContextCookie{}
@@ -755,12 +1039,25 @@ func (thisPt *cSSLVpnServer) processHTTPRequest(req *http.Request, conInfo *sSSL
 			key, _ := req.Cookie(sslCookieNameKey)
 			keyVal, _ := thisPt.decodeKeyCookie(key.Value)
 
+			//the session is removed by the inactive sessions cleanup between the authentication and the connect
+			sessionInfo, found := thisPt.getSessionInfo(keyVal.SessionID)
+			if !found || thisPt.isBannerPending(sessionInfo) {
+				result.Status = sslVpnServerStatusInvalid
+				return result
+			}
+
 			//fill result
 			result.Status = sslVpnServerStatusEstablished
-			result.VirtualIP = net.ParseIP(keyVal.VirtaulIP).To4()
+			result.VirtualIP = net.ParseIP(keyVal.VirtaulIP)
+			if ip4 := result.VirtualIP.To4(); ip4 != nil {
+				result.VirtualIP = ip4
+			}
+			result.VirtualIP6 = sessionInfo.Allocation.IP6
 			result.UserName = keyVal.UserName
 			result.Authenticator = keyVal.Authenticator
-			result.Response = thisPt.generateHTTPStablishResponse(req, keyVal.VirtaulIP)
+			result.SessionID = keyVal.SessionID
+			result.AcceptTime = sessionInfo.AcceptTime
+			result.Response = thisPt.generateHTTPStablishResponse(req, keyVal.VirtaulIP, sessionInfo.Allocation, sessionInfo.Profile)
 		} else {
 			result.Status = sslVpnServerStatusAuthorized
 		}
@@ -912,10 +1209,11 @@ func (thisPt *cSSLVpnServer) readPacket(buffer common.IBuffer, connectionInfo *s
 			packet.SetClientIP(connectionInfo.ClinetIP)
 			packet.SetInNIC(connectionInfo.Nic.GetID())
 			if !packet.ProcessAsNetPacket() {
+				thisPt.params.PacketFactory.FreeProcessInfo(packet)
 				return false, errors.New("invalid packet received")
 			}
 
-			//update nic status
+			//update nic status. the packet is owned by the actor after this call
 			connectionInfo.Nic.UpdateSend(packet)
 			connectionInfo.AccSession.UpdateSend(uint64(packet.GetUsedSize()))
 			thisPt.params.ProtocolActor.OnNewPacket(packet)
@@ -946,14 +1244,19 @@ func (thisPt *cSSLVpnServer) registerInterface(connectionInfo *sSSLVpnServerConn
 		return true
 	}, nic)
 
-	netObj := net.IPNet{}
-	netObj.IP = connectionInfo.httpStablishResults.VirtualIP
-	if len(netObj.IP) == 4 {
-		netObj.Mask = net.CIDRMask(32, 32)
-	} else {
-		netObj.Mask = net.CIDRMask(128, 128)
+	for _, ip := range []net.IP{connectionInfo.httpStablishResults.VirtualIP, connectionInfo.httpStablishResults.VirtualIP6} {
+		if ip == nil || (len(nic.Routes) > 0 && nic.Routes[0].IP.Equal(ip)) {
+			continue
+		}
+		netObj := net.IPNet{}
+		netObj.IP = ip
+		if len(netObj.IP) == 4 {
+			netObj.Mask = net.CIDRMask(32, 32)
+		} else {
+			netObj.Mask = net.CIDRMask(128, 128)
+		}
+		nic.Routes = append(nic.Routes, netObj)
 	}
-	nic.Routes = append(nic.Routes, netObj)
 
 	thisPt.params.NetworkManager.RegisterNIC(nic)
 
@@ -973,6 +1276,7 @@ func (thisPt *cSSLVpnServer) createAccSession(connectionInfo *sSSLVpnServerConne
 	info.User = connectionInfo.httpStablishResults.UserName
 	info.UserIP = connectionInfo.ClinetIP
 	info.VirtualIP = connectionInfo.httpStablishResults.VirtualIP
+	info.AcceptTime = connectionInfo.httpStablishResults.AcceptTime
 	authenticator := thisPt.params.AuthMan.GetAuthenticator(connectionInfo.httpStablishResults.Authenticator)
 	return authenticator.CreateAccountingSession(info)
 }
@@ -1108,6 +1412,7 @@ func (thisPt *cSSLVpnServer) handle(con net.Conn) {
 			if connectionInfo.Nic == nil {
 				return
 			}
+			connectionInfo.AccSession.Start()
 		}
 	}
 }
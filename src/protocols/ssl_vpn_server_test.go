@@ -3,7 +3,11 @@ package protocols
 import (
 	"bufio"
 	"bytes"
+	"fmt"
+	"goconnect/common"
 	"goconnect/utils"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"strings"
 	"testing"
@@ -200,11 +204,116 @@ func testHTTPRead(t *testing.T) {
 	//
 }
 
+//---------------------------------------------------------------------------------------
+func testStablishResponse(t *testing.T) {
+	server := cSSLVpnServer{}
+	server.params.ClientsNetMask = "255.255.0.0"
+	server.params.SplitTunnels = []string{"10.0.0.0/8"}
+	server.params.DNSServers = []string{"8.8.8.8"}
+
+	//the server options without the pool options
+	allocation := common.SIPAllocation{IP: net.ParseIP("172.16.0.2").To4()}
+	header := server.generateHTTPStablishResponse(nil, "172.16.0.2", allocation, nil).Header
+	if header["X-CSTP-Netmask"][0] != "255.255.0.0" || header["X-CSTP-Split-Include"][0] != "10.0.0.0/8" || header["X-CSTP-DNS"][0] != "8.8.8.8" || header["X-CSTP-Address-IP6"] != nil {
+		t.Fatalf("invalid default options %v \n", header)
+	}
+
+	allocation.IP6 = net.ParseIP("fd00::2")
+	allocation.NetMask = "255.255.255.0"
+	allocation.SplitTunnels = []string{"192.168.10.0/24", "192.168.20.0/24"}
+	allocation.DNSServers = []string{"192.168.10.1"}
+	header = server.generateHTTPStablishResponse(nil, "172.16.0.2", allocation, nil).Header
+	if header["X-CSTP-Netmask"][0] != "255.255.255.0" || len(header["X-CSTP-Split-Include"]) != 2 || header["X-CSTP-DNS"][0] != "192.168.10.1" || header["X-CSTP-Address-IP6"][0] != "fd00::2/128" {
+		t.Fatalf("invalid pool options %v \n", header)
+	}
+
+	//the profile options are used before the pool options
+	profile := &common.SClientProfile{Name: "admins", SplitExclude: []string{"192.168.20.0/24"}, SplitDNS: []string{"corp.local"}, IdleTimeout: 600, Banner: "authorized users only"}
+	profile.SplitInclude = []string{"10.10.0.0/16"}
+	header = server.generateHTTPStablishResponse(nil, "172.16.0.2", allocation, profile).Header
+	if len(header["X-CSTP-Split-Include"]) != 1 || header["X-CSTP-Split-Exclude"][0] != "192.168.20.0/24" || header["X-CSTP-DNS"][0] != "192.168.10.1" {
+		t.Fatalf("invalid profile routes %v \n", header)
+	}
+	if header["X-CSTP-Split-DNS"][0] != "corp.local" || header["X-CSTP-Idle-Timeout"][0] != "600" || header["X-CSTP-Banner"][0] != "authorized users only" {
+		t.Fatalf("invalid profile options %v \n", header)
+	}
+
+	//the IPv6 routes and the local LAN exclude
+	server.params.SplitExclude = []string{"10.10.0.0/16", "fd00:1::/32"}
+	server.params.ExcludeLAN = true
+	allocation.SplitTunnels = []string{"10.0.0.0/8", "fd00::/16"}
+	header = server.generateHTTPStablishResponse(nil, "172.16.0.2", allocation, nil).Header
+	if len(header["X-CSTP-Split-Include"]) != 1 || header["X-CSTP-Split-Include-IP6"][0] != "fd00::/16" || header["X-CSTP-Split-Exclude-IP6"][0] != "fd00:1::/32" {
+		t.Fatalf("invalid IPv6 split routes %v \n", header)
+	}
+	if len(header["X-CSTP-Split-Exclude"]) != 2 || header["X-CSTP-Split-Exclude"][1] != sslVPNLocalLANRoute {
+		t.Fatalf("invalid split exclude routes %v \n", header)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+func testBannerAcceptance(t *testing.T) {
+	util := utils.Create()
+	server := cSSLVpnServer{}
+	server.params.Utils = util
+	server.params.AuthMan = &sTestProxyAuthMan{authenticator: &sTestProxyAuthenticator{}}
+	server.params.Banner = "authorized <users> only"
+	server.params.BannerAcceptance = true
+	server.params.IPPool, _ = util.CreateIPPoolManager([]common.SIPPoolConfig{{Name: "default", Start: "172.16.0.1", End: "172.16.0.10"}})
+	server.activeSessions.IDList = util.CreateHashLinkList(16, 60)
+	util.FillRandomBuffer(server.encKey[0:])
+	util.FillRandomBuffer(server.encIV[0:])
+	conInfo := &sSSLVpnServerConnectionInfo{ClinetIP: net.ParseIP("192.168.1.10")}
+
+	post := func(cookie string, body string) http.Response {
+		reqStr := "POST /auth HTTP/1.1\r\n" +
+			"Cookie: " + cookie + "\r\n" +
+			"User-Agent: AnyConnect Windows 4.5.03040\r\n" +
+			fmt.Sprintf("Content-Length: %d\r\n\r\n", len(body)) + body
+		req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(reqStr)))
+		if err != nil {
+			t.Fatalf("%v \n", err)
+		}
+		return server.generateHTTPAuthResponse(req, conInfo)
+	}
+
+	//the key is not sent before the acceptance
+	login := server.generateContextCookie(sslVPNFormTypeLogin)
+	resp := post(login, "password=123456&username=user1")
+	body, _ := ioutil.ReadAll(resp.Body)
+	cookies := resp.Header["Set-Cookie"]
+	if resp.StatusCode != 200 || !strings.Contains(string(body), "authorized &lt;users&gt; only") || len(cookies) != 1 {
+		t.Fatalf("invalid banner response %s %v \n", body, cookies)
+	}
+	contextInfo := sSSLVpnServerBannerCookie{}
+	util.DecryptData(server.encKey[0:], server.encIV[0:], strings.SplitN(cookies[0], "=", 2)[1], &contextInfo)
+	sessionInfo, found := server.getSessionInfo(contextInfo.PendingID)
+	if contextInfo.Type != sslVPNFormTypeBanner || !found || !server.isBannerPending(sessionInfo) {
+		t.Fatalf("invalid pending session %v \n", contextInfo)
+	}
+
+	resp = post(cookies[0], "accept=yes")
+	sessionInfo, _ = server.getSessionInfo(contextInfo.PendingID)
+	if resp.StatusCode != 200 || !strings.HasPrefix(resp.Header["Set-Cookie"][0], sslCookieNameKey+"=") || sessionInfo.AcceptTime == 0 || server.isBannerPending(sessionInfo) {
+		t.Fatalf("accepted banner is not recorded %v \n", resp.Header)
+	}
+
+	//the declined sessions are removed
+	resp = post(login, "password=123456&username=user1")
+	cookies = resp.Header["Set-Cookie"]
+	util.DecryptData(server.encKey[0:], server.encIV[0:], strings.SplitN(cookies[0], "=", 2)[1], &contextInfo)
+	if resp = post(cookies[0], "accept=no"); resp.StatusCode != 401 || server.isValidsessionID(contextInfo.PendingID) {
+		t.Fatalf("declined session is not removed \n")
+	}
+}
+
 //---------------------------------------------------------------------------------------
 func TestSSL(t *testing.T) {
 	testCookies(t)
 	testHTTPAuth(t)
 	testHTTPRead(t)
+	testStablishResponse(t)
+	testBannerAcceptance(t)
 }
 
 //---------------------------------------------------------------------------------------
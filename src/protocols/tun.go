@@ -12,7 +12,7 @@ import (
 	"github.com/vishvananda/netlink"
 )
 
-const tunMAXReadBuffer = 16384
+const tunMAXReadBuffer = 65535
 
 //---------------------------------------------------------------------------------------
 
@@ -124,12 +124,14 @@ func (thisPt *cTun) read() {
 		//create packet
 		packet := thisPt.params.PacketFactory.CreateProcessInfo(buffer[0:n])
 		if packet.ProcessAsNetPacket() == false {
+			thisPt.params.PacketFactory.FreeProcessInfo(packet)
 			continue
 		}
 
+		//the packet is owned by the actor after this call
 		packet.SetInNIC(thisPt.Id)
-		thisPt.params.ProtocolActor.OnNewPacket(packet)
 		thisPt.UpdateSend(packet)
+		thisPt.params.ProtocolActor.OnNewPacket(packet)
 	}
 
 }
@@ -1,16 +1,30 @@
 package protocols
 
 import (
+	"goconnect/common"
 	"goconnect/utils"
+	"goconnect/vnet"
 	"testing"
 
 	"github.com/vishvananda/netlink"
 )
 
+//sTestTunActor drops the packets of the interface, e.g. IPv6 router solicitations. the device is read after the test
+//while the later tests of the package are running
+type sTestTunActor struct {
+	factory common.IProcessFactory
+}
+
+func (thisPt *sTestTunActor) OnNewPacket(packet common.IProcessInfo) {
+	thisPt.factory.FreeProcessInfo(packet)
+}
+
 func TestTun(t *testing.T) {
 
 	params := STunInitParams{}
 	params.Utils = utils.Create()
+	params.PacketFactory = vnet.CreateProcessFactory()
+	params.ProtocolActor = &sTestTunActor{factory: params.PacketFactory}
 	params.Name = "testtun"
 	params.Mtu = 1400
 	params.IPList = append(params.IPList, "172.16.0.1/24")
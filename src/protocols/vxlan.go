@@ -0,0 +1,176 @@
+package protocols
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"goconnect/common"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+//---------------------------------------------------------------------------------------
+
+const (
+	vxlanFlagVNI          = 0x08
+	vxlanFlagNextProtocol = 0x04
+	vxlanProtocolIPv4     = 0x01
+	vxlanProtocolIPv6     = 0x02
+	vxlanHeaderLen        = 8
+	vxlanMaxVNI           = 0xffffff
+	vxlanMaxReadBuffer    = 65535
+)
+
+//---------------------------------------------------------------------------------------
+
+//SVXLANInitParams ...
+type SVXLANInitParams struct {
+	Name           string
+	BindAddress    string
+	RemoteAddress  string
+	VNI            uint32
+	Routes         []string
+	Utils          common.IUtils
+	PacketFactory  common.IProcessFactory
+	ProtocolActor  common.IProtocolActor
+	NetworkManager common.INICManager
+	Commander      common.ICommander
+}
+
+//---------------------------------------------------------------------------------------
+
+//cVXLAN is a VXLAN tunnel of L3 packets. the header is VXLAN-GPE, so the routers know the inner protocol without any ethernet header
+type cVXLAN struct {
+	cPacketTunnel
+	params SVXLANInitParams
+	remote *net.UDPAddr
+	socket *net.UDPConn
+}
+
+//---------------------------------------------------------------------------------------
+
+//encapsulate adds the VXLAN-GPE header
+func (thisPt *cVXLAN) encapsulate(packet []byte) []byte {
+	message := make([]byte, vxlanHeaderLen+len(packet))
+	message[0] = vxlanFlagVNI | vxlanFlagNextProtocol
+	message[3] = vxlanProtocolIPv4
+	if len(packet) > 0 && packet[0]>>4 == 6 {
+		message[3] = vxlanProtocolIPv6
+	}
+	binary.BigEndian.PutUint32(message[4:], thisPt.params.VNI<<8)
+	copy(message[vxlanHeaderLen:], packet)
+	return message
+}
+
+//---------------------------------------------------------------------------------------
+
+//decapsulate returns the inner packet, the packets without the next protocol should be IP packets
+func (thisPt *cVXLAN) decapsulate(message []byte) ([]byte, error) {
+	if len(message) < vxlanHeaderLen || message[0]&vxlanFlagVNI == 0 {
+		return nil, errors.New("invalid VXLAN header")
+	}
+
+	if binary.BigEndian.Uint32(message[4:])>>8 != thisPt.params.VNI {
+		return nil, errors.New("invalid VNI")
+	}
+
+	if message[0]&vxlanFlagNextProtocol != 0 && message[3] != vxlanProtocolIPv4 && message[3] != vxlanProtocolIPv6 {
+		return nil, errors.New("unsupported VXLAN payload")
+	}
+	return message[vxlanHeaderLen:], nil
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cVXLAN) read() {
+	buffer := make([]byte, vxlanMaxReadBuffer)
+	for {
+		n, source, err := thisPt.socket.ReadFromUDP(buffer)
+		if err != nil {
+			if thisPt.isEnded() {
+				return
+			}
+			log.Printf("can not read from VXLAN tunnel %s with error %s \n", thisPt.Name, err.Error())
+			time.Sleep(1 * time.Second)
+			continue
+		}
+
+		//the routers use the source port for the flow entropy, so only the IP is checked
+		if !source.IP.Equal(thisPt.remote.IP) {
+			atomic.AddUint64(&thisPt.stat.UnknownSources, 1)
+			continue
+		}
+
+		inner, err := thisPt.decapsulate(buffer[:n])
+		if err != nil {
+			atomic.AddUint64(&thisPt.stat.InvalidPackets, 1)
+			continue
+		}
+		thisPt.onPacket(inner)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//Write override cNICBase.write
+func (thisPt *cVXLAN) WriteData(data common.IProcessInfo) {
+	if _, err := thisPt.socket.WriteToUDP(thisPt.encapsulate(data.GetBuffer()), thisPt.remote); err != nil {
+		atomic.AddUint64(&thisPt.stat.WriteErrors, 1)
+		return
+	}
+	thisPt.UpdateReceive(data)
+}
+
+//---------------------------------------------------------------------------------------
+
+//End override cNICBase.end
+func (thisPt *cVXLAN) End() {
+	if thisPt.end() {
+		thisPt.socket.Close()
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cVXLAN) Init(params SVXLANInitParams) error {
+	thisPt.params = params
+	if err := thisPt.init(params.Name, "vxlan", params.Routes, params.Utils, params.PacketFactory, params.ProtocolActor); err != nil {
+		return err
+	}
+
+	if thisPt.params.VNI > vxlanMaxVNI {
+		return errors.New("invalid VNI")
+	}
+
+	bindAddress, err := net.ResolveUDPAddr("udp", params.BindAddress)
+	if err != nil {
+		return err
+	}
+	if thisPt.remote, err = net.ResolveUDPAddr("udp", params.RemoteAddress); err != nil {
+		return err
+	}
+	thisPt.localAddress = bindAddress.String()
+	thisPt.remoteAddress = thisPt.remote.String()
+	thisPt.Ip = thisPt.remote.IP
+
+	if thisPt.socket, err = net.ListenUDP("udp", bindAddress); err != nil {
+		return err
+	}
+
+	if thisPt.params.NetworkManager != nil {
+		thisPt.params.NetworkManager.RegisterNIC(thisPt)
+	}
+
+	//
+	go thisPt.read()
+
+	//register api
+	if thisPt.params.Commander != nil {
+		selector := thisPt.params.Commander.CreateSelector()
+		selector.Register(fmt.Sprintf("vxlan_%s_status", thisPt.Name), thisPt.OnStatusCommand, nil)
+	}
+
+	return nil
+}
@@ -0,0 +1,939 @@
+package protocols
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"goconnect/common"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//---------------------------------------------------------------------------------------
+
+const (
+	wgMessageInitiation = 1
+	wgMessageResponse   = 2
+	wgMessageTransport  = 4
+)
+
+//---------------------------------------------------------------------------------------
+
+const (
+	wgInitiationSize      = 148
+	wgResponseSize        = 92
+	wgTransportHeaderSize = 16
+	wgMinTransportSize    = wgTransportHeaderSize + wgTagLen
+	wgPaddingMultiple     = 16
+	wgMaxReadBuffer       = 65535
+)
+
+//---------------------------------------------------------------------------------------
+
+const (
+	wgRejectAfterTime     = 180
+	wgKeepaliveTimeout    = 10
+	wgSessionTimeout      = wgRejectAfterTime * 3
+	wgRejectAfterMessages = ^uint64(0) - (1 << 13)
+	wgMinInitiationGap    = 20 * time.Millisecond
+	wgReplayWords         = 32
+	wgReplayWindow        = (wgReplayWords - 1) * 64
+)
+
+//---------------------------------------------------------------------------------------
+
+//SWireGuardPeerInfo ...
+type SWireGuardPeerInfo struct {
+	Name         string
+	PublicKey    string
+	PresharedKey string
+	AllowedIPs   []string
+}
+
+//---------------------------------------------------------------------------------------
+
+//SWireGuardInitParams ...
+type SWireGuardInitParams struct {
+	BindAddress    string
+	PrivateKey     string
+	Authenticator  string
+	Peers          []SWireGuardPeerInfo
+	Utils          common.IUtils
+	AuthMan        common.IAuthenticationManger
+	PacketFactory  common.IProcessFactory
+	ProtocolActor  common.IProtocolActor
+	NetworkManager common.INICManager
+	Commander      common.ICommander
+}
+
+//---------------------------------------------------------------------------------------
+
+type sWireGuardPeerAddParams struct {
+	Name         string   `help:"Peer name, used as the accounting user name" schema:"name" validate:"alphanum,min=3,max=64"`
+	PublicKey    string   `help:"Peer public key (base64)" schema:"public_key" validate:"len=44"`
+	PresharedKey string   `help:"Optional pre-shared key (base64)" schema:"preshared_key" validate:"omitempty,len=44"`
+	AllowedIPs   []string `help:"Allowed IPs of the peer, routed to the peer" schema:"allowed_ips" validate:"min=1,max=64,routes"`
+}
+
+//---------------------------------------------------------------------------------------
+
+type sWireGuardPeerRemoveParams struct {
+	PublicKey string `help:"Peer public key (base64)" schema:"public_key" validate:"len=44"`
+}
+
+//---------------------------------------------------------------------------------------
+
+type sWireGuardStat struct {
+	Handshakes      uint64 `json:"handshakes"`
+	HandshakeErrors uint64 `json:"handshake_errors"`
+	ReplayDrops     uint64 `json:"replay_drops"`
+	AuthFailures    uint64 `json:"auth_failures"`
+	InvalidPackets  uint64 `json:"invalid_packets"`
+	SpoofedPackets  uint64 `json:"spoofed_packets"`
+	NoSession       uint64 `json:"no_session"`
+}
+
+//---------------------------------------------------------------------------------------
+
+//sWireGuardReplay is the sliding window of the received counters
+type sWireGuardReplay struct {
+	last uint64
+	bits [wgReplayWords]uint64
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *sWireGuardReplay) check(counter uint64) bool {
+	if counter >= wgRejectAfterMessages {
+		return false
+	}
+	if counter > thisPt.last {
+		return true
+	}
+	if thisPt.last-counter >= wgReplayWindow {
+		return false
+	}
+	return thisPt.bits[(counter/64)%wgReplayWords]&(uint64(1)<<(counter%64)) == 0
+}
+
+//---------------------------------------------------------------------------------------
+
+//update should be called after the packet is authenticated
+func (thisPt *sWireGuardReplay) update(counter uint64) {
+	if counter > thisPt.last {
+		current := thisPt.last / 64
+		diff := counter/64 - current
+		if diff > wgReplayWords {
+			diff = wgReplayWords
+		}
+		for i := uint64(1); i <= diff; i++ {
+			thisPt.bits[(current+i)%wgReplayWords] = 0
+		}
+		thisPt.last = counter
+	}
+	thisPt.bits[(counter/64)%wgReplayWords] |= uint64(1) << (counter % 64)
+}
+
+//---------------------------------------------------------------------------------------
+
+//sWireGuardKeypair is the transport keys of a handshake
+type sWireGuardKeypair struct {
+	send        cipher.AEAD
+	receive     cipher.AEAD
+	sendCounter uint64
+	localIndex  uint32
+	remoteIndex uint32
+	createTime  int64
+	replay      sWireGuardReplay
+	peer        *cWireGuardPeer
+}
+
+//---------------------------------------------------------------------------------------
+
+//cWireGuardPeer is the NIC of a peer, the allowed IPs are the routes
+type cWireGuardPeer struct {
+	cNICBase
+	server            *cWireGuardServer
+	publicKey         sWireGuardKey
+	presharedKey      sWireGuardKey
+	staticShared      []byte
+	allowedIPs        []string
+	lock              sync.RWMutex
+	endpoint          *net.UDPAddr
+	current           *sWireGuardKeypair
+	previous          *sWireGuardKeypair
+	next              *sWireGuardKeypair
+	lastTimestamp     [wgTimestampLen]byte
+	lastInitiation    time.Time
+	lastHandshake     int64
+	lastSend          int64
+	lastReceive       int64
+	accountingSession common.IAccountingSession
+	ended             bool
+}
+
+//---------------------------------------------------------------------------------------
+
+//Write override cNICBase.write
+func (thisPt *cWireGuardPeer) WriteData(data common.IProcessInfo) {
+	if !thisPt.send(data.GetBuffer()) {
+		return
+	}
+	thisPt.UpdateReceive(data)
+
+	thisPt.lock.RLock()
+	acc := thisPt.accountingSession
+	thisPt.lock.RUnlock()
+	if acc != nil {
+		acc.UpdateReceive(uint64(data.GetUsedSize()))
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//send encrypts and sends the packet over the current keypair, nil packet is a keepalive
+func (thisPt *cWireGuardPeer) send(packet []byte) bool {
+	thisPt.lock.RLock()
+	keypair := thisPt.current
+	endpoint := thisPt.endpoint
+	thisPt.lock.RUnlock()
+
+	if keypair == nil || endpoint == nil {
+		atomic.AddUint64(&thisPt.server.stat.NoSession, 1)
+		return false
+	}
+
+	counter := atomic.AddUint64(&keypair.sendCounter, 1) - 1
+	if counter >= wgRejectAfterMessages {
+		atomic.AddUint64(&thisPt.server.stat.NoSession, 1)
+		return false
+	}
+
+	//the payload is padded to 16 bytes
+	paddedLen := (len(packet) + wgPaddingMultiple - 1) &^ (wgPaddingMultiple - 1)
+	message := make([]byte, wgTransportHeaderSize, wgTransportHeaderSize+paddedLen+wgTagLen)
+	message[0] = wgMessageTransport
+	binary.LittleEndian.PutUint32(message[4:], keypair.remoteIndex)
+	binary.LittleEndian.PutUint64(message[8:], counter)
+	plain := make([]byte, paddedLen)
+	copy(plain, packet)
+	message = keypair.send.Seal(message, wgNonce(counter), plain, nil)
+
+	if _, err := thisPt.server.socket.WriteToUDP(message, endpoint); err != nil {
+		log.Printf("wireguard peer %s write failed with error %v \n", thisPt.Name, err)
+		return false
+	}
+	atomic.StoreInt64(&thisPt.lastSend, time.Now().Unix())
+	return true
+}
+
+//---------------------------------------------------------------------------------------
+
+//onReceive confirms the next keypair and follows the peer endpoint
+func (thisPt *cWireGuardPeer) onReceive(keypair *sWireGuardKeypair, endpoint *net.UDPAddr) {
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+
+	if keypair == thisPt.next {
+		thisPt.server.removeIndex(thisPt.previous)
+		thisPt.previous = thisPt.current
+		thisPt.current = thisPt.next
+		thisPt.next = nil
+	}
+
+	if thisPt.endpoint == nil || !thisPt.endpoint.IP.Equal(endpoint.IP) || thisPt.endpoint.Port != endpoint.Port {
+		thisPt.endpoint = endpoint
+		thisPt.Ip = endpoint.IP
+	}
+	atomic.StoreInt64(&thisPt.lastReceive, time.Now().Unix())
+}
+
+//---------------------------------------------------------------------------------------
+
+//clearKeypairs should be called under lock
+func (thisPt *cWireGuardPeer) clearKeypairs() {
+	thisPt.server.removeIndex(thisPt.previous)
+	thisPt.server.removeIndex(thisPt.current)
+	thisPt.server.removeIndex(thisPt.next)
+	thisPt.previous, thisPt.current, thisPt.next = nil, nil, nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//disconnect drops the keys, so the peer should handshake again
+func (thisPt *cWireGuardPeer) disconnect() {
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+
+	thisPt.clearKeypairs()
+	thisPt.accountingSession = nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//createAccSession should be called under lock
+func (thisPt *cWireGuardPeer) createAccSession() error {
+	if thisPt.accountingSession != nil || thisPt.server.params.AuthMan == nil {
+		return nil
+	}
+
+	authenticator := thisPt.server.params.AuthMan.GetAuthenticator(thisPt.server.params.Authenticator)
+	if authenticator == nil {
+		return errors.New("can not find authenticator " + thisPt.server.params.Authenticator)
+	}
+	//the peers do not login, so the quota is checked at the session creation
+	if err := thisPt.server.params.AuthMan.CheckQuota(thisPt.Name, authenticator); err != nil {
+		return err
+	}
+	if err := thisPt.server.params.AuthMan.CheckSessionLimit(thisPt.Name, authenticator); err != nil {
+		return err
+	}
+
+	info := common.SAccountingInfo{}
+	info.User = thisPt.Name
+	info.UserIP = thisPt.endpoint.IP
+	info.VirtualIP = thisPt.VirtualIP
+	thisPt.accountingSession = authenticator.CreateAccountingSession(info)
+	thisPt.accountingSession.RegisterDCCallBack(func(session common.IAccountingSession, data interface{}) bool {
+		//the peer should handshake again after the accounting session termination
+		data.(*cWireGuardPeer).disconnect()
+		return true
+	}, thisPt)
+	thisPt.accountingSession.Start()
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//stopAccSession stops the accounting session of the inactive peers
+func (thisPt *cWireGuardPeer) stopAccSession() {
+	thisPt.lock.RLock()
+	acc := thisPt.accountingSession
+	thisPt.lock.RUnlock()
+
+	//the DC callback needs the lock
+	if acc != nil {
+		acc.Stop()
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//checkTimers is called every second
+func (thisPt *cWireGuardPeer) checkTimers(now int64) {
+	thisPt.lock.Lock()
+	if thisPt.current != nil && now-thisPt.current.createTime > wgRejectAfterTime {
+		thisPt.clearKeypairs()
+	}
+	hasSession := thisPt.current != nil
+	inactive := thisPt.accountingSession != nil && now-thisPt.lastHandshake > wgSessionTimeout
+	thisPt.lock.Unlock()
+
+	//passive keepalive, the peer should know that we are alive
+	lastReceive := atomic.LoadInt64(&thisPt.lastReceive)
+	if hasSession && lastReceive > atomic.LoadInt64(&thisPt.lastSend) && now-lastReceive >= wgKeepaliveTimeout {
+		thisPt.send(nil)
+	}
+
+	if inactive {
+		thisPt.stopAccSession()
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//End override cNICBase.end
+func (thisPt *cWireGuardPeer) End() {
+	thisPt.lock.Lock()
+	thisPt.ended = true
+	thisPt.lock.Unlock()
+
+	thisPt.stopAccSession()
+	thisPt.disconnect()
+}
+
+//---------------------------------------------------------------------------------------
+
+//cWireGuardServer is the responder of the WireGuard protocol, each peer is a NIC
+type cWireGuardServer struct {
+	params     SWireGuardInitParams
+	privateKey sWireGuardKey
+	publicKey  sWireGuardKey
+	mac1Key    [32]byte
+	socket     *net.UDPConn
+	peers      map[sWireGuardKey]*cWireGuardPeer
+	indexes    map[uint32]*sWireGuardKeypair
+	lock       sync.RWMutex
+	stat       sWireGuardStat
+	done       chan bool
+}
+
+//---------------------------------------------------------------------------------------
+
+//allocateIndex registers the keypair with a new random index
+func (thisPt *cWireGuardServer) allocateIndex(keypair *sWireGuardKeypair) {
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+
+	buffer := [4]byte{}
+	for {
+		rand.Read(buffer[:])
+		index := binary.LittleEndian.Uint32(buffer[:])
+		if _, fnd := thisPt.indexes[index]; !fnd && index != 0 {
+			keypair.localIndex = index
+			thisPt.indexes[index] = keypair
+			return
+		}
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cWireGuardServer) removeIndex(keypair *sWireGuardKeypair) {
+	if keypair == nil {
+		return
+	}
+
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+	delete(thisPt.indexes, keypair.localIndex)
+}
+
+//---------------------------------------------------------------------------------------
+
+//addPeer registers the peer as a NIC
+func (thisPt *cWireGuardServer) addPeer(info SWireGuardPeerInfo) error {
+	peer := new(cWireGuardPeer)
+	peer.server = thisPt
+	peer.Name = info.Name
+	peer.NicType = common.INICTypeClient
+	peer.allowedIPs = info.AllowedIPs
+
+	var err error
+	if peer.publicKey, err = wgParseKey(info.PublicKey); err != nil {
+		return err
+	}
+	if len(info.PresharedKey) > 0 {
+		if peer.presharedKey, err = wgParseKey(info.PresharedKey); err != nil {
+			return err
+		}
+	}
+	if peer.staticShared, err = wgDH(thisPt.privateKey, peer.publicKey[:]); err != nil {
+		return err
+	}
+
+	for _, r := range info.AllowedIPs {
+		_, netres, err := net.ParseCIDR(r)
+		if err != nil {
+			return err
+		}
+		peer.Routes = append(peer.Routes, *netres)
+	}
+	if len(peer.Routes) == 0 {
+		return errors.New("peer needs at least one allowed IP")
+	}
+	peer.VirtualIP = peer.Routes[0].IP
+
+	thisPt.lock.Lock()
+	if _, fnd := thisPt.peers[peer.publicKey]; fnd {
+		thisPt.lock.Unlock()
+		return errors.New("duplicate peer " + info.PublicKey)
+	}
+	peer.Id = thisPt.params.Utils.GetUniqID()
+	thisPt.peers[peer.publicKey] = peer
+	thisPt.lock.Unlock()
+
+	thisPt.params.NetworkManager.RegisterNIC(peer)
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cWireGuardServer) removePeer(publicKey string) error {
+	key, err := wgParseKey(publicKey)
+	if err != nil {
+		return err
+	}
+
+	thisPt.lock.Lock()
+	peer := thisPt.peers[key]
+	delete(thisPt.peers, key)
+	thisPt.lock.Unlock()
+
+	if peer == nil {
+		return errors.New("can not find peer " + publicKey)
+	}
+
+	thisPt.params.NetworkManager.RemoveNIC(peer.GetID())
+	peer.End()
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//getPeers returns a snapshot of the peers
+func (thisPt *cWireGuardServer) getPeers() []*cWireGuardPeer {
+	thisPt.lock.RLock()
+	defer thisPt.lock.RUnlock()
+
+	peers := make([]*cWireGuardPeer, 0, len(thisPt.peers))
+	for _, peer := range thisPt.peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+//---------------------------------------------------------------------------------------
+
+//consumeInitiation authenticates the initiation message and returns the peer
+func (thisPt *cWireGuardServer) consumeInitiation(message []byte, handshake *sWireGuardHandshake) (*cWireGuardPeer, [wgKeyLen]byte, [wgTimestampLen]byte, error) {
+	var ephemeral [wgKeyLen]byte
+	var timestamp [wgTimestampLen]byte
+
+	mac1 := wgMAC(thisPt.mac1Key[:], message[:116])
+	if !bytes.Equal(mac1[:], message[116:132]) {
+		return nil, ephemeral, timestamp, errors.New("invalid mac1")
+	}
+
+	handshake.init(thisPt.publicKey)
+	copy(ephemeral[:], message[8:40])
+	handshake.mixHash(ephemeral[:])
+	handshake.mixKey(ephemeral[:])
+
+	shared, err := wgDH(thisPt.privateKey, ephemeral[:])
+	if err != nil {
+		return nil, ephemeral, timestamp, err
+	}
+	static, err := handshake.decrypt(handshake.mixKeyAndKey(shared), message[40:88])
+	if err != nil {
+		return nil, ephemeral, timestamp, err
+	}
+
+	var publicKey sWireGuardKey
+	copy(publicKey[:], static)
+	thisPt.lock.RLock()
+	peer := thisPt.peers[publicKey]
+	thisPt.lock.RUnlock()
+	if peer == nil {
+		return nil, ephemeral, timestamp, errors.New("unknown peer " + publicKey.String())
+	}
+
+	stamp, err := handshake.decrypt(handshake.mixKeyAndKey(peer.staticShared), message[88:116])
+	if err != nil {
+		return nil, ephemeral, timestamp, err
+	}
+	copy(timestamp[:], stamp)
+	return peer, ephemeral, timestamp, nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//createResponse creates the response message and the keypair of the handshake by the ephemeral private key of the server
+func (thisPt *cWireGuardServer) createResponse(peer *cWireGuardPeer, handshake *sWireGuardHandshake, ephemeral [wgKeyLen]byte, senderIndex uint32, private sWireGuardKey) ([]byte, *sWireGuardKeypair, error) {
+	public := private.PublicKey()
+
+	keypair := new(sWireGuardKeypair)
+	keypair.peer = peer
+	keypair.remoteIndex = senderIndex
+	keypair.createTime = time.Now().Unix()
+	thisPt.allocateIndex(keypair)
+
+	message := make([]byte, 44, wgResponseSize)
+	message[0] = wgMessageResponse
+	binary.LittleEndian.PutUint32(message[4:], keypair.localIndex)
+	binary.LittleEndian.PutUint32(message[8:], senderIndex)
+	copy(message[12:], public[:])
+	handshake.mixHash(public[:])
+	handshake.mixKey(public[:])
+
+	shared, err := wgDH(private, ephemeral[:])
+	if err != nil {
+		thisPt.removeIndex(keypair)
+		return nil, nil, err
+	}
+	handshake.mixKey(shared)
+
+	if shared, err = wgDH(private, peer.publicKey[:]); err != nil {
+		thisPt.removeIndex(keypair)
+		return nil, nil, err
+	}
+	handshake.mixKey(shared)
+
+	message = handshake.encrypt(handshake.mixPSK(peer.presharedKey), message, nil)
+
+	mac1Key := wgHash(wgLabelMAC1, peer.publicKey[:])
+	mac1 := wgMAC(mac1Key[:], message)
+	message = append(message, mac1[:]...)
+	message = append(message, make([]byte, wgMACLen)...)
+
+	keypair.receive, keypair.send = handshake.transportKeys()
+	return message, keypair, nil
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cWireGuardServer) processInitiation(message []byte, endpoint *net.UDPAddr) {
+	if len(message) != wgInitiationSize {
+		atomic.AddUint64(&thisPt.stat.InvalidPackets, 1)
+		return
+	}
+
+	handshake := sWireGuardHandshake{}
+	peer, ephemeral, timestamp, err := thisPt.consumeInitiation(message, &handshake)
+	if err != nil {
+		atomic.AddUint64(&thisPt.stat.HandshakeErrors, 1)
+		return
+	}
+
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+
+	//replayed or flooded initiations
+	if peer.ended || bytes.Compare(timestamp[:], peer.lastTimestamp[:]) <= 0 || time.Since(peer.lastInitiation) < wgMinInitiationGap {
+		atomic.AddUint64(&thisPt.stat.HandshakeErrors, 1)
+		return
+	}
+
+	private, err := wgGeneratePrivateKey()
+	if err != nil {
+		atomic.AddUint64(&thisPt.stat.HandshakeErrors, 1)
+		return
+	}
+
+	response, keypair, err := thisPt.createResponse(peer, &handshake, ephemeral, binary.LittleEndian.Uint32(message[4:]), private)
+	if err != nil {
+		atomic.AddUint64(&thisPt.stat.HandshakeErrors, 1)
+		return
+	}
+
+	peer.lastTimestamp = timestamp
+	peer.lastInitiation = time.Now()
+	peer.lastHandshake = time.Now().Unix()
+	peer.endpoint = endpoint
+	peer.Ip = endpoint.IP
+
+	//the keypair is used for sending after the peer confirms it
+	thisPt.removeIndex(peer.next)
+	peer.next = keypair
+
+	if err := peer.createAccSession(); err != nil {
+		log.Printf("wireguard peer %s can not create accounting session with error %v \n", peer.Name, err)
+		thisPt.removeIndex(keypair)
+		peer.next = nil
+		return
+	}
+
+	atomic.AddUint64(&thisPt.stat.Handshakes, 1)
+	thisPt.socket.WriteToUDP(response, endpoint)
+}
+
+//---------------------------------------------------------------------------------------
+
+//isValidSource checks the source of the inner packet against the peer allowed IPs
+func (thisPt *cWireGuardServer) isValidSource(peer *cWireGuardPeer, packet common.IProcessInfo) bool {
+	for _, route := range peer.Routes {
+		if route.Contains(packet.GetSourceIP()) {
+			return true
+		}
+	}
+	return false
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cWireGuardServer) processTransport(message []byte, endpoint *net.UDPAddr) {
+	if len(message) < wgMinTransportSize {
+		atomic.AddUint64(&thisPt.stat.InvalidPackets, 1)
+		return
+	}
+
+	thisPt.lock.RLock()
+	keypair := thisPt.indexes[binary.LittleEndian.Uint32(message[4:])]
+	thisPt.lock.RUnlock()
+	if keypair == nil {
+		atomic.AddUint64(&thisPt.stat.InvalidPackets, 1)
+		return
+	}
+
+	//the packets are read by a single goroutine, so the window does not need any lock
+	counter := binary.LittleEndian.Uint64(message[8:])
+	if !keypair.replay.check(counter) {
+		atomic.AddUint64(&thisPt.stat.ReplayDrops, 1)
+		return
+	}
+
+	plain, err := keypair.receive.Open(message[wgTransportHeaderSize:wgTransportHeaderSize], wgNonce(counter), message[wgTransportHeaderSize:], nil)
+	if err != nil {
+		atomic.AddUint64(&thisPt.stat.AuthFailures, 1)
+		return
+	}
+	keypair.replay.update(counter)
+
+	peer := keypair.peer
+	peer.onReceive(keypair, endpoint)
+
+	//keepalive
+	if len(plain) == 0 {
+		return
+	}
+
+	length := getIPPacketLength(plain)
+	if length == 0 || length > len(plain) {
+		atomic.AddUint64(&thisPt.stat.InvalidPackets, 1)
+		return
+	}
+
+	packet := thisPt.params.PacketFactory.CreateProcessInfo(plain[:length])
+	if !packet.ProcessAsNetPacket() {
+		atomic.AddUint64(&thisPt.stat.InvalidPackets, 1)
+		thisPt.params.PacketFactory.FreeProcessInfo(packet)
+		return
+	}
+
+	if !thisPt.isValidSource(peer, packet) {
+		atomic.AddUint64(&thisPt.stat.SpoofedPackets, 1)
+		thisPt.params.PacketFactory.FreeProcessInfo(packet)
+		return
+	}
+
+	peer.lock.RLock()
+	acc := peer.accountingSession
+	peer.lock.RUnlock()
+	if acc != nil {
+		acc.UpdateSend(uint64(packet.GetUsedSize()))
+	}
+
+	//the packet is owned by the actor after this call
+	packet.SetInNIC(peer.Id)
+	peer.UpdateSend(packet)
+	thisPt.params.ProtocolActor.OnNewPacket(packet)
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cWireGuardServer) read() {
+	buffer := make([]byte, wgMaxReadBuffer)
+	for {
+		n, endpoint, err := thisPt.socket.ReadFromUDP(buffer)
+		if err != nil {
+			select {
+			case <-thisPt.done:
+				return
+			default:
+			}
+			log.Printf("can not read from wireguard socket with error %s \n", err.Error())
+			time.Sleep(1 * time.Second)
+			continue
+		}
+
+		if n < 4 {
+			atomic.AddUint64(&thisPt.stat.InvalidPackets, 1)
+			continue
+		}
+
+		switch binary.LittleEndian.Uint32(buffer) {
+		case wgMessageInitiation:
+			thisPt.processInitiation(buffer[:n], endpoint)
+		case wgMessageTransport:
+			thisPt.processTransport(buffer[:n], endpoint)
+		default:
+			atomic.AddUint64(&thisPt.stat.InvalidPackets, 1)
+		}
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cWireGuardServer) checkTimers() {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-thisPt.done:
+			return
+		case now := <-ticker.C:
+			for _, peer := range thisPt.getPeers() {
+				peer.checkTimers(now.Unix())
+			}
+		}
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//End stops the server
+func (thisPt *cWireGuardServer) End() {
+	select {
+	case <-thisPt.done:
+		return
+	default:
+	}
+	close(thisPt.done)
+	thisPt.socket.Close()
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cWireGuardServer) OnPeerAddCommand(req *http.Request, params interface{}) (common.IHTTPResponse, error) {
+	addParams := params.(*sWireGuardPeerAddParams)
+	info := SWireGuardPeerInfo{}
+	info.Name = addParams.Name
+	info.PublicKey = addParams.PublicKey
+	info.PresharedKey = addParams.PresharedKey
+	info.AllowedIPs = addParams.AllowedIPs
+	if err := thisPt.addPeer(info); err != nil {
+		return nil, err
+	}
+	return thisPt.params.Utils.CreateHttpResponseFromString("OK")
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cWireGuardServer) OnPeerRemoveCommand(req *http.Request, params interface{}) (common.IHTTPResponse, error) {
+	if err := thisPt.removePeer(params.(*sWireGuardPeerRemoveParams).PublicKey); err != nil {
+		return nil, err
+	}
+	return thisPt.params.Utils.CreateHttpResponseFromString("OK")
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cWireGuardServer) OnGenerateKeyCommand(req *http.Request, params interface{}) (common.IHTTPResponse, error) {
+	type sWireGuardKeys struct {
+		PrivateKey   string `json:"private_key"`
+		PublicKey    string `json:"public_key"`
+		PresharedKey string `json:"preshared_key"`
+		ServerKey    string `json:"server_public_key"`
+	}
+
+	private, err := wgGeneratePrivateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	psk := sWireGuardKey{}
+	if _, err := rand.Read(psk[:]); err != nil {
+		return nil, err
+	}
+
+	keys := sWireGuardKeys{}
+	keys.PrivateKey = private.String()
+	keys.PublicKey = private.PublicKey().String()
+	keys.PresharedKey = psk.String()
+	keys.ServerKey = thisPt.publicKey.String()
+	return thisPt.params.Utils.CreateHttpResponseFromObject(keys)
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cWireGuardServer) OnHandshakesCommand(req *http.Request, params interface{}) (common.IHTTPResponse, error) {
+	type sWireGuardPeerStatus struct {
+		Name          string               `json:"name"`
+		PublicKey     string               `json:"public_key"`
+		AllowedIPs    []string             `json:"allowed_ips"`
+		Endpoint      string               `json:"endpoint"`
+		LastHandshake int64                `json:"last_handshake"`
+		LastReceive   int64                `json:"last_receive"`
+		Active        bool                 `json:"active"`
+		SessionID     string               `json:"session_id"`
+		Stat          common.STransferStat `json:"stat"`
+	}
+
+	type sWireGuardStatus struct {
+		PublicKey string                 `json:"public_key"`
+		Peers     []sWireGuardPeerStatus `json:"peers"`
+		Stat      sWireGuardStat         `json:"stat"`
+	}
+
+	status := sWireGuardStatus{}
+	status.PublicKey = thisPt.publicKey.String()
+	status.Peers = []sWireGuardPeerStatus{}
+	for _, peer := range thisPt.getPeers() {
+		item := sWireGuardPeerStatus{}
+		item.Name = peer.Name
+		item.PublicKey = peer.publicKey.String()
+		item.AllowedIPs = peer.allowedIPs
+		item.LastReceive = atomic.LoadInt64(&peer.lastReceive)
+		item.Stat = peer.GetStat()
+
+		peer.lock.RLock()
+		if peer.endpoint != nil {
+			item.Endpoint = peer.endpoint.String()
+		}
+		item.LastHandshake = peer.lastHandshake
+		item.Active = peer.current != nil
+		if peer.accountingSession != nil {
+			item.SessionID = peer.accountingSession.GetSessionID()
+		}
+		peer.lock.RUnlock()
+		status.Peers = append(status.Peers, item)
+	}
+
+	status.Stat.Handshakes = atomic.LoadUint64(&thisPt.stat.Handshakes)
+	status.Stat.HandshakeErrors = atomic.LoadUint64(&thisPt.stat.HandshakeErrors)
+	status.Stat.ReplayDrops = atomic.LoadUint64(&thisPt.stat.ReplayDrops)
+	status.Stat.AuthFailures = atomic.LoadUint64(&thisPt.stat.AuthFailures)
+	status.Stat.InvalidPackets = atomic.LoadUint64(&thisPt.stat.InvalidPackets)
+	status.Stat.SpoofedPackets = atomic.LoadUint64(&thisPt.stat.SpoofedPackets)
+	status.Stat.NoSession = atomic.LoadUint64(&thisPt.stat.NoSession)
+	return thisPt.params.Utils.CreateHttpResponseFromObject(status)
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cWireGuardServer) Init(params SWireGuardInitParams) error {
+	thisPt.params = params
+	thisPt.done = make(chan bool)
+	thisPt.peers = make(map[sWireGuardKey]*cWireGuardPeer)
+	thisPt.indexes = make(map[uint32]*sWireGuardKeypair)
+
+	//in case of an empty key, a new key is generated
+	var err error
+	if len(thisPt.params.PrivateKey) == 0 {
+		if thisPt.privateKey, err = wgGeneratePrivateKey(); err != nil {
+			return err
+		}
+		log.Printf("wireguard private key is not set, a temporary key is generated \n")
+	} else if thisPt.privateKey, err = wgParseKey(thisPt.params.PrivateKey); err != nil {
+		return err
+	}
+	thisPt.publicKey = thisPt.privateKey.PublicKey()
+	thisPt.mac1Key = wgHash(wgLabelMAC1, thisPt.publicKey[:])
+	log.Printf("wireguard public key %s \n", thisPt.publicKey.String())
+
+	for _, peer := range thisPt.params.Peers {
+		if err := thisPt.addPeer(peer); err != nil {
+			return err
+		}
+	}
+
+	bindAddress, err := net.ResolveUDPAddr("udp", thisPt.params.BindAddress)
+	if err != nil {
+		return err
+	}
+	if thisPt.socket, err = net.ListenUDP("udp", bindAddress); err != nil {
+		return err
+	}
+
+	//
+	go thisPt.read()
+	go thisPt.checkTimers()
+
+	//register api
+	if thisPt.params.Commander != nil {
+		selector := thisPt.params.Commander.CreateSelector()
+		selector.Register("wireguard_peer_add", thisPt.OnPeerAddCommand, sWireGuardPeerAddParams{})
+		selector.Register("wireguard_peer_remove", thisPt.OnPeerRemoveCommand, sWireGuardPeerRemoveParams{})
+		selector.Register("wireguard_genkey", thisPt.OnGenerateKeyCommand, nil)
+		selector.Register("wireguard_handshakes", thisPt.OnHandshakesCommand, nil)
+	}
+
+	return nil
+}
@@ -0,0 +1,242 @@
+package protocols
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"hash"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+//---------------------------------------------------------------------------------------
+
+const (
+	wgKeyLen       = 32
+	wgTimestampLen = 12
+	wgMACLen       = 16
+	wgTagLen       = 16
+)
+
+//---------------------------------------------------------------------------------------
+
+var (
+	wgConstruction = []byte("Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s")
+	wgIdentifier   = []byte("WireGuard v1 zx2c4 Jason@zx2c4.com")
+	wgLabelMAC1    = []byte("mac1----")
+)
+
+//---------------------------------------------------------------------------------------
+
+type sWireGuardKey [wgKeyLen]byte
+
+//---------------------------------------------------------------------------------------
+
+//String returns the key in the wg tools format
+func (thisPt sWireGuardKey) String() string {
+	return base64.StdEncoding.EncodeToString(thisPt[:])
+}
+
+//---------------------------------------------------------------------------------------
+
+//PublicKey returns the public key of the private key
+func (thisPt sWireGuardKey) PublicKey() sWireGuardKey {
+	var public sWireGuardKey
+	curve25519.ScalarBaseMult((*[wgKeyLen]byte)(&public), (*[wgKeyLen]byte)(&thisPt))
+	return public
+}
+
+//---------------------------------------------------------------------------------------
+
+//wgParseKey decodes the base64 key
+func wgParseKey(value string) (sWireGuardKey, error) {
+	var key sWireGuardKey
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return key, err
+	}
+	if len(data) != wgKeyLen {
+		return key, errors.New("invalid key length")
+	}
+	copy(key[:], data)
+	return key, nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//wgGeneratePrivateKey creates a clamped curve25519 private key
+func wgGeneratePrivateKey() (sWireGuardKey, error) {
+	var key sWireGuardKey
+	if _, err := rand.Read(key[:]); err != nil {
+		return key, err
+	}
+	key[0] &= 248
+	key[31] = (key[31] & 127) | 64
+	return key, nil
+}
+
+//---------------------------------------------------------------------------------------
+
+func wgHash(data ...[]byte) [blake2s.Size]byte {
+	var sum [blake2s.Size]byte
+	h, _ := blake2s.New256(nil)
+	for _, item := range data {
+		h.Write(item)
+	}
+	h.Sum(sum[:0])
+	return sum
+}
+
+//---------------------------------------------------------------------------------------
+
+func wgHMAC(key []byte, data ...[]byte) [blake2s.Size]byte {
+	var sum [blake2s.Size]byte
+	mac := hmac.New(func() hash.Hash {
+		h, _ := blake2s.New256(nil)
+		return h
+	}, key)
+	for _, item := range data {
+		mac.Write(item)
+	}
+	mac.Sum(sum[:0])
+	return sum
+}
+
+//---------------------------------------------------------------------------------------
+
+//wgKDF is the HKDF of the protocol, returns n keys
+func wgKDF(key []byte, input []byte, n int) [][blake2s.Size]byte {
+	result := make([][blake2s.Size]byte, 0, n)
+	secret := wgHMAC(key, input)
+	prev := []byte{}
+	for i := 1; i <= n; i++ {
+		next := wgHMAC(secret[:], prev, []byte{byte(i)})
+		result = append(result, next)
+		prev = next[:]
+	}
+	return result
+}
+
+//---------------------------------------------------------------------------------------
+
+//wgMAC is the keyed BLAKE2s-128 of the handshake messages
+func wgMAC(key []byte, data []byte) [wgMACLen]byte {
+	var sum [wgMACLen]byte
+	h, _ := blake2s.New128(key)
+	h.Write(data)
+	h.Sum(sum[:0])
+	return sum
+}
+
+//---------------------------------------------------------------------------------------
+
+//wgDH rejects the low order points
+func wgDH(private sWireGuardKey, public []byte) ([]byte, error) {
+	return curve25519.X25519(private[:], public)
+}
+
+//---------------------------------------------------------------------------------------
+
+func wgNonce(counter uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
+
+//---------------------------------------------------------------------------------------
+
+func wgSeal(key []byte, counter uint64, dst []byte, plain []byte, ad []byte) []byte {
+	aead, _ := chacha20poly1305.New(key)
+	return aead.Seal(dst, wgNonce(counter), plain, ad)
+}
+
+//---------------------------------------------------------------------------------------
+
+func wgOpen(key []byte, counter uint64, dst []byte, cipherText []byte, ad []byte) ([]byte, error) {
+	aead, _ := chacha20poly1305.New(key)
+	return aead.Open(dst, wgNonce(counter), cipherText, ad)
+}
+
+//---------------------------------------------------------------------------------------
+
+//sWireGuardHandshake is the symmetric state of the noise handshake
+type sWireGuardHandshake struct {
+	chainKey [blake2s.Size]byte
+	hash     [blake2s.Size]byte
+}
+
+//---------------------------------------------------------------------------------------
+
+//init starts the handshake state with the responder static key
+func (thisPt *sWireGuardHandshake) init(responder sWireGuardKey) {
+	thisPt.chainKey = wgHash(wgConstruction)
+	thisPt.hash = wgHash(thisPt.chainKey[:], wgIdentifier)
+	thisPt.mixHash(responder[:])
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *sWireGuardHandshake) mixHash(data []byte) {
+	thisPt.hash = wgHash(thisPt.hash[:], data)
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *sWireGuardHandshake) mixKey(input []byte) {
+	thisPt.chainKey = wgKDF(thisPt.chainKey[:], input, 1)[0]
+}
+
+//---------------------------------------------------------------------------------------
+
+//mixKeyAndKey returns the key of the next AEAD
+func (thisPt *sWireGuardHandshake) mixKeyAndKey(input []byte) []byte {
+	keys := wgKDF(thisPt.chainKey[:], input, 2)
+	thisPt.chainKey = keys[0]
+	return keys[1][:]
+}
+
+//---------------------------------------------------------------------------------------
+
+//mixPSK mixes the pre-shared key, returns the key of the next AEAD
+func (thisPt *sWireGuardHandshake) mixPSK(psk sWireGuardKey) []byte {
+	keys := wgKDF(thisPt.chainKey[:], psk[:], 3)
+	thisPt.chainKey = keys[0]
+	thisPt.mixHash(keys[1][:])
+	return keys[2][:]
+}
+
+//---------------------------------------------------------------------------------------
+
+//encrypt encrypts and mixes the data
+func (thisPt *sWireGuardHandshake) encrypt(key []byte, dst []byte, plain []byte) []byte {
+	out := wgSeal(key, 0, dst, plain, thisPt.hash[:])
+	thisPt.mixHash(out[len(dst):])
+	return out
+}
+
+//---------------------------------------------------------------------------------------
+
+//decrypt decrypts and mixes the data
+func (thisPt *sWireGuardHandshake) decrypt(key []byte, cipherText []byte) ([]byte, error) {
+	plain, err := wgOpen(key, 0, nil, cipherText, thisPt.hash[:])
+	if err != nil {
+		return nil, err
+	}
+	thisPt.mixHash(cipherText)
+	return plain, nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//transportKeys returns the initiator and responder sending keys
+func (thisPt *sWireGuardHandshake) transportKeys() (cipher.AEAD, cipher.AEAD) {
+	keys := wgKDF(thisPt.chainKey[:], nil, 2)
+	initiator, _ := chacha20poly1305.New(keys[0][:])
+	responder, _ := chacha20poly1305.New(keys[1][:])
+	return initiator, responder
+}
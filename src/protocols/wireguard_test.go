@@ -0,0 +1,419 @@
+package protocols
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"goconnect/common"
+	"goconnect/utils"
+	"goconnect/vnet"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//---------------------------------------------------------------------------------------
+
+//sTestWireGuardNICManager removes the NICs of the removed peers
+type sTestWireGuardNICManager struct {
+	sTestESPNICManager
+}
+
+func (thisPt *sTestWireGuardNICManager) RemoveNIC(id uint64) {
+	for i, nic := range thisPt.nics {
+		if nic.GetID() == id {
+			thisPt.nics = append(thisPt.nics[:i], thisPt.nics[i+1:]...)
+			return
+		}
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//testWireGuardVector is a handshake and the first transport messages of wireguard-go, the reference implementation.
+//the indexes, the ephemeral keys and the timestamp are taken from the handshake and the mac2 fields are empty
+var testWireGuardVector = struct {
+	clientKey       string
+	serverKey       string
+	psk             string
+	clientEphemeral string
+	serverEphemeral string
+	timestamp       string
+	initiation      string
+	response        string
+	clientTransport string
+	serverTransport string
+}{
+	clientKey:       "68df5cb67fef56453a68fcb52fba5b4a2e88be11bce963bef1df0b832b5f6d56",
+	serverKey:       "c8bc804814b43c97ed710d2fc19cb1647012a618156912b68242177d03231645",
+	psk:             "0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20",
+	clientEphemeral: "20311616590ce9eb016dc73e9f585d605768935793e6d2907b2109b8d50d8661",
+	serverEphemeral: "b8a13ed7a3794659d6d17d2e1e26d8cf63fcff4a35efc7501e9886c0d140c668",
+	timestamp:       "400000006ad5d02d1f000000",
+	initiation:      "0100000089406dff9fbc3c7f468a46abeaa6d99e3da80c6d57993d9765c74a300c23c6b9cff060561f3863c421fa1b3bc60274649fe77999d1bc781c1930edf984b4591642a3c8d8a319ddb34247e7a328eb20ab123a02adbec3e69a772544110e15cce14ccb7cc821d1c44ab1f5abb5f2e04126099498b9aa2892df280f05ad1cd48b7300000000000000000000000000000000",
+	response:        "02000000f4ba319089406dff2a0fd6496072a805601242d96bc3c99dc99af66072bd85aaca71c9eebaa1a443bfb58a13f3a3882f237aadaab495c6fe8ee95c64549d415b10171a077a0ad70500000000000000000000000000000000",
+	clientTransport: "04000000f4ba3190000000000000000045b9ca830aa7bbe22a7ecfacba1f6b2c04edfc519882cc79aa362e46c3cad8eb9f51acb4269dea76439e306c512ea91f",
+	serverTransport: "0400000089406dff0000000000000000e59a558c479bf32bc4b951044cf07d26ea160226b6e80a1c72d7c487b9c277034a84c65253c0d22ee6b67368697d8ed2",
+}
+
+//---------------------------------------------------------------------------------------
+
+//sTestWireGuardClient is a minimal initiator
+type sTestWireGuardClient struct {
+	private     sWireGuardKey
+	server      sWireGuardKey
+	psk         sWireGuardKey
+	conn        *net.UDPConn
+	localIndex  uint32
+	remoteIndex uint32
+	send        cipher.AEAD
+	receive     cipher.AEAD
+	counter     uint64
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *sTestWireGuardClient) createInitiation(handshake *sWireGuardHandshake, ephemeral sWireGuardKey, stamp time.Time) []byte {
+	public := ephemeral.PublicKey()
+	static := thisPt.private.PublicKey()
+
+	message := make([]byte, 8, wgInitiationSize)
+	message[0] = wgMessageInitiation
+	binary.LittleEndian.PutUint32(message[4:], thisPt.localIndex)
+	message = append(message, public[:]...)
+
+	handshake.init(thisPt.server)
+	handshake.mixHash(public[:])
+	handshake.mixKey(public[:])
+	shared, _ := wgDH(ephemeral, thisPt.server[:])
+	message = handshake.encrypt(handshake.mixKeyAndKey(shared), message, static[:])
+
+	timestamp := [wgTimestampLen]byte{}
+	binary.BigEndian.PutUint64(timestamp[0:], 0x400000000000000a+uint64(stamp.Unix()))
+	binary.BigEndian.PutUint32(timestamp[8:], uint32(stamp.Nanosecond()))
+	shared, _ = wgDH(thisPt.private, thisPt.server[:])
+	message = handshake.encrypt(handshake.mixKeyAndKey(shared), message, timestamp[:])
+
+	mac1Key := wgHash(wgLabelMAC1, thisPt.server[:])
+	mac1 := wgMAC(mac1Key[:], message)
+	message = append(message, mac1[:]...)
+	return append(message, make([]byte, wgMACLen)...)
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *sTestWireGuardClient) handshake(t *testing.T, stamp time.Time) []byte {
+	handshake := sWireGuardHandshake{}
+	ephemeral, _ := wgGeneratePrivateKey()
+	initiation := thisPt.createInitiation(&handshake, ephemeral, stamp)
+	thisPt.conn.Write(initiation)
+
+	response := thisPt.read(t)
+	if len(response) != wgResponseSize || response[0] != wgMessageResponse || binary.LittleEndian.Uint32(response[8:]) != thisPt.localIndex {
+		t.Fatalf("invalid handshake response \n")
+	}
+
+	handshake.mixHash(response[12:44])
+	handshake.mixKey(response[12:44])
+	shared, _ := wgDH(ephemeral, response[12:44])
+	handshake.mixKey(shared)
+	shared, _ = wgDH(thisPt.private, response[12:44])
+	handshake.mixKey(shared)
+	if _, err := handshake.decrypt(handshake.mixPSK(thisPt.psk), response[44:60]); err != nil {
+		t.Fatalf("can not authenticate the handshake response %v \n", err)
+	}
+
+	thisPt.remoteIndex = binary.LittleEndian.Uint32(response[4:])
+	thisPt.send, thisPt.receive = handshake.transportKeys()
+	thisPt.counter = 0
+	return initiation
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *sTestWireGuardClient) seal(packet []byte) []byte {
+	message := make([]byte, wgTransportHeaderSize)
+	message[0] = wgMessageTransport
+	binary.LittleEndian.PutUint32(message[4:], thisPt.remoteIndex)
+	binary.LittleEndian.PutUint64(message[8:], thisPt.counter)
+	plain := make([]byte, (len(packet)+15)&^15)
+	copy(plain, packet)
+	message = thisPt.send.Seal(message, wgNonce(thisPt.counter), plain, nil)
+	thisPt.counter++
+	return message
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *sTestWireGuardClient) read(t *testing.T) []byte {
+	buffer := make([]byte, wgMaxReadBuffer)
+	thisPt.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := thisPt.conn.Read(buffer)
+	if err != nil {
+		t.Fatalf("can not read from server %v \n", err)
+	}
+	return buffer[:n]
+}
+
+//---------------------------------------------------------------------------------------
+
+func TestWireGuard(t *testing.T) {
+	factory := vnet.CreateProcessFactory()
+	actor := &sTestESPActor{factory: factory, packets: make(chan []byte, 64)}
+	nicManager := &sTestWireGuardNICManager{}
+
+	serverKey, _ := wgGeneratePrivateKey()
+	clientKey, _ := wgGeneratePrivateKey()
+	psk, _ := wgGeneratePrivateKey()
+
+	params := SWireGuardInitParams{}
+	params.BindAddress = "127.0.0.1:45101"
+	params.PrivateKey = serverKey.String()
+	params.Utils = utils.Create()
+	params.PacketFactory = factory
+	params.ProtocolActor = actor
+	params.NetworkManager = nicManager
+	params.Peers = []SWireGuardPeerInfo{{Name: "laptop", PublicKey: clientKey.PublicKey().String(), PresharedKey: psk.String(), AllowedIPs: []string{"172.16.1.2/32"}}}
+
+	server := cWireGuardServer{}
+	if err := server.Init(params); err != nil {
+		t.Fatalf("can not init wireguard server %v \n", err)
+	}
+	defer server.End()
+
+	if len(nicManager.nics) != 1 || nicManager.nics[0].GetVirtualIP().String() != "172.16.1.2" {
+		t.Fatalf("peer is not registered as a NIC \n")
+	}
+	peer := nicManager.nics[0].(*cWireGuardPeer)
+
+	//duplicate and invalid peers
+	if server.addPeer(params.Peers[0]) == nil || server.addPeer(SWireGuardPeerInfo{Name: "bad", PublicKey: "invalid", AllowedIPs: []string{"172.16.1.3/32"}}) == nil {
+		t.Fatalf("invalid peer accepted \n")
+	}
+
+	client := sTestWireGuardClient{private: clientKey, server: serverKey.PublicKey(), psk: psk, localIndex: 1234}
+	client.conn, _ = net.DialUDP("udp", nil, server.socket.LocalAddr().(*net.UDPAddr))
+	defer client.conn.Close()
+	initiation := client.handshake(t, time.Now())
+
+	//the server should not send before the keypair is confirmed
+	peer.WriteData(factory.CreateProcessInfo(createTestESPPacket("10.0.0.1", "172.16.1.2", []byte{1})))
+	if atomic.LoadUint64(&server.stat.NoSession) != 1 {
+		t.Fatalf("unconfirmed keypair is used \n")
+	}
+
+	//client to server
+	packet := createTestESPPacket("172.16.1.2", "10.0.0.1", []byte{1, 2, 3})
+	message := client.seal(packet)
+	client.conn.Write(message)
+	waitTestESPPacket(t, actor, packet)
+
+	//server to client
+	packet = createTestESPPacket("10.0.0.1", "172.16.1.2", []byte{4, 5, 6, 7})
+	peer.WriteData(factory.CreateProcessInfo(packet))
+	response := client.read(t)
+	plain, err := client.receive.Open(nil, wgNonce(binary.LittleEndian.Uint64(response[8:])), response[wgTransportHeaderSize:], nil)
+	if err != nil || binary.LittleEndian.Uint32(response[4:]) != client.localIndex || !bytes.Equal(plain[:len(packet)], packet) || len(plain)%16 != 0 {
+		t.Fatalf("invalid transport message %v \n", err)
+	}
+
+	//replayed transport and initiation messages
+	client.conn.Write(message)
+	client.conn.Write(initiation)
+
+	//spoofed inner source
+	client.conn.Write(client.seal(createTestESPPacket("172.16.1.3", "10.0.0.1", []byte{1})))
+	time.Sleep(100 * time.Millisecond)
+	if atomic.LoadUint64(&server.stat.ReplayDrops) != 1 || atomic.LoadUint64(&server.stat.HandshakeErrors) != 1 || atomic.LoadUint64(&server.stat.SpoofedPackets) != 1 || len(actor.packets) != 0 {
+		t.Fatalf("invalid messages are accepted %v \n", server.stat)
+	}
+
+	//a new handshake should replace the keys
+	time.Sleep(wgMinInitiationGap)
+	client.localIndex = 5678
+	client.handshake(t, time.Now())
+	packet = createTestESPPacket("172.16.1.2", "10.0.0.1", []byte{8})
+	client.conn.Write(client.seal(packet))
+	waitTestESPPacket(t, actor, packet)
+	if peer.previous == nil || peer.current == nil || len(server.indexes) != 2 {
+		t.Fatalf("keypairs are not rotated \n")
+	}
+
+	//removing the peer should drop the keys
+	if err := server.removePeer(clientKey.PublicKey().String()); err != nil || len(server.indexes) != 0 || len(nicManager.nics) != 0 {
+		t.Fatalf("can not remove peer %v \n", err)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//sTestWireGuardAuthMan rejects the users without the remaining quota
+type sTestWireGuardAuthMan struct {
+	sTestProxyAuthMan
+	exhausted bool
+}
+
+func (thisPt *sTestWireGuardAuthMan) GetAuthenticator(typeName string) common.IAuthenticator {
+	return thisPt.authenticator
+}
+
+func (thisPt *sTestWireGuardAuthMan) CheckQuota(user string, authenticator common.IAuthenticator) error {
+	if thisPt.exhausted {
+		return errors.New("quota exceeded")
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+
+func TestWireGuardQuota(t *testing.T) {
+	factory := vnet.CreateProcessFactory()
+	actor := &sTestESPActor{factory: factory, packets: make(chan []byte, 64)}
+	nicManager := &sTestWireGuardNICManager{}
+	authMan := &sTestWireGuardAuthMan{sTestProxyAuthMan: sTestProxyAuthMan{authenticator: &sTestProxyAuthenticator{}}}
+
+	serverKey, _ := wgGeneratePrivateKey()
+	clientKey, _ := wgGeneratePrivateKey()
+
+	params := SWireGuardInitParams{}
+	params.BindAddress = "127.0.0.1:45103"
+	params.PrivateKey = serverKey.String()
+	params.Utils = utils.Create()
+	params.PacketFactory = factory
+	params.ProtocolActor = actor
+	params.NetworkManager = nicManager
+	params.AuthMan = authMan
+	params.Authenticator = "proxy"
+	params.Peers = []SWireGuardPeerInfo{{Name: "laptop", PublicKey: clientKey.PublicKey().String(), AllowedIPs: []string{"172.16.1.2/32"}}}
+
+	server := cWireGuardServer{}
+	if err := server.Init(params); err != nil {
+		t.Fatalf("can not init wireguard server %v \n", err)
+	}
+	defer server.End()
+	peer := nicManager.nics[0].(*cWireGuardPeer)
+
+	client := sTestWireGuardClient{private: clientKey, server: serverKey.PublicKey(), localIndex: 1234}
+	client.conn, _ = net.DialUDP("udp", nil, server.socket.LocalAddr().(*net.UDPAddr))
+	defer client.conn.Close()
+	client.handshake(t, time.Now())
+	if atomic.LoadInt32(&authMan.authenticator.sessions) != 1 {
+		t.Fatalf("accounting session is not created \n")
+	}
+
+	//the quota check stops the session, the peer should not handshake again
+	authMan.exhausted = true
+	peer.stopAccSession()
+	time.Sleep(wgMinInitiationGap)
+	handshake := sWireGuardHandshake{}
+	ephemeral, _ := wgGeneratePrivateKey()
+	client.conn.Write(client.createInitiation(&handshake, ephemeral, time.Now()))
+
+	buffer := make([]byte, wgMaxReadBuffer)
+	client.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := client.conn.Read(buffer); err == nil {
+		t.Fatalf("peer without quota completed the handshake \n")
+	}
+	if atomic.LoadInt32(&authMan.authenticator.sessions) != 1 || peer.accountingSession != nil || peer.next != nil {
+		t.Fatalf("peer without quota created a session \n")
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+func TestWireGuardReplay(t *testing.T) {
+	replay := sWireGuardReplay{}
+	for _, counter := range []uint64{0, 1, 5, 3, 2000, 100} {
+		if !replay.check(counter) {
+			t.Fatalf("valid counter %d rejected \n", counter)
+		}
+		replay.update(counter)
+	}
+
+	for _, counter := range []uint64{0, 3, 5, 2000, wgRejectAfterMessages} {
+		if replay.check(counter) {
+			t.Fatalf("replayed counter %d accepted \n", counter)
+		}
+	}
+
+	replay.update(2000 + wgReplayWindow)
+	if replay.check(2000) || !replay.check(2001+wgReplayWindow) || replay.check(2000+wgReplayWindow) {
+		t.Fatalf("invalid window \n")
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+func TestWireGuardVector(t *testing.T) {
+	decode := func(value string) []byte {
+		data, err := hex.DecodeString(value)
+		if err != nil {
+			t.Fatalf("invalid vector %v \n", err)
+		}
+		return data
+	}
+	key := func(value string) sWireGuardKey {
+		var result sWireGuardKey
+		copy(result[:], decode(value))
+		return result
+	}
+
+	vector := testWireGuardVector
+	serverKey, clientKey, psk := key(vector.serverKey), key(vector.clientKey), key(vector.psk)
+	initiation, response, timestamp := decode(vector.initiation), decode(vector.response), decode(vector.timestamp)
+	senderIndex := binary.LittleEndian.Uint32(initiation[4:])
+
+	//the test initiator creates the same initiation by the same ephemeral key and timestamp
+	stamp := time.Unix(int64(binary.BigEndian.Uint64(timestamp)-0x400000000000000a), int64(binary.BigEndian.Uint32(timestamp[8:])))
+	client := sTestWireGuardClient{private: clientKey, server: serverKey.PublicKey(), psk: psk, localIndex: senderIndex}
+	if message := client.createInitiation(&sWireGuardHandshake{}, key(vector.clientEphemeral), stamp); !bytes.Equal(message, initiation) {
+		t.Fatalf("invalid initiation %x \n", message)
+	}
+
+	factory := vnet.CreateProcessFactory()
+	params := SWireGuardInitParams{}
+	params.BindAddress = "127.0.0.1:45102"
+	params.PrivateKey = serverKey.String()
+	params.Utils = utils.Create()
+	params.PacketFactory = factory
+	params.ProtocolActor = &sTestESPActor{factory: factory, packets: make(chan []byte, 64)}
+	params.NetworkManager = &sTestWireGuardNICManager{}
+	params.Peers = []SWireGuardPeerInfo{{Name: "reference", PublicKey: clientKey.PublicKey().String(), PresharedKey: psk.String(), AllowedIPs: []string{"172.16.1.2/32"}}}
+
+	server := cWireGuardServer{}
+	if err := server.Init(params); err != nil {
+		t.Fatalf("can not init wireguard server %v \n", err)
+	}
+	defer server.End()
+
+	handshake := sWireGuardHandshake{}
+	peer, ephemeral, received, err := server.consumeInitiation(initiation, &handshake)
+	if err != nil || !bytes.Equal(received[:], timestamp) {
+		t.Fatalf("can not consume the initiation %v \n", err)
+	}
+
+	//the sender index is allocated by the server, so the mac1 of the reference response is checked separately
+	message, keypair, err := server.createResponse(peer, &handshake, ephemeral, senderIndex, key(vector.serverEphemeral))
+	if err != nil || !bytes.Equal(message[8:60], response[8:60]) {
+		t.Fatalf("invalid response %x %v \n", message, err)
+	}
+	clientPublic := clientKey.PublicKey()
+	mac1Key := wgHash(wgLabelMAC1, clientPublic[:])
+	if mac1 := wgMAC(mac1Key[:], response[:60]); !bytes.Equal(mac1[:], response[60:76]) {
+		t.Fatalf("invalid response mac1 \n")
+	}
+
+	//the transport keys of the both sides
+	transport := decode(vector.clientTransport)
+	plain, err := keypair.receive.Open(nil, wgNonce(0), transport[wgTransportHeaderSize:], nil)
+	if err != nil || !bytes.HasPrefix(plain, []byte("wireguard test message")) {
+		t.Fatalf("can not open the client transport message %v \n", err)
+	}
+	transport = decode(vector.serverTransport)
+	if sealed := keypair.send.Seal(nil, wgNonce(0), plain, nil); !bytes.Equal(sealed, transport[wgTransportHeaderSize:]) {
+		t.Fatalf("invalid server transport message %x \n", sealed)
+	}
+}
@@ -4,16 +4,22 @@ import (
 	"flag"
 	"fmt"
 	"goconnect/auth"
+	"goconnect/cluster"
 	"goconnect/commander"
 	"goconnect/common"
+	"goconnect/config"
 	"goconnect/db"
+	"goconnect/dns"
+	"goconnect/policy"
 	"goconnect/protocols"
 	"goconnect/utils"
 	"goconnect/vnet"
 	"log"
 	"log/syslog"
+	"net"
 	"os"
 	"os/signal"
+	"runtime"
 	"strings"
 	"syscall"
 	"time"
@@ -29,7 +35,18 @@ type CServer struct {
 	routerv6      common.IRouter
 	nicManager    common.INICManager
 	flowManager   common.IFlowManager
-	ipPool        common.IIPPool
+	icmpGenerator common.IICMPGenerator
+	packetCapture common.IPacketCapture
+	flowExporter  common.IFlowExporter
+	pipeline      common.IPipeline
+	dnsForwarder  common.IDNSForwarder
+	dnsInspector  common.IDNSInspector
+	configManager common.IDynamicConfigManager
+	policyManager common.IPolicyManager
+	staticRoutes  common.IStaticRouteManager
+	routeTracer   common.IRouteTracer
+	ipPool        common.IIPPoolManager
+	nodeManager   common.INodeManager
 	commander     common.ICommander
 	settings      cSettings
 }
@@ -44,11 +61,19 @@ func (thisPt *CServer) OnNewPacket(packet common.IProcessInfo) {
 		thisPt.packetFactory.FreeProcessInfo(packet)
 	}()
 
+	//troubleshooting captures see the packets before any processing
+	thisPt.packetCapture.Capture(packet)
+
 	//check for multicast
 	if packet.GetDestinationIP().IsMulticast() {
 		return
 	}
 
+	//answer pings addressed to the gateway itself
+	if thisPt.handleGatewayEcho(packet) {
+		return
+	}
+
 	//find packet flow
 	flow := thisPt.flowManager.GetFlow(packet)
 	if flow == nil {
@@ -57,25 +82,47 @@ func (thisPt *CServer) OnNewPacket(packet common.IProcessInfo) {
 
 	//check for blocked sessions
 	if flow.GetBlocked() {
+		thisPt.sendICMPUnreachable(packet, common.ICMPREASONPROHIBITED)
 		return
 	}
 
+	//learn domains from DNS traffic
+	thisPt.dnsInspector.Inspect(packet)
+
 	//first time routing
 	if flow.GetOutNIC() == 0 {
+
+		//check policies
+		if thisPt.policyManager.Evaluate(packet) == common.POLICYACTIONBLOCK {
+			flow.SetBlocked(true)
+			thisPt.sendICMPUnreachable(packet, common.ICMPREASONPROHIBITED)
+			return
+		}
+
 		outNic := uint64(0)
 		if packet.GetIPVersion() == 4 {
-			outNic = thisPt.routerv4.GetDestinatin(packet.GetDestinationIP())
+			outNic = thisPt.routerv4.GetDestinatin(packet.GetDestinationIP(), packet.GetFlowKey())
 		} else {
-			outNic = thisPt.routerv6.GetDestinatin(packet.GetDestinationIP())
+			outNic = thisPt.routerv6.GetDestinatin(packet.GetDestinationIP(), packet.GetFlowKey())
 		}
 
 		//can not find any destination
-		if outNic == 0 || outNic == packet.GetInNIC() {
+		if outNic == 0 {
+			thisPt.sendICMPUnreachable(packet, common.ICMPREASONNOROUTE)
+			return
+		}
+
+		if outNic == packet.GetInNIC() {
 			return
 		}
 		flow.SetOutNIC(outNic)
 	}
 
+	//blackhole routes drop the packets silently
+	if flow.GetOutNIC() == common.ROUTENICBLACKHOLE {
+		return
+	}
+
 	//find the packet destination
 	dir := flow.GetDirection(packet)
 	if dir == common.FLOWDIRECTIONRECIVE {
@@ -87,6 +134,35 @@ func (thisPt *CServer) OnNewPacket(packet common.IProcessInfo) {
 	thisPt.nicManager.WriteData(flow.GetOutNIC(), packet)
 }
 
+//---------------------------------------------------------------------------------------
+
+//sendICMPUnreachable inform the client about the dropped packet, instead of waiting for timeout
+func (thisPt *CServer) sendICMPUnreachable(packet common.IProcessInfo, reason uint32) {
+	if thisPt.icmpGenerator == nil {
+		return
+	}
+
+	if reply := thisPt.icmpGenerator.CreateUnreachable(packet, reason); reply != nil {
+		thisPt.nicManager.WriteData(packet.GetInNIC(), reply)
+		thisPt.packetFactory.FreeProcessInfo(reply)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//handleGatewayEcho answer echo requests sent to the gateway virtual IP
+func (thisPt *CServer) handleGatewayEcho(packet common.IProcessInfo) bool {
+	if thisPt.icmpGenerator == nil || !thisPt.icmpGenerator.IsGatewayEchoRequest(packet) {
+		return false
+	}
+
+	if reply := thisPt.icmpGenerator.CreateEchoReply(packet); reply != nil {
+		thisPt.nicManager.WriteData(packet.GetInNIC(), reply)
+		thisPt.packetFactory.FreeProcessInfo(reply)
+	}
+	return true
+}
+
 //---------------------------------------------------------------------------------------
 func (thisPt *CServer) initCommander() {
 
@@ -124,9 +200,61 @@ func (thisPt *CServer) initDB() {
 
 func (thisPt *CServer) initAuthenticators() {
 
+	//commanders of the other nodes, used by the cluster mode of the APIs
+	remoteParams := commander.SRemoteCommandersInitParams{}
+	remoteParams.Name = thisPt.settings.getSettings().Command.NodeName
+	if remoteParams.Name == "" {
+		remoteParams.Name, _ = os.Hostname()
+	}
+	for _, peer := range thisPt.settings.getSettings().Command.Peers {
+		info := commander.SRemoteCommanderInfo{}
+		info.Name = peer.Name
+		info.Address = peer.Address
+		info.User = peer.User
+		info.Password = peer.Password
+		info.SkipVerify = peer.SkipVerify
+		remoteParams.Peers = append(remoteParams.Peers, info)
+	}
+
 	params := auth.SAuthenticationManagerParams{}
 	params.Utils = thisPt.utils
 	params.Commander = thisPt.commander
+	params.RemoteCommanders = commander.CreateRemoteCommanders(remoteParams)
+	params.Database = thisPt.db
+	params.History = thisPt.settings.getSettings().Accounting.History
+	params.HistoryRetention = thisPt.settings.getSettings().Accounting.RetentionDays
+	params.InterimInterval = thisPt.settings.getSettings().Accounting.InterimInterval
+	params.DummyGroups = thisPt.settings.getSettings().Authentication.DummyGroups
+	params.SplitExclude = thisPt.settings.getSettings().SSLVpn.SplitExclude
+	params.SplitIncludes = append(params.SplitIncludes, thisPt.settings.getSettings().SSLVpn.SplitTunnels)
+	for _, pool := range thisPt.settings.getSettings().IPPools {
+		params.SplitIncludes = append(params.SplitIncludes, pool.SplitTunnels)
+	}
+	for _, quota := range thisPt.settings.getSettings().Accounting.Quotas {
+		rule := auth.SQuotaRule{}
+		rule.Name = quota.Name
+		rule.Users = quota.Users
+		rule.Groups = quota.Groups
+		rule.DailyBytes = quota.DailyBytes
+		rule.MonthlyBytes = quota.MonthlyBytes
+		rule.MaxSessionTime = quota.MaxSessionTime
+		params.Quotas = append(params.Quotas, rule)
+	}
+	params.MaxSessions = thisPt.settings.getSettings().Accounting.SessionLimit.MaxSessions
+	params.SessionLimitAction = thisPt.settings.getSettings().Accounting.SessionLimit.Action
+	for _, limit := range thisPt.settings.getSettings().Accounting.SessionLimit.Rules {
+		rule := auth.SSessionLimitRule{}
+		rule.Name = limit.Name
+		rule.Users = limit.Users
+		rule.Groups = limit.Groups
+		rule.MaxSessions = limit.MaxSessions
+		params.SessionLimits = append(params.SessionLimits, rule)
+	}
+	params.Lockout.UserFailCount = thisPt.settings.getSettings().Authentication.Lockout.UserFailCount
+	params.Lockout.IPFailCount = thisPt.settings.getSettings().Authentication.Lockout.IPFailCount
+	params.Lockout.TrackTime = thisPt.settings.getSettings().Authentication.Lockout.TrackTime
+	params.Lockout.LockoutTime = thisPt.settings.getSettings().Authentication.Lockout.LockoutTime
+	params.Lockout.Delay = thisPt.settings.getSettings().Authentication.Lockout.Delay
 
 	//
 	thisPt.authManager = auth.Create(params)
@@ -165,6 +293,26 @@ func (thisPt *CServer) initNetworkSubsystems() {
 	nicParams.Commander = thisPt.commander
 	thisPt.nicManager = vnet.CreateNICManager(nicParams)
 
+	//
+	staticParams := vnet.SStaticRouteManagerInitParams{}
+	staticParams.RouterV4 = thisPt.routerv4
+	staticParams.RouterV6 = thisPt.routerv6
+	staticParams.Config = thisPt.configManager
+	staticParams.Commander = thisPt.commander
+	staticParams.Util = thisPt.utils
+	thisPt.staticRoutes = vnet.CreateStaticRouteManager(staticParams)
+
+	//
+	tracerParams := vnet.SRouteTracerInitParams{}
+	tracerParams.RouterV4 = thisPt.routerv4
+	tracerParams.RouterV6 = thisPt.routerv6
+	tracerParams.NicManager = thisPt.nicManager
+	tracerParams.PolicyManager = thisPt.policyManager
+	tracerParams.PacketFactory = thisPt.packetFactory
+	tracerParams.Util = thisPt.utils
+	tracerParams.Commander = thisPt.commander
+	thisPt.routeTracer = vnet.CreateRouteTracer(tracerParams)
+
 	//
 	flowParams := vnet.SFlowManagerInitParams{}
 	flowParams.MaxActiveFlowCount = thisPt.settings.settings.FlowManager.MaximumFlowCount
@@ -173,10 +321,105 @@ func (thisPt *CServer) initNetworkSubsystems() {
 	flowParams.Util = thisPt.utils
 	flowParams.NicManager = thisPt.nicManager
 	flowParams.Commander = thisPt.commander
+	flowParams.ActiveTimeout = thisPt.settings.settings.FlowExport.ActiveTimeout
+	flowParams.Workers = thisPt.settings.settings.Pipeline.Workers
+	if flowParams.Workers == 0 {
+		flowParams.Workers = uint32(runtime.NumCPU())
+	}
+	if thisPt.settings.settings.FlowExport.Enable {
+		exportParams := vnet.SFlowExporterInitParams{}
+		exportParams.Collectors = thisPt.settings.settings.FlowExport.Collectors
+		exportParams.Protocol = thisPt.settings.settings.FlowExport.Protocol
+		exportParams.ObservationDomain = thisPt.settings.settings.FlowExport.ObservationDomain
+		exportParams.EnterpriseNumber = thisPt.settings.settings.FlowExport.EnterpriseNumber
+		exportParams.Util = thisPt.utils
+		exportParams.Commander = thisPt.commander
+		exportParams.AuthMan = thisPt.authManager
+		thisPt.flowExporter = vnet.CreateFlowExporter(exportParams)
+		flowParams.Exporter = thisPt.flowExporter
+	}
 	thisPt.flowManager = vnet.CreateFlowManager(flowParams)
 
 	//
-	thisPt.ipPool = thisPt.utils.CreateLocalIPPool(thisPt.settings.settings.IPPool.Start, thisPt.settings.settings.IPPool.End)
+	captureParams := vnet.SPacketCaptureInitParams{}
+	captureParams.Util = thisPt.utils
+	captureParams.Commander = thisPt.commander
+	captureParams.AuthMan = thisPt.authManager
+	thisPt.packetCapture = vnet.CreatePacketCapture(captureParams)
+
+	//
+	if thisPt.settings.settings.ICMP.Enable {
+		icmpParams := vnet.SICMPGeneratorInitParams{}
+		icmpParams.Util = thisPt.utils
+		icmpParams.Commander = thisPt.commander
+		icmpParams.PacketFactory = thisPt.packetFactory
+		icmpParams.RateLimit = thisPt.settings.settings.ICMP.RateLimit
+		icmpParams.SourceRateLimit = thisPt.settings.settings.ICMP.SourceRateLimit
+		icmpParams.GatewayIPs = thisPt.settings.getGatewayIPs()
+		thisPt.icmpGenerator = vnet.CreateICMPGenerator(icmpParams)
+	}
+
+	//packets are processed by the pipeline workers, sharded by flow
+	pipelineParams := vnet.SPipelineInitParams{}
+	pipelineParams.Workers = flowParams.Workers
+	pipelineParams.QueueSize = thisPt.settings.settings.Pipeline.QueueSize
+	pipelineParams.Actor = thisPt
+	pipelineParams.PacketFactory = thisPt.packetFactory
+	pipelineParams.Util = thisPt.utils
+	pipelineParams.Commander = thisPt.commander
+	thisPt.pipeline = vnet.CreatePipeline(pipelineParams)
+
+	//
+	//the ip_pool is the default pool, the other pools are selected by the user groups and the authenticators
+	pools := []common.SIPPoolConfig{}
+	pools = append(pools, common.SIPPoolConfig{Name: "default", Start: thisPt.settings.settings.IPPool.Start, End: thisPt.settings.settings.IPPool.End, Start6: thisPt.settings.settings.IPPool.Start6, End6: thisPt.settings.settings.IPPool.End6})
+	for _, pool := range thisPt.settings.settings.IPPools {
+		config := common.SIPPoolConfig{}
+		config.Name = pool.Name
+		config.Start = pool.Start
+		config.End = pool.End
+		config.Start6 = pool.Start6
+		config.End6 = pool.End6
+		config.NetMask = pool.NetMask
+		config.DNSServers = pool.DNSServers
+		config.SplitTunnels = pool.SplitTunnels
+		config.Groups = pool.Groups
+		config.Authenticators = pool.Authenticators
+		pools = append(pools, config)
+	}
+	var err error
+	if thisPt.ipPool, err = thisPt.utils.CreateIPPoolManager(pools); err != nil {
+		log.Fatalln(err)
+	}
+	thisPt.ipPool.SetCommander(thisPt.commander)
+	for _, static := range thisPt.settings.settings.IPPool.StaticIPs {
+		if err := thisPt.ipPool.SetStaticIP(static.User, net.ParseIP(static.IP)); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if thisPt.settings.settings.IPPool.Sticky {
+		if err := thisPt.ipPool.SetLeaseStore(thisPt.db); err != nil {
+			log.Printf("can not load the IP leases with error %v \n", err)
+		}
+	}
+
+	//the client NICs are announced to the other nodes, so it should be created before the protocols
+	if thisPt.settings.settings.Cluster.Enable {
+		clusterParams := cluster.SNodeManagerInitParams{}
+		clusterParams.Name = thisPt.settings.settings.Cluster.Name
+		clusterParams.BindAddress = thisPt.settings.settings.Cluster.BindAddress
+		clusterParams.AdvertiseAddress = thisPt.settings.settings.Cluster.AdvertiseAddress
+		clusterParams.SharedKey = thisPt.settings.settings.Cluster.SharedKey
+		clusterParams.Peers = thisPt.settings.settings.Cluster.Peers
+		clusterParams.RouterV4 = thisPt.routerv4
+		clusterParams.RouterV6 = thisPt.routerv6
+		clusterParams.NetworkManager = thisPt.nicManager
+		clusterParams.PacketFactory = thisPt.packetFactory
+		clusterParams.ProtocolActor = thisPt.pipeline
+		clusterParams.Utils = thisPt.utils
+		clusterParams.Commander = thisPt.commander
+		thisPt.nodeManager = cluster.CreateNodeManager(clusterParams)
+	}
 }
 
 //---------------------------------------------------------------------------------------
@@ -200,15 +443,25 @@ func (thisPt *CServer) initProtocols() {
 		sslParams.TunnelDNS = thisPt.settings.getSettings().SSLVpn.TunnelDNS
 		sslParams.Debug = thisPt.settings.getSettings().SSLVpn.Debug
 		sslParams.DNSServers = thisPt.settings.getSettings().SSLVpn.DNSServers
+		sslParams.SplitTunnels = thisPt.settings.getSettings().SSLVpn.SplitTunnels
+		sslParams.SplitExclude = thisPt.settings.getSettings().SSLVpn.SplitExclude
+		sslParams.ExcludeLAN = thisPt.settings.getSettings().SSLVpn.ExcludeLAN
+		sslParams.Banner = thisPt.settings.getSettings().SSLVpn.Banner
+		sslParams.BannerAcceptance = thisPt.settings.getSettings().SSLVpn.BannerAcceptance
 		sslParams.Utils = thisPt.utils
 		sslParams.AuthMan = thisPt.authManager
 		sslParams.NetworkManager = thisPt.nicManager
 		sslParams.PacketFactory = thisPt.packetFactory
 		sslParams.IPPool = thisPt.ipPool
-		sslParams.ProtocolActor = thisPt
+		sslParams.ProtocolActor = thisPt.pipeline
 		sslParams.Command = thisPt.commander
 		if thisPt.settings.getSettings().SSLVpn.UseLocalDNSServer {
-			sslParams.DNSServers = append(sslParams.DNSServers, thisPt.settings.getSettings().TUN.IPList...)
+			sslParams.DNSServers = append(sslParams.DNSServers, thisPt.settings.getLocalDNSServers()...)
+		}
+		if thisPt.settings.getSettings().DNS.Enable {
+			for _, split := range thisPt.settings.getSettings().DNS.SplitDNS {
+				sslParams.SplitDNS = append(sslParams.SplitDNS, split.Domain)
+			}
 		}
 		protocols.CreateSSLVPN(sslParams)
 	}
@@ -225,9 +478,169 @@ func (thisPt *CServer) initProtocols() {
 		tunParams.NetworkManager = thisPt.nicManager
 		tunParams.PacketFactory = thisPt.packetFactory
 		tunParams.Utils = thisPt.utils
-		tunParams.ProtocolActor = thisPt
+		tunParams.ProtocolActor = thisPt.pipeline
 		protocols.CreateTunInterface(tunParams)
 	}
+
+	//site to site tunnels
+	for _, tunnel := range thisPt.settings.getSettings().ESP {
+		espParams := protocols.SESPInitParams{}
+		espParams.Name = tunnel.Name
+		espParams.BindAddress = tunnel.BindAddress
+		espParams.PeerAddress = tunnel.PeerAddress
+		espParams.Routes = tunnel.Routes
+		espParams.MyPSK = tunnel.MyPSK
+		espParams.PeerPSK = tunnel.PeerPSK
+		espParams.Lifetime = tunnel.Lifetime
+		espParams.NetworkManager = thisPt.nicManager
+		espParams.PacketFactory = thisPt.packetFactory
+		espParams.Utils = thisPt.utils
+		espParams.ProtocolActor = thisPt.pipeline
+		espParams.Commander = thisPt.commander
+		protocols.CreateESPTunnel(espParams)
+	}
+
+	//links to the routers
+	for _, tunnel := range thisPt.settings.getSettings().GRE {
+		greParams := protocols.SGREInitParams{}
+		greParams.Name = tunnel.Name
+		greParams.LocalAddress = tunnel.LocalAddress
+		greParams.RemoteAddress = tunnel.RemoteAddress
+		greParams.Key = tunnel.Key
+		greParams.Routes = tunnel.Routes
+		greParams.NetworkManager = thisPt.nicManager
+		greParams.PacketFactory = thisPt.packetFactory
+		greParams.Utils = thisPt.utils
+		greParams.ProtocolActor = thisPt.pipeline
+		greParams.Commander = thisPt.commander
+		protocols.CreateGRETunnel(greParams)
+	}
+
+	for _, tunnel := range thisPt.settings.getSettings().VXLAN {
+		vxlanParams := protocols.SVXLANInitParams{}
+		vxlanParams.Name = tunnel.Name
+		vxlanParams.BindAddress = tunnel.BindAddress
+		vxlanParams.RemoteAddress = tunnel.RemoteAddress
+		vxlanParams.VNI = tunnel.VNI
+		vxlanParams.Routes = tunnel.Routes
+		vxlanParams.NetworkManager = thisPt.nicManager
+		vxlanParams.PacketFactory = thisPt.packetFactory
+		vxlanParams.Utils = thisPt.utils
+		vxlanParams.ProtocolActor = thisPt.pipeline
+		vxlanParams.Commander = thisPt.commander
+		protocols.CreateVXLANTunnel(vxlanParams)
+	}
+
+	//wireguard server
+	if thisPt.settings.getSettings().WireGuard.Enable {
+		wgParams := protocols.SWireGuardInitParams{}
+		wgParams.BindAddress = thisPt.settings.getSettings().WireGuard.BindAddress
+		wgParams.PrivateKey = thisPt.settings.getSettings().WireGuard.PrivateKey
+		wgParams.Authenticator = thisPt.settings.getSettings().WireGuard.Authenticator
+		for _, peer := range thisPt.settings.getSettings().WireGuard.Peers {
+			info := protocols.SWireGuardPeerInfo{}
+			info.Name = peer.Name
+			info.PublicKey = peer.PublicKey
+			info.PresharedKey = peer.PresharedKey
+			info.AllowedIPs = peer.AllowedIPs
+			wgParams.Peers = append(wgParams.Peers, info)
+		}
+		wgParams.NetworkManager = thisPt.nicManager
+		wgParams.PacketFactory = thisPt.packetFactory
+		wgParams.Utils = thisPt.utils
+		wgParams.AuthMan = thisPt.authManager
+		wgParams.ProtocolActor = thisPt.pipeline
+		wgParams.Commander = thisPt.commander
+		protocols.CreateWireGuardServer(wgParams)
+	}
+
+	//proxy for the clients without a tunnel
+	if thisPt.settings.getSettings().Proxy.Enable {
+		proxyParams := protocols.SProxyInitParams{}
+		proxyParams.BindAddress = thisPt.settings.getSettings().Proxy.BindAddress
+		proxyParams.IdleTimeout = thisPt.settings.getSettings().Proxy.IdleTimeout
+		proxyParams.Utils = thisPt.utils
+		proxyParams.AuthMan = thisPt.authManager
+		proxyParams.IPPool = thisPt.ipPool
+		proxyParams.RouteTracer = thisPt.routeTracer
+		proxyParams.NicManager = thisPt.nicManager
+		proxyParams.FlowExporter = thisPt.flowExporter
+		proxyParams.Commander = thisPt.commander
+		protocols.CreateProxyServer(proxyParams)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *CServer) initPolicies() {
+
+	//DNS inspector, used by the domain objects
+	inspectorParams := dns.SDNSInspectorInitParams{}
+	inspectorParams.CacheSize = thisPt.settings.getSettings().DNS.DomainCacheSize
+	inspectorParams.MaxTTL = thisPt.settings.getSettings().DNS.MaxCacheTTL
+	inspectorParams.LogQueries = thisPt.settings.getSettings().DNS.LogQueries
+	inspectorParams.Util = thisPt.utils
+	inspectorParams.Commander = thisPt.commander
+	inspectorParams.AuthMan = thisPt.authManager
+	inspectorParams.NicManager = thisPt.nicManager
+	thisPt.dnsInspector = dns.CreateDNSInspector(inspectorParams)
+
+	//dynamic configurations
+	thisPt.configManager = config.Create(thisPt.utils)
+	thisPt.authManager.SetConfigManager(thisPt.configManager)
+
+	//policy manager
+	policyParams := policy.SPolicyManagerInitParams{}
+	policyParams.Util = thisPt.utils
+	policyParams.Config = thisPt.configManager
+	policyParams.Commander = thisPt.commander
+	policyParams.DNSInspector = thisPt.dnsInspector
+	policyParams.AuthMan = thisPt.authManager
+	thisPt.policyManager = policy.CreatePolicyManager(policyParams)
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *CServer) initDynamicConfig() {
+
+	//objects, policies and routes are loaded from the configuration file
+	if fileName := thisPt.settings.params.FileName; len(fileName) > 0 {
+		if err := thisPt.configManager.LoadFile(fileName); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *CServer) initDNS() {
+	if !thisPt.settings.getSettings().DNS.Enable {
+		return
+	}
+
+	//upstream servers
+	toUpstreams := func(list []string) []string {
+		upstreams := []string{}
+		for _, ip := range list {
+			upstreams = append(upstreams, net.JoinHostPort(ip, "53"))
+		}
+		return upstreams
+	}
+
+	dnsParams := dns.SDNSForwarderInitParams{}
+	dnsParams.BindAddresses = thisPt.settings.getDNSBindAddresses()
+	dnsParams.Upstreams = toUpstreams(thisPt.settings.getSettings().DNS.Upstreams)
+	for _, split := range thisPt.settings.getSettings().DNS.SplitDNS {
+		dnsParams.SplitDNS = append(dnsParams.SplitDNS, dns.SDNSSplitDomain{Domain: split.Domain, Upstreams: toUpstreams(split.Upstreams)})
+	}
+	dnsParams.LocalDomain = thisPt.settings.getSettings().DNS.LocalDomain
+	dnsParams.CacheSize = thisPt.settings.getSettings().DNS.CacheSize
+	dnsParams.MaxCacheTTL = thisPt.settings.getSettings().DNS.MaxCacheTTL
+	dnsParams.Timeout = thisPt.settings.getSettings().DNS.Timeout
+	dnsParams.Util = thisPt.utils
+	dnsParams.Commander = thisPt.commander
+	dnsParams.AuthMan = thisPt.authManager
+	thisPt.dnsForwarder = dns.CreateDNSForwarder(dnsParams)
 }
 
 //---------------------------------------------------------------------------------------
@@ -262,10 +675,28 @@ func (thisPt *CServer) handleSignals() {
 
 	<-sigc
 
+	//stop DNS forwarder
+	if thisPt.dnsForwarder != nil {
+		thisPt.dnsForwarder.End()
+	}
+
+	//send the remaining flow records
+	if thisPt.flowExporter != nil {
+		thisPt.flowExporter.End()
+	}
+
+	//disconnect the other nodes
+	if thisPt.nodeManager != nil {
+		thisPt.nodeManager.End()
+	}
+
 	//Send termination command to all the active interfaces
 	thisPt.nicManager.Flush()
 	time.Sleep(1 * time.Second)
 
+	//process the queued packets
+	thisPt.pipeline.End()
+
 	log.Printf("successfully terminated\n")
 }
 
@@ -305,12 +736,21 @@ func (thisPt *CServer) init() {
 	//
 	thisPt.initCommander()
 
+	//
+	thisPt.initPolicies()
+
 	//
 	thisPt.initNetworkSubsystems()
 
+	//should be called after all the configuration actors are registered
+	thisPt.initDynamicConfig()
+
 	//
 	thisPt.initProtocols()
 
+	//should be called after TUN initialization
+	thisPt.initDNS()
+
 	//
 	log.Printf("successfully initialized !\n")
 
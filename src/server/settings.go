@@ -3,6 +3,7 @@ package server
 import (
 	"encoding/json"
 	"goconnect/common"
+	"net"
 )
 
 type sSettings struct {
@@ -16,9 +17,13 @@ type sSettings struct {
 		DPDInterval             uint32   `json:"dpd_interval" validate:"min=1,max=60"`
 		NetMask                 string   `json:"net_mask" validate:"ip"`
 		SplitTunnels            []string `json:"split_tunnels" validate:"routes"`
+		SplitExclude            []string `json:"split_exclude" validate:"routes"`
+		ExcludeLAN              bool     `json:"exclude_local_lan"`
 		DNSServers              []string `json:"dns_servers" validate:"iplist"`
 		UseLocalDNSServer       bool     `json:"use_local_dns_server"`
 		TunnelDNS               bool     `json:"tunnel_dns"`
+		Banner                  string   `json:"banner" validate:"max=4096"`
+		BannerAcceptance        bool     `json:"banner_acceptance"`
 		Debug                   bool     `json:"debug"`
 		KeepAliveInterval       uint32   `json:"keepalive_interval" validate:"min=10,max=600"`
 		IdelTimeout             uint32   `json:"idle_timeout" validate:"min=600,max=86400"`
@@ -32,24 +37,163 @@ type sSettings struct {
 		Name       string   `json:"name" validate:"alphanum,min=4,max=40"`
 		IPList     []string `json:"ip_list" validate:"routes"`
 		Routes     []string `json:"routes" validate:"routes"`
-		Mtu        uint16   `json:"mtu" validate:"min=1100,max=1500"`
+		Mtu        uint16   `json:"mtu" validate:"min=1100,max=9000"`
 		Enable     bool     `json:"enable"`
 		UpScript   []string `json:"up_commands"`
 		DownScript []string `json:"down_commands"`
 	} `json:"tun"`
 
+	//
+	ESP []struct {
+		Name        string   `json:"name" validate:"alphanum,min=3,max=32"`
+		BindAddress string   `json:"bind_address" validate:"udp_addr"`
+		PeerAddress string   `json:"peer_address" validate:"udp_addr"`
+		Routes      []string `json:"routes" validate:"min=1,routes"`
+		MyPSK       string   `json:"my_psk" validate:"min=16,max=256"`
+		PeerPSK     string   `json:"peer_psk" validate:"min=16,max=256"`
+		Lifetime    uint32   `json:"lifetime" validate:"omitempty,min=60,max=86400"`
+	} `json:"esp" validate:"max=16,dive"`
+
+	//
+	GRE []struct {
+		Name          string   `json:"name" validate:"alphanum,min=3,max=32"`
+		LocalAddress  string   `json:"local_address" validate:"ip"`
+		RemoteAddress string   `json:"remote_address" validate:"ip"`
+		Key           uint32   `json:"key"`
+		Routes        []string `json:"routes" validate:"min=1,routes"`
+	} `json:"gre" validate:"max=64,dive"`
+
+	//
+	VXLAN []struct {
+		Name          string   `json:"name" validate:"alphanum,min=3,max=32"`
+		BindAddress   string   `json:"bind_address" validate:"udp_addr"`
+		RemoteAddress string   `json:"remote_address" validate:"udp_addr"`
+		VNI           uint32   `json:"vni" validate:"min=0,max=16777215"`
+		Routes        []string `json:"routes" validate:"min=1,routes"`
+	} `json:"vxlan" validate:"max=64,dive"`
+
+	//
+	WireGuard struct {
+		Enable        bool   `json:"enable"`
+		BindAddress   string `json:"bind_address" validate:"udp_addr"`
+		PrivateKey    string `json:"private_key" validate:"omitempty,len=44"`
+		Authenticator string `json:"authenticator" validate:"min=1,max=64"`
+		Peers         []struct {
+			Name         string   `json:"name" validate:"alphanum,min=3,max=64"`
+			PublicKey    string   `json:"public_key" validate:"len=44"`
+			PresharedKey string   `json:"preshared_key" validate:"omitempty,len=44"`
+			AllowedIPs   []string `json:"allowed_ips" validate:"min=1,max=64,routes"`
+		} `json:"peers" validate:"max=10240,dive"`
+	} `json:"wireguard"`
+
+	//
+	Proxy struct {
+		Enable      bool   `json:"enable"`
+		BindAddress string `json:"bind_address" validate:"tcp_addr"`
+		IdleTimeout uint32 `json:"idle_timeout" validate:"min=10,max=86400"`
+	} `json:"proxy"`
+
+	//
+	Cluster struct {
+		Enable           bool     `json:"enable"`
+		Name             string   `json:"name" validate:"omitempty,alphanum,max=64"`
+		BindAddress      string   `json:"bind_address" validate:"tcp_addr"`
+		AdvertiseAddress string   `json:"advertise_address" validate:"omitempty,tcp_addr"`
+		SharedKey        string   `json:"shared_key" validate:"omitempty,min=16,max=256"`
+		Peers            []string `json:"peers" validate:"max=256,dive,tcp_addr"`
+	} `json:"cluster"`
+
+	//
+	ICMP struct {
+		Enable          bool     `json:"enable"`
+		GatewayIPs      []string `json:"gateway_ips" validate:"iplist"`
+		RateLimit       uint32   `json:"rate_limit" validate:"min=1,max=100000"`
+		SourceRateLimit uint32   `json:"source_rate_limit" validate:"min=1,max=100000"`
+	} `json:"icmp"`
+
+	//
+	DNS struct {
+		Enable        bool     `json:"enable"`
+		BindAddresses []string `json:"bind_addresses" validate:"iplist"`
+		Upstreams     []string `json:"upstreams" validate:"iplist"`
+		SplitDNS      []struct {
+			Domain    string   `json:"domain" validate:"min=1,max=255"`
+			Upstreams []string `json:"upstreams" validate:"min=1,iplist"`
+		} `json:"split_dns" validate:"max=256,dive"`
+		LocalDomain     string `json:"local_domain" validate:"omitempty,max=255"`
+		CacheSize       uint32 `json:"cache_size" validate:"min=0,max=1024000"`
+		MaxCacheTTL     uint32 `json:"max_cache_ttl" validate:"min=1,max=86400"`
+		Timeout         uint32 `json:"timeout" validate:"min=1,max=30"`
+		LogQueries      bool   `json:"log_queries"`
+		DomainCacheSize uint32 `json:"domain_cache_size" validate:"min=0,max=10240000"`
+	} `json:"dns"`
+
 	//
 	IPPool struct {
-		Start string `json:"start" validate:"ip"`
-		End   string `json:"end" validate:"ip"`
+		Start     string `json:"start" validate:"ip"`
+		End       string `json:"end" validate:"ip"`
+		Start6    string `json:"start6" validate:"omitempty,ipv6"`
+		End6      string `json:"end6" validate:"omitempty,ipv6"`
+		Sticky    bool   `json:"sticky"`
+		StaticIPs []struct {
+			User string `json:"user" validate:"min=1,max=64"`
+			IP   string `json:"ip" validate:"ip"`
+		} `json:"static_ips" validate:"max=65536,dive"`
 	} `json:"ip_pool"`
 
+	//
+	IPPools []struct {
+		Name           string   `json:"name" validate:"min=1,max=64"`
+		Start          string   `json:"start" validate:"omitempty,ipv4"`
+		End            string   `json:"end" validate:"omitempty,ipv4"`
+		Start6         string   `json:"start6" validate:"omitempty,ipv6"`
+		End6           string   `json:"end6" validate:"omitempty,ipv6"`
+		NetMask        string   `json:"net_mask" validate:"omitempty,ip"`
+		DNSServers     []string `json:"dns_servers" validate:"iplist"`
+		SplitTunnels   []string `json:"split_tunnels" validate:"routes"`
+		Groups         []string `json:"groups" validate:"max=256"`
+		Authenticators []string `json:"authenticators" validate:"max=16"`
+	} `json:"ip_pools" validate:"max=64,dive"`
+
 	//
 	Authentication struct {
-		DummyAuthConfigPath string `json:"dummy_auth_config_path" validate:"max=1024"`
-		EnableDummyAuth     bool   `json:"enable_dummy"`
+		DummyAuthConfigPath string   `json:"dummy_auth_config_path" validate:"max=1024"`
+		EnableDummyAuth     bool     `json:"enable_dummy"`
+		DummyGroups         []string `json:"dummy_groups" validate:"max=64"`
+		Lockout             struct {
+			UserFailCount uint32 `json:"user_fail_count" validate:"max=1000"`
+			IPFailCount   uint32 `json:"ip_fail_count" validate:"max=10000"`
+			TrackTime     uint32 `json:"track_time" validate:"min=60,max=86400"`
+			LockoutTime   uint32 `json:"lockout_time" validate:"min=60,max=86400"`
+			Delay         uint32 `json:"delay" validate:"max=5000"`
+		} `json:"lockout"`
 	} `json:"authentication"`
 
+	//
+	Accounting struct {
+		History         bool   `json:"history"`
+		RetentionDays   uint32 `json:"retention_days" validate:"min=0,max=3650"`
+		InterimInterval uint32 `json:"interim_interval" validate:"omitempty,min=10,max=86400"`
+		Quotas          []struct {
+			Name           string   `json:"name" validate:"min=1,max=64"`
+			Users          []string `json:"users" validate:"max=1024"`
+			Groups         []string `json:"groups" validate:"max=256"`
+			DailyBytes     uint64   `json:"daily_bytes"`
+			MonthlyBytes   uint64   `json:"monthly_bytes"`
+			MaxSessionTime uint32   `json:"max_session_time" validate:"max=31536000"`
+		} `json:"quotas" validate:"max=256,dive"`
+		SessionLimit struct {
+			MaxSessions uint32 `json:"max_sessions" validate:"max=65535"`
+			Action      string `json:"action" validate:"omitempty,eq=reject|eq=disconnect_oldest"`
+			Rules       []struct {
+				Name        string   `json:"name" validate:"min=1,max=64"`
+				Users       []string `json:"users" validate:"max=1024"`
+				Groups      []string `json:"groups" validate:"max=256"`
+				MaxSessions uint32   `json:"max_sessions" validate:"max=65535"`
+			} `json:"rules" validate:"max=256,dive"`
+		} `json:"session_limit"`
+	} `json:"accounting"`
+
 	//
 	Log struct {
 		LogFile string `json:"log_file" validate:"max=1024"`
@@ -68,6 +212,22 @@ type sSettings struct {
 		MaximumFlowCount uint32 `json:"maximum_flow_count" validate:"min=10000,max=10240000"`
 	} `json:"flow_manager"`
 
+	//
+	Pipeline struct {
+		Workers   uint32 `json:"workers" validate:"min=0,max=256"`
+		QueueSize uint32 `json:"queue_size" validate:"min=16,max=1048576"`
+	} `json:"pipeline"`
+
+	//
+	FlowExport struct {
+		Enable            bool     `json:"enable"`
+		Protocol          string   `json:"protocol" validate:"eq=ipfix|eq=netflow9"`
+		Collectors        []string `json:"collectors" validate:"max=8,dive,udp_addr"`
+		ActiveTimeout     uint32   `json:"active_timeout" validate:"min=10,max=3600"`
+		ObservationDomain uint32   `json:"observation_domain"`
+		EnterpriseNumber  uint32   `json:"enterprise_number"`
+	} `json:"flow_export"`
+
 	//
 	Command struct {
 		Enable               bool     `json:"enable"`
@@ -79,6 +239,14 @@ type sSettings struct {
 		ValidClients         []string `json:"valid_clients" validate:"omitempty,iplist"`
 		MaintenanceHook      bool     `json:"maintenance_hook"`
 		AuthTokenMaxLifeTime uint32   `json:"token_life_time" validate:"min=60,max=3600"`
+		NodeName             string   `json:"node_name" validate:"omitempty,max=64"`
+		Peers                []struct {
+			Name       string `json:"name" validate:"min=1,max=64"`
+			Address    string `json:"address" validate:"tcp_addr"`
+			User       string `json:"user" validate:"min=3,max=64"`
+			Password   string `json:"password" validate:"min=6,max=64"`
+			SkipVerify bool   `json:"skip_verify"`
+		} `json:"peers" validate:"max=64,dive"`
 	} `json:"command"`
 }
 
@@ -98,7 +266,21 @@ type cSettings struct {
 //---------------------------------------------------------------------------------------
 
 func (thisPt *cSettings) checkSettings() error {
-	return thisPt.params.Util.ValidateStruct(thisPt.settings)
+	if err := thisPt.params.Util.ValidateStruct(thisPt.settings); err != nil {
+		return err
+	}
+
+	//the split exclude of the server is used with the split tunnels of the pools
+	exclude := thisPt.settings.SSLVpn.SplitExclude
+	if err := thisPt.params.Util.CheckSplitRoutes(thisPt.settings.SSLVpn.SplitTunnels, exclude); err != nil {
+		return err
+	}
+	for _, pool := range thisPt.settings.IPPools {
+		if err := thisPt.params.Util.CheckSplitRoutes(pool.SplitTunnels, exclude); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 //---------------------------------------------------------------------------------------
@@ -111,12 +293,37 @@ func (thisPt *cSettings) fillDefault() {
 	thisPt.settings.FlowManager.InactiveLifeTime = 600
 	thisPt.settings.FlowManager.MaximumFlowCount = 512000
 
+	//pipeline
+	thisPt.settings.Pipeline.Workers = 0
+	thisPt.settings.Pipeline.QueueSize = 4096
+
+	//flow export
+	thisPt.settings.FlowExport.Enable = false
+	thisPt.settings.FlowExport.Protocol = "ipfix"
+	thisPt.settings.FlowExport.ActiveTimeout = 60
+	thisPt.settings.FlowExport.ObservationDomain = 1
+	thisPt.settings.FlowExport.EnterpriseNumber = 32473
+
 	//tun
 	thisPt.settings.TUN.Enable = true
 	thisPt.settings.TUN.Name = "goconnect"
 	thisPt.settings.TUN.Mtu = 1430
 	thisPt.settings.TUN.IPList = []string{"172.16.0.1/24"}
 
+	//wireguard
+	thisPt.settings.WireGuard.Enable = false
+	thisPt.settings.WireGuard.BindAddress = "0.0.0.0:51820"
+	thisPt.settings.WireGuard.Authenticator = "dummy"
+
+	//proxy
+	thisPt.settings.Proxy.Enable = false
+	thisPt.settings.Proxy.BindAddress = "127.0.0.1:1080"
+	thisPt.settings.Proxy.IdleTimeout = 300
+
+	//cluster
+	thisPt.settings.Cluster.Enable = false
+	thisPt.settings.Cluster.BindAddress = "0.0.0.0:7440"
+
 	//ssl
 	thisPt.settings.SSLVpn.Mtu = 1430
 	thisPt.settings.SSLVpn.DPDInterval = 10
@@ -131,9 +338,25 @@ func (thisPt *cSettings) fillDefault() {
 	thisPt.settings.SSLVpn.Debug = false
 	thisPt.settings.SSLVpn.InboundManagement = false
 
+	//icmp
+	thisPt.settings.ICMP.Enable = true
+	thisPt.settings.ICMP.RateLimit = 100
+	thisPt.settings.ICMP.SourceRateLimit = 10
+
+	//dns
+	thisPt.settings.DNS.Enable = false
+	thisPt.settings.DNS.Upstreams = []string{"1.1.1.1", "8.8.8.8"}
+	thisPt.settings.DNS.LocalDomain = "vpn.internal"
+	thisPt.settings.DNS.CacheSize = 10000
+	thisPt.settings.DNS.MaxCacheTTL = 3600
+	thisPt.settings.DNS.Timeout = 3
+	thisPt.settings.DNS.LogQueries = false
+	thisPt.settings.DNS.DomainCacheSize = 100000
+
 	//ippool
 	thisPt.settings.IPPool.Start = "172.16.0.2"
 	thisPt.settings.IPPool.End = "172.16.0.254"
+	thisPt.settings.IPPool.Sticky = true
 
 	//DB
 	thisPt.settings.DB.Driver = "sqlite3"
@@ -141,6 +364,17 @@ func (thisPt *cSettings) fillDefault() {
 
 	//authentication
 	thisPt.settings.Authentication.EnableDummyAuth = true
+	thisPt.settings.Authentication.Lockout.UserFailCount = 5
+	thisPt.settings.Authentication.Lockout.IPFailCount = 20
+	thisPt.settings.Authentication.Lockout.TrackTime = 900
+	thisPt.settings.Authentication.Lockout.LockoutTime = 900
+	thisPt.settings.Authentication.Lockout.Delay = 500
+
+	//accounting
+	thisPt.settings.Accounting.History = true
+	thisPt.settings.Accounting.RetentionDays = 90
+	thisPt.settings.Accounting.InterimInterval = 300
+	thisPt.settings.Accounting.SessionLimit.Action = "reject"
 
 	//commander
 	thisPt.settings.Command.BindAddress = "127.0.0.1:4443"
@@ -162,6 +396,50 @@ func (thisPt *cSettings) getSettings() *sSettings {
 
 //---------------------------------------------------------------------------------------
 
+//getGatewayIPs returns the gateway virtual IPs. By default, it is the TUN interface address list
+func (thisPt *cSettings) getGatewayIPs() []string {
+	if len(thisPt.settings.ICMP.GatewayIPs) > 0 {
+		return thisPt.settings.ICMP.GatewayIPs
+	}
+	return thisPt.getTunIPs()
+}
+
+//---------------------------------------------------------------------------------------
+
+//getTunIPs returns the TUN interface addresses without mask
+func (thisPt *cSettings) getTunIPs() []string {
+	list := []string{}
+	for _, ipMask := range thisPt.settings.TUN.IPList {
+		if ip, _, err := net.ParseCIDR(ipMask); err == nil {
+			list = append(list, ip.String())
+		}
+	}
+	return list
+}
+
+//---------------------------------------------------------------------------------------
+
+//getLocalDNSServers returns the IP addresses of the built-in DNS forwarder
+func (thisPt *cSettings) getLocalDNSServers() []string {
+	if len(thisPt.settings.DNS.BindAddresses) > 0 {
+		return thisPt.settings.DNS.BindAddresses
+	}
+	return thisPt.getTunIPs()
+}
+
+//---------------------------------------------------------------------------------------
+
+//getDNSBindAddresses returns the DNS forwarder listen addresses (ip:port)
+func (thisPt *cSettings) getDNSBindAddresses() []string {
+	addresses := []string{}
+	for _, ip := range thisPt.getLocalDNSServers() {
+		addresses = append(addresses, net.JoinHostPort(ip, "53"))
+	}
+	return addresses
+}
+
+//---------------------------------------------------------------------------------------
+
 func (thisPt *cSettings) init(info sSettingsInitparams) error {
 
 	//
@@ -72,8 +72,11 @@ func (thisPt *cHashLinkList) Iterate(callBack common.THashIterationFunc) uint32
 //Init for IHashLinkList
 func (thisPt *cHashLinkList) Init(segmentCount int, minInActiveTime int64) bool {
 
-	//initialize segments
+	//initialize segments. segments are created up front since the list is shared by the pipeline workers
 	thisPt.segments = make([]*sHashLinkListSegment, segmentCount)
+	for i := range thisPt.segments {
+		thisPt.segments[i] = &sHashLinkListSegment{}
+	}
 	thisPt.minInActiveTime = minInActiveTime
 	return true
 }
@@ -172,7 +175,7 @@ func (thisPt *cHashLinkList) Find(key uint64, cmpFunc common.THashCompareFunc, u
 			if cmpFunc != nil && cmpFunc(node.Data, userData) == false {
 				continue
 			}
-			node.LastAccessTime = thisPt.getTime()
+			atomic.StoreInt64(&node.LastAccessTime, thisPt.getTime())
 			return node.Data
 		}
 	}
@@ -184,8 +187,7 @@ func (thisPt *cHashLinkList) Find(key uint64, cmpFunc common.THashCompareFunc, u
 //CheckForTimeOut for IHashLinkList
 func (thisPt *cHashLinkList) CheckForTimeOut(cmpFunc common.THashTimeOutFunc, userData interface{}, t int64) int {
 	//find last segment
-	index := thisPt.lastCheckSegment % uint32(len(thisPt.segments))
-	atomic.AddUint32(&thisPt.lastCheckSegment, 1)
+	index := (atomic.AddUint32(&thisPt.lastCheckSegment, 1) - 1) % uint32(len(thisPt.segments))
 
 	//
 	segment := thisPt.segments[index]
@@ -201,7 +203,7 @@ func (thisPt *cHashLinkList) CheckForTimeOut(cmpFunc common.THashTimeOutFunc, us
 	var pNode *sHashLinkListNode
 	cnt := 0
 	for node := segment.Head; node != nil; {
-		delta := t - node.LastAccessTime
+		delta := t - atomic.LoadInt64(&node.LastAccessTime)
 		if delta > thisPt.minInActiveTime {
 			//check for timeout
 			if cmpFunc != nil && cmpFunc(node.Data, userData, delta) == false {
@@ -234,7 +236,7 @@ func (thisPt *cHashLinkList) CheckForTimeOut(cmpFunc common.THashTimeOutFunc, us
 //Clear for IHashLinkList
 func (thisPt *cHashLinkList) Clear() {
 	for i := 0; i < len(thisPt.segments); i++ {
-		thisPt.segments[i] = nil
+		thisPt.segments[i] = &sHashLinkListSegment{}
 	}
 	thisPt.itemCount = 0
 	thisPt.lastCheckSegment = 0
@@ -244,5 +246,5 @@ func (thisPt *cHashLinkList) Clear() {
 
 //GetItemsCount for IHashLinkList
 func (thisPt *cHashLinkList) GetItemsCount() uint32 {
-	return uint32(thisPt.itemCount)
+	return uint32(atomic.LoadInt32(&thisPt.itemCount))
 }
@@ -73,13 +73,14 @@ func (thisPt *cHttpResponse) ToByte() []byte {
 
 //Copy for IHTTPResponse
 func (thisPt *cHttpResponse) Copy(writer http.ResponseWriter) {
-	writer.WriteHeader(thisPt.response.StatusCode)
-	io.Copy(writer, thisPt.response.Body)
+	//headers should be set before writing the status code
 	for k, v := range thisPt.response.Header {
 		for _, hV := range v {
 			writer.Header().Add(k, hV)
 		}
 	}
+	writer.WriteHeader(thisPt.response.StatusCode)
+	io.Copy(writer, thisPt.response.Body)
 	thisPt.response.Body.Close()
 }
 
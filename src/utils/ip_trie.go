@@ -152,13 +152,30 @@ func (thisPt *cIPTrie) Search(ip net.IP) interface{} {
 
 //---------------------------------------------------------------------------------------
 
-//Search for IIPTrie
+//findPath returns the nodes from the root to the network, nil If there is not any node at the mask depth
+func (thisPt *cIPTrie) findPath(ip net.IP, mask uint32) []*sIPTriNode {
+	path := make([]*sIPTriNode, 0, mask+1)
+	activeNode := &thisPt.root
+	path = append(path, activeNode)
+	for i := uint32(0); i < mask; i++ {
+		activeNode = activeNode.nodes[thisPt.getIPBit(ip, i)]
+		if activeNode == nil {
+			return nil
+		}
+		path = append(path, activeNode)
+	}
+	return path
+}
+
+//---------------------------------------------------------------------------------------
+
+//SearchExact for IIPTrie, only the network with the same mask is returned
 func (thisPt *cIPTrie) SearchExact(ip net.IP, mask uint32) interface{} {
-	node := thisPt.findNode(ip, mask-1)
-	if node == nil {
+	path := thisPt.findPath(ip, mask)
+	if path == nil {
 		return nil
 	}
-	return node.Value
+	return path[len(path)-1].Value
 }
 
 //---------------------------------------------------------------------------------------
@@ -176,14 +193,22 @@ func (thisPt *cIPTrie) SearchExactString(ipMask string) interface{} {
 
 //---------------------------------------------------------------------------------------
 
-//Remove for IIPTrie
+//Remove for IIPTrie, only the network with the same mask is removed. the empty nodes of the path are released
 func (thisPt *cIPTrie) Remove(ip net.IP, mask uint32) interface{} {
-	node := thisPt.findNode(ip, 0)
-	if node == nil {
+	path := thisPt.findPath(ip, mask)
+	if path == nil {
 		return nil
 	}
-	value := node.Value
-	node.Value = nil
+	value := path[mask].Value
+	path[mask].Value = nil
+
+	for i := mask; i > 0; i-- {
+		node := path[i]
+		if node.Value != nil || node.nodes[0] != nil || node.nodes[1] != nil {
+			break
+		}
+		path[i-1].nodes[thisPt.getIPBit(ip, i-1)] = nil
+	}
 	return value
 }
 
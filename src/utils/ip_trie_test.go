@@ -58,10 +58,19 @@ func TestIPTrie(t *testing.T) {
 		log.Fatalln("failed ")
 	}
 
+	//the networks with the same address are removed by their masks
+	Trie.AddString("192.168.1.0/1", 3)
+	if Trie.SearchExactString("128.0.0.0/1").(int) != 3 || Trie.RemoveString("128.0.0.0/1").(int) != 3 || Trie.SearchString("192.168.1.10").(int) != 1 {
+		t.Fatalf("remove of the /1 network failed \n")
+	}
+
 	Trie.RemoveString("192.168.0.0/16")
-	if Trie.SearchString("192.168.3.10") != nil {
+	if Trie.SearchString("192.168.3.10") != nil || Trie.SearchString("192.168.1.10").(int) != 1 {
 		log.Fatalln("failed ")
 	}
+	if Trie.RemoveString("192.168.1.0/16") != nil || Trie.SearchExactString("192.168.1.0/24").(int) != 1 {
+		t.Fatalf("removed network is removed again \n")
+	}
 
 	//load test
 	ip := net.ParseIP("192.168.1.255")
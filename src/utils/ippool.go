@@ -2,16 +2,43 @@ package utils
 
 import (
 	"bytes"
+	"errors"
+	"goconnect/common"
 	"log"
 	"net"
 	"sync"
 )
 
-//
+//---------------------------------------------------------------------------------------
+
+const ipLeaseTable = "ip_leases"
+
+//---------------------------------------------------------------------------------------
+
+//sIPLease is the last IP of a user, persisted for the sticky allocation after the restarts
+type sIPLease struct {
+	ID   int64  `db:"id, primarykey, autoincrement"`
+	Pool string `db:"pool_name,size:64"`
+	User string `db:"user_name,size:64"`
+	IP   string `db:"ip,size:64"`
+}
+
+//---------------------------------------------------------------------------------------
+
+//cIPPool the free IPs are allocated as FIFO, the static IPs are reserved for their users and never allocated dynamically
 type cIPPool struct {
 	listLock sync.Mutex //access lock
 	ipList   []net.IP   //IP pool list
 	ipv4     bool
+	name     string //the leases are saved by the pool name
+	capacity int
+	first    net.IP //the first and the last IPs of the range
+	last     net.IP
+	statics  map[string]net.IP    //user to static IP
+	reserved map[string]string    //static IP to user
+	used     map[string]string    //allocated IP to user
+	leases   map[string]*sIPLease //user to the last IP
+	database common.IDatabase
 }
 
 //---------------------------------------------------------------------------------------
@@ -33,6 +60,104 @@ func (thisPt *cIPPool) getNextIP(ip *net.IP) net.IP {
 
 //---------------------------------------------------------------------------------------
 
+func (thisPt *cIPPool) normalizeIP(ip net.IP) net.IP {
+	if thisPt.ipv4 && ip.To4() != nil {
+		return ip.To4()
+	}
+	return ip
+}
+
+//---------------------------------------------------------------------------------------
+
+//takeIP removes the IP from the free list, should be called by the lock
+func (thisPt *cIPPool) takeIP(ip net.IP) bool {
+	for i, v := range thisPt.ipList {
+		if v.Equal(ip) {
+			thisPt.ipList = append(thisPt.ipList[:i], thisPt.ipList[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+//---------------------------------------------------------------------------------------
+
+//saveLease should be called by the lock
+func (thisPt *cIPPool) saveLease(user string, ip net.IP) {
+	lease, ok := thisPt.leases[user]
+	if !ok {
+		lease = &sIPLease{Pool: thisPt.name, User: user}
+		thisPt.leases[user] = lease
+	}
+	if lease.IP == ip.String() {
+		return
+	}
+	lease.IP = ip.String()
+
+	if thisPt.database == nil {
+		return
+	}
+
+	var err error
+	if lease.ID == 0 {
+		err = thisPt.database.SerializeObject(ipLeaseTable, lease)
+	} else {
+		err = thisPt.database.UpdateObject(ipLeaseTable, lease)
+	}
+	if err != nil {
+		log.Printf("can not save the IP lease of user %s with error %v \n", user, err)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//contains checks whether the IP is in the range of the pool
+func (thisPt *cIPPool) contains(ip net.IP) bool {
+	if thisPt.capacity == 0 || (ip.To4() != nil) != thisPt.ipv4 {
+		return false
+	}
+	ip = ip.To16()
+	return bytes.Compare(ip, thisPt.first.To16()) >= 0 && bytes.Compare(ip, thisPt.last.To16()) <= 0
+}
+
+//---------------------------------------------------------------------------------------
+
+//overlaps checks whether the ranges of the pools have any common IP
+func (thisPt *cIPPool) overlaps(pool *cIPPool) bool {
+	return thisPt.contains(pool.first) || thisPt.contains(pool.last) || pool.contains(thisPt.first)
+}
+
+//---------------------------------------------------------------------------------------
+
+//allocateStaticIP should be called by the lock. the IPs of the other users and the allocated IPs are conflicts,
+//the IPs out of the range are accepted only if they are configured for the user
+func (thisPt *cIPPool) allocateStaticIP(user string, ip net.IP) bool {
+	key := ip.String()
+	owner, ok := thisPt.reserved[key]
+	if ok && owner != user {
+		log.Printf("static IP %s of user %s is reserved for user %s \n", key, user, owner)
+		return false
+	}
+	if !ok && !thisPt.contains(ip) {
+		log.Printf("static IP %s of user %s is out of the range of pool %s \n", key, user, thisPt.name)
+		return false
+	}
+	if owner, ok := thisPt.used[key]; ok {
+		if owner != user {
+			log.Printf("static IP %s of user %s is allocated to user %s \n", key, user, owner)
+		}
+		return false
+	}
+
+	//the static IPs of the authenticators are reserved at the first use
+	thisPt.takeIP(ip)
+	thisPt.reserved[key] = user
+	thisPt.used[key] = user
+	return true
+}
+
+//---------------------------------------------------------------------------------------
+
 //AllocateIP for IIPPool
 func (thisPt *cIPPool) AllocateIP() (bool, net.IP) {
 	thisPt.listLock.Lock()
@@ -44,15 +169,114 @@ func (thisPt *cIPPool) AllocateIP() (bool, net.IP) {
 
 	ip := thisPt.ipList[0]
 	thisPt.ipList = thisPt.ipList[1:]
+	thisPt.used[ip.String()] = ""
 	return true, ip
 }
 
 //---------------------------------------------------------------------------------------
 
+//AllocateUserIP for IIPPool, the static IP is used first, then the last IP of the user and then a free IP.
+//the static IP of the authenticator is preferred to the configured one
+func (thisPt *cIPPool) AllocateUserIP(user string, staticIP net.IP) (bool, net.IP) {
+	thisPt.listLock.Lock()
+	defer thisPt.listLock.Unlock()
+
+	if staticIP == nil {
+		staticIP = thisPt.statics[user]
+	}
+	if staticIP != nil {
+		staticIP = thisPt.normalizeIP(staticIP)
+		if thisPt.allocateStaticIP(user, staticIP) {
+			return true, staticIP
+		}
+	}
+
+	if lease, ok := thisPt.leases[user]; ok {
+		if ip := thisPt.normalizeIP(net.ParseIP(lease.IP)); ip != nil && thisPt.takeIP(ip) {
+			thisPt.used[ip.String()] = user
+			return true, ip
+		}
+	}
+
+	if len(thisPt.ipList) == 0 {
+		return false, nil
+	}
+
+	ip := thisPt.ipList[0]
+	thisPt.ipList = thisPt.ipList[1:]
+	thisPt.used[ip.String()] = user
+	thisPt.saveLease(user, ip)
+	return true, ip
+}
+
+//---------------------------------------------------------------------------------------
+
+//SetStaticIP for IIPPool, the IP is removed from the free IPs. the IP can be out of the pool range
+func (thisPt *cIPPool) SetStaticIP(user string, ip net.IP) error {
+	thisPt.listLock.Lock()
+	defer thisPt.listLock.Unlock()
+
+	ip = thisPt.normalizeIP(ip)
+	key := ip.String()
+	if owner, ok := thisPt.reserved[key]; ok && owner != user {
+		return errors.New("static IP " + key + " is already reserved for user " + owner)
+	}
+	if owner, ok := thisPt.used[key]; ok && owner != user {
+		return errors.New("static IP " + key + " is already allocated")
+	}
+	if old, ok := thisPt.statics[user]; ok && !old.Equal(ip) {
+		return errors.New("user " + user + " has already the static IP " + old.String())
+	}
+
+	thisPt.takeIP(ip)
+	thisPt.statics[user] = ip
+	thisPt.reserved[key] = user
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//SetLeaseStore for IIPPool, the leases are loaded from the database and the leased IPs are moved to the end of the free IPs
+func (thisPt *cIPPool) SetLeaseStore(database common.IDatabase) error {
+	if err := database.Register(ipLeaseTable, sIPLease{}); err != nil {
+		return err
+	}
+
+	leases := []sIPLease{}
+	if err := database.LoadObject(&leases, "select * from "+ipLeaseTable+" where pool_name='%s'", thisPt.name); err != nil {
+		return err
+	}
+
+	thisPt.listLock.Lock()
+	defer thisPt.listLock.Unlock()
+
+	thisPt.database = database
+	leased := []net.IP{}
+	for i := range leases {
+		lease := leases[i]
+		thisPt.leases[lease.User] = &lease
+		if ip := thisPt.normalizeIP(net.ParseIP(lease.IP)); ip != nil && thisPt.takeIP(ip) {
+			leased = append(leased, ip)
+		}
+	}
+	thisPt.ipList = append(thisPt.ipList, leased...)
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+
 //FreeIP for IIPPool
 func (thisPt *cIPPool) FreeIP(ip net.IP) {
 	thisPt.listLock.Lock()
 	defer thisPt.listLock.Unlock()
+
+	key := ip.String()
+	delete(thisPt.used, key)
+
+	//the static IPs are not allocated dynamically
+	if _, ok := thisPt.reserved[key]; ok {
+		return
+	}
 	thisPt.ipList = append(thisPt.ipList, ip)
 }
 
@@ -64,6 +288,11 @@ func (thisPt *cIPPool) Init(start string, end string) int {
 	startIP := net.ParseIP(start)
 	endIP := net.ParseIP(end)
 
+	thisPt.statics = make(map[string]net.IP)
+	thisPt.reserved = make(map[string]string)
+	thisPt.used = make(map[string]string)
+	thisPt.leases = make(map[string]*sIPLease)
+
 	//
 	if startIP.IsUnspecified() || endIP.IsUnspecified() {
 		log.Printf("invalid ip pool range address %s %s \n", start, end)
@@ -93,5 +322,29 @@ func (thisPt *cIPPool) Init(start string, end string) int {
 		}
 		thisPt.ipList = append(thisPt.ipList, adIp)
 	}
+	thisPt.capacity = i
+	if i > 0 {
+		thisPt.first = thisPt.ipList[0]
+		thisPt.last = thisPt.ipList[i-1]
+	}
 	return i
 }
+
+//---------------------------------------------------------------------------------------
+
+//getStatus returns the capacity, the allocated and the free IPs of the pool
+func (thisPt *cIPPool) getStatus() (int, int, int) {
+	thisPt.listLock.Lock()
+	defer thisPt.listLock.Unlock()
+	return thisPt.capacity, len(thisPt.used), len(thisPt.ipList)
+}
+
+//---------------------------------------------------------------------------------------
+
+//isAllocated checks the owner of an IP
+func (thisPt *cIPPool) isAllocated(ip net.IP) bool {
+	thisPt.listLock.Lock()
+	defer thisPt.listLock.Unlock()
+	_, ok := thisPt.used[ip.String()]
+	return ok
+}
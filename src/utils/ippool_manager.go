@@ -0,0 +1,300 @@
+package utils
+
+import (
+	"errors"
+	"goconnect/common"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+)
+
+//---------------------------------------------------------------------------------------
+
+//sIPPoolEntry a named pool, the IPv6 pool is optional
+type sIPPoolEntry struct {
+	config common.SIPPoolConfig
+	pool   *cIPPool
+	pool6  *cIPPool
+}
+
+//---------------------------------------------------------------------------------------
+
+type sIPPoolStatus struct {
+	Name      string `json:"name"`
+	Capacity  int    `json:"capacity"`
+	Used      int    `json:"used"`
+	Free      int    `json:"free"`
+	Capacity6 int    `json:"capacity6"`
+	Used6     int    `json:"used6"`
+	Free6     int    `json:"free6"`
+}
+
+//---------------------------------------------------------------------------------------
+
+//cIPPoolManager the pools are selected by the user groups, then the authenticator and then the default pool
+type cIPPoolManager struct {
+	pools   []*sIPPoolEntry
+	statics map[string]*sIPPoolEntry //user to the pool of the static IPs
+	lock    sync.RWMutex
+	utils   common.IUtils
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cIPPoolManager) contains(items []string, value string) bool {
+	for _, item := range items {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cIPPoolManager) selectPool(authenticator string, groups []string) *sIPPoolEntry {
+	for _, entry := range thisPt.pools {
+		for _, group := range groups {
+			if thisPt.contains(entry.config.Groups, group) {
+				return entry
+			}
+		}
+	}
+
+	for _, entry := range thisPt.pools {
+		if thisPt.contains(entry.config.Authenticators, authenticator) {
+			return entry
+		}
+	}
+	return thisPt.pools[0]
+}
+
+//---------------------------------------------------------------------------------------
+
+//findPool returns the pool whose range contains the IP
+func (thisPt *cIPPoolManager) findPool(ip net.IP) *sIPPoolEntry {
+	for _, entry := range thisPt.pools {
+		for _, pool := range []*cIPPool{entry.pool, entry.pool6} {
+			if pool != nil && pool.contains(ip) {
+				return entry
+			}
+		}
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//selectStaticPool returns the pool of the static IP of the authenticator or the configured static IPs of the user
+func (thisPt *cIPPoolManager) selectStaticPool(user string, staticIP net.IP) *sIPPoolEntry {
+	if staticIP != nil {
+		if entry := thisPt.findPool(staticIP); entry != nil {
+			return entry
+		}
+	}
+
+	thisPt.lock.RLock()
+	defer thisPt.lock.RUnlock()
+	return thisPt.statics[user]
+}
+
+//---------------------------------------------------------------------------------------
+
+//AllocateIP for IIPPoolManager, the users with a static IP get the IPs of the pool containing the static IP.
+//the static IP of the user is allocated from the pool of the same IP version
+func (thisPt *cIPPoolManager) AllocateIP(user string, authenticator string, info common.SUserInfo) (common.SIPAllocation, error) {
+	entry := thisPt.selectStaticPool(user, info.StaticIP)
+	if entry == nil {
+		entry = thisPt.selectPool(authenticator, info.Groups)
+	}
+
+	allocation := common.SIPAllocation{}
+	allocation.Pool = entry.config.Name
+	allocation.NetMask = entry.config.NetMask
+	allocation.DNSServers = entry.config.DNSServers
+	allocation.SplitTunnels = entry.config.SplitTunnels
+
+	var static, static6 net.IP
+	if info.StaticIP != nil && info.StaticIP.To4() != nil {
+		static = info.StaticIP
+	} else {
+		static6 = info.StaticIP
+	}
+
+	if entry.pool != nil {
+		res, ip := entry.pool.AllocateUserIP(user, static)
+		if !res {
+			return allocation, errors.New("out of IP in pool " + entry.config.Name)
+		}
+		allocation.IP = ip
+	}
+
+	if entry.pool6 != nil {
+		res, ip := entry.pool6.AllocateUserIP(user, static6)
+		if !res {
+			if allocation.IP != nil {
+				entry.pool.FreeIP(allocation.IP)
+			}
+			return allocation, errors.New("out of IPv6 in pool " + entry.config.Name)
+		}
+		allocation.IP6 = ip
+	}
+	return allocation, nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//FreeIP for IIPPoolManager, the IP is returned to its own pool
+func (thisPt *cIPPoolManager) FreeIP(ip net.IP) {
+	if ip == nil {
+		return
+	}
+
+	for _, entry := range thisPt.pools {
+		for _, pool := range []*cIPPool{entry.pool, entry.pool6} {
+			if pool != nil && pool.isAllocated(ip) {
+				pool.FreeIP(ip)
+				return
+			}
+		}
+	}
+	log.Printf("can not find the pool of IP %s \n", ip.String())
+}
+
+//---------------------------------------------------------------------------------------
+
+//SetStaticIP for IIPPoolManager, the static IPs are reserved in the pool containing the IP. the IPs out of the
+//ranges are reserved in the default pool. the static IPs of a user should be in the same pool
+func (thisPt *cIPPoolManager) SetStaticIP(user string, ip net.IP) error {
+	entry := thisPt.findPool(ip)
+	if entry == nil {
+		entry = thisPt.pools[0]
+	}
+
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+
+	if old, ok := thisPt.statics[user]; ok && old != entry {
+		return errors.New("static IP " + ip.String() + " of user " + user + " is not in the pool " + old.config.Name)
+	}
+
+	var err error
+	switch {
+	case ip.To4() != nil && entry.pool != nil:
+		err = entry.pool.SetStaticIP(user, ip)
+	case ip.To4() == nil && entry.pool6 != nil:
+		err = entry.pool6.SetStaticIP(user, ip)
+	default:
+		err = errors.New("pool " + entry.config.Name + " has no range for static IP " + ip.String())
+	}
+	if err != nil {
+		return err
+	}
+	thisPt.statics[user] = entry
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//SetLeaseStore for IIPPoolManager
+func (thisPt *cIPPoolManager) SetLeaseStore(database common.IDatabase) error {
+	for _, entry := range thisPt.pools {
+		for _, pool := range []*cIPPool{entry.pool, entry.pool6} {
+			if pool == nil {
+				continue
+			}
+			if err := pool.SetLeaseStore(database); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cIPPoolManager) OnStatusCommand(req *http.Request, params interface{}) (common.IHTTPResponse, error) {
+	result := []sIPPoolStatus{}
+	for _, entry := range thisPt.pools {
+		status := sIPPoolStatus{Name: entry.config.Name}
+		if entry.pool != nil {
+			status.Capacity, status.Used, status.Free = entry.pool.getStatus()
+		}
+		if entry.pool6 != nil {
+			status.Capacity6, status.Used6, status.Free6 = entry.pool6.getStatus()
+		}
+		result = append(result, status)
+	}
+	return thisPt.utils.CreateHttpResponseFromObject(result)
+}
+
+//---------------------------------------------------------------------------------------
+
+//SetCommander for IIPPoolManager
+func (thisPt *cIPPoolManager) SetCommander(commander common.ICommander) {
+	selector := commander.CreateSelector()
+	selector.Register("pools_status", thisPt.OnStatusCommand, nil)
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cIPPoolManager) createPool(name string, start string, end string, ipv4 bool) (*cIPPool, error) {
+	if start == "" && end == "" {
+		return nil, nil
+	}
+
+	pool := &cIPPool{name: name}
+	if pool.Init(start, end) == 0 || pool.ipv4 != ipv4 {
+		return nil, errors.New("invalid range " + start + " - " + end + " of pool " + name)
+	}
+	return pool, nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//checkOverlaps the ranges of the pools should not have any common IP
+func (thisPt *cIPPoolManager) checkOverlaps(entry *sIPPoolEntry) error {
+	for _, other := range thisPt.pools {
+		if (entry.pool != nil && other.pool != nil && entry.pool.overlaps(other.pool)) || (entry.pool6 != nil && other.pool6 != nil && entry.pool6.overlaps(other.pool6)) {
+			return errors.New("range of pool " + entry.config.Name + " overlaps pool " + other.config.Name)
+		}
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//init creates the pools, the pool names should be unique, the ranges should not overlap and each pool needs at least one range
+func (thisPt *cIPPoolManager) init(utils common.IUtils, pools []common.SIPPoolConfig) error {
+	thisPt.utils = utils
+	thisPt.statics = make(map[string]*sIPPoolEntry)
+	if len(pools) == 0 {
+		return errors.New("no IP pool")
+	}
+
+	names := make(map[string]bool)
+	for _, config := range pools {
+		if names[config.Name] {
+			return errors.New("duplicate IP pool " + config.Name)
+		}
+		names[config.Name] = true
+
+		var err error
+		entry := &sIPPoolEntry{config: config}
+		if entry.pool, err = thisPt.createPool(config.Name, config.Start, config.End, true); err != nil {
+			return err
+		}
+		if entry.pool6, err = thisPt.createPool(config.Name, config.Start6, config.End6, false); err != nil {
+			return err
+		}
+		if entry.pool == nil && entry.pool6 == nil {
+			return errors.New("no range in pool " + config.Name)
+		}
+		if err := thisPt.checkOverlaps(entry); err != nil {
+			return err
+		}
+		thisPt.pools = append(thisPt.pools, entry)
+	}
+	return nil
+}
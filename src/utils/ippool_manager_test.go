@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"encoding/json"
+	"goconnect/common"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+//---------------------------------------------------------------------------------------
+
+func TestIPPoolManager(t *testing.T) {
+	util := Create()
+	pools := []common.SIPPoolConfig{
+		{Name: "default", Start: "172.16.0.1", End: "172.16.0.10"},
+		{Name: "guests", Start: "172.17.0.1", End: "172.17.0.4", Start6: "fd00::1", End6: "fd00::4", Groups: []string{"guests"}, DNSServers: []string{"172.17.0.1"}},
+		{Name: "ldap", Start6: "fd01::1", End6: "fd01::10", Authenticators: []string{"ldap"}},
+	}
+
+	if _, err := util.CreateIPPoolManager(append(pools, common.SIPPoolConfig{Name: "guests", Start: "172.18.0.1", End: "172.18.0.4"})); err == nil {
+		t.Fatalf("duplicate pool is accepted \n")
+	}
+	if _, err := util.CreateIPPoolManager([]common.SIPPoolConfig{{Name: "invalid", Start: "fd00::1", End: "fd00::4"}}); err == nil {
+		t.Fatalf("IPv6 range is accepted as IPv4 range \n")
+	}
+	if _, err := util.CreateIPPoolManager(append(pools, common.SIPPoolConfig{Name: "overlap", Start: "172.16.0.8", End: "172.16.0.20"})); err == nil {
+		t.Fatalf("overlapping pool is accepted \n")
+	}
+
+	manager, err := util.CreateIPPoolManager(pools)
+	if err != nil {
+		t.Fatalf("can not create the pools %v \n", err)
+	}
+
+	//the groups are checked before the authenticators
+	allocation, err := manager.AllocateIP("user1", "ldap", common.SUserInfo{Groups: []string{"users", "guests"}})
+	if err != nil || allocation.Pool != "guests" || !allocation.IP.Equal(net.ParseIP("172.17.0.2")) || !allocation.IP6.Equal(net.ParseIP("fd00::2")) || allocation.DNSServers[0] != "172.17.0.1" {
+		t.Fatalf("invalid group allocation %v %v \n", allocation, err)
+	}
+	if allocation, err := manager.AllocateIP("user2", "ldap", common.SUserInfo{}); err != nil || allocation.Pool != "ldap" || allocation.IP != nil || allocation.IP6 == nil {
+		t.Fatalf("invalid authenticator allocation %v %v \n", allocation, err)
+	}
+	if allocation, err := manager.AllocateIP("user3", "dummy", common.SUserInfo{}); err != nil || allocation.Pool != "default" || allocation.IP6 != nil {
+		t.Fatalf("invalid default allocation %v %v \n", allocation, err)
+	}
+
+	//the IPs are returned to their own pools
+	manager.FreeIP(allocation.IP6)
+	manager.FreeIP(net.ParseIP("10.0.0.1"))
+
+	response, err := manager.(*cIPPoolManager).OnStatusCommand(nil, nil)
+	if err != nil {
+		t.Fatalf("can not get the pools status %v \n", err)
+	}
+	body, _ := ioutil.ReadAll(response.GetRespose().Body)
+	status := []sIPPoolStatus{}
+	if err := json.Unmarshal(body, &status); err != nil || len(status) != 3 {
+		t.Fatalf("invalid status %s \n", string(body))
+	}
+	if status[0].Capacity != 8 || status[0].Used != 1 || status[1].Used != 1 || status[1].Used6 != 0 || status[1].Free6 != 2 || status[2].Used6 != 1 || status[2].Capacity != 0 {
+		t.Fatalf("invalid status %s \n", string(body))
+	}
+
+	//the static IPs are reserved in the pool containing them
+	if err := manager.SetStaticIP("user4", net.ParseIP("172.17.0.3")); err != nil {
+		t.Fatalf("can not set static IP %v \n", err)
+	}
+	if err := manager.SetStaticIP("user4", net.ParseIP("172.16.0.5")); err == nil {
+		t.Fatalf("static IPs in different pools are accepted \n")
+	}
+	if allocation, err := manager.AllocateIP("user4", "dummy", common.SUserInfo{}); err != nil || allocation.Pool != "guests" || !allocation.IP.Equal(net.ParseIP("172.17.0.3")) {
+		t.Fatalf("invalid static allocation %v %v \n", allocation, err)
+	}
+
+	//the framed IP selects the pool containing it
+	if allocation, err := manager.AllocateIP("user5", "dummy", common.SUserInfo{StaticIP: net.ParseIP("fd01::5")}); err != nil || allocation.Pool != "ldap" || !allocation.IP6.Equal(net.ParseIP("fd01::5")) {
+		t.Fatalf("invalid framed allocation %v %v \n", allocation, err)
+	}
+}
@@ -1,7 +1,11 @@
 package utils
 
 import (
+	"goconnect/db"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -39,3 +43,67 @@ func TestIPPool(t *testing.T) {
 
 	t.Log("successfully test cIPPool \n")
 }
+
+//---------------------------------------------------------------------------------------
+
+func TestIPPoolUsers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goconnect")
+	if err != nil {
+		t.Fatalf("can not create temp directory %v \n", err)
+	}
+	defer os.RemoveAll(dir)
+	database := db.Create("sqlite3", filepath.Join(dir, "leases.db"))
+
+	ipPool := cIPPool{}
+	ipPool.Init("172.16.0.1", "172.16.0.10")
+	if err := ipPool.SetLeaseStore(database); err != nil {
+		t.Fatalf("can not set the lease store %v \n", err)
+	}
+
+	//the static IP is not allocated dynamically
+	if err := ipPool.SetStaticIP("user1", net.ParseIP("172.16.0.2")); err != nil {
+		t.Fatalf("can not set static IP %v \n", err)
+	}
+	if err := ipPool.SetStaticIP("user2", net.ParseIP("172.16.0.2")); err == nil {
+		t.Fatalf("duplicate static IP is accepted \n")
+	}
+	if res, ip := ipPool.AllocateUserIP("user1", nil); !res || !ip.Equal(net.ParseIP("172.16.0.2")) {
+		t.Fatalf("invalid static IP %v \n", ip)
+	}
+	ipPool.FreeIP(net.ParseIP("172.16.0.2").To4())
+	if len(ipPool.ipList) != 7 {
+		t.Fatalf("static IP is freed to the pool \n")
+	}
+
+	//the static IP of the authenticator is reserved too, the second session of the user gets a dynamic IP
+	if res, ip := ipPool.AllocateUserIP("user3", net.ParseIP("172.16.0.5")); !res || !ip.Equal(net.ParseIP("172.16.0.5")) {
+		t.Fatalf("invalid framed IP %v \n", ip)
+	}
+	if res, ip := ipPool.AllocateUserIP("user4", net.ParseIP("172.16.0.5")); !res || ip.Equal(net.ParseIP("172.16.0.5")) {
+		t.Fatalf("reserved framed IP is allocated %v \n", ip)
+	}
+	if res, ip := ipPool.AllocateUserIP("user6", net.ParseIP("10.0.0.1")); !res || ip.Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("framed IP out of the range is allocated %v \n", ip)
+	}
+
+	//sticky IP
+	_, first := ipPool.AllocateUserIP("user2", nil)
+	ipPool.FreeIP(first)
+	_, other := ipPool.AllocateUserIP("user5", nil)
+	if other.Equal(first) {
+		t.Fatalf("last IP of user2 is allocated first \n")
+	}
+	if _, ip := ipPool.AllocateUserIP("user2", nil); !ip.Equal(first) {
+		t.Fatalf("sticky IP is not allocated %v %v \n", ip, first)
+	}
+
+	//the leases are loaded after the restart
+	restarted := cIPPool{}
+	restarted.Init("172.16.0.1", "172.16.0.10")
+	if err := restarted.SetLeaseStore(database); err != nil {
+		t.Fatalf("can not load the leases %v \n", err)
+	}
+	if _, ip := restarted.AllocateUserIP("user2", nil); !ip.Equal(first) {
+		t.Fatalf("lease is not persisted %v %v \n", ip, first)
+	}
+}
@@ -109,6 +109,17 @@ func (thisPt *CUtils) CreateLocalIPPool(start string, end string) common.IIPPool
 
 //---------------------------------------------------------------------------------------
 
+//CreateIPPoolManager for IUtils
+func (thisPt *CUtils) CreateIPPoolManager(pools []common.SIPPoolConfig) (common.IIPPoolManager, error) {
+	manager := new(cIPPoolManager)
+	if err := manager.init(thisPt, pools); err != nil {
+		return nil, err
+	}
+	return manager, nil
+}
+
+//---------------------------------------------------------------------------------------
+
 //CreateHashLinkList for IUtils
 func (thisPt *CUtils) CreateHashLinkList(segmentCount uint32, inactveTimeOut uint64) common.IHashLinkList {
 	list := new(cHashLinkList)
@@ -563,6 +574,32 @@ func (thisPt *CUtils) CastJsonObject(in interface{}, out interface{}) error {
 
 //---------------------------------------------------------------------------------------
 
+//CheckSplitRoutes for IUtils, an exclude network conflicts with the include networks inside it.
+//the exclude networks inside an include network are valid
+func (thisPt *CUtils) CheckSplitRoutes(include []string, exclude []string) error {
+	for _, excludeRoute := range exclude {
+		_, excludeNet, err := net.ParseCIDR(excludeRoute)
+		if err != nil {
+			return err
+		}
+		excludeSize, _ := excludeNet.Mask.Size()
+
+		for _, includeRoute := range include {
+			_, includeNet, err := net.ParseCIDR(includeRoute)
+			if err != nil {
+				return err
+			}
+			includeSize, _ := includeNet.Mask.Size()
+			if len(includeNet.IP) == len(excludeNet.IP) && excludeSize <= includeSize && excludeNet.Contains(includeNet.IP) {
+				return fmt.Errorf("split include %s conflicts with split exclude %s", includeRoute, excludeRoute)
+			}
+		}
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+
 //Create ...
 func Create() common.IUtils {
 	utility := new(CUtils)
@@ -71,8 +71,25 @@ func testHelpString(t *testing.T) {
 
 //---------------------------------------------------------------------------------------
 
+func testSplitRoutes(t *testing.T) {
+	utils := CUtils{}
+	include := []string{"10.0.0.0/8", "192.168.1.0/24", "fd00::/16"}
+
+	if err := utils.CheckSplitRoutes(include, []string{"10.10.0.0/16", "fd00:1::/32", "172.16.0.0/12"}); err != nil {
+		t.Fatalf("valid split routes are rejected %v \n", err)
+	}
+	for _, exclude := range []string{"10.0.0.0/8", "192.168.0.0/16", "fd00::/8", "0.0.0.0/0"} {
+		if err := utils.CheckSplitRoutes(include, []string{exclude}); err == nil {
+			t.Fatalf("conflict of split exclude %s is not detected \n", exclude)
+		}
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
 func TestUtils(t *testing.T) {
 	testCertificate(t)
 	testCrypto(t)
 	testHelpString(t)
+	testSplitRoutes(t)
 }
@@ -3,22 +3,30 @@ package vnet
 import (
 	"goconnect/common"
 	"net"
+	"time"
 )
 
 //---------------------------------------------------------------------------------------
 
 //cFlow ...
 type cFlow struct {
-	Id          uint64               `json:"id"`
-	Stat        common.STransferStat `json:"stat"`
-	Source      net.IP               `json:"src"`
-	Destination net.IP               `json:"dst"`
-	InNIC       uint64               `json:"in_nic"`
-	OutNIC      uint64               `json:"out_nic"`
-	Blocked     bool                 `json:"blocked"`
-	InNICName   string               `json:"in_nic_name"`
-	OutNICName  string               `json:"out_nic_name"`
-	netManager  common.INICManager
+	Id              uint64               `json:"id"`
+	Stat            common.STransferStat `json:"stat"`
+	Source          net.IP               `json:"src"`
+	Destination     net.IP               `json:"dst"`
+	SourcePort      uint16               `json:"src_port"`
+	DestinationPort uint16               `json:"dst_port"`
+	Protocol        uint8                `json:"protocol"`
+	InNIC           uint64               `json:"in_nic"`
+	OutNIC          uint64               `json:"out_nic"`
+	Blocked         bool                 `json:"blocked"`
+	InNICName       string               `json:"in_nic_name"`
+	OutNICName      string               `json:"out_nic_name"`
+	StartTime       int64                `json:"start_time"`
+	UpdateTime      int64                `json:"update_time"`
+	netManager      common.INICManager
+	exportStat      common.STransferStat
+	exportTime      int64
 }
 
 //---------------------------------------------------------------------------------------
@@ -61,7 +69,9 @@ func (thisPt *cFlow) GetOutNIC() uint64 {
 //SetOutNIC for IFlow
 func (thisPt *cFlow) SetOutNIC(nic uint64) {
 	thisPt.OutNIC = nic
-	thisPt.OutNICName = thisPt.netManager.GetNICName(nic)
+	if thisPt.netManager != nil {
+		thisPt.OutNICName = thisPt.netManager.GetNICName(nic)
+	}
 }
 
 //---------------------------------------------------------------------------------------
@@ -80,6 +90,13 @@ func (thisPt *cFlow) GetBlocked() bool {
 
 //---------------------------------------------------------------------------------------
 
+//SetBlocked for IFlow
+func (thisPt *cFlow) SetBlocked(blocked bool) {
+	thisPt.Blocked = blocked
+}
+
+//---------------------------------------------------------------------------------------
+
 //GetDirection for IFlow
 func (thisPt *cFlow) GetDirection(process common.IProcessInfo) uint32 {
 	if process.GetSourceIP().Equal(thisPt.Source) {
@@ -100,4 +117,63 @@ func (thisPt *cFlow) UpdateStat(process common.IProcessInfo) {
 		thisPt.Stat.ReceiveByte += uint64(process.GetUsedSize())
 		thisPt.Stat.ReceivePacket++
 	}
+	thisPt.UpdateTime = time.Now().Unix()
+}
+
+//---------------------------------------------------------------------------------------
+
+//createRecords returns the export records of both directions, since the last export
+func (thisPt *cFlow) createRecords(reason uint8) []*common.SFlowRecord {
+	records := []*common.SFlowRecord{}
+
+	delta := thisPt.Stat
+	delta.SendByte -= thisPt.exportStat.SendByte
+	delta.SendPacket -= thisPt.exportStat.SendPacket
+	delta.ReceiveByte -= thisPt.exportStat.ReceiveByte
+	delta.ReceivePacket -= thisPt.exportStat.ReceivePacket
+
+	startTime := thisPt.StartTime
+	if thisPt.exportTime != 0 {
+		startTime = thisPt.exportTime
+	}
+
+	//client to server
+	if delta.SendPacket > 0 {
+		record := &common.SFlowRecord{}
+		record.Source = thisPt.Source
+		record.Destination = thisPt.Destination
+		record.SourcePort = thisPt.SourcePort
+		record.DestinationPort = thisPt.DestinationPort
+		record.Protocol = thisPt.Protocol
+		record.InNIC = thisPt.InNIC
+		record.OutNIC = thisPt.OutNIC
+		record.Stat.SendByte = delta.SendByte
+		record.Stat.SendPacket = delta.SendPacket
+		record.StartTime = startTime
+		record.EndTime = thisPt.UpdateTime
+		record.EndReason = reason
+		records = append(records, record)
+	}
+
+	//server to client
+	if delta.ReceivePacket > 0 {
+		record := &common.SFlowRecord{}
+		record.Source = thisPt.Destination
+		record.Destination = thisPt.Source
+		record.SourcePort = thisPt.DestinationPort
+		record.DestinationPort = thisPt.SourcePort
+		record.Protocol = thisPt.Protocol
+		record.InNIC = thisPt.OutNIC
+		record.OutNIC = thisPt.InNIC
+		record.Stat.SendByte = delta.ReceiveByte
+		record.Stat.SendPacket = delta.ReceivePacket
+		record.StartTime = startTime
+		record.EndTime = thisPt.UpdateTime
+		record.EndReason = reason
+		records = append(records, record)
+	}
+
+	thisPt.exportStat = thisPt.Stat
+	thisPt.exportTime = thisPt.UpdateTime
+	return records
 }
@@ -0,0 +1,450 @@
+package vnet
+
+import (
+	"encoding/binary"
+	"goconnect/common"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+//---------------------------------------------------------------------------------------
+
+//Flow export protocols
+const (
+	FlowExportProtocolNetFlowV9 = "netflow9"
+	FlowExportProtocolIPFIX     = "ipfix"
+)
+
+//---------------------------------------------------------------------------------------
+
+const (
+	flowExporterQueueSize        = 4096
+	flowExporterMaxRecords       = 10
+	flowExporterTemplateInterval = 60
+	flowExporterUserNameLen      = 32
+	flowExporterTemplateIDv4     = 256
+	flowExporterTemplateIDv6     = 257
+)
+
+//---------------------------------------------------------------------------------------
+
+//IPFIX / NetFlow v9 information elements
+const (
+	flowFieldOctetDeltaCount      = 1
+	flowFieldPacketDeltaCount     = 2
+	flowFieldProtocolIdentifier   = 4
+	flowFieldSourceTransportPort  = 7
+	flowFieldSourceIPv4Address    = 8
+	flowFieldIngressInterface     = 10
+	flowFieldDestTransportPort    = 11
+	flowFieldDestIPv4Address      = 12
+	flowFieldEgressInterface      = 14
+	flowFieldLastSwitched         = 21
+	flowFieldFirstSwitched        = 22
+	flowFieldSourceIPv6Address    = 27
+	flowFieldDestIPv6Address      = 28
+	flowFieldFlowEndReason        = 136
+	flowFieldFlowStartSeconds     = 150
+	flowFieldFlowEndSeconds       = 151
+	flowFieldEnterpriseUserName   = 1
+	flowFieldEnterpriseVirtualIP  = 2
+	flowFieldEnterpriseVirtualIP6 = 3
+	flowFieldEnterpriseBit        = 0x8000
+)
+
+//---------------------------------------------------------------------------------------
+
+//SFlowExporterInitParams ...
+type SFlowExporterInitParams struct {
+	Collectors        []string
+	Protocol          string
+	ObservationDomain uint32
+	EnterpriseNumber  uint32
+	Util              common.IUtils
+	Commander         common.ICommander
+	AuthMan           common.IAuthenticationManger
+}
+
+//---------------------------------------------------------------------------------------
+
+type sFlowExporterStat struct {
+	Records        uint64 `json:"records"`
+	Packets        uint64 `json:"packets"`
+	DroppedRecords uint64 `json:"dropped_records"`
+	SendErrors     uint64 `json:"send_errors"`
+}
+
+//---------------------------------------------------------------------------------------
+
+type sFlowTemplateField struct {
+	fieldType  uint16
+	length     uint16
+	enterprise bool
+}
+
+//---------------------------------------------------------------------------------------
+
+//cFlowExporter ...
+type cFlowExporter struct {
+	params           SFlowExporterInitParams
+	queue            chan *common.SFlowRecord
+	done             chan bool
+	connections      []net.Conn
+	templatev4       []sFlowTemplateField
+	templatev6       []sFlowTemplateField
+	sequence         uint32
+	startTime        time.Time
+	lastTemplateTime int64
+	stat             sFlowExporterStat
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cFlowExporter) isIPFIX() bool {
+	return thisPt.params.Protocol == FlowExportProtocolIPFIX
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cFlowExporter) createTemplate(version int) []sFlowTemplateField {
+	srcField, dstField, ipLen, vipField := uint16(flowFieldSourceIPv4Address), uint16(flowFieldDestIPv4Address), uint16(4), uint16(flowFieldEnterpriseVirtualIP)
+	if version == 6 {
+		srcField, dstField, ipLen, vipField = flowFieldSourceIPv6Address, flowFieldDestIPv6Address, 16, flowFieldEnterpriseVirtualIP6
+	}
+
+	startField, endField := uint16(flowFieldFirstSwitched), uint16(flowFieldLastSwitched)
+	if thisPt.isIPFIX() {
+		startField, endField = flowFieldFlowStartSeconds, flowFieldFlowEndSeconds
+	}
+
+	return []sFlowTemplateField{
+		{fieldType: srcField, length: ipLen},
+		{fieldType: dstField, length: ipLen},
+		{fieldType: flowFieldSourceTransportPort, length: 2},
+		{fieldType: flowFieldDestTransportPort, length: 2},
+		{fieldType: flowFieldProtocolIdentifier, length: 1},
+		{fieldType: flowFieldIngressInterface, length: 4},
+		{fieldType: flowFieldEgressInterface, length: 4},
+		{fieldType: flowFieldOctetDeltaCount, length: 8},
+		{fieldType: flowFieldPacketDeltaCount, length: 8},
+		{fieldType: startField, length: 4},
+		{fieldType: endField, length: 4},
+		{fieldType: flowFieldFlowEndReason, length: 1},
+		{fieldType: flowFieldEnterpriseUserName, length: flowExporterUserNameLen, enterprise: true},
+		{fieldType: vipField, length: ipLen, enterprise: true},
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//appendTemplateSet adds a template set (IPFIX) or a template flowset (NetFlow v9)
+func (thisPt *cFlowExporter) appendTemplateSet(buffer []byte) []byte {
+	setID := uint16(0)
+	if thisPt.isIPFIX() {
+		setID = 2
+	}
+
+	start := len(buffer)
+	buffer = append(buffer, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(buffer[start:], setID)
+
+	for i, template := range [][]sFlowTemplateField{thisPt.templatev4, thisPt.templatev6} {
+		id := flowExporterTemplateIDv4 + i
+		buffer = append(buffer, byte(id>>8), byte(id), 0, byte(len(template)))
+		for _, field := range template {
+			fieldType := field.fieldType
+			if field.enterprise {
+				//NetFlow v9 does not support enterprise numbers, vendor specific fields are used instead
+				fieldType |= flowFieldEnterpriseBit
+			}
+			buffer = append(buffer, byte(fieldType>>8), byte(fieldType), byte(field.length>>8), byte(field.length))
+			if field.enterprise && thisPt.isIPFIX() {
+				buffer = append(buffer, 0, 0, 0, 0)
+				binary.BigEndian.PutUint32(buffer[len(buffer)-4:], thisPt.params.EnterpriseNumber)
+			}
+		}
+	}
+
+	binary.BigEndian.PutUint16(buffer[start+2:], uint16(len(buffer)-start))
+	return buffer
+}
+
+//---------------------------------------------------------------------------------------
+
+//getUserInfo returns the user name and the virtual IP of the flow owner
+func (thisPt *cFlowExporter) getUserInfo(record *common.SFlowRecord) (string, net.IP) {
+	user := ""
+	var vip net.IP
+	if thisPt.params.AuthMan == nil {
+		return user, vip
+	}
+
+	for _, ip := range []net.IP{record.Source, record.Destination} {
+		thisPt.params.AuthMan.GetAccountingSessionByVIP(ip, func(object interface{}) {
+			user = object.(common.IAccountingSession).GetUserName()
+			vip = ip
+		})
+
+		if vip != nil {
+			break
+		}
+	}
+	return user, vip
+}
+
+//---------------------------------------------------------------------------------------
+
+//toSwitched converts unix time to NetFlow v9 system up time (ms)
+func (thisPt *cFlowExporter) toSwitched(t int64) uint32 {
+	return uint32((t - thisPt.startTime.Unix()) * 1000)
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cFlowExporter) appendIP(buffer []byte, ip net.IP, length int) []byte {
+	if length == 4 {
+		ip = ip.To4()
+	} else {
+		ip = ip.To16()
+	}
+
+	if ip == nil {
+		ip = make(net.IP, length)
+	}
+	return append(buffer, ip...)
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cFlowExporter) appendRecord(buffer []byte, record *common.SFlowRecord, ipLen int) []byte {
+	var field [8]byte
+
+	buffer = thisPt.appendIP(buffer, record.Source, ipLen)
+	buffer = thisPt.appendIP(buffer, record.Destination, ipLen)
+
+	binary.BigEndian.PutUint16(field[:], record.SourcePort)
+	buffer = append(buffer, field[:2]...)
+	binary.BigEndian.PutUint16(field[:], record.DestinationPort)
+	buffer = append(buffer, field[:2]...)
+	buffer = append(buffer, record.Protocol)
+	binary.BigEndian.PutUint32(field[:], uint32(record.InNIC))
+	buffer = append(buffer, field[:4]...)
+	binary.BigEndian.PutUint32(field[:], uint32(record.OutNIC))
+	buffer = append(buffer, field[:4]...)
+	binary.BigEndian.PutUint64(field[:], record.Stat.SendByte)
+	buffer = append(buffer, field[:8]...)
+	binary.BigEndian.PutUint64(field[:], record.Stat.SendPacket)
+	buffer = append(buffer, field[:8]...)
+
+	if thisPt.isIPFIX() {
+		binary.BigEndian.PutUint32(field[:], uint32(record.StartTime))
+		buffer = append(buffer, field[:4]...)
+		binary.BigEndian.PutUint32(field[:], uint32(record.EndTime))
+		buffer = append(buffer, field[:4]...)
+	} else {
+		binary.BigEndian.PutUint32(field[:], thisPt.toSwitched(record.StartTime))
+		buffer = append(buffer, field[:4]...)
+		binary.BigEndian.PutUint32(field[:], thisPt.toSwitched(record.EndTime))
+		buffer = append(buffer, field[:4]...)
+	}
+	buffer = append(buffer, record.EndReason)
+
+	//enterprise fields
+	user, vip := thisPt.getUserInfo(record)
+	userName := make([]byte, flowExporterUserNameLen)
+	copy(userName, user)
+	buffer = append(buffer, userName...)
+	buffer = thisPt.appendIP(buffer, vip, ipLen)
+	return buffer
+}
+
+//---------------------------------------------------------------------------------------
+
+//createPacket creates an export packet for the records with the same IP version
+func (thisPt *cFlowExporter) createPacket(records []*common.SFlowRecord, ipVersion int) []byte {
+	now := time.Now()
+	headerLen := 20
+	if thisPt.isIPFIX() {
+		headerLen = 16
+	}
+	buffer := make([]byte, headerLen, 1500)
+	recordCount := 0
+
+	//templates are sent periodically, since the transport is UDP
+	if now.Unix()-thisPt.lastTemplateTime >= flowExporterTemplateInterval {
+		thisPt.lastTemplateTime = now.Unix()
+		buffer = thisPt.appendTemplateSet(buffer)
+		recordCount += 2
+	}
+
+	templateID, ipLen := uint16(flowExporterTemplateIDv4), 4
+	if ipVersion == 6 {
+		templateID, ipLen = flowExporterTemplateIDv6, 16
+	}
+
+	//data set
+	start := len(buffer)
+	buffer = append(buffer, byte(templateID>>8), byte(templateID), 0, 0)
+	for _, record := range records {
+		buffer = thisPt.appendRecord(buffer, record, ipLen)
+	}
+	for (len(buffer)-start)%4 != 0 {
+		buffer = append(buffer, 0)
+	}
+	binary.BigEndian.PutUint16(buffer[start+2:], uint16(len(buffer)-start))
+	recordCount += len(records)
+
+	//header
+	if thisPt.isIPFIX() {
+		binary.BigEndian.PutUint16(buffer[0:], 10)
+		binary.BigEndian.PutUint16(buffer[2:], uint16(len(buffer)))
+		binary.BigEndian.PutUint32(buffer[4:], uint32(now.Unix()))
+		binary.BigEndian.PutUint32(buffer[8:], thisPt.sequence)
+		binary.BigEndian.PutUint32(buffer[12:], thisPt.params.ObservationDomain)
+		thisPt.sequence += uint32(len(records))
+	} else {
+		binary.BigEndian.PutUint16(buffer[0:], 9)
+		binary.BigEndian.PutUint16(buffer[2:], uint16(recordCount))
+		binary.BigEndian.PutUint32(buffer[4:], uint32(now.Sub(thisPt.startTime).Nanoseconds()/int64(time.Millisecond)))
+		binary.BigEndian.PutUint32(buffer[8:], uint32(now.Unix()))
+		binary.BigEndian.PutUint32(buffer[12:], thisPt.sequence)
+		binary.BigEndian.PutUint32(buffer[16:], thisPt.params.ObservationDomain)
+		thisPt.sequence++
+	}
+	return buffer
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cFlowExporter) send(records []*common.SFlowRecord, ipVersion int) {
+	if len(records) == 0 {
+		return
+	}
+
+	packet := thisPt.createPacket(records, ipVersion)
+	for _, conn := range thisPt.connections {
+		if _, err := conn.Write(packet); err != nil {
+			atomic.AddUint64(&thisPt.stat.SendErrors, 1)
+			continue
+		}
+		atomic.AddUint64(&thisPt.stat.Packets, 1)
+	}
+	atomic.AddUint64(&thisPt.stat.Records, uint64(len(records)))
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cFlowExporter) flush(pending []*common.SFlowRecord) {
+	v4Records := []*common.SFlowRecord{}
+	v6Records := []*common.SFlowRecord{}
+	for _, record := range pending {
+		if record.Source.To4() != nil {
+			v4Records = append(v4Records, record)
+		} else {
+			v6Records = append(v6Records, record)
+		}
+	}
+	thisPt.send(v4Records, 4)
+	thisPt.send(v6Records, 6)
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cFlowExporter) run() {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	pending := []*common.SFlowRecord{}
+	for {
+		select {
+		case record := <-thisPt.queue:
+			pending = append(pending, record)
+			if len(pending) >= flowExporterMaxRecords {
+				thisPt.flush(pending)
+				pending = pending[:0]
+			}
+		case <-ticker.C:
+			thisPt.flush(pending)
+			pending = pending[:0]
+		case <-thisPt.done:
+			//drain the queue
+			for len(thisPt.queue) > 0 {
+				pending = append(pending, <-thisPt.queue)
+				if len(pending) >= flowExporterMaxRecords {
+					thisPt.flush(pending)
+					pending = pending[:0]
+				}
+			}
+			thisPt.flush(pending)
+			for _, conn := range thisPt.connections {
+				conn.Close()
+			}
+			return
+		}
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//Export for IFlowExporter
+func (thisPt *cFlowExporter) Export(record *common.SFlowRecord) {
+	//never block the packet processing path
+	select {
+	case thisPt.queue <- record:
+	default:
+		atomic.AddUint64(&thisPt.stat.DroppedRecords, 1)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//End for IFlowExporter
+func (thisPt *cFlowExporter) End() {
+	thisPt.done <- true
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cFlowExporter) OnStatusCommand(req *http.Request, params interface{}) (common.IHTTPResponse, error) {
+	status := sFlowExporterStat{}
+	status.Records = atomic.LoadUint64(&thisPt.stat.Records)
+	status.Packets = atomic.LoadUint64(&thisPt.stat.Packets)
+	status.DroppedRecords = atomic.LoadUint64(&thisPt.stat.DroppedRecords)
+	status.SendErrors = atomic.LoadUint64(&thisPt.stat.SendErrors)
+	return thisPt.params.Util.CreateHttpResponseFromObject(status)
+}
+
+//---------------------------------------------------------------------------------------
+
+//Init
+func (thisPt *cFlowExporter) Init(params SFlowExporterInitParams) error {
+	thisPt.params = params
+	thisPt.queue = make(chan *common.SFlowRecord, flowExporterQueueSize)
+	thisPt.done = make(chan bool)
+	thisPt.startTime = time.Now()
+	thisPt.templatev4 = thisPt.createTemplate(4)
+	thisPt.templatev6 = thisPt.createTemplate(6)
+
+	//connect to the collectors
+	for _, collector := range params.Collectors {
+		conn, err := net.Dial("udp", collector)
+		if err != nil {
+			return err
+		}
+		thisPt.connections = append(thisPt.connections, conn)
+	}
+
+	go thisPt.run()
+
+	//register api
+	if thisPt.params.Commander != nil {
+		selector := thisPt.params.Commander.CreateSelector()
+		selector.Register("flow_export_status", thisPt.OnStatusCommand, nil)
+	}
+
+	log.Printf("flow export (%s) to %v is started \n", params.Protocol, params.Collectors)
+	return nil
+}
@@ -0,0 +1,114 @@
+package vnet
+
+import (
+	"encoding/binary"
+	"goconnect/utils"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//---------------------------------------------------------------------------------------
+
+//readDataRecords parses an export packet and returns the number of data records of the given template
+func readDataRecords(t *testing.T, packet []byte, headerLen int, templateID uint16, recordLen int) int {
+	count := 0
+	for offset := headerLen; offset+4 <= len(packet); {
+		setID := binary.BigEndian.Uint16(packet[offset:])
+		setLen := int(binary.BigEndian.Uint16(packet[offset+2:]))
+		if setLen < 4 || offset+setLen > len(packet) {
+			t.Fatalf("invalid set length %d \n", setLen)
+		}
+
+		if setID == templateID {
+			count += (setLen - 4) / recordLen
+		}
+		offset += setLen
+	}
+	return count
+}
+
+//---------------------------------------------------------------------------------------
+
+func TestFlowExporter(t *testing.T) {
+
+	//local collector
+	collector, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("can not create collector with error %v \n", err)
+	}
+	defer collector.Close()
+
+	exporter := &cFlowExporter{}
+	exporterParams := SFlowExporterInitParams{}
+	exporterParams.Collectors = []string{collector.LocalAddr().String()}
+	exporterParams.Protocol = FlowExportProtocolIPFIX
+	exporterParams.ObservationDomain = 1
+	exporterParams.EnterpriseNumber = 32473
+	if err := exporter.Init(exporterParams); err != nil {
+		t.Fatalf("can not create exporter with error %v \n", err)
+	}
+
+	//create a bidirectional flow
+	params := SFlowManagerInitParams{}
+	params.MaxActiveFlowCount = 64
+	params.Util = utils.Create()
+	params.SegmentCount = 4
+	params.MaxLifeTime = 100
+	params.Exporter = exporter
+
+	flowMan := cFlowManager{}
+	flowMan.Init(params)
+
+	packetFactory := CreateProcessFactory()
+	flowMan.GetFlow(packetFactory.CreateProcessInfoByName("dns_reqv4"))
+	flowMan.GetFlow(packetFactory.CreateProcessInfoByName("dns_resv4"))
+
+	//expire the flow
+	for i := 0; i < int(params.SegmentCount); i++ {
+		flowMan.flowTable.CheckForTimeOut(flowMan.onFlowTimeOut, nil, time.Now().Unix()+110)
+	}
+	exporter.End()
+
+	//read the export packet
+	collector.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buffer := make([]byte, 2048)
+	n, err := collector.Read(buffer)
+	if err != nil {
+		t.Fatalf("can not read export packet with error %v \n", err)
+	}
+	packet := buffer[:n]
+
+	if binary.BigEndian.Uint16(packet) != 10 || int(binary.BigEndian.Uint16(packet[2:])) != n {
+		t.Fatalf("invalid IPFIX header %x \n", packet[:16])
+	}
+
+	const v4RecordLen = 4 + 4 + 2 + 2 + 1 + 4 + 4 + 8 + 8 + 4 + 4 + 1 + flowExporterUserNameLen + 4
+	if count := readDataRecords(t, packet, 16, flowExporterTemplateIDv4, v4RecordLen); count != 2 {
+		t.Fatalf("invalid data records count %d \n", count)
+	}
+
+	if atomic.LoadUint64(&exporter.stat.Records) != 2 {
+		t.Fatalf("invalid exporter stat %v \n", exporter.stat)
+	}
+
+	//NetFlow v9 packet format
+	exporter = &cFlowExporter{}
+	exporter.Init(SFlowExporterInitParams{Protocol: FlowExportProtocolNetFlowV9})
+	defer exporter.End()
+
+	flow := cFlow{Source: net.ParseIP("2001:db8::1"), Destination: net.ParseIP("2001:db8::2"), StartTime: time.Now().Unix()}
+	flow.Stat.SendPacket = 1
+	flow.Stat.SendByte = 100
+	packet = exporter.createPacket(flow.createRecords(1), 6)
+
+	const v6RecordLen = v4RecordLen + 12*3
+	if binary.BigEndian.Uint16(packet) != 9 || binary.BigEndian.Uint16(packet[2:]) != 3 {
+		t.Fatalf("invalid NetFlow v9 header %x \n", packet[:20])
+	}
+
+	if count := readDataRecords(t, packet, 20, flowExporterTemplateIDv6, v6RecordLen); count != 1 {
+		t.Fatalf("invalid NetFlow v9 data records count %d \n", count)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"sync/atomic"
+	"time"
 )
 
 //---------------------------------------------------------------------------------------
@@ -25,9 +27,20 @@ type SFlowManagerInitParams struct {
 	Util               common.IUtils
 	Commander          common.ICommander
 	NicManager         common.INICManager
+	Exporter           common.IFlowExporter
 	SegmentCount       uint32
 	MaxLifeTime        uint32
 	MaxActiveFlowCount uint32
+	ActiveTimeout      uint32
+	Workers            uint32
+}
+
+//---------------------------------------------------------------------------------------
+
+//sFlowManagerWorkerStat is padded to avoid false sharing between the workers counters
+type sFlowManagerWorkerStat struct {
+	stat    common.STransferStat
+	padding [32]byte
 }
 
 //---------------------------------------------------------------------------------------
@@ -36,7 +49,7 @@ type SFlowManagerInitParams struct {
 type cFlowManager struct {
 	flowTable common.IHashLinkList
 	params    SFlowManagerInitParams
-	stat      common.STransferStat
+	stat      []sFlowManagerWorkerStat
 }
 
 //---------------------------------------------------------------------------------------
@@ -90,16 +103,32 @@ func (thisPt *cFlowManager) OnDCCommand(req *http.Request, params interface{}) (
 
 func (thisPt *cFlowManager) OnStatusCommand(req *http.Request, params interface{}) (common.IHTTPResponse, error) {
 	type sFlowStatus struct {
-		FlowCount       uint32               `json:"flow_count"`
-		MaxFlowCount    uint32               `json:"max_flow_count"`
-		MaxFlowLifeTime uint32               `json:"max_flow_life_time"`
-		Status          common.STransferStat `json:"total_transfer"`
+		FlowCount       uint32                 `json:"flow_count"`
+		MaxFlowCount    uint32                 `json:"max_flow_count"`
+		MaxFlowLifeTime uint32                 `json:"max_flow_life_time"`
+		Status          common.STransferStat   `json:"total_transfer"`
+		WorkersStatus   []common.STransferStat `json:"workers_transfer"`
 	}
 	flowInfo := sFlowStatus{}
 	flowInfo.FlowCount = thisPt.GetFlowCount()
 	flowInfo.MaxFlowCount = thisPt.params.MaxActiveFlowCount
 	flowInfo.MaxFlowLifeTime = thisPt.params.MaxLifeTime
-	flowInfo.Status = thisPt.stat
+
+	//aggregate workers statistics
+	for i := range thisPt.stat {
+		stat := &thisPt.stat[i].stat
+		workerStat := common.STransferStat{}
+		workerStat.SendByte = atomic.LoadUint64(&stat.SendByte)
+		workerStat.SendPacket = atomic.LoadUint64(&stat.SendPacket)
+		workerStat.ReceiveByte = atomic.LoadUint64(&stat.ReceiveByte)
+		workerStat.ReceivePacket = atomic.LoadUint64(&stat.ReceivePacket)
+		flowInfo.WorkersStatus = append(flowInfo.WorkersStatus, workerStat)
+
+		flowInfo.Status.SendByte += workerStat.SendByte
+		flowInfo.Status.SendPacket += workerStat.SendPacket
+		flowInfo.Status.ReceiveByte += workerStat.ReceiveByte
+		flowInfo.Status.ReceivePacket += workerStat.ReceivePacket
+	}
 
 	return thisPt.params.Util.CreateHttpResponseFromObject(flowInfo)
 }
@@ -132,6 +161,45 @@ func (thisPt *cFlowManager) OnListCommand(req *http.Request, params interface{})
 
 //---------------------------------------------------------------------------------------
 
+//export sends the flow records to the exporter
+func (thisPt *cFlowManager) export(flow *cFlow, reason uint8) {
+	if thisPt.params.Exporter == nil {
+		return
+	}
+
+	for _, record := range flow.createRecords(reason) {
+		thisPt.params.Exporter.Export(record)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//onFlowTimeOut is called for the inactive flows, before removing them from the flow table
+func (thisPt *cFlowManager) onFlowTimeOut(inHashData interface{}, userdata interface{}, delta int64) bool {
+	thisPt.export(inHashData.(*cFlow), common.FLOWENDREASONIDLE)
+	return true
+}
+
+//---------------------------------------------------------------------------------------
+
+//checkActiveTimeOut exports long-lived flows periodically
+func (thisPt *cFlowManager) checkActiveTimeOut(flow *cFlow) {
+	if thisPt.params.Exporter == nil || thisPt.params.ActiveTimeout == 0 {
+		return
+	}
+
+	lastExport := flow.StartTime
+	if flow.exportTime != 0 {
+		lastExport = flow.exportTime
+	}
+
+	if flow.UpdateTime-lastExport >= int64(thisPt.params.ActiveTimeout) {
+		thisPt.export(flow, common.FLOWENDREASONACTIVE)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
 //GetFlow for IFlowManager
 func (thisPt *cFlowManager) GetFlow(process common.IProcessInfo) common.IFlow {
 
@@ -143,21 +211,24 @@ func (thisPt *cFlowManager) GetFlow(process common.IProcessInfo) common.IFlow {
 
 			//update flow stat
 			flow.UpdateStat(process)
+			thisPt.checkActiveTimeOut(flow)
 
-			//update total send and receive
+			//update total send and receive. flows are sharded the same way as the pipeline workers
+			stat := &thisPt.stat[process.GetFlowKey()%uint64(len(thisPt.stat))].stat
 			if flow.GetDirection(process) == common.FLOWDIRECTIONSEND {
-				thisPt.stat.SendByte += uint64(process.GetUsedSize())
-				thisPt.stat.SendPacket++
+				atomic.AddUint64(&stat.SendByte, uint64(process.GetUsedSize()))
+				atomic.AddUint64(&stat.SendPacket, 1)
 			} else {
-				thisPt.stat.ReceiveByte += uint64(process.GetUsedSize())
-				thisPt.stat.ReceivePacket++
+				atomic.AddUint64(&stat.ReceiveByte, uint64(process.GetUsedSize()))
+				atomic.AddUint64(&stat.ReceivePacket, 1)
 			}
 		}
-		thisPt.flowTable.CheckForTimeOut(nil, nil, 0)
+		thisPt.flowTable.CheckForTimeOut(thisPt.onFlowTimeOut, nil, time.Now().Unix())
 	}()
 
 	if flowInt := thisPt.flowTable.Find(process.GetFlowKey(), nil, nil); flowInt != nil {
-		return flowInt.(*cFlow)
+		flow = flowInt.(*cFlow)
+		return flow
 	}
 
 	//check for max flow count
@@ -168,11 +239,19 @@ func (thisPt *cFlowManager) GetFlow(process common.IProcessInfo) common.IFlow {
 
 	flow = new(cFlow)
 	flow.Id = process.GetFlowKey()
-	flow.Destination = process.GetDestinationIP()
-	flow.Source = process.GetSourceIP()
+	//the packet addresses point to the packet buffer, which is recycled
+	flow.Destination = append(net.IP(nil), process.GetDestinationIP()...)
+	flow.Source = append(net.IP(nil), process.GetSourceIP()...)
+	flow.SourcePort = process.GetSourcePort()
+	flow.DestinationPort = process.GetDestinationPort()
+	flow.Protocol = process.GetL4Protocol()
 	flow.InNIC = process.GetInNIC()
+	flow.StartTime = time.Now().Unix()
+	flow.UpdateTime = flow.StartTime
 	flow.netManager = thisPt.params.NicManager
-	flow.InNICName = thisPt.params.NicManager.GetNICName(flow.InNIC)
+	if flow.netManager != nil {
+		flow.InNICName = flow.netManager.GetNICName(flow.InNIC)
+	}
 	thisPt.flowTable.Add(process.GetFlowKey(), flow)
 	return flow
 }
@@ -189,14 +268,20 @@ func (thisPt *cFlowManager) GetFlowCount() uint32 {
 //
 func (thisPt *cFlowManager) Init(params SFlowManagerInitParams) {
 	thisPt.params = params
+	if thisPt.params.Workers == 0 {
+		thisPt.params.Workers = 1
+	}
+	thisPt.stat = make([]sFlowManagerWorkerStat, thisPt.params.Workers)
 	thisPt.flowTable = params.Util.CreateHashLinkList(params.SegmentCount, uint64(params.MaxLifeTime))
 	if thisPt.flowTable == nil {
 		log.Fatalf("can not create flow table \n")
 	}
 
 	//register api
-	selector := thisPt.params.Commander.CreateSelector()
-	selector.Register("flows_list", thisPt.OnListCommand, sFlowManagerCommandSearchParams{})
-	selector.Register("flows_dc", thisPt.OnDCCommand, sFlowManagerCommandSearchParams{})
-	selector.Register("flows_status", thisPt.OnStatusCommand, nil)
+	if thisPt.params.Commander != nil {
+		selector := thisPt.params.Commander.CreateSelector()
+		selector.Register("flows_list", thisPt.OnListCommand, sFlowManagerCommandSearchParams{})
+		selector.Register("flows_dc", thisPt.OnDCCommand, sFlowManagerCommandSearchParams{})
+		selector.Register("flows_status", thisPt.OnStatusCommand, nil)
+	}
 }
@@ -0,0 +1,422 @@
+package vnet
+
+import (
+	"goconnect/common"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+//---------------------------------------------------------------------------------------
+
+const (
+	icmpGeneratorTTL          = 64
+	icmpGeneratorMaxV4Payload = 576 - 28
+	icmpGeneratorMaxV6Payload = 1280 - 48
+	icmpGeneratorMaxSources   = 4096
+)
+
+//---------------------------------------------------------------------------------------
+
+//SICMPGeneratorInitParams ...
+type SICMPGeneratorInitParams struct {
+	Util            common.IUtils
+	Commander       common.ICommander
+	PacketFactory   common.IProcessFactory
+	GatewayIPs      []string
+	RateLimit       uint32
+	SourceRateLimit uint32
+}
+
+//---------------------------------------------------------------------------------------
+
+type sICMPGeneratorStat struct {
+	Unreachable uint64 `json:"unreachable"`
+	EchoReply   uint64 `json:"echo_reply"`
+	RateLimited uint64 `json:"rate_limited"`
+}
+
+//---------------------------------------------------------------------------------------
+
+//sICMPSourceBucket is the token bucket of a source virtual IP
+type sICMPSourceBucket struct {
+	tokens float64
+	update int64
+}
+
+//---------------------------------------------------------------------------------------
+
+//cICMPGenerator ...
+type cICMPGenerator struct {
+	params      SICMPGeneratorInitParams
+	gatewayIPv4 []net.IP
+	gatewayIPv6 []net.IP
+	window      int64
+	windowCount uint32
+	sources     map[string]*sICMPSourceBucket
+	sourcesLock sync.Mutex
+	stat        sICMPGeneratorStat
+}
+
+//---------------------------------------------------------------------------------------
+
+//allowSource implements a token bucket per source virtual IP, so a single client can not use the whole rate
+func (thisPt *cICMPGenerator) allowSource(ip net.IP) bool {
+	if thisPt.params.SourceRateLimit == 0 {
+		return true
+	}
+
+	now := time.Now().UnixNano()
+	rate := float64(thisPt.params.SourceRateLimit)
+	key := string(ip.To16())
+
+	thisPt.sourcesLock.Lock()
+	defer thisPt.sourcesLock.Unlock()
+
+	bucket, ok := thisPt.sources[key]
+	if !ok {
+		if len(thisPt.sources) >= icmpGeneratorMaxSources {
+			thisPt.purgeSources(now, rate)
+		}
+		bucket = &sICMPSourceBucket{tokens: rate, update: now}
+		thisPt.sources[key] = bucket
+	}
+
+	bucket.tokens += float64(now-bucket.update) * rate / float64(time.Second)
+	if bucket.tokens > rate {
+		bucket.tokens = rate
+	}
+	bucket.update = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+//---------------------------------------------------------------------------------------
+
+//purgeSources should be called under lock, the full buckets are removed
+func (thisPt *cICMPGenerator) purgeSources(now int64, rate float64) {
+	for key, bucket := range thisPt.sources {
+		if bucket.tokens+float64(now-bucket.update)*rate/float64(time.Second) >= rate {
+			delete(thisPt.sources, key)
+		}
+	}
+
+	//all of the sources are active, start over
+	if len(thisPt.sources) >= icmpGeneratorMaxSources {
+		thisPt.sources = make(map[string]*sICMPSourceBucket)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//allow implements a simple per second rate limiter, so the gateway can not be used for amplification
+func (thisPt *cICMPGenerator) allow(source net.IP) bool {
+	if !thisPt.allowSource(source) {
+		atomic.AddUint64(&thisPt.stat.RateLimited, 1)
+		return false
+	}
+
+	//only one of the concurrent callers resets the window
+	now := time.Now().Unix()
+	if window := atomic.LoadInt64(&thisPt.window); window != now && atomic.CompareAndSwapInt64(&thisPt.window, window, now) {
+		atomic.StoreUint32(&thisPt.windowCount, 0)
+	}
+
+	if atomic.AddUint32(&thisPt.windowCount, 1) > thisPt.params.RateLimit {
+		atomic.AddUint64(&thisPt.stat.RateLimited, 1)
+		return false
+	}
+	return true
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cICMPGenerator) isGatewayIP(ip net.IP) bool {
+	list := thisPt.gatewayIPv4
+	if ip.To4() == nil {
+		list = thisPt.gatewayIPv6
+	}
+
+	for _, gIP := range list {
+		if gIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//---------------------------------------------------------------------------------------
+
+//getSourceIP select the source address of the generated packet
+func (thisPt *cICMPGenerator) getSourceIP(packet common.IProcessInfo) net.IP {
+	if packet.GetIPVersion() == 4 && len(thisPt.gatewayIPv4) > 0 {
+		return thisPt.gatewayIPv4[0]
+	} else if packet.GetIPVersion() == 6 && len(thisPt.gatewayIPv6) > 0 {
+		return thisPt.gatewayIPv6[0]
+	}
+	return packet.GetDestinationIP()
+}
+
+//---------------------------------------------------------------------------------------
+
+//isICMPError checks whether the packet is an ICMP error message. ICMP errors never trigger another one
+func (thisPt *cICMPGenerator) isICMPError(packet common.IProcessInfo) bool {
+	if packet.GetL4Protocol() == common.L4PROTOCOLICMP {
+		icmp := thisPt.decodeICMPv4(packet)
+		if icmp == nil {
+			return true
+		}
+		t := icmp.TypeCode.Type()
+		return (t != layers.ICMPv4TypeEchoRequest && t != layers.ICMPv4TypeEchoReply)
+	} else if packet.GetL4Protocol() == common.L4PROTOCOLICMPV6 {
+		icmp := thisPt.decodeICMPv6(packet)
+		if icmp == nil {
+			return true
+		}
+		return icmp.TypeCode.Type() < layers.ICMPv6TypeEchoRequest
+	}
+	return false
+}
+
+//---------------------------------------------------------------------------------------
+
+//isNonInitialFragment checks the fragment offset, the other fragments do not trigger ICMP errors (RFC 1812 4.3.2.7)
+func (thisPt *cICMPGenerator) isNonInitialFragment(packet common.IProcessInfo) bool {
+	if packet.GetIPVersion() == 4 {
+		lpacket := gopacket.NewPacket(packet.GetBuffer(), layers.LayerTypeIPv4, gopacket.NoCopy)
+		if layer := lpacket.Layer(layers.LayerTypeIPv4); layer != nil {
+			return layer.(*layers.IPv4).FragOffset != 0
+		}
+		return false
+	}
+
+	lpacket := gopacket.NewPacket(packet.GetBuffer(), layers.LayerTypeIPv6, gopacket.NoCopy)
+	if layer := lpacket.Layer(layers.LayerTypeIPv6Fragment); layer != nil {
+		return layer.(*layers.IPv6Fragment).FragmentOffset != 0
+	}
+	return false
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cICMPGenerator) decodeICMPv4(packet common.IProcessInfo) *layers.ICMPv4 {
+	lpacket := gopacket.NewPacket(packet.GetBuffer(), layers.LayerTypeIPv4, gopacket.NoCopy)
+	if layer := lpacket.Layer(layers.LayerTypeICMPv4); layer != nil {
+		return layer.(*layers.ICMPv4)
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cICMPGenerator) decodeICMPv6(packet common.IProcessInfo) *layers.ICMPv6 {
+	lpacket := gopacket.NewPacket(packet.GetBuffer(), layers.LayerTypeIPv6, gopacket.NoCopy)
+	if layer := lpacket.Layer(layers.LayerTypeICMPv6); layer != nil {
+		return layer.(*layers.ICMPv6)
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//serialize converts layers to a new process object
+func (thisPt *cICMPGenerator) serialize(serializeLayers ...gopacket.SerializableLayer) common.IProcessInfo {
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buffer, options, serializeLayers...); err != nil {
+		log.Printf("can not create icmp packet with error %v \n", err)
+		return nil
+	}
+
+	process := thisPt.params.PacketFactory.CreateProcessInfo(buffer.Bytes())
+	if !process.ProcessAsNetPacket() {
+		thisPt.params.PacketFactory.FreeProcessInfo(process)
+		return nil
+	}
+	return process
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cICMPGenerator) createIPv4Header(src net.IP, dst net.IP) *layers.IPv4 {
+	return &layers.IPv4{
+		Version:  4,
+		TTL:      icmpGeneratorTTL,
+		Protocol: layers.IPProtocolICMPv4,
+		SrcIP:    src,
+		DstIP:    dst,
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cICMPGenerator) createIPv6Header(src net.IP, dst net.IP) *layers.IPv6 {
+	return &layers.IPv6{
+		Version:    6,
+		HopLimit:   icmpGeneratorTTL,
+		NextHeader: layers.IPProtocolICMPv6,
+		SrcIP:      src,
+		DstIP:      dst,
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//IsGatewayEchoRequest for IICMPGenerator
+func (thisPt *cICMPGenerator) IsGatewayEchoRequest(packet common.IProcessInfo) bool {
+	if !thisPt.isGatewayIP(packet.GetDestinationIP()) {
+		return false
+	}
+
+	if packet.GetL4Protocol() == common.L4PROTOCOLICMP {
+		icmp := thisPt.decodeICMPv4(packet)
+		return icmp != nil && icmp.TypeCode.Type() == layers.ICMPv4TypeEchoRequest
+	} else if packet.GetL4Protocol() == common.L4PROTOCOLICMPV6 {
+		icmp := thisPt.decodeICMPv6(packet)
+		return icmp != nil && icmp.TypeCode.Type() == layers.ICMPv6TypeEchoRequest
+	}
+	return false
+}
+
+//---------------------------------------------------------------------------------------
+
+//CreateEchoReply for IICMPGenerator
+func (thisPt *cICMPGenerator) CreateEchoReply(packet common.IProcessInfo) common.IProcessInfo {
+
+	if !thisPt.IsGatewayEchoRequest(packet) || !thisPt.allow(packet.GetSourceIP()) {
+		return nil
+	}
+
+	var reply common.IProcessInfo
+	if packet.GetIPVersion() == 4 {
+		request := thisPt.decodeICMPv4(packet)
+		ip := thisPt.createIPv4Header(packet.GetDestinationIP(), packet.GetSourceIP())
+		icmp := &layers.ICMPv4{
+			TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoReply, 0),
+			Id:       request.Id,
+			Seq:      request.Seq,
+		}
+		reply = thisPt.serialize(ip, icmp, gopacket.Payload(request.Payload))
+	} else {
+		lpacket := gopacket.NewPacket(packet.GetBuffer(), layers.LayerTypeIPv6, gopacket.NoCopy)
+		echoLayer := lpacket.Layer(layers.LayerTypeICMPv6Echo)
+		if echoLayer == nil {
+			return nil
+		}
+		request := echoLayer.(*layers.ICMPv6Echo)
+		ip := thisPt.createIPv6Header(packet.GetDestinationIP(), packet.GetSourceIP())
+		icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeEchoReply, 0)}
+		icmp.SetNetworkLayerForChecksum(ip)
+		echo := &layers.ICMPv6Echo{Identifier: request.Identifier, SeqNumber: request.SeqNumber}
+		reply = thisPt.serialize(ip, icmp, echo, gopacket.Payload(request.Payload))
+	}
+
+	if reply != nil {
+		atomic.AddUint64(&thisPt.stat.EchoReply, 1)
+	}
+	return reply
+}
+
+//---------------------------------------------------------------------------------------
+
+//CreateUnreachable for IICMPGenerator
+func (thisPt *cICMPGenerator) CreateUnreachable(packet common.IProcessInfo, reason uint32) common.IProcessInfo {
+
+	if thisPt.isICMPError(packet) || thisPt.isNonInitialFragment(packet) || !thisPt.allow(packet.GetSourceIP()) {
+		return nil
+	}
+
+	var reply common.IProcessInfo
+	original := packet.GetBuffer()
+	if packet.GetIPVersion() == 4 {
+		if len(original) > icmpGeneratorMaxV4Payload {
+			original = original[:icmpGeneratorMaxV4Payload]
+		}
+
+		code := uint8(layers.ICMPv4CodeNet)
+		if reason == common.ICMPREASONPROHIBITED {
+			code = layers.ICMPv4CodeCommAdminProhibited
+		}
+
+		ip := thisPt.createIPv4Header(thisPt.getSourceIP(packet), packet.GetSourceIP())
+		icmp := &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, code)}
+		reply = thisPt.serialize(ip, icmp, gopacket.Payload(original))
+	} else {
+		if len(original) > icmpGeneratorMaxV6Payload {
+			original = original[:icmpGeneratorMaxV6Payload]
+		}
+
+		code := uint8(layers.ICMPv6CodeNoRouteToDst)
+		if reason == common.ICMPREASONPROHIBITED {
+			code = layers.ICMPv6CodeAdminProhibited
+		}
+
+		ip := thisPt.createIPv6Header(thisPt.getSourceIP(packet), packet.GetSourceIP())
+		icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeDestinationUnreachable, code)}
+		icmp.SetNetworkLayerForChecksum(ip)
+
+		//4 bytes unused field, followed by the original packet
+		payload := make([]byte, 4+len(original))
+		copy(payload[4:], original)
+		reply = thisPt.serialize(ip, icmp, gopacket.Payload(payload))
+	}
+
+	if reply != nil {
+		atomic.AddUint64(&thisPt.stat.Unreachable, 1)
+	}
+	return reply
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cICMPGenerator) OnStatusCommand(req *http.Request, params interface{}) (common.IHTTPResponse, error) {
+	type sICMPStatus struct {
+		RateLimit       uint32             `json:"rate_limit"`
+		SourceRateLimit uint32             `json:"source_rate_limit"`
+		Stat            sICMPGeneratorStat `json:"stat"`
+	}
+	status := sICMPStatus{}
+	status.RateLimit = thisPt.params.RateLimit
+	status.SourceRateLimit = thisPt.params.SourceRateLimit
+	status.Stat.Unreachable = atomic.LoadUint64(&thisPt.stat.Unreachable)
+	status.Stat.EchoReply = atomic.LoadUint64(&thisPt.stat.EchoReply)
+	status.Stat.RateLimited = atomic.LoadUint64(&thisPt.stat.RateLimited)
+	return thisPt.params.Util.CreateHttpResponseFromObject(status)
+}
+
+//---------------------------------------------------------------------------------------
+
+//Init
+func (thisPt *cICMPGenerator) Init(params SICMPGeneratorInitParams) {
+	thisPt.params = params
+	thisPt.sources = make(map[string]*sICMPSourceBucket)
+
+	for _, ipStr := range params.GatewayIPs {
+		ip := net.ParseIP(ipStr)
+		if ip == nil {
+			log.Printf("invalid gateway ip %s \n", ipStr)
+			continue
+		}
+		if v4 := ip.To4(); v4 != nil {
+			thisPt.gatewayIPv4 = append(thisPt.gatewayIPv4, v4)
+		} else {
+			thisPt.gatewayIPv6 = append(thisPt.gatewayIPv6, ip)
+		}
+	}
+
+	//register api
+	if thisPt.params.Commander != nil {
+		selector := thisPt.params.Commander.CreateSelector()
+		selector.Register("icmp_status", thisPt.OnStatusCommand, nil)
+	}
+}
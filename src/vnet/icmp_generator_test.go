@@ -0,0 +1,135 @@
+package vnet
+
+import (
+	"goconnect/common"
+	"goconnect/utils"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestICMPGenerator(t *testing.T) {
+
+	packetFactory := CreateProcessFactory()
+
+	params := SICMPGeneratorInitParams{}
+	params.Util = utils.Create()
+	params.PacketFactory = packetFactory
+	params.GatewayIPs = []string{"172.16.0.1"}
+	params.RateLimit = 2
+
+	generator := cICMPGenerator{}
+	generator.Init(params)
+
+	//unreachable for a simple udp packet
+	request := packetFactory.CreateProcessInfoByName("dns_reqv4")
+	reply := generator.CreateUnreachable(request, common.ICMPREASONNOROUTE)
+	if reply == nil {
+		t.Fatalf("can not create unreachable packet \n")
+	}
+
+	if reply.GetL4Protocol() != common.L4PROTOCOLICMP || !reply.GetDestinationIP().Equal(request.GetSourceIP()) {
+		t.Fatalf("invalid unreachable packet %v \n", reply)
+	}
+
+	if !reply.GetSourceIP().Equal(net.ParseIP("172.16.0.1")) {
+		t.Fatalf("invalid unreachable source %v \n", reply)
+	}
+
+	//ICMP errors should not trigger another ICMP error
+	if generator.CreateUnreachable(reply, common.ICMPREASONNOROUTE) != nil {
+		t.Fatalf("icmp error loop \n")
+	}
+
+	//echo request to the gateway IP
+	echo := packetFactory.CreateProcessInfoByName("icmp_echo_reqv4")
+	if !generator.IsGatewayEchoRequest(echo) {
+		t.Fatalf("can not detect echo request \n")
+	}
+
+	if generator.IsGatewayEchoRequest(request) {
+		t.Fatalf("invalid echo request detection \n")
+	}
+
+	reply = generator.CreateEchoReply(echo)
+	if reply == nil || !reply.GetDestinationIP().Equal(echo.GetSourceIP()) || reply.GetUsedSize() != echo.GetUsedSize() {
+		t.Fatalf("invalid echo reply %v \n", reply)
+	}
+
+	//rate limit
+	for i := 0; i < 3 && generator.CreateEchoReply(echo) != nil; i++ {
+	}
+	if generator.stat.RateLimited == 0 {
+		t.Fatalf("rate limit stat failed \n")
+	}
+}
+
+//---------------------------------------------------------------------------------------
+func TestICMPGeneratorLimits(t *testing.T) {
+
+	packetFactory := CreateProcessFactory()
+
+	params := SICMPGeneratorInitParams{}
+	params.Util = utils.Create()
+	params.PacketFactory = packetFactory
+	params.RateLimit = 100
+	params.SourceRateLimit = 2
+
+	generator := cICMPGenerator{}
+	generator.Init(params)
+
+	createPacket := func(serializeLayers ...gopacket.SerializableLayer) common.IProcessInfo {
+		packet := packetFactory.CreateProcessInfo(serializeTestPacket(t, serializeLayers...))
+		if !packet.ProcessAsNetPacket() {
+			t.Fatalf("can not decode packet \n")
+		}
+		return packet
+	}
+
+	//the non initial fragments do not trigger the errors
+	src, dst := net.ParseIP("fd00::2"), net.ParseIP("fd00::1")
+	ipv4 := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP, FragOffset: 100, SrcIP: net.IP{172, 16, 0, 2}, DstIP: net.IP{10, 0, 0, 2}}
+	if generator.CreateUnreachable(createPacket(ipv4, gopacket.Payload(make([]byte, 16))), common.ICMPREASONNOROUTE) != nil {
+		t.Fatalf("unreachable for an IPv4 fragment \n")
+	}
+
+	//the fragment header with the offset of 8 bytes
+	fragment := []byte{byte(layers.IPProtocolUDP), 0, 0, 1 << 3, 0, 0, 0, 1}
+	ipv6 := &layers.IPv6{Version: 6, NextHeader: layers.IPProtocolIPv6Fragment, HopLimit: 64, SrcIP: src, DstIP: dst}
+	if generator.CreateUnreachable(createPacket(ipv6, gopacket.Payload(append(fragment, make([]byte, 16)...))), common.ICMPREASONNOROUTE) != nil {
+		t.Fatalf("unreachable for an IPv6 fragment \n")
+	}
+
+	//the first fragment with the more fragments flag
+	fragment[3] = 1
+	if generator.CreateUnreachable(createPacket(ipv6, gopacket.Payload(append(fragment, make([]byte, 16)...))), common.ICMPREASONNOROUTE) == nil {
+		t.Fatalf("no unreachable for the first IPv6 fragment \n")
+	}
+
+	//each source has its own bucket
+	request := packetFactory.CreateProcessInfoByName("dns_reqv4")
+	for i := 0; i < 2; i++ {
+		if generator.CreateUnreachable(request, common.ICMPREASONNOROUTE) == nil {
+			t.Fatalf("unreachable under the source limit is dropped \n")
+		}
+	}
+	if generator.CreateUnreachable(request, common.ICMPREASONNOROUTE) != nil || generator.stat.RateLimited != 1 {
+		t.Fatalf("source rate limit failed \n")
+	}
+
+	ipv4.FragOffset = 0
+	if generator.CreateUnreachable(createPacket(ipv4, gopacket.Payload(make([]byte, 16))), common.ICMPREASONNOROUTE) == nil {
+		t.Fatalf("unreachable of the other source is dropped \n")
+	}
+
+	//the idle sources are removed when the map is full
+	for i := len(generator.sources); i < icmpGeneratorMaxSources; i++ {
+		generator.sources[string([]byte{byte(i >> 8), byte(i)})] = &sICMPSourceBucket{update: time.Now().Add(-time.Second).UnixNano()}
+	}
+	if !generator.allowSource(net.ParseIP("172.16.0.9")) || len(generator.sources) >= icmpGeneratorMaxSources {
+		t.Fatalf("idle sources are not removed %d \n", len(generator.sources))
+	}
+}
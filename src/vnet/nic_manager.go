@@ -17,9 +17,10 @@ type SNICManagerInitparams struct {
 
 //cNICManager ...
 type cNICManager struct {
-	nicMap map[uint64]common.INIC
-	lock   sync.RWMutex
-	params SNICManagerInitparams
+	nicMap    map[uint64]common.INIC
+	observers []common.INICObserver
+	lock      sync.RWMutex
+	params    SNICManagerInitparams
 }
 
 //---------------------------------------------------------------------------------------
@@ -47,6 +48,14 @@ func (thisPt *cNICManager) RegisterNIC(nic common.INIC) {
 		}
 	}
 
+	//activate static routes
+	thisPt.params.RouterV4.BindNIC(nic.GetID(), nic.GetName())
+	thisPt.params.RouterV6.BindNIC(nic.GetID(), nic.GetName())
+
+	//the observers should not call the manager
+	for _, observer := range thisPt.observers {
+		observer.OnNICRegistered(nic)
+	}
 }
 
 //---------------------------------------------------------------------------------------
@@ -54,8 +63,12 @@ func (thisPt *cNICManager) RegisterNIC(nic common.INIC) {
 //GetNICName for INICManager
 
 func (thisPt *cNICManager) GetNICName(id uint64) string {
-	thisPt.lock.Lock()
-	defer thisPt.lock.Unlock()
+	if id == common.ROUTENICBLACKHOLE {
+		return common.ROUTENICBLACKHOLENAME
+	}
+
+	thisPt.lock.RLock()
+	defer thisPt.lock.RUnlock()
 
 	nic := thisPt.nicMap[id]
 	if nic == nil {
@@ -66,6 +79,21 @@ func (thisPt *cNICManager) GetNICName(id uint64) string {
 
 //---------------------------------------------------------------------------------------
 
+//GetNICType for INICManager
+
+func (thisPt *cNICManager) GetNICType(id uint64) uint32 {
+	thisPt.lock.RLock()
+	defer thisPt.lock.RUnlock()
+
+	nic := thisPt.nicMap[id]
+	if nic == nil {
+		return 0
+	}
+	return nic.GetType()
+}
+
+//---------------------------------------------------------------------------------------
+
 //RemoveNIC for INICManager
 
 func (thisPt *cNICManager) RemoveNIC(id uint64) {
@@ -85,6 +113,12 @@ func (thisPt *cNICManager) RemoveNIC(id uint64) {
 			thisPt.params.RouterV6.RemoveRoute(r, nic.GetID())
 		}
 	}
+	thisPt.params.RouterV4.UnbindNIC(nic.GetID())
+	thisPt.params.RouterV6.UnbindNIC(nic.GetID())
+
+	for _, observer := range thisPt.observers {
+		observer.OnNICRemoved(nic)
+	}
 
 	delete(thisPt.nicMap, id)
 
@@ -108,6 +142,17 @@ func (thisPt *cNICManager) WriteData(id uint64, data common.IProcessInfo) {
 
 //---------------------------------------------------------------------------------------
 
+//RegisterObserver for INICManager
+
+func (thisPt *cNICManager) RegisterObserver(observer common.INICObserver) {
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+
+	thisPt.observers = append(thisPt.observers, observer)
+}
+
+//---------------------------------------------------------------------------------------
+
 //Flush for INICManager
 
 func (thisPt *cNICManager) Flush() {
@@ -0,0 +1,416 @@
+package vnet
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"goconnect/common"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+//---------------------------------------------------------------------------------------
+
+const (
+	packetCaptureMaxSessions = 8
+	packetCaptureMaxBytes    = 32 * 1024 * 1024
+	packetCaptureMaxDuration = 3600
+)
+
+//---------------------------------------------------------------------------------------
+
+//SPacketCaptureInitParams ...
+type SPacketCaptureInitParams struct {
+	Util      common.IUtils
+	Commander common.ICommander
+	AuthMan   common.IAuthenticationManger
+}
+
+//---------------------------------------------------------------------------------------
+
+type sPacketCaptureStartParams struct {
+	User       string `help:"User name" schema:"user" validate:"omitempty,min=2,max=64"`
+	VirtualIP  string `help:"Client virtual IP" schema:"v_ip" validate:"omitempty,ip"`
+	NIC        uint64 `help:"Input NIC ID" schema:"nic" validate:"omitempty,min=1"`
+	SrcIP      string `help:"Source IP, matches both directions" schema:"src_ip" validate:"omitempty,cidr"`
+	DstIP      string `help:"Destination IP, matches both directions" schema:"dst_ip" validate:"omitempty,cidr"`
+	SrcPort    uint16 `help:"Source port" schema:"src_port" validate:"omitempty,max=65535"`
+	DstPort    uint16 `help:"Destination port" schema:"dst_port" validate:"omitempty,max=65535"`
+	Protocol   uint8  `help:"L4 protocol number" schema:"protocol" validate:"omitempty,max=255"`
+	MaxPackets uint32 `help:"Stop after capturing this number of packets" schema:"max_packets" validate:"omitempty,max=10000000"`
+	MaxBytes   uint32 `help:"Stop after capturing this number of bytes (max 32MB)" schema:"max_bytes" validate:"omitempty,max=33554432"`
+	Duration   uint32 `help:"Stop after this period in second (max 3600)" schema:"duration" validate:"omitempty,max=3600"`
+	vipList    []net.IP
+	srcIPObj   *net.IPNet
+	dstIPObj   *net.IPNet
+}
+
+//---------------------------------------------------------------------------------------
+
+type sPacketCaptureIDParams struct {
+	ID uint64 `help:"Capture ID" schema:"id" validate:"required,min=1"`
+}
+
+//---------------------------------------------------------------------------------------
+
+type sPacketCaptureStatus struct {
+	ID         uint64 `json:"id"`
+	Filter     string `json:"filter"`
+	Running    bool   `json:"running"`
+	Packets    uint32 `json:"packets"`
+	Bytes      uint32 `json:"bytes"`
+	StartTime  int64  `json:"start_time"`
+	StopTime   int64  `json:"stop_time"`
+	StopReason string `json:"stop_reason"`
+}
+
+//---------------------------------------------------------------------------------------
+
+//sPacketCaptureSession the status is changed by the packets, so it should be accessed by the lock
+type sPacketCaptureSession struct {
+	sPacketCaptureStatus
+	params *sPacketCaptureStartParams
+	buffer bytes.Buffer
+	writer *pcapgo.NgWriter
+	timer  *time.Timer
+	lock   sync.Mutex
+}
+
+//---------------------------------------------------------------------------------------
+
+//cPacketCapture ...
+type cPacketCapture struct {
+	params      SPacketCaptureInitParams
+	sessions    map[uint64]*sPacketCaptureSession
+	lock        sync.RWMutex
+	activeCount int32
+	lastID      uint64
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cPacketCapture) matchPort(process common.IProcessInfo, port uint16) bool {
+	return process.GetSourcePort() == port || process.GetDestinationPort() == port
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cPacketCapture) matchIP(process common.IProcessInfo, ipNet *net.IPNet) bool {
+	return ipNet.Contains(process.GetSourceIP()) || ipNet.Contains(process.GetDestinationIP())
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cPacketCapture) match(process common.IProcessInfo, params *sPacketCaptureStartParams) bool {
+
+	if params.NIC != 0 && process.GetInNIC() != params.NIC {
+		return false
+	}
+
+	if params.Protocol != 0 && process.GetL4Protocol() != params.Protocol {
+		return false
+	}
+
+	if params.srcIPObj != nil && !thisPt.matchIP(process, params.srcIPObj) {
+		return false
+	}
+
+	if params.dstIPObj != nil && !thisPt.matchIP(process, params.dstIPObj) {
+		return false
+	}
+
+	if params.SrcPort != 0 && !thisPt.matchPort(process, params.SrcPort) {
+		return false
+	}
+
+	if params.DstPort != 0 && !thisPt.matchPort(process, params.DstPort) {
+		return false
+	}
+
+	//user and virtual IP filters
+	if len(params.vipList) > 0 {
+		for _, vip := range params.vipList {
+			if vip.Equal(process.GetSourceIP()) || vip.Equal(process.GetDestinationIP()) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+//---------------------------------------------------------------------------------------
+
+//stop should be called in the context of the session lock
+func (thisPt *cPacketCapture) stop(session *sPacketCaptureSession, reason string) {
+	if !session.Running {
+		return
+	}
+	session.Running = false
+	session.StopTime = time.Now().Unix()
+	session.StopReason = reason
+	session.writer.Flush()
+	session.timer.Stop()
+	atomic.AddInt32(&thisPt.activeCount, -1)
+}
+
+//---------------------------------------------------------------------------------------
+
+//getStatus returns a copy of the session status
+func (thisPt *cPacketCapture) getStatus(session *sPacketCaptureSession) sPacketCaptureStatus {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	return session.sPacketCaptureStatus
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cPacketCapture) write(session *sPacketCaptureSession, process common.IProcessInfo) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+
+	if !session.Running {
+		return
+	}
+
+	params := session.params
+	data := process.GetBuffer()[:process.GetUsedSize()]
+	if session.Bytes+uint32(len(data)) > params.MaxBytes {
+		thisPt.stop(session, "max_bytes")
+		return
+	}
+
+	info := gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(data), Length: len(data), InterfaceIndex: 0}
+	if err := session.writer.WritePacket(info, data); err != nil {
+		thisPt.stop(session, err.Error())
+		return
+	}
+
+	session.Packets++
+	session.Bytes += uint32(len(data))
+	if params.MaxPackets != 0 && session.Packets >= params.MaxPackets {
+		thisPt.stop(session, "max_packets")
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//Capture for IPacketCapture
+func (thisPt *cPacketCapture) Capture(process common.IProcessInfo) {
+
+	//fast path, there is no active capture
+	if atomic.LoadInt32(&thisPt.activeCount) == 0 {
+		return
+	}
+
+	thisPt.lock.RLock()
+	defer thisPt.lock.RUnlock()
+
+	for _, session := range thisPt.sessions {
+		if thisPt.match(process, session.params) {
+			thisPt.write(session, process)
+		}
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cPacketCapture) start(params *sPacketCaptureStartParams) (*sPacketCaptureSession, error) {
+
+	_, params.srcIPObj, _ = net.ParseCIDR(params.SrcIP)
+	_, params.dstIPObj, _ = net.ParseCIDR(params.DstIP)
+
+	if len(params.VirtualIP) > 0 {
+		params.vipList = append(params.vipList, net.ParseIP(params.VirtualIP))
+	}
+
+	//resolve user virtual IPs
+	if len(params.User) > 0 {
+		if thisPt.params.AuthMan == nil {
+			return nil, errors.New("user filter is not supported")
+		}
+
+		thisPt.params.AuthMan.GetUserAccountingSessions(params.User, func(object interface{}) {
+			if vip := object.(common.IAccountingSession).GetVIP(); vip != nil {
+				params.vipList = append(params.vipList, vip)
+			}
+		})
+
+		if len(params.vipList) == 0 {
+			return nil, errors.New("there is no active session for user " + params.User)
+		}
+	}
+
+	//limits
+	if params.MaxBytes == 0 || params.MaxBytes > packetCaptureMaxBytes {
+		params.MaxBytes = packetCaptureMaxBytes
+	}
+
+	if params.Duration == 0 || params.Duration > packetCaptureMaxDuration {
+		params.Duration = packetCaptureMaxDuration
+	}
+
+	//create session
+	session := new(sPacketCaptureSession)
+	session.params = params
+	session.Running = true
+	session.StartTime = time.Now().Unix()
+	session.Filter = fmt.Sprintf("user=%s v_ip=%s nic=%d src=%s dst=%s sport=%d dport=%d proto=%d", params.User, params.VirtualIP, params.NIC, params.SrcIP, params.DstIP, params.SrcPort, params.DstPort, params.Protocol)
+
+	writer, err := pcapgo.NewNgWriter(&session.buffer, layers.LinkTypeRaw)
+	if err != nil {
+		return nil, err
+	}
+	session.writer = writer
+
+	//the duration is checked without waiting for the packets
+	session.lock.Lock()
+	session.timer = time.AfterFunc(time.Duration(params.Duration)*time.Second, func() {
+		session.lock.Lock()
+		defer session.lock.Unlock()
+		thisPt.stop(session, "duration")
+	})
+	session.lock.Unlock()
+
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+
+	//remove the oldest stopped session
+	if len(thisPt.sessions) >= packetCaptureMaxSessions {
+		var oldest *sPacketCaptureSession
+		for _, item := range thisPt.sessions {
+			if !item.Running && (oldest == nil || item.ID < oldest.ID) {
+				oldest = item
+			}
+		}
+
+		if oldest == nil {
+			session.timer.Stop()
+			return nil, errors.New("too many active captures")
+		}
+		delete(thisPt.sessions, oldest.ID)
+	}
+
+	thisPt.lastID++
+	session.ID = thisPt.lastID
+	thisPt.sessions[session.ID] = session
+	atomic.AddInt32(&thisPt.activeCount, 1)
+	return session, nil
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cPacketCapture) getSession(id uint64) (*sPacketCaptureSession, error) {
+	thisPt.lock.RLock()
+	defer thisPt.lock.RUnlock()
+
+	session := thisPt.sessions[id]
+	if session == nil {
+		return nil, errors.New("invalid capture ID")
+	}
+	return session, nil
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cPacketCapture) OnStartCommand(req *http.Request, params interface{}) (common.IHTTPResponse, error) {
+	session, err := thisPt.start(params.(*sPacketCaptureStartParams))
+	if err != nil {
+		return nil, err
+	}
+	return thisPt.params.Util.CreateHttpResponseFromObject(thisPt.getStatus(session))
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cPacketCapture) OnStopCommand(req *http.Request, params interface{}) (common.IHTTPResponse, error) {
+	session, err := thisPt.getSession(params.(*sPacketCaptureIDParams).ID)
+	if err != nil {
+		return nil, err
+	}
+
+	session.lock.Lock()
+	thisPt.stop(session, "stopped")
+	session.lock.Unlock()
+	return thisPt.params.Util.CreateHttpResponseFromObject(thisPt.getStatus(session))
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cPacketCapture) OnListCommand(req *http.Request, params interface{}) (common.IHTTPResponse, error) {
+	thisPt.lock.RLock()
+	defer thisPt.lock.RUnlock()
+
+	list := []sPacketCaptureStatus{}
+	for _, session := range thisPt.sessions {
+		list = append(list, thisPt.getStatus(session))
+	}
+	return thisPt.params.Util.CreateHttpResponseFromObject(list)
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cPacketCapture) OnDownloadCommand(req *http.Request, params interface{}) (common.IHTTPResponse, error) {
+	session, err := thisPt.getSession(params.(*sPacketCaptureIDParams).ID)
+	if err != nil {
+		return nil, err
+	}
+
+	session.lock.Lock()
+	defer session.lock.Unlock()
+
+	//make the captured data available, the capture can continue
+	session.writer.Flush()
+
+	resp, err := thisPt.params.Util.CreateHttpResponseFromBuffer(session.buffer.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	resp.Header().Set("Content-Type", "application/octet-stream")
+	resp.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"capture_%d.pcapng\"", session.ID))
+	return resp, nil
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cPacketCapture) OnDeleteCommand(req *http.Request, params interface{}) (common.IHTTPResponse, error) {
+	session, err := thisPt.getSession(params.(*sPacketCaptureIDParams).ID)
+	if err != nil {
+		return nil, err
+	}
+
+	session.lock.Lock()
+	thisPt.stop(session, "deleted")
+	session.lock.Unlock()
+
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+	delete(thisPt.sessions, session.ID)
+	return thisPt.params.Util.CreateHttpResponseFromString("OK")
+}
+
+//---------------------------------------------------------------------------------------
+
+//Init
+func (thisPt *cPacketCapture) Init(params SPacketCaptureInitParams) {
+	thisPt.params = params
+	thisPt.sessions = make(map[uint64]*sPacketCaptureSession)
+
+	//register api
+	if thisPt.params.Commander != nil {
+		selector := thisPt.params.Commander.CreateSelector()
+		selector.Register("capture_start", thisPt.OnStartCommand, sPacketCaptureStartParams{})
+		selector.Register("capture_stop", thisPt.OnStopCommand, sPacketCaptureIDParams{})
+		selector.Register("capture_list", thisPt.OnListCommand, nil)
+		selector.Register("capture_download", thisPt.OnDownloadCommand, sPacketCaptureIDParams{})
+		selector.Register("capture_delete", thisPt.OnDeleteCommand, sPacketCaptureIDParams{})
+	}
+}
@@ -0,0 +1,118 @@
+package vnet
+
+import (
+	"bytes"
+	"goconnect/common"
+	"goconnect/utils"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/pcapgo"
+)
+
+func TestPacketCapture(t *testing.T) {
+
+	packetFactory := CreateProcessFactory()
+
+	capture := cPacketCapture{}
+	capture.Init(SPacketCaptureInitParams{Util: utils.Create()})
+
+	//capture only DNS packets
+	session, err := capture.start(&sPacketCaptureStartParams{DstPort: 53, Protocol: common.L4PROTOCOLUDP, MaxPackets: 2})
+	if err != nil {
+		t.Fatalf("can not start capture with error %v \n", err)
+	}
+
+	capture.Capture(packetFactory.CreateProcessInfoByName("icmp_echo_reqv4"))
+	capture.Capture(packetFactory.CreateProcessInfoByName("dns_reqv4"))
+	capture.Capture(packetFactory.CreateProcessInfoByName("dns_resv4"))
+	capture.Capture(packetFactory.CreateProcessInfoByName("dns_reqv4"))
+
+	if session.Packets != 2 || session.Running || session.StopReason != "max_packets" {
+		t.Fatalf("invalid capture session %v \n", session)
+	}
+
+	//read the file back
+	reader, err := pcapgo.NewNgReader(bytes.NewReader(session.buffer.Bytes()), pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatalf("invalid pcapng file %v \n", err)
+	}
+
+	count := 0
+	for {
+		data, _, err := reader.ReadPacketData()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("can not read packet %v \n", err)
+		}
+		count++
+		if count == 2 && len(data) != 72 {
+			t.Fatalf("invalid packet size %d \n", len(data))
+		}
+	}
+
+	if count != 2 {
+		t.Fatalf("invalid packet count %d \n", count)
+	}
+
+	//the duration should stop the capture without any packet
+	session, err = capture.start(&sPacketCaptureStartParams{DstPort: 53, Duration: 1})
+	if err != nil {
+		t.Fatalf("can not start capture with error %v \n", err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if status := capture.getStatus(session); status.Running || status.StopReason != "duration" || atomic.LoadInt32(&capture.activeCount) != 0 {
+		t.Fatalf("capture is not stopped by the duration %v \n", status)
+	}
+
+	//the status is read while the packets are captured
+	session, _ = capture.start(&sPacketCaptureStartParams{DstPort: 53})
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			capture.Capture(packetFactory.CreateProcessInfoByName("dns_reqv4"))
+		}
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		capture.OnListCommand(nil, nil)
+	}
+	<-done
+	if status := capture.getStatus(session); status.Packets != 100 || !status.Running {
+		t.Fatalf("invalid capture status %v \n", status)
+	}
+
+	//user filter without authentication manager
+	if _, err := capture.start(&sPacketCaptureStartParams{User: "user1"}); err == nil {
+		t.Fatalf("invalid user filter \n")
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+func TestPacketCaptureParams(t *testing.T) {
+	util := utils.Create()
+
+	//the commander validates the parameters before the handlers
+	startParams := sPacketCaptureStartParams{NIC: 3, SrcPort: 1024, DstPort: 53, Protocol: common.L4PROTOCOLUDP, MaxPackets: 10, MaxBytes: 1000, Duration: 60}
+	if err := util.ValidateStruct(startParams); err != nil {
+		t.Fatalf("valid start parameters are rejected %v \n", err)
+	}
+	if err := util.ValidateStruct(sPacketCaptureStartParams{}); err != nil {
+		t.Fatalf("empty start parameters are rejected %v \n", err)
+	}
+	if err := util.ValidateStruct(sPacketCaptureStartParams{MaxBytes: packetCaptureMaxBytes + 1}); err == nil {
+		t.Fatalf("invalid max bytes is accepted \n")
+	}
+
+	if err := util.ValidateStruct(sPacketCaptureIDParams{ID: 12}); err != nil {
+		t.Fatalf("valid capture ID is rejected %v \n", err)
+	}
+	if err := util.ValidateStruct(sPacketCaptureIDParams{}); err == nil {
+		t.Fatalf("empty capture ID is accepted \n")
+	}
+}
@@ -0,0 +1,160 @@
+package vnet
+
+import (
+	"goconnect/common"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+//---------------------------------------------------------------------------------------
+
+//SPipelineInitParams ...
+type SPipelineInitParams struct {
+	Workers       uint32
+	QueueSize     uint32
+	Actor         common.IProtocolActor
+	PacketFactory common.IProcessFactory
+	Util          common.IUtils
+	Commander     common.ICommander
+}
+
+//---------------------------------------------------------------------------------------
+
+type sPipelineWorkerStat struct {
+	Processed uint64 `json:"processed"`
+	Dropped   uint64 `json:"dropped"`
+	QueueLen  uint32 `json:"queue_len"`
+}
+
+//---------------------------------------------------------------------------------------
+
+//sPipelineWorker is padded to avoid false sharing between the workers counters
+type sPipelineWorker struct {
+	queue     chan common.IProcessInfo
+	processed uint64
+	dropped   uint64
+	padding   [48]byte
+}
+
+//---------------------------------------------------------------------------------------
+
+//cPipeline dispatches the packets to the workers based on the flow key. so all the packets of a flow are
+//processed by the same worker, in order
+type cPipeline struct {
+	params  SPipelineInitParams
+	workers []sPipelineWorker
+	done    chan bool
+	wait    sync.WaitGroup
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cPipeline) run(worker *sPipelineWorker) {
+	defer thisPt.wait.Done()
+	for {
+		select {
+		case packet := <-worker.queue:
+			thisPt.params.Actor.OnNewPacket(packet)
+			atomic.AddUint64(&worker.processed, 1)
+		case <-thisPt.done:
+			//drain the queue. the queues are never closed since the NIC readers may still be running
+			for {
+				select {
+				case packet := <-worker.queue:
+					thisPt.params.Actor.OnNewPacket(packet)
+					atomic.AddUint64(&worker.processed, 1)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//OnNewPacket for IProtocolActor
+func (thisPt *cPipeline) OnNewPacket(packet common.IProcessInfo) {
+	worker := &thisPt.workers[packet.GetFlowKey()%uint64(len(thisPt.workers))]
+
+	//never block the NIC readers
+	select {
+	case worker.queue <- packet:
+	default:
+		atomic.AddUint64(&worker.dropped, 1)
+		thisPt.params.PacketFactory.FreeProcessInfo(packet)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//getStat returns the workers statistics
+func (thisPt *cPipeline) getStat() []sPipelineWorkerStat {
+	list := []sPipelineWorkerStat{}
+	for i := range thisPt.workers {
+		worker := &thisPt.workers[i]
+		stat := sPipelineWorkerStat{}
+		stat.Processed = atomic.LoadUint64(&worker.processed)
+		stat.Dropped = atomic.LoadUint64(&worker.dropped)
+		stat.QueueLen = uint32(len(worker.queue))
+		list = append(list, stat)
+	}
+	return list
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cPipeline) OnStatusCommand(req *http.Request, params interface{}) (common.IHTTPResponse, error) {
+	type sPipelineStatus struct {
+		Workers   uint32                `json:"workers"`
+		QueueSize uint32                `json:"queue_size"`
+		Processed uint64                `json:"processed"`
+		Dropped   uint64                `json:"dropped"`
+		Stat      []sPipelineWorkerStat `json:"workers_stat"`
+	}
+
+	status := sPipelineStatus{}
+	status.Workers = uint32(len(thisPt.workers))
+	status.QueueSize = thisPt.params.QueueSize
+	status.Stat = thisPt.getStat()
+	for _, stat := range status.Stat {
+		status.Processed += stat.Processed
+		status.Dropped += stat.Dropped
+	}
+	return thisPt.params.Util.CreateHttpResponseFromObject(status)
+}
+
+//---------------------------------------------------------------------------------------
+
+//End for IPipeline. waits for the queued packets to be processed
+func (thisPt *cPipeline) End() {
+	close(thisPt.done)
+	thisPt.wait.Wait()
+}
+
+//---------------------------------------------------------------------------------------
+
+//Init
+func (thisPt *cPipeline) Init(params SPipelineInitParams) {
+	thisPt.params = params
+	if thisPt.params.Workers == 0 {
+		thisPt.params.Workers = uint32(runtime.NumCPU())
+	}
+
+	//start workers
+	thisPt.done = make(chan bool)
+	thisPt.workers = make([]sPipelineWorker, thisPt.params.Workers)
+	for i := range thisPt.workers {
+		thisPt.workers[i].queue = make(chan common.IProcessInfo, thisPt.params.QueueSize)
+		thisPt.wait.Add(1)
+		go thisPt.run(&thisPt.workers[i])
+	}
+
+	//register api
+	if thisPt.params.Commander != nil {
+		selector := thisPt.params.Commander.CreateSelector()
+		selector.Register("pipeline_status", thisPt.OnStatusCommand, nil)
+	}
+}
@@ -0,0 +1,150 @@
+package vnet
+
+import (
+	"goconnect/common"
+	"goconnect/utils"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+//---------------------------------------------------------------------------------------
+
+type sTestPipelineActor struct {
+	received uint64
+	block    chan bool
+	wait     *sync.WaitGroup
+	handler  func(common.IProcessInfo)
+}
+
+func (thisPt *sTestPipelineActor) OnNewPacket(packet common.IProcessInfo) {
+	if thisPt.block != nil {
+		<-thisPt.block
+	}
+	if thisPt.handler != nil {
+		thisPt.handler(packet)
+	}
+	atomic.AddUint64(&thisPt.received, 1)
+	if thisPt.wait != nil {
+		thisPt.wait.Done()
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+func TestPipeline(t *testing.T) {
+	packetFactory := CreateProcessFactory()
+	actor := &sTestPipelineActor{}
+
+	params := SPipelineInitParams{}
+	params.Workers = 4
+	params.QueueSize = 128
+	params.Actor = actor
+	params.PacketFactory = packetFactory
+	params.Util = utils.Create()
+
+	pipeline := cPipeline{}
+	pipeline.Init(params)
+
+	//all the packets should be processed
+	packets := []common.IProcessInfo{}
+	for i := 0; i < 100; i++ {
+		packets = append(packets, packetFactory.CreateRandomProcessInfoByName("dns_reqv4"))
+	}
+	for _, packet := range packets {
+		pipeline.OnNewPacket(packet)
+	}
+	pipeline.End()
+
+	if atomic.LoadUint64(&actor.received) != 100 {
+		t.Fatalf("invalid processed count %d \n", actor.received)
+	}
+
+	//packets of a flow should be dispatched to the same worker
+	processed := uint64(0)
+	for i, stat := range pipeline.getStat() {
+		expected := uint64(0)
+		for _, packet := range packets {
+			if packet.GetFlowKey()%uint64(params.Workers) == uint64(i) {
+				expected++
+			}
+		}
+		if stat.Processed != expected {
+			t.Fatalf("invalid worker %d processed count %d, expected %d \n", i, stat.Processed, expected)
+		}
+		processed += stat.Processed
+	}
+	if processed != 100 {
+		t.Fatalf("invalid total processed count %d \n", processed)
+	}
+
+	//check drop on full queue
+	blockedActor := &sTestPipelineActor{}
+	blockedActor.block = make(chan bool)
+	params.Workers = 1
+	params.QueueSize = 2
+	params.Actor = blockedActor
+
+	blockedPipeline := cPipeline{}
+	blockedPipeline.Init(params)
+
+	//one packet is held by the worker, two are queued, the rest should be dropped
+	for i := 0; i < 10; i++ {
+		blockedPipeline.OnNewPacket(packetFactory.CreateProcessInfoByName("dns_reqv4"))
+	}
+	close(blockedActor.block)
+	blockedPipeline.End()
+
+	stat := blockedPipeline.getStat()[0]
+	if stat.Processed+stat.Dropped != 10 || stat.Dropped < 7 {
+		t.Fatalf("invalid drop count %d, processed %d \n", stat.Dropped, stat.Processed)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+func benchmarkPipeline(b *testing.B, workers uint32) {
+	packetFactory := CreateProcessFactory()
+
+	flowParams := SFlowManagerInitParams{}
+	flowParams.MaxActiveFlowCount = 1024000
+	flowParams.SegmentCount = 64000
+	flowParams.MaxLifeTime = 600
+	flowParams.Workers = workers
+	flowParams.Util = utils.Create()
+	flowManager := CreateFlowManager(flowParams)
+
+	wait := &sync.WaitGroup{}
+	actor := &sTestPipelineActor{}
+	actor.wait = wait
+	actor.handler = func(packet common.IProcessInfo) {
+		flowManager.GetFlow(packet)
+	}
+
+	params := SPipelineInitParams{}
+	params.Workers = workers
+	params.QueueSize = uint32(b.N) + 1
+	params.Actor = actor
+	params.PacketFactory = packetFactory
+	params.Util = flowParams.Util
+	pipeline := CreatePipeline(params)
+	defer pipeline.End()
+
+	packets := []common.IProcessInfo{}
+	for i := 0; i < 4096; i++ {
+		packets = append(packets, packetFactory.CreateRandomProcessInfoByName("dns_reqv4"))
+	}
+
+	//the queues are large enough to never drop a packet
+	b.ResetTimer()
+	wait.Add(b.N)
+	for i := 0; i < b.N; i++ {
+		pipeline.OnNewPacket(packets[i%len(packets)])
+	}
+	wait.Wait()
+}
+
+func BenchmarkPipeline1(b *testing.B) { benchmarkPipeline(b, 1) }
+func BenchmarkPipeline2(b *testing.B) { benchmarkPipeline(b, 2) }
+func BenchmarkPipeline4(b *testing.B) { benchmarkPipeline(b, 4) }
+func BenchmarkPipeline8(b *testing.B) { benchmarkPipeline(b, 8) }
@@ -5,13 +5,31 @@ import (
 	"fmt"
 	"goconnect/common"
 	"net"
+)
+
+//---------------------------------------------------------------------------------------
 
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
+const (
+	processDefaultBufferSize = 4096
+	processMaxBufferSize     = 65535
+
+	ipv4MinHeaderLen = 20
+	ipv6HeaderLen    = 40
+	tcpMinHeaderLen  = 20
+	udpHeaderLen     = 8
+	icmpHeaderLen    = 8
+
+	ipv6ExtHopByHop    = 0
+	ipv6ExtRouting     = 43
+	ipv6ExtFragment    = 44
+	ipv6ExtAH          = 51
+	ipv6ExtDestOptions = 60
 )
 
+//---------------------------------------------------------------------------------------
+
 type cProcess struct {
-	buffer          [4096]byte
+	buffer          []byte
 	usedSize        uint32
 	ipVersion       uint8
 	l4Protocol      uint8
@@ -27,6 +45,7 @@ type cProcess struct {
 	srcIPIndex      uint64
 	dstIPIndex      uint64
 	applicationData []byte
+	free            bool
 }
 
 //---------------------------------------------------------------------------------------
@@ -169,9 +188,12 @@ func (thisPt *cProcess) GetFlowKey() uint64 {
 
 //---------------------------------------------------------------------------------------
 
-//End
+//Free resets the packet, so it can be reused by the factory
 func (thisPt *cProcess) Free() {
-
+	buffer := thisPt.buffer
+	*thisPt = cProcess{}
+	thisPt.buffer = buffer
+	thisPt.free = true
 }
 
 //---------------------------------------------------------------------------------------
@@ -181,55 +203,166 @@ func (thisPt *cProcess) GetApplicationPayload() []byte {
 
 //---------------------------------------------------------------------------------------
 func (thisPt *cProcess) Init(buffer []byte) {
-	copy(thisPt.buffer[0:], buffer)
+	if len(buffer) > processMaxBufferSize {
+		buffer = buffer[:processMaxBufferSize]
+	}
+
+	//jumbo packets
+	if cap(thisPt.buffer) < len(buffer) {
+		thisPt.buffer = make([]byte, len(buffer))
+	}
+	thisPt.buffer = thisPt.buffer[:cap(thisPt.buffer)]
+	copy(thisPt.buffer, buffer)
 	thisPt.usedSize = uint32(len(buffer))
+	thisPt.free = false
 }
 
 //---------------------------------------------------------------------------------------
 
-//ProcessAsPacket for IProcessInfo
-func (thisPt *cProcess) ProcessAsNetPacket() bool {
+//decodeIPv4 returns the transport layer of the packet
+func (thisPt *cProcess) decodeIPv4(data []byte) ([]byte, bool) {
+	if len(data) < ipv4MinHeaderLen {
+		return nil, false
+	}
 
-	layer := layers.LayerTypeIPv4
-	if (thisPt.buffer[0] & 0xf0) == 0x60 {
-		layer = layers.LayerTypeIPv6
+	headerLen := int(data[0]&0x0f) * 4
+	totalLen := int(binary.BigEndian.Uint16(data[2:]))
+	if headerLen < ipv4MinHeaderLen || totalLen < headerLen || totalLen > len(data) {
+		return nil, false
 	}
 
-	lpacket := gopacket.NewPacket(thisPt.buffer[:thisPt.usedSize], layer, gopacket.NoCopy)
-	network := lpacket.NetworkLayer()
-	transport := lpacket.TransportLayer()
-
-	if network.LayerType() == layers.LayerTypeIPv6 {
-		ipv6 := network.(*layers.IPv6)
-		thisPt.srcIP = ipv6.SrcIP
-		thisPt.dstIP = ipv6.DstIP
-		thisPt.ipVersion = 6
-		thisPt.l4Protocol = uint8(ipv6.NextHeader)
-	} else if network.LayerType() == layers.LayerTypeIPv4 {
-		ipv4 := network.(*layers.IPv4)
-		thisPt.srcIP = ipv4.SrcIP.To4()
-		thisPt.dstIP = ipv4.DstIP.To4()
-		thisPt.ipVersion = 4
-		thisPt.l4Protocol = uint8(ipv4.Protocol)
-	} else {
+	thisPt.ipVersion = 4
+	thisPt.l4Protocol = data[9]
+	thisPt.srcIP = net.IP(data[12:16])
+	thisPt.dstIP = net.IP(data[16:20])
+
+	//only the first fragment contains the transport header
+	if binary.BigEndian.Uint16(data[6:])&0x1fff != 0 {
+		return nil, true
+	}
+	return data[headerLen:totalLen], true
+}
+
+//---------------------------------------------------------------------------------------
+
+//decodeIPv6 returns the transport layer of the packet, after the extension headers
+func (thisPt *cProcess) decodeIPv6(data []byte) ([]byte, bool) {
+	if len(data) < ipv6HeaderLen {
+		return nil, false
+	}
+
+	payloadLen := int(binary.BigEndian.Uint16(data[4:]))
+	if ipv6HeaderLen+payloadLen > len(data) {
+		return nil, false
+	}
+
+	thisPt.ipVersion = 6
+	thisPt.srcIP = net.IP(data[8:24])
+	thisPt.dstIP = net.IP(data[24:40])
+
+	nextHeader := data[6]
+	data = data[ipv6HeaderLen : ipv6HeaderLen+payloadLen]
+	for {
+		extLen := 0
+		switch nextHeader {
+		case ipv6ExtHopByHop, ipv6ExtRouting, ipv6ExtDestOptions:
+			if len(data) < 2 {
+				return nil, false
+			}
+			extLen = (int(data[1]) + 1) * 8
+		case ipv6ExtAH:
+			if len(data) < 2 {
+				return nil, false
+			}
+			extLen = (int(data[1]) + 2) * 4
+		case ipv6ExtFragment:
+			if len(data) < 8 {
+				return nil, false
+			}
+			extLen = 8
+		default:
+			thisPt.l4Protocol = nextHeader
+			return data, true
+		}
+
+		if extLen > len(data) {
+			return nil, false
+		}
+
+		//only the first fragment contains the transport header
+		if nextHeader == ipv6ExtFragment && binary.BigEndian.Uint16(data[2:])&0xfff8 != 0 {
+			thisPt.l4Protocol = data[0]
+			return nil, true
+		}
+
+		nextHeader = data[0]
+		data = data[extLen:]
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+//decodeTransport decodes TCP and UDP ports and finds the application payload
+func (thisPt *cProcess) decodeTransport(data []byte) bool {
+	switch thisPt.l4Protocol {
+	case common.L4PROTOCOLTCP:
+		if len(data) < tcpMinHeaderLen {
+			return false
+		}
+		headerLen := int(data[12]>>4) * 4
+		if headerLen < tcpMinHeaderLen || headerLen > len(data) {
+			return false
+		}
+		thisPt.srcPort = binary.BigEndian.Uint16(data[0:])
+		thisPt.dstPort = binary.BigEndian.Uint16(data[2:])
+		data = data[headerLen:]
+	case common.L4PROTOCOLUDP:
+		if len(data) < udpHeaderLen {
+			return false
+		}
+		thisPt.srcPort = binary.BigEndian.Uint16(data[0:])
+		thisPt.dstPort = binary.BigEndian.Uint16(data[2:])
+		data = data[udpHeaderLen:]
+	case common.L4PROTOCOLICMP, common.L4PROTOCOLICMPV6:
+		if len(data) < icmpHeaderLen {
+			return true
+		}
+		data = data[icmpHeaderLen:]
+	default:
+		return true
+	}
+
+	if len(data) > 0 {
+		thisPt.applicationData = data
+	}
+	return true
+}
+
+//---------------------------------------------------------------------------------------
+
+//ProcessAsPacket for IProcessInfo. the addresses and the payload point to the packet buffer, so they are only
+//valid until the packet is freed
+func (thisPt *cProcess) ProcessAsNetPacket() bool {
+	data := thisPt.buffer[:thisPt.usedSize]
+	if len(data) == 0 {
 		return false
 	}
 
-	//TCP or UDP
-	if thisPt.l4Protocol == common.L4PROTOCOLTCP {
-		tcp := transport.(*layers.TCP)
-		thisPt.srcPort = uint16(tcp.SrcPort)
-		thisPt.dstPort = uint16(tcp.DstPort)
-	} else if thisPt.l4Protocol == common.L4PROTOCOLUDP {
-		udp := transport.(*layers.UDP)
-		thisPt.srcPort = uint16(udp.SrcPort)
-		thisPt.dstPort = uint16(udp.DstPort)
+	var transport []byte
+	var res bool
+	switch data[0] >> 4 {
+	case 4:
+		transport, res = thisPt.decodeIPv4(data)
+	case 6:
+		transport, res = thisPt.decodeIPv6(data)
+	}
+	if !res {
+		return false
 	}
 
-	//get application layer
-	application := lpacket.ApplicationLayer()
-	if application != nil {
-		thisPt.applicationData = application.LayerContents()
+	//TCP or UDP
+	if transport != nil && !thisPt.decodeTransport(transport) {
+		return false
 	}
 
 	//calculate flow key
@@ -5,6 +5,7 @@ import (
 	"goconnect/common"
 	"log"
 	"math/rand"
+	"sync"
 )
 
 //sample packets
@@ -16,17 +17,21 @@ type sMockPacketInfo struct {
 var gMockPacketsInfo = []sMockPacketInfo{
 	{Name: "dns_reqv4", HexData: "45000038e6364000401181fec0a801c808080808dfcd0035002476b5c2b40100000100000000000006676f6f676c6503636f6d0000010001"},
 	{Name: "dns_resv4", HexData: "45000048d84c000072119dd808080808c0a801c80035dfcd0034dec1c2b48180000100010000000006676f6f676c6503636f6d0000010001c00c00010001000000770004acd9a9ee"},
+	{Name: "icmp_echo_reqv4", HexData: "4500002c1c4640004001c667ac100002ac1000010800d2fa12340001676f636f6e6e6563742d70696e672121"},
 }
 
 //---------------------------------------------------------------------------------------
+
+//cProcessFactory recycles the packets, so the hot path does not allocate
 type cProcessFactory struct {
+	pool sync.Pool
 }
 
 //---------------------------------------------------------------------------------------
 
 //CreateProcessInfo for IProcessFactory
 func (thisPt *cProcessFactory) CreateProcessInfo(buffer []byte) common.IProcessInfo {
-	process := new(cProcess)
+	process := thisPt.pool.Get().(*cProcess)
 	process.Init(buffer)
 	return process
 }
@@ -42,7 +47,24 @@ func (thisPt *cProcessFactory) FreeProcessInfo(process common.IProcessInfo) {
 		return
 	}
 
+	if packet.free {
+		log.Printf("packet is already freed \n")
+		return
+	}
+
 	packet.Free()
+	thisPt.pool.Put(packet)
+}
+
+//---------------------------------------------------------------------------------------
+
+//Init
+func (thisPt *cProcessFactory) Init() {
+	thisPt.pool.New = func() interface{} {
+		process := new(cProcess)
+		process.buffer = make([]byte, processDefaultBufferSize)
+		return process
+	}
 }
 
 //---------------------------------------------------------------------------------------
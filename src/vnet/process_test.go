@@ -1,8 +1,15 @@
 package vnet
 
 import (
+	"bytes"
+	"encoding/hex"
+	"goconnect/common"
 	"log"
+	"net"
 	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 )
 
 func TestProcess(t *testing.T) {
@@ -21,3 +28,115 @@ func TestProcess(t *testing.T) {
 		log.Fatalf("invalid flow key")
 	}
 }
+
+//---------------------------------------------------------------------------------------
+
+//serializeTestPacket builds a packet with gopacket, to compare the results of the decoder
+func serializeTestPacket(t *testing.T, packetLayers ...gopacket.SerializableLayer) []byte {
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buffer, options, packetLayers...); err != nil {
+		t.Fatalf("can not serialize packet %v \n", err)
+	}
+	return buffer.Bytes()
+}
+
+//---------------------------------------------------------------------------------------
+
+func TestProcessDecoder(t *testing.T) {
+	packetFactory := CreateProcessFactory()
+	src := net.ParseIP("2001:db8::1")
+	dst := net.ParseIP("2001:db8::2")
+	payload := gopacket.Payload("goconnect")
+
+	//IPv6 TCP with a hop by hop extension header
+	ipv6 := &layers.IPv6{Version: 6, NextHeader: layers.IPProtocolIPv6HopByHop, HopLimit: 64, SrcIP: src, DstIP: dst}
+	ipv6.HopByHop = &layers.IPv6HopByHop{}
+	ipv6.HopByHop.NextHeader = layers.IPProtocolTCP
+	ipv6.HopByHop.Options = []*layers.IPv6HopByHopOption{{OptionType: 1, OptionLength: 4, OptionData: []byte{0, 0, 0, 0}}}
+	tcp := &layers.TCP{SrcPort: 443, DstPort: 51000, Window: 1024}
+	tcp.SetNetworkLayerForChecksum(ipv6)
+
+	packet := packetFactory.CreateProcessInfo(serializeTestPacket(t, ipv6, tcp, payload))
+	if !packet.ProcessAsNetPacket() {
+		t.Fatalf("can not decode IPv6 packet \n")
+	}
+	if packet.GetIPVersion() != 6 || !packet.GetSourceIP().Equal(src) || !packet.GetDestinationIP().Equal(dst) {
+		t.Fatalf("invalid IPv6 header %v \n", packet)
+	}
+	if packet.GetL4Protocol() != common.L4PROTOCOLTCP || packet.GetSourcePort() != 443 || packet.GetDestinationPort() != 51000 {
+		t.Fatalf("invalid TCP header %v \n", packet)
+	}
+	if !bytes.Equal(packet.GetApplicationPayload(), payload) {
+		t.Fatalf("invalid payload %x \n", packet.GetApplicationPayload())
+	}
+	packetFactory.FreeProcessInfo(packet)
+
+	//IPv4 non first fragment has no transport header
+	ipv4 := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP, FragOffset: 100, SrcIP: net.IP{10, 0, 0, 1}, DstIP: net.IP{10, 0, 0, 2}}
+	packet = packetFactory.CreateProcessInfo(serializeTestPacket(t, ipv4, payload))
+	if !packet.ProcessAsNetPacket() {
+		t.Fatalf("can not decode IPv4 fragment \n")
+	}
+	if packet.GetL4Protocol() != common.L4PROTOCOLUDP || packet.GetSourcePort() != 0 || packet.GetApplicationPayload() != nil {
+		t.Fatalf("invalid IPv4 fragment %v \n", packet)
+	}
+	packetFactory.FreeProcessInfo(packet)
+
+	//truncated packets
+	data, _ := hex.DecodeString(gMockPacketsInfo[0].HexData)
+	for _, size := range []int{0, 10, 24, len(data) - 1} {
+		packet = packetFactory.CreateProcessInfo(data[:size])
+		if packet.ProcessAsNetPacket() {
+			t.Fatalf("truncated packet (%d) decoded \n", size)
+		}
+		packetFactory.FreeProcessInfo(packet)
+	}
+
+	//jumbo packet
+	udp := &layers.UDP{SrcPort: 4789, DstPort: 4789}
+	ipv6 = &layers.IPv6{Version: 6, NextHeader: layers.IPProtocolUDP, HopLimit: 64, SrcIP: src, DstIP: dst}
+	udp.SetNetworkLayerForChecksum(ipv6)
+	jumbo := gopacket.Payload(make([]byte, 8900))
+	packet = packetFactory.CreateProcessInfo(serializeTestPacket(t, ipv6, udp, jumbo))
+	if !packet.ProcessAsNetPacket() || packet.GetUsedSize() != 8948 || len(packet.GetApplicationPayload()) != len(jumbo) {
+		t.Fatalf("can not decode jumbo packet %v \n", packet)
+	}
+	packetFactory.FreeProcessInfo(packet)
+
+	//recycled packets should not keep the previous state
+	packet = packetFactory.CreateProcessInfo(data[:10])
+	if packet.GetL4Protocol() != 0 || packet.GetApplicationPayload() != nil || packet.GetSourceIP() != nil {
+		t.Fatalf("recycled packet is not reset %v \n", packet)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+func BenchmarkProcessDecode(b *testing.B) {
+	packetFactory := CreateProcessFactory()
+	data, _ := hex.DecodeString(gMockPacketsInfo[0].HexData)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		packet := packetFactory.CreateProcessInfo(data)
+		packet.ProcessAsNetPacket()
+		packetFactory.FreeProcessInfo(packet)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+
+func BenchmarkProcessDecodeGoPacket(b *testing.B) {
+	data, _ := hex.DecodeString(gMockPacketsInfo[0].HexData)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buffer := [processDefaultBufferSize]byte{}
+		copy(buffer[:], data)
+		packet := gopacket.NewPacket(buffer[:len(data)], layers.LayerTypeIPv4, gopacket.NoCopy)
+		packet.NetworkLayer()
+		packet.TransportLayer()
+		packet.ApplicationLayer()
+	}
+}
@@ -0,0 +1,323 @@
+package vnet
+
+import (
+	"errors"
+	"goconnect/common"
+	"net"
+	"net/http"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+//---------------------------------------------------------------------------------------
+
+//SRouteTracerInitParams ...
+type SRouteTracerInitParams struct {
+	RouterV4      common.IRouter
+	RouterV6      common.IRouter
+	NicManager    common.INICManager
+	PolicyManager common.IPolicyManager
+	PacketFactory common.IProcessFactory
+	Util          common.IUtils
+	Commander     common.ICommander
+}
+
+//---------------------------------------------------------------------------------------
+
+type sRouteLookupParams struct {
+	IP     string `help:"Destination IP" schema:"ip" validate:"ip"`
+	Source string `help:"Source IP, used for selecting between equal cost routes" schema:"source" validate:"omitempty,ip"`
+}
+
+//---------------------------------------------------------------------------------------
+
+type sRouteTraceParams struct {
+	Source          string `help:"Source IP" schema:"src_ip" validate:"ip"`
+	Destination     string `help:"Destination IP" schema:"dst_ip" validate:"ip"`
+	Protocol        string `help:"Protocol tcp, udp or icmp" schema:"protocol" validate:"eq=tcp|eq=udp|eq=icmp"`
+	SourcePort      uint16 `help:"Source port" schema:"src_port"`
+	DestinationPort uint16 `help:"Destination port" schema:"dst_port"`
+}
+
+//---------------------------------------------------------------------------------------
+
+type sRouteLookupResult struct {
+	common.SRouteLookup
+	IP              string `json:"ip"`
+	SelectedName    string `json:"selected_nic_name"`
+	SelectedNICType string `json:"selected_nic_type"`
+}
+
+//---------------------------------------------------------------------------------------
+
+type sRouteTraceStage struct {
+	Stage  string `json:"stage"`
+	Result string `json:"result"`
+	Detail string `json:"detail"`
+}
+
+//---------------------------------------------------------------------------------------
+
+//cRouteTracer answers where a packet would go and why
+type cRouteTracer struct {
+	params SRouteTracerInitParams
+}
+
+//---------------------------------------------------------------------------------------
+
+//getNICType returns the NIC type name
+func (thisPt *cRouteTracer) getNICType(id uint64) string {
+	if id == common.ROUTENICBLACKHOLE {
+		return common.ROUTENICBLACKHOLENAME
+	}
+
+	if thisPt.params.NicManager == nil {
+		return ""
+	}
+
+	switch thisPt.params.NicManager.GetNICType(id) {
+	case common.INICTypeTUN:
+		return "tun"
+	case common.INICTypeTunnel:
+		return "tunnel"
+	case common.INICTypePeer:
+		return "peer"
+	case common.INICTypeClient:
+		return "client"
+	}
+	return ""
+}
+
+//---------------------------------------------------------------------------------------
+
+//createPacket builds a packet of the given 5-tuple, so it can go through the same stages as the real packets
+func (thisPt *cRouteTracer) createPacket(src net.IP, dst net.IP, protocol string, srcPort uint16, dstPort uint16) (common.IProcessInfo, error) {
+	var network gopacket.NetworkLayer
+	var ipLayer gopacket.SerializableLayer
+	if src.To4() != nil && dst.To4() != nil {
+		ipv4 := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, SrcIP: src.To4(), DstIP: dst.To4()}
+		network, ipLayer = ipv4, ipv4
+		switch protocol {
+		case "tcp":
+			ipv4.Protocol = layers.IPProtocolTCP
+		case "udp":
+			ipv4.Protocol = layers.IPProtocolUDP
+		default:
+			ipv4.Protocol = layers.IPProtocolICMPv4
+		}
+	} else if src.To4() == nil && dst.To4() == nil {
+		ipv6 := &layers.IPv6{Version: 6, HopLimit: 64, SrcIP: src, DstIP: dst}
+		network, ipLayer = ipv6, ipv6
+		switch protocol {
+		case "tcp":
+			ipv6.NextHeader = layers.IPProtocolTCP
+		case "udp":
+			ipv6.NextHeader = layers.IPProtocolUDP
+		default:
+			ipv6.NextHeader = layers.IPProtocolICMPv6
+		}
+	} else {
+		return nil, errors.New("source and destination IP versions do not match")
+	}
+
+	var transport gopacket.SerializableLayer
+	switch protocol {
+	case "tcp":
+		tcp := &layers.TCP{SrcPort: layers.TCPPort(srcPort), DstPort: layers.TCPPort(dstPort), SYN: true, Window: 1024}
+		tcp.SetNetworkLayerForChecksum(network)
+		transport = tcp
+	case "udp":
+		udp := &layers.UDP{SrcPort: layers.UDPPort(srcPort), DstPort: layers.UDPPort(dstPort)}
+		udp.SetNetworkLayerForChecksum(network)
+		transport = udp
+	default:
+		if src.To4() != nil {
+			transport = &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0)}
+		} else {
+			icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeEchoRequest, 0)}
+			icmp.SetNetworkLayerForChecksum(network)
+			transport = icmp
+		}
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buffer, options, ipLayer, transport); err != nil {
+		return nil, err
+	}
+
+	process := thisPt.params.PacketFactory.CreateProcessInfo(buffer.Bytes())
+	if !process.ProcessAsNetPacket() {
+		thisPt.params.PacketFactory.FreeProcessInfo(process)
+		return nil, errors.New("can not create packet")
+	}
+	return process, nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//lookup finds the route of the destination
+func (thisPt *cRouteTracer) lookup(ip net.IP, flowKey uint64) sRouteLookupResult {
+	router := thisPt.params.RouterV6
+	if ip.To4() != nil {
+		router = thisPt.params.RouterV4
+	}
+
+	result := sRouteLookupResult{}
+	result.IP = ip.String()
+	result.SRouteLookup = router.Lookup(ip, flowKey)
+	for _, candidate := range result.Candidates {
+		if candidate.NIC == result.Selected && candidate.Active {
+			result.SelectedName = candidate.NICName
+			result.SelectedNICType = thisPt.getNICType(candidate.NIC)
+			break
+		}
+	}
+	return result
+}
+
+//---------------------------------------------------------------------------------------
+
+//getFlowKey returns the flow key of the source and destination, used for selecting between equal cost routes
+func (thisPt *cRouteTracer) getFlowKey(ip net.IP, source net.IP) (uint64, error) {
+	if source == nil {
+		return 0, nil
+	}
+
+	process, err := thisPt.createPacket(source, ip, "udp", 0, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer thisPt.params.PacketFactory.FreeProcessInfo(process)
+	return process.GetFlowKey(), nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//Lookup for IRouteTracer
+func (thisPt *cRouteTracer) Lookup(ip net.IP, source net.IP) (common.SRouteLookup, error) {
+	flowKey, err := thisPt.getFlowKey(ip, source)
+	if err != nil {
+		return common.SRouteLookup{}, err
+	}
+	return thisPt.lookup(ip, flowKey).SRouteLookup, nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//trace runs the packet through the same stages as CServer.OnNewPacket
+func (thisPt *cRouteTracer) trace(process common.IProcessInfo) []sRouteTraceStage {
+	stages := []sRouteTraceStage{}
+
+	//multicast
+	if process.GetDestinationIP().IsMulticast() {
+		return append(stages, sRouteTraceStage{Stage: "multicast", Result: "drop", Detail: "multicast packets are not forwarded"})
+	}
+
+	//policy
+	if thisPt.params.PolicyManager != nil {
+		name, action := thisPt.params.PolicyManager.Trace(process)
+		switch action {
+		case common.POLICYACTIONBLOCK:
+			return append(stages, sRouteTraceStage{Stage: "policy", Result: "block", Detail: "blocked by policy " + name})
+		case common.POLICYACTIONALLOW:
+			stages = append(stages, sRouteTraceStage{Stage: "policy", Result: "allow", Detail: "allowed by policy " + name})
+		default:
+			stages = append(stages, sRouteTraceStage{Stage: "policy", Result: "allow", Detail: "no policy matched"})
+		}
+	}
+
+	//route
+	route := thisPt.lookup(process.GetDestinationIP(), process.GetFlowKey())
+	switch {
+	case route.Selected == 0:
+		stages = append(stages, sRouteTraceStage{Stage: "route", Result: "drop", Detail: "no route to host"})
+	case route.Selected == common.ROUTENICBLACKHOLE:
+		stages = append(stages, sRouteTraceStage{Stage: "route", Result: "drop", Detail: "blackhole route " + route.Network})
+	default:
+		stages = append(stages, sRouteTraceStage{Stage: "route", Result: "forward", Detail: "route " + route.Network + " via " + route.SelectedName})
+	}
+	return stages
+}
+
+//---------------------------------------------------------------------------------------
+
+//Evaluate for IRouteTracer. checks the policies and routes of a connection originated by the gateway,
+//the policy hits are updated as the real packets. returns the ICMP reason of the dropped connections
+func (thisPt *cRouteTracer) Evaluate(source net.IP, destination net.IP, protocol string, sourcePort uint16, destinationPort uint16) (uint32, error) {
+	process, err := thisPt.createPacket(source, destination, protocol, sourcePort, destinationPort)
+	if err != nil {
+		return 0, err
+	}
+	defer thisPt.params.PacketFactory.FreeProcessInfo(process)
+
+	if destination.IsMulticast() {
+		return common.ICMPREASONNOROUTE, errors.New("multicast destination " + destination.String())
+	}
+
+	if thisPt.params.PolicyManager != nil && thisPt.params.PolicyManager.Evaluate(process) == common.POLICYACTIONBLOCK {
+		return common.ICMPREASONPROHIBITED, errors.New("blocked by policy")
+	}
+
+	route := thisPt.lookup(destination, process.GetFlowKey())
+	switch route.Selected {
+	case 0:
+		return common.ICMPREASONNOROUTE, errors.New("no route to host " + destination.String())
+	case common.ROUTENICBLACKHOLE:
+		return common.ICMPREASONNOROUTE, errors.New("blackhole route " + route.Network)
+	}
+	return 0, nil
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cRouteTracer) OnLookupCommand(req *http.Request, params interface{}) (common.IHTTPResponse, error) {
+	lookupParams := params.(*sRouteLookupParams)
+	ip := net.ParseIP(lookupParams.IP)
+
+	flowKey, err := thisPt.getFlowKey(ip, net.ParseIP(lookupParams.Source))
+	if err != nil {
+		return nil, err
+	}
+	return thisPt.params.Util.CreateHttpResponseFromObject(thisPt.lookup(ip, flowKey))
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cRouteTracer) OnTraceCommand(req *http.Request, params interface{}) (common.IHTTPResponse, error) {
+	type sRouteTraceResult struct {
+		Packet  string             `json:"packet"`
+		FlowKey uint64             `json:"flow_key"`
+		Stages  []sRouteTraceStage `json:"stages"`
+		Verdict string             `json:"verdict"`
+	}
+
+	traceParams := params.(*sRouteTraceParams)
+	process, err := thisPt.createPacket(net.ParseIP(traceParams.Source), net.ParseIP(traceParams.Destination), traceParams.Protocol, traceParams.SourcePort, traceParams.DestinationPort)
+	if err != nil {
+		return nil, err
+	}
+	defer thisPt.params.PacketFactory.FreeProcessInfo(process)
+
+	result := sRouteTraceResult{}
+	result.Packet = process.String()
+	result.FlowKey = process.GetFlowKey()
+	result.Stages = thisPt.trace(process)
+	result.Verdict = result.Stages[len(result.Stages)-1].Result
+	return thisPt.params.Util.CreateHttpResponseFromObject(result)
+}
+
+//---------------------------------------------------------------------------------------
+
+//Init
+func (thisPt *cRouteTracer) Init(params SRouteTracerInitParams) {
+	thisPt.params = params
+
+	//register api
+	if thisPt.params.Commander != nil {
+		selector := thisPt.params.Commander.CreateSelector()
+		selector.Register("routes_lookup", thisPt.OnLookupCommand, sRouteLookupParams{})
+		selector.Register("routes_trace", thisPt.OnTraceCommand, sRouteTraceParams{})
+	}
+}
@@ -0,0 +1,99 @@
+package vnet
+
+import (
+	"goconnect/common"
+	"goconnect/utils"
+	"net"
+	"testing"
+)
+
+//---------------------------------------------------------------------------------------
+
+type sTestTracePolicyManager struct {
+	blockedPort uint16
+}
+
+func (thisPt *sTestTracePolicyManager) Evaluate(process common.IProcessInfo) uint32 {
+	_, action := thisPt.Trace(process)
+	return action
+}
+
+func (thisPt *sTestTracePolicyManager) Trace(process common.IProcessInfo) (string, uint32) {
+	if process.GetDestinationPort() == thisPt.blockedPort {
+		return "block_port", common.POLICYACTIONBLOCK
+	}
+	return "", common.POLICYACTIONNOMATCH
+}
+
+//---------------------------------------------------------------------------------------
+
+func TestRouteTracer(t *testing.T) {
+	util := utils.Create()
+	routerV4 := CreateRouter(SRouteParams{Util: util, Version: 4})
+	routerV6 := CreateRouter(SRouteParams{Util: util, Version: 6})
+
+	params := SRouteTracerInitParams{}
+	params.RouterV4 = routerV4
+	params.RouterV6 = routerV6
+	params.PolicyManager = &sTestTracePolicyManager{blockedPort: 23}
+	params.PacketFactory = CreateProcessFactory()
+	params.Util = util
+
+	tracer := cRouteTracer{}
+	tracer.Init(params)
+
+	_, inet, _ := net.ParseCIDR("10.0.0.0/8")
+	routerV4.RegisterRoute(*inet, 1, "site1", common.ROUTEMETRICSTATIC)
+	routerV4.RegisterRoute(*inet, 2, "site2", common.ROUTEMETRICSTATIC)
+	routerV4.RegisterStaticRoute(*inet, "site3", common.ROUTEMETRICSTATIC)
+
+	//lookup should report all the candidates
+	dst := net.ParseIP("10.1.2.3")
+	result, err := tracer.Lookup(dst, nil)
+	if err != nil || result.Network != "10.0.0.0/8" || len(result.Candidates) != 3 || result.Selected != 1 {
+		t.Fatalf("invalid lookup result %v %v \n", result, err)
+	}
+	if result.Candidates[2].Active {
+		t.Fatalf("unbound static route is active \n")
+	}
+
+	//lookup should select the same path as the packets
+	src := net.ParseIP("172.16.0.10")
+	process, _ := tracer.createPacket(src, dst, "tcp", 1000, 80)
+	result, _ = tracer.Lookup(dst, src)
+	if result.Selected != routerV4.GetDestinatin(dst, process.GetFlowKey()) {
+		t.Fatalf("lookup and routing selected different paths \n")
+	}
+
+	//trace stages
+	stages := tracer.trace(process)
+	if len(stages) != 2 || stages[0].Stage != "policy" || stages[1].Result != "forward" {
+		t.Fatalf("invalid trace %v \n", stages)
+	}
+
+	process, _ = tracer.createPacket(src, dst, "tcp", 1000, 23)
+	if stages = tracer.trace(process); len(stages) != 1 || stages[0].Result != "block" {
+		t.Fatalf("policy stage failed %v \n", stages)
+	}
+
+	process, _ = tracer.createPacket(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), "icmp", 0, 0)
+	if stages = tracer.trace(process); stages[len(stages)-1].Result != "drop" {
+		t.Fatalf("route stage failed %v \n", stages)
+	}
+
+	//connections of the gateway
+	if reason, err := tracer.Evaluate(src, dst, "tcp", 1000, 80); reason != 0 || err != nil {
+		t.Fatalf("allowed connection is dropped %v \n", err)
+	}
+	if reason, _ := tracer.Evaluate(src, dst, "tcp", 1000, 23); reason != common.ICMPREASONPROHIBITED {
+		t.Fatalf("blocked connection is allowed \n")
+	}
+	if reason, _ := tracer.Evaluate(src, net.ParseIP("192.168.1.1"), "tcp", 1000, 80); reason != common.ICMPREASONNOROUTE {
+		t.Fatalf("connection without route is allowed \n")
+	}
+
+	//invalid tuple
+	if _, err := tracer.createPacket(src, net.ParseIP("2001:db8::2"), "udp", 1, 2); err == nil {
+		t.Fatalf("mixed IP versions accepted \n")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 )
 
 //---------------------------------------------------------------------------------------
@@ -24,6 +25,7 @@ type sRouteInfo struct {
 	MatchCount uint64 `json:"match_count"`
 	Metric     uint32 `json:"metric"`
 	NicName    string `json:"nic_name"`
+	Static     bool   `json:"static"`
 }
 
 //---------------------------------------------------------------------------------------
@@ -42,6 +44,9 @@ type cRouter struct {
 	defaultRoute sRoutes
 	lock         sync.RWMutex
 	params       SRouteParams
+	nicIDs       map[string]uint64
+	nicNames     map[uint64]string
+	staticNames  map[string]uint32
 }
 
 //---------------------------------------------------------------------------------------
@@ -50,16 +55,25 @@ func (thisPt *cRouter) OnListCommand(req *http.Request, params interface{}) (com
 	thisPt.lock.RLock()
 	defer thisPt.lock.RUnlock()
 
-	routeList := []*sRoutes{}
+	//routes are copied, since the match counters are updated concurrently
+	routeList := []sRoutes{}
+	copyRoutes := func(routes *sRoutes) {
+		item := sRoutes{Network: routes.Network}
+		for i := range routes.Routes {
+			info := routes.Routes[i]
+			info.MatchCount = atomic.LoadUint64(&routes.Routes[i].MatchCount)
+			item.Routes = append(item.Routes, info)
+		}
+		routeList = append(routeList, item)
+	}
 	itFunc := func(data interface{}) {
-		routes := data.(*sRoutes)
-		routeList = append(routeList, routes)
+		copyRoutes(data.(*sRoutes))
 	}
 	thisPt.routes.Iterate(itFunc)
 
 	//add default routes
 	if len(thisPt.defaultRoute.Routes) > 0 {
-		routeList = append(routeList, &thisPt.defaultRoute)
+		copyRoutes(&thisPt.defaultRoute)
 	}
 
 	return thisPt.params.Util.CreateHttpResponseFromObject(routeList)
@@ -67,31 +81,71 @@ func (thisPt *cRouter) OnListCommand(req *http.Request, params interface{}) (com
 
 //---------------------------------------------------------------------------------------
 
-//RegisterRoute for IRoute
+//findRoutes returns the routes of the network, creates them if needed. should be called under lock
+func (thisPt *cRouter) findRoutes(network net.IPNet, create bool) *sRoutes {
+	iMask, _ := network.Mask.Size()
 
-func (thisPt *cRouter) RegisterRoute(network net.IPNet, nicID uint64, nicName string, metric uint32) {
+	if iMask == 0 {
+		return &thisPt.defaultRoute
+	}
 
-	thisPt.lock.Lock()
-	defer thisPt.lock.Unlock()
+	if res := thisPt.routes.SearchExact(network.IP, uint32(iMask)); res != nil {
+		return res.(*sRoutes)
+	}
+
+	if !create {
+		return nil
+	}
+
+	route := new(sRoutes)
+	route.Network = common.SIPNet(network)
+	thisPt.routes.Add(network.IP, uint32(iMask), route)
+	return route
+}
+
+//---------------------------------------------------------------------------------------
+
+//removeRouteInfo removes the route at index, and the network If there is not any other route
+func (thisPt *cRouter) removeRouteInfo(network net.IPNet, route *sRoutes, index int) {
+	route.Routes = append(route.Routes[:index], route.Routes[index+1:]...)
 
 	iMask, _ := network.Mask.Size()
+	if len(route.Routes) == 0 && iMask != 0 {
+		thisPt.routes.Remove(network.IP, uint32(iMask))
+	}
+}
 
-	var route *sRoutes
+//---------------------------------------------------------------------------------------
 
-	//first try to find existing routes
-	if iMask == 0 {
-		route = &thisPt.defaultRoute
-	} else if res := thisPt.routes.SearchExact(network.IP, uint32(iMask)); res == nil {
-		route = new(sRoutes)
-		route.Network = common.SIPNet(network)
-		thisPt.routes.Add(network.IP, uint32(iMask), route)
-	} else {
-		route = res.(*sRoutes)
+//iterateStaticRoutes calls the function for all the static routes. should be called under lock
+func (thisPt *cRouter) iterateStaticRoutes(itFunc func(info *sRouteInfo)) {
+	update := func(routes *sRoutes) {
+		for i := range routes.Routes {
+			if routes.Routes[i].Static {
+				itFunc(&routes.Routes[i])
+			}
+		}
 	}
+	thisPt.routes.Iterate(func(data interface{}) {
+		update(data.(*sRoutes))
+	})
+	update(&thisPt.defaultRoute)
+}
+
+//---------------------------------------------------------------------------------------
+
+//RegisterRoute for IRoute
+
+func (thisPt *cRouter) RegisterRoute(network net.IPNet, nicID uint64, nicName string, metric uint32) {
+
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+
+	route := thisPt.findRoutes(network, true)
 
 	//check for duplicate
 	for _, rInfo := range route.Routes {
-		if rInfo.Nic == nicID {
+		if rInfo.Nic == nicID && !rInfo.Static {
 			log.Printf("duplicate route registration \n")
 			return
 		}
@@ -114,66 +168,263 @@ func (thisPt *cRouter) RemoveRoute(network net.IPNet, nicID uint64) {
 	thisPt.lock.Lock()
 	defer thisPt.lock.Unlock()
 
-	iMask, _ := network.Mask.Size()
-	res := thisPt.routes.SearchExact(network.IP, uint32(iMask))
-
-	if res == nil {
+	route := thisPt.findRoutes(network, false)
+	if route == nil {
 		return
 	}
 
-	route := res.(*sRoutes)
-
 	//find route info
 	for index, rInfo := range route.Routes {
-		if rInfo.Nic == nicID {
-			route.Routes = append(route.Routes[:index], route.Routes[index+1:]...)
+		if rInfo.Nic == nicID && !rInfo.Static {
+			thisPt.removeRouteInfo(network, route, index)
 			break
 		}
 	}
+}
 
-	if len(route.Routes) == 0 {
-		thisPt.routes.Remove(network.IP, uint32(iMask))
+//---------------------------------------------------------------------------------------
+
+//RegisterStaticRoute for IRoute. the route is inactive until a NIC with the same name is registered
+func (thisPt *cRouter) RegisterStaticRoute(network net.IPNet, nicName string, metric uint32) bool {
+
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+
+	route := thisPt.findRoutes(network, true)
+
+	//check for duplicate
+	for _, rInfo := range route.Routes {
+		if rInfo.NicName == nicName && rInfo.Static {
+			return false
+		}
 	}
 
+	routeInfo := sRouteInfo{}
+	routeInfo.Metric = metric
+	routeInfo.NicName = nicName
+	routeInfo.Static = true
+	if nicName == common.ROUTENICBLACKHOLENAME {
+		routeInfo.Nic = common.ROUTENICBLACKHOLE
+	} else {
+		routeInfo.Nic = thisPt.nicIDs[nicName]
+	}
+	route.Routes = append(route.Routes, routeInfo)
+	thisPt.staticNames[nicName]++
+	return true
 }
 
 //---------------------------------------------------------------------------------------
 
-//GetDestinatin for IRoute
+//RemoveStaticRoute for IRoute
 
-func (thisPt *cRouter) GetDestinatin(ip net.IP) uint64 {
+func (thisPt *cRouter) RemoveStaticRoute(network net.IPNet, nicName string) bool {
 
-	thisPt.lock.RLock()
-	defer thisPt.lock.RUnlock()
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+
+	route := thisPt.findRoutes(network, false)
+	if route == nil {
+		return false
+	}
+
+	for index, rInfo := range route.Routes {
+		if rInfo.NicName == nicName && rInfo.Static {
+			thisPt.removeRouteInfo(network, route, index)
+			if thisPt.staticNames[nicName]--; thisPt.staticNames[nicName] == 0 {
+				delete(thisPt.staticNames, nicName)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+//---------------------------------------------------------------------------------------
+
+//BindNIC for IRoute. activates the static routes of the NIC
+func (thisPt *cRouter) BindNIC(nicID uint64, nicName string) {
+
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+
+	thisPt.nicIDs[nicName] = nicID
+	thisPt.nicNames[nicID] = nicName
+
+	if thisPt.staticNames[nicName] == 0 {
+		return
+	}
+
+	thisPt.iterateStaticRoutes(func(info *sRouteInfo) {
+		if info.NicName == nicName {
+			info.Nic = nicID
+		}
+	})
+}
+
+//---------------------------------------------------------------------------------------
+
+//UnbindNIC for IRoute. deactivates the static routes of the NIC
+func (thisPt *cRouter) UnbindNIC(nicID uint64) {
+
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+
+	nicName, fnd := thisPt.nicNames[nicID]
+	if !fnd {
+		return
+	}
+
+	delete(thisPt.nicNames, nicID)
+	if thisPt.nicIDs[nicName] != nicID {
+		return
+	}
+	delete(thisPt.nicIDs, nicName)
+
+	if thisPt.staticNames[nicName] == 0 {
+		return
+	}
+
+	thisPt.iterateStaticRoutes(func(info *sRouteInfo) {
+		if info.Nic == nicID {
+			info.Nic = 0
+		}
+	})
+}
+
+//---------------------------------------------------------------------------------------
+
+//selectRoute returns the index of the selected route of the network, -1 without any active route
+func (thisPt *cRouter) selectRoute(routes *sRoutes, flowKey uint64) int {
+
+	//find the best metric, static routes without NIC are inactive
+	count := uint64(0)
+	metric := uint32(0)
+	for i := range routes.Routes {
+		if routes.Routes[i].Nic == 0 {
+			continue
+		}
+		if count == 0 || routes.Routes[i].Metric < metric {
+			metric = routes.Routes[i].Metric
+			count = 0
+		}
+		if routes.Routes[i].Metric == metric {
+			count++
+		}
+	}
+
+	//can not find any destination
+	if count == 0 {
+		return -1
+	}
+
+	//select one of the equal cost routes
+	selected := flowKey % count
+	for i := range routes.Routes {
+		if routes.Routes[i].Nic == 0 || routes.Routes[i].Metric != metric {
+			continue
+		}
+		if selected == 0 {
+			return i
+		}
+		selected--
+	}
+	return -1
+}
+
+//---------------------------------------------------------------------------------------
+
+//findBestRoutes returns the routes of the destination and the index of the selected one. the less specific
+//networks are used when the longest prefix has only inactive routes, the longest prefix is returned without any
+//active route. should be called under lock
+func (thisPt *cRouter) findBestRoute(ip net.IP, flowKey uint64) (*sRoutes, int) {
 
 	//select
-	var routes *sRoutes
 	out := thisPt.routes.Search(ip)
 	if out == nil {
-		routes = &thisPt.defaultRoute
-	} else {
-		routes = out.(*sRoutes)
+		return &thisPt.defaultRoute, thisPt.selectRoute(&thisPt.defaultRoute, flowKey)
 	}
 
-	//can not find any destination
-	if len(routes.Routes) == 0 {
-		return 0
+	longest := out.(*sRoutes)
+	if index := thisPt.selectRoute(longest, flowKey); index >= 0 {
+		return longest, index
 	}
 
-	//selecting the best route based on less metric or lower match count
-	bestRoute := &routes.Routes[0]
-	for i := 1; i < len(routes.Routes); i++ {
-		if routes.Routes[i].Metric < bestRoute.Metric {
-			bestRoute = &routes.Routes[i]
-		} else if bestRoute.Metric == routes.Routes[i].Metric {
-			if bestRoute.MatchCount > routes.Routes[i].MatchCount {
-				bestRoute = &routes.Routes[i]
-			}
+	size, _ := longest.Network.Mask.Size()
+	for mask := size - 1; mask > 0; mask-- {
+		out := thisPt.routes.SearchExact(ip, uint32(mask))
+		if out == nil {
+			continue
 		}
+
+		routes := out.(*sRoutes)
+		if index := thisPt.selectRoute(routes, flowKey); index >= 0 {
+			return routes, index
+		}
+	}
+
+	if index := thisPt.selectRoute(&thisPt.defaultRoute, flowKey); index >= 0 {
+		return &thisPt.defaultRoute, index
+	}
+	return longest, -1
+}
+
+//---------------------------------------------------------------------------------------
+
+//GetDestinatin for IRoute. equal cost routes are selected based on the flow key, so all the packets of a flow
+//take the same path
+
+func (thisPt *cRouter) GetDestinatin(ip net.IP, flowKey uint64) uint64 {
+
+	thisPt.lock.RLock()
+	defer thisPt.lock.RUnlock()
+
+	routes, index := thisPt.findBestRoute(ip, flowKey)
+	if index < 0 {
+		return 0
 	}
 
-	bestRoute.MatchCount++
-	return bestRoute.Nic
+	atomic.AddUint64(&routes.Routes[index].MatchCount, 1)
+	return routes.Routes[index].Nic
+}
+
+//---------------------------------------------------------------------------------------
+
+//Lookup for IRoute. same as GetDestinatin, without updating the statistics
+
+func (thisPt *cRouter) Lookup(ip net.IP, flowKey uint64) common.SRouteLookup {
+
+	thisPt.lock.RLock()
+	defer thisPt.lock.RUnlock()
+
+	result := common.SRouteLookup{}
+	result.Candidates = []common.SRouteCandidate{}
+
+	routes, index := thisPt.findBestRoute(ip, flowKey)
+	if len(routes.Routes) == 0 {
+		return result
+	}
+
+	network := net.IPNet(routes.Network)
+	if routes == &thisPt.defaultRoute {
+		result.Network = "default"
+	} else {
+		result.Network = network.String()
+	}
+
+	for i, info := range routes.Routes {
+		candidate := common.SRouteCandidate{}
+		candidate.NIC = info.Nic
+		candidate.NICName = info.NicName
+		candidate.Metric = info.Metric
+		candidate.Static = info.Static
+		candidate.Active = info.Nic != 0
+		result.Candidates = append(result.Candidates, candidate)
+
+		if i == index {
+			result.Selected = info.Nic
+		}
+	}
+	return result
 }
 
 //---------------------------------------------------------------------------------------
@@ -184,8 +435,13 @@ func (thisPt *cRouter) Init(params SRouteParams) {
 	//
 	thisPt.routes = params.Util.CreateNewIPTrie(params.Version)
 	thisPt.params = params
+	thisPt.nicIDs = make(map[string]uint64)
+	thisPt.nicNames = make(map[uint64]string)
+	thisPt.staticNames = make(map[string]uint32)
 
 	//
-	selector := thisPt.params.Commander.CreateSelector()
-	selector.Register(fmt.Sprintf("routes%d_list", params.Version), thisPt.OnListCommand, nil)
+	if thisPt.params.Commander != nil {
+		selector := thisPt.params.Commander.CreateSelector()
+		selector.Register(fmt.Sprintf("routes%d_list", params.Version), thisPt.OnListCommand, nil)
+	}
 }
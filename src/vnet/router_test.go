@@ -1,6 +1,7 @@
 package vnet
 
 import (
+	"goconnect/common"
 	"goconnect/utils"
 	"net"
 	"testing"
@@ -19,32 +20,37 @@ func TestRouter(t *testing.T) {
 	testIP := net.ParseIP("192.168.1.1")
 	//simple test
 	router.RegisterRoute(*inet, 1, "test", 10)
-	if router.GetDestinatin(testIP) != 1 {
+	if router.GetDestinatin(testIP, 0) != 1 {
 		t.Fatalf("simple search failed \n")
 	}
 
 	//check for best route
 	router.RegisterRoute(*inet, 2, "test", 1)
-	if router.GetDestinatin(testIP) != 2 {
+	if router.GetDestinatin(testIP, 0) != 2 {
 		t.Fatalf("best route failed \n")
 	}
 
 	//remove best
 	router.RemoveRoute(*inet, 2)
-	if router.GetDestinatin(testIP) != 1 {
+	if router.GetDestinatin(testIP, 0) != 1 {
 		t.Fatalf("best route failed \n")
 	}
 
 	//remove all
 	router.RemoveRoute(*inet, 1)
-	if router.GetDestinatin(testIP) != 0 {
+	if router.GetDestinatin(testIP, 0) != 0 {
 		t.Fatalf("best route failed \n")
 	}
 
 	//check for load balancing
 	router.RegisterRoute(*inet, 2, "test", 1)
 	router.RegisterRoute(*inet, 1, "test", 1)
-	if router.GetDestinatin(testIP) == router.GetDestinatin(testIP) {
+	if router.GetDestinatin(testIP, 0) == router.GetDestinatin(testIP, 1) {
+		t.Fatalf("load balancing failed\n")
+	}
+
+	//same flow should always take the same path
+	if router.GetDestinatin(testIP, 7) != router.GetDestinatin(testIP, 7) {
 		t.Fatalf("load balancing failed\n")
 	}
 
@@ -52,9 +58,135 @@ func TestRouter(t *testing.T) {
 	_, inet2, _ := net.ParseCIDR("192.168.1.1/32")
 	router.RegisterRoute(*inet, 2, "test", 1)
 	router.RegisterRoute(*inet2, 3, "test", 1)
-	if router.GetDestinatin(testIP) != 3 {
+	if router.GetDestinatin(testIP, 0) != 3 {
 		t.Fatalf("load balancing failed\n")
 	}
 
 	t.Log("successfully test Router \n")
 }
+
+//---------------------------------------------------------------------------------------
+
+func TestStaticRoutes(t *testing.T) {
+	routerV4 := CreateRouter(SRouteParams{Util: utils.Create(), Version: 4})
+	routerV6 := CreateRouter(SRouteParams{Util: utils.Create(), Version: 6})
+
+	params := SStaticRouteManagerInitParams{}
+	params.RouterV4 = routerV4
+	params.RouterV6 = routerV6
+	params.Util = utils.Create()
+
+	manager := cStaticRouteManager{}
+	manager.Init(params)
+
+	//static routes are inactive until the NIC is registered
+	testIP := net.ParseIP("10.1.2.3")
+	config := []interface{}{
+		map[string]interface{}{"network": "10.0.0.0/8", "nic": "site1"},
+		map[string]interface{}{"network": "10.0.0.0/8", "nic": "site2"},
+		map[string]interface{}{"network": "10.1.2.0/24", "blackhole": true},
+	}
+	if err := manager.OnCommand("routes", config[:2]); err != nil {
+		t.Fatalf("can not load routes %v \n", err)
+	}
+	if routerV4.GetDestinatin(testIP, 0) != 0 {
+		t.Fatalf("inactive static route selected \n")
+	}
+
+	routerV4.BindNIC(10, "site1")
+	if routerV4.GetDestinatin(testIP, 0) != 10 || routerV4.GetDestinatin(testIP, 1) != 10 {
+		t.Fatalf("static route failed \n")
+	}
+
+	//equal cost multipath
+	routerV4.BindNIC(20, "site2")
+	if routerV4.GetDestinatin(testIP, 0) != 10 || routerV4.GetDestinatin(testIP, 1) != 20 {
+		t.Fatalf("ECMP failed \n")
+	}
+
+	//connected routes have better metric
+	_, inet, _ := net.ParseCIDR("10.0.0.0/8")
+	routerV4.RegisterRoute(*inet, 30, "tun", 0)
+	if routerV4.GetDestinatin(testIP, 1) != 30 {
+		t.Fatalf("connected route failed \n")
+	}
+	routerV4.RemoveRoute(*inet, 30)
+
+	//the less specific route is used when the longest prefix has only inactive routes
+	if err := manager.AddRoute("10.1.0.0/16", "site3", false); err != nil {
+		t.Fatalf("can not add static route %v \n", err)
+	}
+	if routerV4.GetDestinatin(testIP, 0) != 10 || routerV4.Lookup(testIP, 0).Network != "10.0.0.0/8" {
+		t.Fatalf("inactive static route hides the less specific route \n")
+	}
+	routerV4.BindNIC(40, "site3")
+	if routerV4.GetDestinatin(testIP, 0) != 40 {
+		t.Fatalf("static route failed \n")
+	}
+	routerV4.UnbindNIC(40)
+	if err := manager.RemoveRoute("10.1.0.0/16", "site3", false); err != nil {
+		t.Fatalf("can not remove static route %v \n", err)
+	}
+
+	//NIC removal
+	routerV4.UnbindNIC(10)
+	if routerV4.GetDestinatin(testIP, 0) != 20 {
+		t.Fatalf("unbind failed \n")
+	}
+
+	//blackhole
+	if err := manager.AddRoute("10.1.2.0/24", "", true); err != nil {
+		t.Fatalf("can not add blackhole route %v \n", err)
+	}
+	if routerV4.GetDestinatin(testIP, 0) != common.ROUTENICBLACKHOLE {
+		t.Fatalf("blackhole route failed \n")
+	}
+	if manager.AddRoute("10.1.2.0/24", "", true) == nil {
+		t.Fatalf("duplicate route added \n")
+	}
+	if err := manager.RemoveRoute("10.1.2.0/24", "", true); err != nil {
+		t.Fatalf("can not remove blackhole route %v \n", err)
+	}
+
+	//invalid routes
+	if manager.OnCommand("routes", []interface{}{map[string]interface{}{"network": "10.0.0.0/8"}}) == nil {
+		t.Fatalf("route without NIC accepted \n")
+	}
+	if manager.OnCommand("routes", append(config, config[0])) == nil {
+		t.Fatalf("duplicate routes accepted \n")
+	}
+
+	//configuration replaces the routes
+	if err := manager.OnCommand("routes", config[2:]); err != nil {
+		t.Fatalf("can not load routes %v \n", err)
+	}
+	if len(manager.routes) != 1 || routerV4.GetDestinatin(testIP, 0) != common.ROUTENICBLACKHOLE {
+		t.Fatalf("routes are not replaced %v \n", manager.routes)
+	}
+	if routerV4.GetDestinatin(net.ParseIP("10.2.0.1"), 0) != 0 {
+		t.Fatalf("old route is not removed \n")
+	}
+
+	//removing a static route keeps the more specific network of the same address
+	_, connected, _ := net.ParseCIDR("10.0.0.0/24")
+	routerV4.RegisterRoute(*connected, 1, "tun", 0)
+	if err := manager.AddRoute("10.0.0.0/8", "site2", false); err != nil {
+		t.Fatalf("can not add static route %v \n", err)
+	}
+	if err := manager.RemoveRoute("10.0.0.0/8", "site2", false); err != nil {
+		t.Fatalf("can not remove static route %v \n", err)
+	}
+	if routerV4.GetDestinatin(net.ParseIP("10.0.0.5"), 0) != 1 || routerV4.(*cRouter).routes.SearchExact(net.ParseIP("10.0.0.0"), 8) != nil {
+		t.Fatalf("static route removal removes the connected network \n")
+	}
+	routerV4.RemoveRoute(*connected, 1)
+
+	//IPv6
+	if err := manager.AddRoute("2001:db8::/32", "site2", false); err != nil {
+		t.Fatalf("can not add IPv6 route %v \n", err)
+	}
+	routerV6.BindNIC(20, "site2")
+	if routerV6.GetDestinatin(net.ParseIP("2001:db8::1"), 0) != 20 {
+		t.Fatalf("IPv6 static route failed \n")
+	}
+}
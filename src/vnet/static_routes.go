@@ -0,0 +1,222 @@
+package vnet
+
+import (
+	"errors"
+	"goconnect/common"
+	"net"
+	"net/http"
+	"sync"
+)
+
+//---------------------------------------------------------------------------------------
+
+//SStaticRouteManagerInitParams ...
+type SStaticRouteManagerInitParams struct {
+	RouterV4  common.IRouter
+	RouterV6  common.IRouter
+	Config    common.IDynamicConfigManager
+	Commander common.ICommander
+	Util      common.IUtils
+}
+
+//---------------------------------------------------------------------------------------
+
+type sStaticRoute struct {
+	Network   string `json:"network" help:"Destination network" schema:"network" validate:"cidr"`
+	NIC       string `json:"nic" help:"Output NIC name. routes to the same network with different NICs are load balanced" schema:"nic" validate:"omitempty,min=1,max=128"`
+	Blackhole bool   `json:"blackhole" help:"Drop the packets" schema:"blackhole"`
+}
+
+//---------------------------------------------------------------------------------------
+
+//cStaticRouteManager keeps the static routes of the configuration and the API
+type cStaticRouteManager struct {
+	params SStaticRouteManagerInitParams
+	routes []sStaticRoute
+	lock   sync.Mutex
+}
+
+//---------------------------------------------------------------------------------------
+
+//parseRoute returns the network, the router and the NIC name of the route
+func (thisPt *cStaticRouteManager) parseRoute(route *sStaticRoute) (*net.IPNet, common.IRouter, string, error) {
+	_, network, err := net.ParseCIDR(route.Network)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	nicName := route.NIC
+	if route.Blackhole {
+		if len(nicName) != 0 {
+			return nil, nil, "", errors.New("blackhole routes can not have NIC")
+		}
+		nicName = common.ROUTENICBLACKHOLENAME
+	} else if len(nicName) == 0 || nicName == common.ROUTENICBLACKHOLENAME {
+		return nil, nil, "", errors.New("invalid NIC name for route " + route.Network)
+	}
+
+	router := thisPt.params.RouterV6
+	if network.IP.To4() != nil {
+		network.IP = network.IP.To4()
+		router = thisPt.params.RouterV4
+	}
+	return network, router, nicName, nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//add should be called under lock
+func (thisPt *cStaticRouteManager) add(route sStaticRoute) error {
+	network, router, nicName, err := thisPt.parseRoute(&route)
+	if err != nil {
+		return err
+	}
+
+	if !router.RegisterStaticRoute(*network, nicName, common.ROUTEMETRICSTATIC) {
+		return errors.New("duplicate route " + route.Network + " " + nicName)
+	}
+	thisPt.routes = append(thisPt.routes, route)
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//remove should be called under lock
+func (thisPt *cStaticRouteManager) remove(route sStaticRoute) error {
+	network, router, nicName, err := thisPt.parseRoute(&route)
+	if err != nil {
+		return err
+	}
+
+	if !router.RemoveStaticRoute(*network, nicName) {
+		return errors.New("can not find route " + route.Network + " " + nicName)
+	}
+
+	for i := range thisPt.routes {
+		if item, _, name, _ := thisPt.parseRoute(&thisPt.routes[i]); item.String() == network.String() && name == nicName {
+			thisPt.routes = append(thisPt.routes[:i], thisPt.routes[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//OnCommand for IDynamicConfigActor. replaces all the static routes
+func (thisPt *cStaticRouteManager) OnCommand(section string, params interface{}) error {
+	routeList, res := params.([]interface{})
+	if !res {
+		return errors.New("invalid routes configuration")
+	}
+
+	tempList := []sStaticRoute{}
+	keys := make(map[string]bool)
+	for _, routeInfo := range routeList {
+		route := sStaticRoute{}
+		if err := thisPt.params.Util.CastJsonObject(routeInfo, &route); err != nil {
+			return err
+		}
+
+		if err := thisPt.params.Util.ValidateStruct(route); err != nil {
+			return err
+		}
+
+		network, _, nicName, err := thisPt.parseRoute(&route)
+		if err != nil {
+			return err
+		}
+
+		//check for duplicate route
+		key := network.String() + " " + nicName
+		if keys[key] {
+			return errors.New("duplicate route " + key)
+		}
+		keys[key] = true
+		tempList = append(tempList, route)
+	}
+
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+
+	//Everything seems good, swap the routes
+	for len(thisPt.routes) > 0 {
+		thisPt.remove(thisPt.routes[0])
+	}
+	for _, route := range tempList {
+		if err := thisPt.add(route); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//AddRoute for IStaticRouteManager
+func (thisPt *cStaticRouteManager) AddRoute(network string, nicName string, blackhole bool) error {
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+
+	return thisPt.add(sStaticRoute{Network: network, NIC: nicName, Blackhole: blackhole})
+}
+
+//---------------------------------------------------------------------------------------
+
+//RemoveRoute for IStaticRouteManager
+func (thisPt *cStaticRouteManager) RemoveRoute(network string, nicName string, blackhole bool) error {
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+
+	return thisPt.remove(sStaticRoute{Network: network, NIC: nicName, Blackhole: blackhole})
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cStaticRouteManager) OnAddCommand(req *http.Request, params interface{}) (common.IHTTPResponse, error) {
+	route := params.(*sStaticRoute)
+	if err := thisPt.AddRoute(route.Network, route.NIC, route.Blackhole); err != nil {
+		return nil, err
+	}
+	return thisPt.params.Util.CreateHttpResponseFromString("OK")
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cStaticRouteManager) OnRemoveCommand(req *http.Request, params interface{}) (common.IHTTPResponse, error) {
+	route := params.(*sStaticRoute)
+	if err := thisPt.RemoveRoute(route.Network, route.NIC, route.Blackhole); err != nil {
+		return nil, err
+	}
+	return thisPt.params.Util.CreateHttpResponseFromString("OK")
+}
+
+//---------------------------------------------------------------------------------------
+
+func (thisPt *cStaticRouteManager) OnListCommand(req *http.Request, params interface{}) (common.IHTTPResponse, error) {
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+
+	list := append([]sStaticRoute{}, thisPt.routes...)
+	return thisPt.params.Util.CreateHttpResponseFromObject(list)
+}
+
+//---------------------------------------------------------------------------------------
+
+//Init
+func (thisPt *cStaticRouteManager) Init(params SStaticRouteManagerInitParams) {
+	thisPt.params = params
+
+	//routes are loaded from the configuration
+	if thisPt.params.Config != nil {
+		thisPt.params.Config.RegisterActor("routes", nil, thisPt)
+	}
+
+	//register api
+	if thisPt.params.Commander != nil {
+		selector := thisPt.params.Commander.CreateSelector()
+		selector.Register("routes_static_add", thisPt.OnAddCommand, sStaticRoute{})
+		selector.Register("routes_static_remove", thisPt.OnRemoveCommand, sStaticRoute{})
+		selector.Register("routes_static_list", thisPt.OnListCommand, nil)
+	}
+}
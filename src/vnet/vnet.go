@@ -2,13 +2,16 @@ package vnet
 
 import (
 	"goconnect/common"
+	"log"
 )
 
 //---------------------------------------------------------------------------------------
 
 //CreateProcessFactory ...
 func CreateProcessFactory() common.IProcessFactory {
-	return new(cProcessFactory)
+	factory := new(cProcessFactory)
+	factory.Init()
+	return factory
 }
 
 //---------------------------------------------------------------------------------------
@@ -37,3 +40,59 @@ func CreateFlowManager(params SFlowManagerInitParams) common.IFlowManager {
 	flowMan.Init(params)
 	return flowMan
 }
+
+//---------------------------------------------------------------------------------------
+
+//CreateICMPGenerator ...
+func CreateICMPGenerator(params SICMPGeneratorInitParams) common.IICMPGenerator {
+	generator := new(cICMPGenerator)
+	generator.Init(params)
+	return generator
+}
+
+//---------------------------------------------------------------------------------------
+
+//CreatePacketCapture ...
+func CreatePacketCapture(params SPacketCaptureInitParams) common.IPacketCapture {
+	capture := new(cPacketCapture)
+	capture.Init(params)
+	return capture
+}
+
+//---------------------------------------------------------------------------------------
+
+//CreateFlowExporter ...
+func CreateFlowExporter(params SFlowExporterInitParams) common.IFlowExporter {
+	exporter := new(cFlowExporter)
+	if err := exporter.Init(params); err != nil {
+		log.Fatalln(err)
+	}
+	return exporter
+}
+
+//---------------------------------------------------------------------------------------
+
+//CreatePipeline ...
+func CreatePipeline(params SPipelineInitParams) common.IPipeline {
+	pipeline := new(cPipeline)
+	pipeline.Init(params)
+	return pipeline
+}
+
+//---------------------------------------------------------------------------------------
+
+//CreateStaticRouteManager ...
+func CreateStaticRouteManager(params SStaticRouteManagerInitParams) common.IStaticRouteManager {
+	manager := new(cStaticRouteManager)
+	manager.Init(params)
+	return manager
+}
+
+//---------------------------------------------------------------------------------------
+
+//CreateRouteTracer ...
+func CreateRouteTracer(params SRouteTracerInitParams) common.IRouteTracer {
+	tracer := new(cRouteTracer)
+	tracer.Init(params)
+	return tracer
+}